@@ -7,6 +7,9 @@ addHotkey('d', true, false, false, true, false, 'toggleDebugDisplay(nil, false)'
 addHotkey('d', true, false, true, true, false, 'toggleDebugDisplay(nil, true)')
 addHotkey('d', false, false, true, true, false, 'toggleDebugDisplay(true, nil)')
 addHotkey('w', true, false, false, true, false, 'toggleWireframeDisplay()')
+addHotkey('e', true, false, false, true, false, 'toggleConsoleInput()')
+addHotkey('p', true, false, false, true, false, 'toggleProfiler()')
+addHotkey('p', true, false, true, true, false, 'profilerDump("save/logs/Profiler-" .. os.date("%Y-%m-%d_%Hh%Mm%Ss") .. ".csv")')
 addHotkey('s', true, false, false, true, true, 'changeSpeed()')
 addHotkey('KP_PLUS', true, false, false, true, true, 'changeSpeed(0.01)')
 addHotkey('KP_MINUS', true, false, false, true, true, 'changeSpeed(-0.01)')
@@ -46,6 +49,12 @@ addHotkey('SPACE', false, false, false, false, true, 'full(1); full(2); full(3);
 addHotkey('i', true, false, false, true, true, 'stand(1); stand(2); stand(3); stand(4); stand(5); stand(6); stand(7); stand(8)')
 addHotkey('PAUSE', false, false, false, true, false, 'togglePause(); closeMenu()')
 addHotkey('SCROLLLOCK', false, false, false, true, false, 'frameStep()')
+addHotkey('COMMA', true, false, false, true, false, 'replayStep(-1)')
+addHotkey('PERIOD', true, false, false, true, false, 'replayStep(1)')
+addHotkey('COMMA', true, false, true, true, false, 'replayStep(-60)')
+addHotkey('PERIOD', true, false, true, true, false, 'replayStep(60)')
+addHotkey('PAGEUP', true, false, false, true, false, 'main.f_replayRound(-1)')
+addHotkey('PAGEDOWN', true, false, false, true, false, 'main.f_replayRound(1)')
 
 function changeSpeed(add)
 	local accel = debugMode("accel")
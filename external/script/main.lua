@@ -716,6 +716,12 @@ function main.f_commandLine()
 	if flags['-log'] ~= nil then
 		main.f_printTable(getGameStats().Matches[matchNo()], flags['-log'])
 	end
+	if flags['-synctest'] ~= nil then
+		os.exit(syncTestFinish() or 0)
+	end
+	if flags['-scenario'] ~= nil then
+		os.exit(scenarioFinish() or 0)
+	end
 	os.exit()
 end
 
@@ -1837,6 +1843,13 @@ main.t_itemname = {
 		end
 		return nil
 	end,
+	--SERVER LOBBY
+	['serverlobby'] = function(t, item)
+		local doneSnd = motif[main.group].cursor.done.snd.serverlobby or motif[main.group].cursor.done.snd.default
+		sndPlay(motif.Snd, doneSnd[1], doneSnd[2])
+		main.f_lobby(gameOption('Netplay.LobbyServer'))
+		return nil
+	end,
 	--SERVER HOST
 	['serverhost'] = function(t, item)
 		local doneSnd = motif[main.group].cursor.done.snd.serverhost or motif[main.group].cursor.done.snd.default
@@ -2645,6 +2658,30 @@ function main.f_renameReplay(item, t)
 	return t, item
 end
 
+--short description of a replay file (players, characters and number of matches), read without playing it
+function main.f_replaySummary(path)
+	local info = getReplayInfo(path)
+	if info == nil or info.Matches == nil or #info.Matches == 0 then
+		return nil
+	end
+	local sides = {}
+	for side = 1, 2 do
+		local names = {}
+		for _, c in ipairs(info.Matches[1].Sides[side] or {}) do
+			table.insert(names, c.Name)
+		end
+		sides[side] = table.concat(names, '/')
+		if info.Players ~= nil and info.Players[side] ~= nil and info.Players[side] ~= '' then
+			sides[side] = info.Players[side] .. ' (' .. sides[side] .. ')'
+		end
+	end
+	local txt = sides[1] .. ' vs ' .. sides[2]
+	if #info.Matches > 1 then
+		txt = txt .. ' +' .. (#info.Matches - 1)
+	end
+	return txt
+end
+
 --replay menu
 function main.f_replay()
 	local w = main.f_menuWindow(motif.replay_info.menu)
@@ -2671,7 +2708,8 @@ function main.f_replay()
 			path = path:gsub('\\', '/')
 			ext = ext:lower()
 			if ext == 'replay' then
-				table.insert(t, {itemname = path .. filename .. '.' .. ext, displayname = filename})
+				local itemname = path .. filename .. '.' .. ext
+				table.insert(t, {itemname = itemname, displayname = filename, vardisplay = main.f_replaySummary(itemname)})
 			end
 		end)
 	end
@@ -2715,36 +2753,278 @@ function main.f_replay()
 	end
 end
 
-function main.f_connect(server, str)
-	enterNetPlay(server)
+--replay scrub bar, shown while a replay match is paused or seeking
+main.t_replayBar = {
+	bg = rectNew(),
+	fill = rectNew(),
+	markers = {},
+}
+rectSetLocalcoord(main.t_replayBar.bg, 320, 240)
+rectSetColor(main.t_replayBar.bg, 0, 0, 0)
+rectSetAlpha(main.t_replayBar.bg, 160, 96)
+rectSetLocalcoord(main.t_replayBar.fill, 320, 240)
+rectSetColor(main.t_replayBar.fill, 255, 255, 255)
+rectSetAlpha(main.t_replayBar.fill, 255, 0)
+
+function main.f_replayBar()
+	local frame = replayFrame()
+	if frame == nil or not (paused() or replaySeeking()) then
+		return
+	end
+	local t = main.t_replayBar
+	local len = math.max(replayLength(), frame, 1)
+	local x1, x2, y1, y2 = 10, 310, 226, 230
+	rectSetWindow(t.bg, x1, y1, x2, y2)
+	rectDraw(t.bg, 2)
+	rectSetWindow(t.fill, x1, y1, x1 + math.max(1, (x2 - x1) * frame / len), y2)
+	rectDraw(t.fill, 2)
+	for i, m in ipairs(replayRoundMarkers()) do
+		if t.markers[i] == nil then
+			t.markers[i] = rectNew()
+			rectSetLocalcoord(t.markers[i], 320, 240)
+			rectSetColor(t.markers[i], 255, 200, 0)
+			rectSetAlpha(t.markers[i], 255, 0)
+		end
+		local x = x1 + (x2 - x1) * m.frame / len
+		rectSetWindow(t.markers[i], x, y1 - 2, x + 1, y2 + 2)
+		rectDraw(t.markers[i], 2)
+	end
+end
+hook.add("loop", "replayBar", main.f_replayBar)
+
+--jump to the previous or next round start of the replay match
+function main.f_replayRound(dir)
+	if replayFrame() == nil then
+		return
+	end
+	if dir > 0 then
+		replaySeekRound(roundNo() + 1)
+		return
+	end
+	--go to the start of the current round, or the previous one if already close to it
+	local target = nil
+	for _, m in ipairs(replayRoundMarkers()) do
+		if m.frame < replayFrame() - 30 then
+			target = m.frame
+		end
+	end
+	if target ~= nil then
+		replaySeek(target)
+	end
+end
+
+--replay verification (-verifyreplay): plays the replay once and exits with the verification result
+function main.f_verifyReplay(path)
+	if enterReplay(path) and synchronize() then
+		enterSyncedNetplayMenu()
+	end
+	replayStop()
+	exitNetPlay()
+	exitReplay()
+	local warning = getSessionWarning()
+	if warning ~= nil and warning ~= '' then
+		print(warning)
+	end
+	os.exit(replayVerifyFinish() or 0)
+end
+
+--draws the connecting screen with the given text
+function main.f_drawConnecting(txt)
+	--draw clearcolor
+	clearColor(motif[main.background].bgclearcolor[1], motif[main.background].bgclearcolor[2], motif[main.background].bgclearcolor[3])
+	--draw layerno = 0 backgrounds
+	bgDraw(motif[main.background].BGDef, 0)
+	--draw overlay
+	rectDraw(motif.title_info.connecting.overlay.RectData)
+	--draw text
+	textImgReset(motif.title_info.connecting.TextSpriteData)
+	textImgSetText(motif.title_info.connecting.TextSpriteData, txt)
+	textImgDraw(motif.title_info.connecting.TextSpriteData)
+	--draw layerno = 1 backgrounds
+	bgDraw(motif[main.background].BGDef, 1)
+	refresh()
+end
+
+function main.f_connect(server, str, lobby)
+	if lobby then
+		enterLobbyNetPlay()
+	else
+		enterNetPlay(server)
+	end
 	while not connected() do
 		if esc() or getInput(-1, motif.title_info.menu.cancel.key) then
 			sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
 			exitNetPlay()
 			return false
 		end
-		--draw clearcolor
-		clearColor(motif[main.background].bgclearcolor[1], motif[main.background].bgclearcolor[2], motif[main.background].bgclearcolor[3])
-		--draw layerno = 0 backgrounds
-		bgDraw(motif[main.background].BGDef, 0)
-		--draw overlay
-		rectDraw(motif.title_info.connecting.overlay.RectData)
-		--draw text
 		local txt = string.format(motif.title_info.connecting.text.default, str)
 		if server ~= '' then
 			txt = string.format(motif.title_info.connecting.text.join, server, str)
 		end
-		textImgReset(motif.title_info.connecting.TextSpriteData)
-		textImgSetText(motif.title_info.connecting.TextSpriteData, txt)
-		textImgDraw(motif.title_info.connecting.TextSpriteData)
-		--draw layerno = 1 backgrounds
-		bgDraw(motif[main.background].BGDef, 1)
-		refresh()
+		main.f_drawConnecting(txt)
 	end
 	replayRecord('save/replays/' .. os.date("%Y-%m-%d_%Hh%Mm%Ss") .. '.replay')
 	return true
 end
 
+--plays back the matches of a session joined at keyframes, menus are not sent
+function main.f_spectateMatches(server, str)
+	while true do
+		local started = spectateMatch()
+		if started == nil then
+			if esc() or getInput(-1, motif.title_info.menu.cancel.key) then
+				sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
+				return
+			end
+			main.f_drawConnecting(string.format(motif.title_info.connecting.text.join, server, str))
+		elseif started then
+			if game() == -1 then
+				return
+			end
+		else
+			return
+		end
+	end
+end
+
+--connects to a netplay host as a spectator and plays back its session
+function main.f_spectate(server, str)
+	enterSpectate(server)
+	while not spectateConnected() do
+		if esc() or getInput(-1, motif.title_info.menu.cancel.key) then
+			sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
+			exitReplay()
+			return false
+		end
+		main.f_drawConnecting(string.format(motif.title_info.connecting.text.join, server, str))
+	end
+	local ok, late = spectateStart()
+	if ok and late then
+		main.f_spectateMatches(server, str)
+	elseif ok and synchronize() then
+		enterSyncedNetplayMenu()
+	end
+	replayStop()
+	exitNetPlay()
+	exitReplay()
+	showSessionWarning()
+	return true
+end
+
+--waits until the hosted or joined lobby room is matched with another player
+function main.f_lobbyWait(txt)
+	while true do
+		local status = lobbyStatus()
+		if status.state == 'matched' then
+			return true
+		elseif status.state ~= 'hosting' and status.state ~= 'joining' then
+			if status.error ~= '' then
+				print(status.error)
+			end
+			sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
+			return false
+		elseif esc() or getInput(-1, motif.title_info.menu.cancel.key) then
+			sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
+			lobbyLeave()
+			return false
+		end
+		main.f_drawConnecting(txt)
+	end
+end
+
+--lobby room list, items are rebuilt from the latest lobby server reply
+function main.f_lobbyItems()
+	local t = {{itemname = 'create', displayname = 'CREATE ROOM'}}
+	for _, v in ipairs(lobbyRooms()) do
+		local vardisplay = v.host
+		if v.rollback then
+			vardisplay = vardisplay .. ' (rollback)'
+		end
+		table.insert(t, {itemname = 'room', displayname = v.name, vardisplay = vardisplay, id = v.id})
+	end
+	table.insert(t, {itemname = 'back', displayname = motif.replay_info.menu.itemname.back})
+	return t
+end
+
+--lists the rooms of a lobby server, hosts or joins one and starts the netplay session
+function main.f_lobby(server)
+	local ok, err = lobbyConnect(server)
+	if not ok then
+		sndPlay(motif.Snd, motif.title_info.cancel.snd[1], motif.title_info.cancel.snd[2])
+		print('Lobby: ' .. tostring(err))
+		return false
+	end
+	--the lobby reuses the replay select screen layout
+	textImgReset(motif.replay_info.title.TextSpriteData)
+	textImgSetText(motif.replay_info.title.TextSpriteData, 'LOBBY')
+	local cursorPosY = 1
+	local moveTxt = 0
+	local item = 1
+	local t = main.f_lobbyItems()
+	local counter = 0
+	bgReset(motif.replaybgdef.BGDef)
+	fadeInInit(motif.replay_info.fadein.FadeData)
+	main.close = false
+	while true do
+		counter = counter + 1
+		if counter % 60 == 0 then
+			lobbyRefresh()
+		elseif counter % 60 == 10 then
+			t = main.f_lobbyItems()
+			item = math.min(item, #t)
+			cursorPosY = math.min(cursorPosY, item)
+		end
+		main.f_menuCommonDraw(t, item, cursorPosY, moveTxt, motif.replay_info, motif.replaybgdef, false)
+		cursorPosY, moveTxt, item = main.f_menuCommonCalc(t, item, cursorPosY, moveTxt, motif.replay_info, motif.replay_info.cursor)
+		if main.close and not fadeActive() then
+			bgReset(motif[main.background].BGDef)
+			fadeInInit(motif[main.group].fadein.FadeData)
+			main.close = false
+			break
+		elseif esc() or getInput(-1, motif[main.group].menu.cancel.key) or (t[item].itemname == 'back' and getInput(-1, motif[main.group].menu.done.key)) then
+			sndPlay(motif.Snd, motif.replay_info.cancel.snd[1], motif.replay_info.cancel.snd[2])
+			fadeOutInit(motif.replay_info.fadeout.FadeData)
+			main.close = true
+		elseif getInput(-1, motif[main.group].menu.done.key) then
+			sndPlay(motif.Snd, motif[main.group].cursor.done.snd.default[1], motif[main.group].cursor.done.snd.default[2])
+			local matched = false
+			if t[item].itemname == 'create' then
+				lobbyCreate()
+				matched = main.f_lobbyWait(string.format(motif.title_info.connecting.text.default, gameOption('Netplay.ListenPort')))
+			else
+				lobbyJoin(t[item].id)
+				matched = main.f_lobbyWait(string.format(motif.title_info.connecting.text.join, t[item].displayname, t[item].vardisplay))
+			end
+			if matched then
+				local status = lobbyStatus()
+				local peer = ''
+				if t[item].itemname ~= 'create' then
+					peer = status.peer or ''
+				end
+				if main.f_connect(peer, status.name, true) then
+					if synchronize() then
+						enterSyncedNetplayMenu()
+					end
+					replayStop()
+					exitNetPlay()
+					exitReplay()
+					showSessionWarning()
+				end
+				lobbyLeave()
+			end
+			if lobbyStatus().state == 'closed' then
+				break
+			end
+			textImgReset(motif.replay_info.title.TextSpriteData)
+			textImgSetText(motif.replay_info.title.TextSpriteData, 'LOBBY')
+			lobbyRefresh()
+			counter = 0
+		end
+	end
+	lobbyDisconnect()
+	return true
+end
+
 --asserts content unlock conditions
 function main.f_unlock(permanent)
 	local refreshRandom = false
@@ -3611,6 +3891,18 @@ if getCommandLineValue("-p1") ~= nil and getCommandLineValue("-p2") ~= nil then
 	main.f_commandLine()
 end
 
+if getCommandLineValue("-verifyreplay") ~= nil then
+	main.f_verifyReplay(getCommandLineValue("-verifyreplay"))
+end
+
+if getCommandLineValue("-spectate") ~= nil then
+	main.f_spectate(getCommandLineValue("-spectate"), getCommandLineValue("-spectate"))
+end
+
+if getCommandLineValue("-lobby") ~= nil then
+	main.f_lobby(getCommandLineValue("-lobby"))
+end
+
 main.f_loadingRefresh()
 
 if motif.attract_mode.enabled then
@@ -282,6 +282,14 @@ function start.f_remapAI(ai)
 			end
 		end
 	end
+	--Netplay parties: P3/P4 are controlled by the 3rd/4th participant in simul and tag
+	for i = 3, netPlayers() do
+		local side = (i - 1) % 2 + 1
+		if (start.p[side].teamMode == 1 or start.p[side].teamMode == 3) and i <= #start.p[side].t_selected * 2 then
+			remapInput(i, i)
+			setCom(i, 0)
+		end
+	end
 end
 
 --sets lifebar elements, round time, rounds to win
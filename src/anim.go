@@ -928,6 +928,7 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 
 	rp := RenderParams{
 		tex:            a.spr.Tex,
+		uv:             a.spr.uv,
 		paltex:         paltex,
 		size:           a.spr.Size,
 		x:              x * sys.widthScale,
@@ -979,6 +980,7 @@ func (a *Animation) ShadowDraw(window *[4]int32, x, y, xscl, yscl, vscl, rxadd f
 
 	rp := RenderParams{
 		tex:            a.spr.Tex,
+		uv:             a.spr.uv,
 		paltex:         nil,
 		size:           a.spr.Size,
 		x:              Abs(xscl*h) * float32(a.spr.Offset[0]) * sys.widthScale,
@@ -1283,6 +1285,8 @@ func (dl DrawList) draw(layerno int32, under bool, cameraX, cameraY, cameraScl f
 	shake := sys.envShake.getOffset()
 
 	// Draw only the filtered items
+	spriteBatch.begin()
+	defer spriteBatch.end()
 	for _, idx := range sortList {
 		s := dl[idx]
 
@@ -2023,7 +2027,7 @@ func (a *Anim) Copy() *Anim {
 		}
 		dst := newSprite()
 
-		dst.Tex = src.Tex
+		dst.Tex, dst.uv = src.Tex, src.uv
 		dst.palidx = src.palidx
 		dst.coldepth = src.coldepth
 		// Copy arrays (if not slices, this is fine as-is)
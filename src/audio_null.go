@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopxl/beep/v2"
+)
+
+// NullSpeaker is the AudioSink used in headless mode. It has no device and
+// simply drains the mixer in real time, so finished streamers are removed
+// from the mixer exactly as they would be with a real speaker.
+type NullSpeaker struct {
+	mixer      *beep.Mixer
+	mu         sync.Mutex
+	sampleRate beep.SampleRate
+	bufferSize int
+	buf        [][2]float64
+	closed     bool
+}
+
+func (s *NullSpeaker) Init(sampleRate beep.SampleRate, bufferSize int) error {
+	s.sampleRate = sampleRate
+	s.mixer = &beep.Mixer{}
+	s.buf = make([][2]float64, bufferSize)
+	s.bufferSize = bufferSize
+
+	interval := sampleRate.D(bufferSize)
+	SafeGo(func() {
+		for {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			s.FillAudio()
+			time.Sleep(interval)
+		}
+	})
+
+	return nil
+}
+
+func (s *NullSpeaker) FillAudio() {
+	s.mu.Lock()
+	s.mixer.Stream(s.buf)
+	s.mu.Unlock()
+}
+
+func (s *NullSpeaker) Play(st beep.Streamer) {
+	s.mu.Lock()
+	s.mixer.Add(st)
+	s.mu.Unlock()
+}
+
+func (s *NullSpeaker) Lock()   { s.mu.Lock() }
+func (s *NullSpeaker) Unlock() { s.mu.Unlock() }
+
+func (s *NullSpeaker) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
@@ -252,6 +252,8 @@ const (
 	OC_ex_
 	OC_ex2_
 	OC_ex3_
+	OC_specialize // Code folded for one player, then the generic code. See bytecode_optimizer.go
+	OC_localarray // Element of a local array. Operands: first slot, length - 1
 )
 const (
 	OC_const_data_life OpCode = iota
@@ -1142,6 +1144,22 @@ func (bv *BytecodeValue) SetB(b bool) {
 	bv.value = float64(Btoi(b))
 }
 
+// Converts a value assigned to a typed local. Undefined values stay undefined
+func (bv BytecodeValue) convert(vt ValueType) BytecodeValue {
+	if bv.IsUndefined() || bv.vtype == vt {
+		return bv
+	}
+	switch vt {
+	case VT_Float:
+		bv.SetF(bv.ToF())
+	case VT_Int:
+		bv.SetI(bv.ToI())
+	case VT_Bool:
+		bv.SetB(bv.ToB())
+	}
+	return bv
+}
+
 func bvNone() BytecodeValue {
 	return BytecodeValue{VT_None, 0}
 }
@@ -1905,6 +1923,14 @@ func (be BytecodeExp) run(c *Char) BytecodeValue {
 			fallthrough
 		case OC_jmp:
 			be.JumpToNext(&i)
+		case OC_specialize:
+			// The first version has the const() values of this player folded
+			if c.playerNo == int(be[i]) {
+				i += 5
+			} else {
+				i++
+				be.JumpToNext(&i)
+			}
 		case OC_player:
 			if c = sys.playerID(c.getPlayerID(int(sys.bcStack.Pop().ToI()))); c != nil {
 				// Valid: Move past the length header and enter the block
@@ -2367,6 +2393,15 @@ func (be BytecodeExp) run(c *Char) BytecodeValue {
 		case OC_localvar:
 			sys.bcStack.Push(sys.bcVar[uint8(be[i])])
 			i++
+		case OC_localarray:
+			// The index is checked so it can't reach other locals
+			if n := sys.bcStack.Top().ToI(); n < 0 || n > int32(uint8(be[i+1])) {
+				sys.appendToConsole(c.warn() + fmt.Sprintf("local array index %v out of range", n))
+				*sys.bcStack.Top() = BytecodeUndefined()
+			} else {
+				*sys.bcStack.Top() = sys.bcVar[int(uint8(be[i]))+int(n)]
+			}
+			i += 2
 		}
 		c = oc
 	}
@@ -4397,10 +4432,13 @@ func (NullStateController) Run(_ *Char, _ []int32) bool {
 var nullStateController NullStateController
 
 type bytecodeFunction struct {
-	numVars int32
-	numRets int32
-	numArgs int32
-	ctrls   []StateController
+	numVars     int32
+	numRets     int32
+	numArgs     int32           // Slots taken by the arguments
+	params      []*zssType      // Types of array and record parameters, nil for the others
+	locals      []BytecodeValue // Initial values of the typed locals
+	ctrls       []StateController
+	ctrlIndexes []int32 // Number of each controller in ctrls, for the profiler
 }
 
 func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
@@ -4414,7 +4452,8 @@ func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
 
 	copy(sys.bcVar, sys.bcStack)
 	sys.bcStack.Clear()
-	for _, sc := range bf.ctrls {
+	copy(sys.bcVar[bf.numArgs+bf.numRets:], bf.locals)
+	for i := range bf.ctrls {
 		// Do not check ignorehitpause here. The function call already did it
 		//switch sc.(type) {
 		//case StateBlock:
@@ -4423,7 +4462,7 @@ func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
 		//		continue
 		//	}
 		//}
-		if sc.Run(c, nil) {
+		if sys.profiler.run(c, nil, bf.ctrls, bf.ctrlIndexes, i) {
 			changeState = true
 			break
 		}
@@ -4466,7 +4505,11 @@ func (cf callFunction) Run(c *Char, _ []int32) (changeState bool) {
 	}
 
 	// Execute the function and map return values back to the designated variables
-	return bf.run(c, cf.ret)
+	oldFunction := sys.profiler.function
+	sys.profiler.function = cf.name
+	changeState = bf.run(c, cf.ret)
+	sys.profiler.function = oldFunction
+	return
 }
 
 type StateBlock struct {
@@ -4478,6 +4521,8 @@ type StateBlock struct {
 	trigger             BytecodeExp
 	elseBlock           *StateBlock
 	ctrls               []StateController
+	ctrlIndex           int32   // Number of the first controller, for the profiler
+	ctrlIndexes         []int32 // Number of each controller in ctrls, for the profiler
 	// Loop fields
 	loopBlock        bool
 	nestedInLoop     bool
@@ -4572,13 +4617,13 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			// Decide if while loop should be stopped
 			if !b.forLoop {
 				// While loop needs to eval conditional indefinitely until it returns false
-				if len(b.trigger) > 0 && !b.trigger.evalB(c) {
+				if len(b.trigger) > 0 && !sys.profiler.trigger(&b, c) {
 					interrupt = true
 				}
 			}
 			// Run state controllers
 			if !interrupt {
-				for _, sc := range b.ctrls {
+				for i, sc := range b.ctrls {
 					switch sc.(type) {
 					case StateBlock:
 					default:
@@ -4586,7 +4631,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 							continue
 						}
 					}
-					if sc.Run(c, ps) {
+					if sys.profiler.run(c, ps, b.ctrls, b.ctrlIndexes, i) {
 						if sys.loopBreak {
 							sys.loopBreak = false
 							interrupt = true
@@ -4627,13 +4672,13 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			}
 		}
 	} else {
-		if len(b.trigger) > 0 && !b.trigger.evalB(c) {
+		if len(b.trigger) > 0 && !sys.profiler.trigger(&b, c) {
 			if b.elseBlock != nil {
 				return b.elseBlock.Run(c, ps)
 			}
 			return false
 		}
-		for _, sc := range b.ctrls {
+		for i, sc := range b.ctrls {
 			switch sc.(type) {
 			case StateBlock:
 			default:
@@ -4641,7 +4686,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 					continue
 				}
 			}
-			if sc.Run(c, ps) {
+			if sys.profiler.run(c, ps, b.ctrls, b.ctrlIndexes, i) {
 				return true
 			}
 		}
@@ -4662,10 +4707,30 @@ func (se StateExpr) Run(c *Char, _ []int32) (changeState bool) {
 type varAssign struct {
 	vari uint8
 	be   BytecodeExp
+	vt   ValueType // Type of typed locals, VT_None for let variables
 }
 
 func (va varAssign) Run(c *Char, _ []int32) (changeState bool) {
-	sys.bcVar[va.vari] = va.be.run(c)
+	sys.bcVar[va.vari] = va.be.run(c).convert(va.vt)
+	return false
+}
+
+// Assignment to an element of a local array
+type localArrayAssign struct {
+	vari   uint8 // First slot of the array
+	length int32
+	vt     ValueType
+	index  BytecodeExp
+	be     BytecodeExp
+}
+
+func (la localArrayAssign) Run(c *Char, _ []int32) (changeState bool) {
+	n := la.index.evalI(c)
+	if n < 0 || n >= la.length {
+		sys.appendToConsole(c.warn() + fmt.Sprintf("local array index %v out of range", n))
+		return false
+	}
+	sys.bcVar[int(la.vari)+int(n)] = la.be.run(c).convert(la.vt)
 	return false
 }
 
@@ -14845,10 +14910,12 @@ type StateBytecode struct {
 	moveType  MoveType
 	physics   StateType
 	playerNo  int
+	stateNo   int32
 	stateDef  stateDef
 	block     StateBlock
 	ctrlsps   []int32
 	numVars   int32
+	locals    []BytecodeValue // Typed locals, kept until the state changes
 }
 
 // StateDef bytecode creation function
@@ -14896,8 +14963,13 @@ func (sb *StateBytecode) init(c *Char) {
 
 func (sb *StateBytecode) run(c *Char) (changeState bool) {
 	sys.bcVar = sys.bcVarStack.Alloc(int(sb.numVars))
+	copy(sys.bcVar, sb.locals)
 	sys.workingState = sb
 	changeState = sb.block.Run(c, sb.ctrlsps)
+	// Negative states are shared, so only the current state keeps its locals
+	if !changeState && sb == &c.ss.sb {
+		copy(sb.locals, sys.bcVar)
+	}
 	if len(sys.bcStack) != 0 {
 		LogMessage(sys.cgi[sb.playerNo].def)
 		for _, v := range sys.bcStack {
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Disassembler for compiled states (-disasm <char.def>, or disassemble() in
+// the debug console), to check what the compiler actually produced. Each
+// controller is listed with its triggers and parameters, one instruction per
+// line: byte offset, opcode name and decoded operands. Jumps show the offset
+// they land on, and the code a redirection applies to is indented under it.
+//
+// Controllers are numbered like the profiler numbers them. Parameters are
+// listed by the id the controller's compiler gave them.
+
+type bcDisasm struct {
+	sb strings.Builder
+	pn int // Player whose string pool the code uses
+}
+
+func (d *bcDisasm) line(depth int, format string, a ...interface{}) {
+	d.sb.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(&d.sb, format, a...)
+	d.sb.WriteByte('\n')
+}
+
+func bcName(names []string, op OpCode) string {
+	if int(op) < len(names) {
+		return names[op]
+	}
+	return fmt.Sprintf("op%d", op)
+}
+
+// Name of the sub OpCode of OC_const_, OC_st_ and OC_ex*_
+func bcSubName(op, sub OpCode) string {
+	switch op {
+	case OC_const_:
+		return bcName(bcConstNames, sub)
+	case OC_st_:
+		return bcName(bcStNames, sub)
+	case OC_ex_:
+		return bcName(bcExNames, sub)
+	case OC_ex2_:
+		return bcName(bcEx2Names, sub)
+	}
+	return bcName(bcEx3Names, sub)
+}
+
+// Whether the 4 byte operand of a sub OpCode is an index in the string pool
+func bcPoolOperand(op, sub OpCode) bool {
+	switch op {
+	case OC_const_, OC_st_:
+		return true
+	case OC_ex_:
+		switch sub {
+		case OC_ex_gamemode, OC_ex_helpername, OC_ex_maparray, OC_ex_selfcommand:
+			return true
+		}
+	case OC_ex2_:
+		return sub != OC_ex2_hitbyattr
+	}
+	return false
+}
+
+func (d *bcDisasm) poolString(idx int) string {
+	if list := sys.stringPool[d.pn].List; idx >= 0 && idx < len(list) {
+		return strconv.Quote(list[idx])
+	}
+	return fmt.Sprintf("string#%d", idx)
+}
+
+// Text of the instruction at p, n bytes long and jumping to t
+func (d *bcDisasm) instr(be BytecodeExp, p, n, t int) string {
+	op := be[p]
+	name := bcName(bcOpNames, op)
+	target := func() string {
+		if t == len(be) {
+			return "end"
+		}
+		return fmt.Sprintf("%04d", t)
+	}
+	switch {
+	case op == OC_jmp8 || op == OC_jz8 || op == OC_jnz8 || op == OC_jsf8 ||
+		op == OC_jmp || op == OC_jz || op == OC_jnz:
+		return name + " -> " + target()
+	case bcIsRedirect(op):
+		return name + " (until " + target() + ")"
+	}
+	switch op {
+	case OC_int8, OC_int, OC_int64, OC_float:
+		return fmt.Sprintf("%v %v", name, bcLiteral(be[p:p+n]).value)
+	case OC_statetype, OC_movetype, OC_teammode, OC_localvar:
+		return fmt.Sprintf("%v %v", name, be[p+1])
+	case OC_localarray:
+		return fmt.Sprintf("%v %v[%v]", name, be[p+1], int(be[p+2])+1)
+	case OC_command:
+		return name + " " + d.poolString(be.i32At(p+1))
+	case OC_hitdefattr:
+		return fmt.Sprintf("%v 0x%x", name, uint32(be.i32At(p+1)))
+	case OC_run, OC_nordrun:
+		return fmt.Sprintf("%v (%d bytes)", name, n-5)
+	case OC_specialize:
+		return fmt.Sprintf("%v P%v, else %04d", name, int(be[p+1])+1, p+6+be.i32At(p+2))
+	case OC_const_, OC_st_, OC_ex_, OC_ex2_, OC_ex3_:
+		sub := be[p+1]
+		s := name + " " + bcSubName(op, sub)
+		switch n - 2 {
+		case 1:
+			s += fmt.Sprintf(" %v", be[p+2])
+		case 4:
+			if bcPoolOperand(op, sub) {
+				s += " " + d.poolString(be.i32At(p+2))
+			} else {
+				s += fmt.Sprintf(" 0x%x", uint32(be.i32At(p+2)))
+			}
+		case 8:
+			s += fmt.Sprintf(" 0x%x", *(*uint64)(unsafe.Pointer(&be[p+2])))
+		}
+		return s
+	}
+	return name
+}
+
+// Lists the instructions of an expression
+func (d *bcDisasm) exp(be BytecodeExp, depth int) {
+	var ends []int // Ends of the redirected code
+	for p := 0; p < len(be); {
+		for len(ends) > 0 && p >= ends[len(ends)-1] {
+			ends = ends[:len(ends)-1]
+		}
+		indent := depth + len(ends)
+		n, t, ok := be.instrLen(p)
+		if !ok {
+			d.line(indent, "%04d  invalid %v", p, []OpCode(be[p:]))
+			return
+		}
+		d.line(indent, "%04d  %v", p, d.instr(be, p, n, t))
+		op := be[p]
+		switch {
+		case op == OC_run || op == OC_nordrun:
+			d.exp(be[p+5:p+n], indent+1)
+		case op == OC_specialize:
+			// Both versions follow, each with its own jumps
+			p += 6
+			continue
+		case bcIsRedirect(op):
+			ends = append(ends, t)
+		}
+		p += n
+	}
+}
+
+// Lists the parameters of a controller, by id
+func (d *bcDisasm) params(scb StateControllerBase, depth int) {
+	lintParams(scb, func(id byte, exp []BytecodeExp) {
+		for i, be := range exp {
+			if len(exp) > 1 {
+				d.line(depth, "param %v[%v]:", id, i)
+			} else {
+				d.line(depth, "param %v:", id)
+			}
+			d.exp(be, depth+1)
+		}
+	})
+}
+
+func (d *bcDisasm) ctrls(ctrls []StateController, depth int, n *int32) {
+	for _, sc := range ctrls {
+		d.ctrl(sc, depth, n)
+	}
+}
+
+func (d *bcDisasm) ctrl(sc StateController, depth int, n *int32) {
+	switch sc := sc.(type) {
+	case StateBlock:
+		d.block(&sc, depth, n)
+		return
+	case varAssign:
+		d.line(depth, "#%v varAssign local %v:", *n, sc.vari)
+		d.exp(sc.be, depth+1)
+	case localArrayAssign:
+		d.line(depth, "#%v localArrayAssign local %v[%v], index:", *n, sc.vari, sc.length)
+		d.exp(sc.index, depth+1)
+		d.line(depth, "value:")
+		d.exp(sc.be, depth+1)
+	case StateExpr:
+		d.line(depth, "#%v expression:", *n)
+		d.exp(BytecodeExp(sc), depth+1)
+	case callFunction:
+		d.line(depth, "#%v callFunction %v, returns to locals %v:", *n, sc.name, sc.ret)
+		d.exp(sc.arg, depth+1)
+	default:
+		d.line(depth, "#%v %v", *n, reflect.TypeOf(sc).Name())
+		if v := reflect.ValueOf(sc); v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			d.params(StateControllerBase(v.Bytes()), depth+1)
+		}
+	}
+	*n++
+}
+
+func (d *bcDisasm) block(b *StateBlock, depth int, n *int32) {
+	var attrs []string
+	if b.persistentIndex >= 0 {
+		attrs = append(attrs, fmt.Sprintf("persistent %v", b.persistent))
+	}
+	if b.ignorehitpause >= -1 {
+		attrs = append(attrs, "ignorehitpause")
+	}
+	kind := "block"
+	if b.loopBlock {
+		kind = "while"
+		if b.forLoop {
+			kind = "for"
+		}
+	}
+	d.line(depth, "%v #%v %v", kind, *n, strings.Join(attrs, ", "))
+	if b.forLoop {
+		if b.forAssign {
+			d.line(depth+1, "local %v =", b.forCtrlVar.vari)
+			d.exp(b.forCtrlVar.be, depth+2)
+		}
+		for i, be := range b.forExpression {
+			if len(be) > 0 {
+				d.line(depth+1, "expression %v:", i+1)
+				d.exp(be, depth+2)
+			}
+		}
+	}
+	if len(b.trigger) > 0 {
+		d.line(depth+1, "trigger:")
+		d.exp(b.trigger, depth+2)
+	}
+	d.ctrls(b.ctrls, depth+1, n)
+	if b.elseBlock != nil {
+		d.line(depth, "else")
+		d.block(b.elseBlock, depth, n)
+	}
+}
+
+func bcStateTypeName(st StateType) string {
+	switch st {
+	case ST_S:
+		return "S"
+	case ST_C:
+		return "C"
+	case ST_A:
+		return "A"
+	case ST_L:
+		return "L"
+	case ST_N:
+		return "N"
+	case ST_U:
+		return "U"
+	}
+	return strconv.Itoa(int(st))
+}
+
+func bcMoveTypeName(mt MoveType) string {
+	switch mt {
+	case MT_I:
+		return "I"
+	case MT_H:
+		return "H"
+	case MT_A:
+		return "A"
+	case MT_U:
+		return "U"
+	}
+	return strconv.Itoa(int(mt))
+}
+
+func (d *bcDisasm) state(no int32, sb *StateBytecode) {
+	d.pn = sb.playerNo
+	d.line(0, "Statedef %v (P%v): type %v, movetype %v, physics %v, %v locals (%v typed)", no, sb.playerNo+1,
+		bcStateTypeName(sb.stateType), bcMoveTypeName(sb.moveType), bcStateTypeName(sb.physics), sb.numVars,
+		len(sb.locals))
+	d.params(StateControllerBase(sb.stateDef), 1)
+	var n int32
+	d.block(&sb.block, 1, &n)
+}
+
+func (d *bcDisasm) function(name string, bf *bytecodeFunction) {
+	d.line(0, "Function %v: %v args, %v returns, %v locals (%v typed)", name, bf.numArgs, bf.numRets, bf.numVars,
+		len(bf.locals))
+	var n int32
+	d.ctrls(bf.ctrls, 1, &n)
+}
+
+// Lists states, all of them if nos is empty, and functions
+func disassemble(pn int, states map[int32]StateBytecode, nos []int32, funcs map[string]bytecodeFunction) string {
+	var d bcDisasm
+	d.pn = pn
+	if len(nos) == 0 {
+		for no := range states {
+			nos = append(nos, no)
+		}
+		sort.Slice(nos, func(i, j int) bool { return nos[i] < nos[j] })
+	}
+	for _, no := range nos {
+		if sb, ok := states[no]; ok {
+			d.state(no, &sb)
+		} else {
+			d.line(0, "Statedef %v doesn't exist", no)
+		}
+	}
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bf := funcs[name]
+		d.pn = pn
+		d.function(name, &bf)
+	}
+	return d.sb.String()
+}
+
+// Compiles a character and prints the listing of its states. Returns the
+// process exit code
+func runDisasm(def, stateList string) int {
+	var nos []int32
+	for _, s := range strings.Split(stateList, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		no, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			fmt.Printf("Invalid -disasmstate: %v\n", s)
+			return 1
+		}
+		nos = append(nos, int32(no))
+	}
+	gi := lintSetup(def)
+	if _, err := lintConstants(def, gi); err != nil {
+		fmt.Printf("Disassembly failed: %v\n", err)
+		return 1
+	}
+	comp := newCompiler()
+	states, err := comp.Compile(0, def, gi.constants)
+	if err != nil {
+		fmt.Printf("Disassembly failed: %v\n", err)
+		return 1
+	}
+	funcs := comp.funcs
+	if len(nos) > 0 {
+		funcs = nil
+	}
+	os.Stdout.WriteString(disassemble(0, states, nos, funcs))
+	return 0
+}
+
+// Names of the OpCode constants in bytecode.go, in the same order, without
+// their OC_ prefixes
+var bcOpNames = strings.Fields(`
+	var sysvar fvar sysfvar localvar int8 int int64 float pop dup swap run
+	nordrun jsf8 jmp8 jz8 jnz8 jmp jz jnz eq ne gt ge lt le range_ii
+	range_ie range_ei range_ee neg blnot bland blxor blor not and xor or add
+	sub mul div mod pow abs exp ln log cos sin tan acos asin atan floor ceil
+	ifelse time animtime animelemtime animelemno statetype movetype ctrl
+	command random pos_x pos_y vel_x vel_y vel_z screenpos_x screenpos_y
+	facing anim animexist selfanimexist alive life lifemax power powermax
+	canrecover roundstate roundswon ishelper numhelper numexplod numprojid
+	numproj numtext teammode teamside hitdefattr inguarddist movecontact
+	movehit moveguarded movereversed projcontacttime projhittime
+	projguardedtime projcanceltime backedge backedgedist backedgebodydist
+	frontedge frontedgedist frontedgebodydist leftedge rightedge topedge
+	bottomedge camerapos_x camerapos_y camerazoom gamewidth gameheight
+	screenwidth screenheight stateno prevstateno id playeridexist gametime
+	numtarget numenemy numpartner ailevel palno hitcount uniqhitcount
+	hitpausetime hitover hitshakeover hitfall hitvel_x hitvel_y hitvel_z
+	player parent root helper target partner enemy enemynear playerid
+	playerindex helperindex p2 stateowner rdreset const_ st_ ex_ ex2_ ex3_
+	specialize localarray`)
+
+var bcConstNames = strings.Fields(`
+	data_life data_power data_guardpoints data_dizzypoints data_attack
+	data_defence data_fall_defence_up data_fall_defence_mul
+	data_liedown_time data_airjuggle data_sparkno data_guard_sparkno
+	data_hitsound_channel data_guardsound_channel data_ko_echo data_volume
+	data_intpersistindex data_floatpersistindex size_xscale size_yscale
+	size_ground_back size_ground_front size_air_back size_air_front
+	size_height size_attack_dist_width_front size_attack_dist_width_back
+	size_attack_dist_height_top size_attack_dist_height_bottom
+	size_attack_dist_depth_top size_attack_dist_depth_bottom
+	size_attack_depth_top size_attack_depth_bottom
+	size_proj_attack_dist_width_front size_proj_attack_dist_width_back
+	size_proj_attack_dist_height_top size_proj_attack_dist_height_bottom
+	size_proj_attack_dist_depth_top size_proj_attack_dist_depth_bottom
+	size_proj_doscale size_head_pos_x size_head_pos_y size_mid_pos_x
+	size_mid_pos_y size_shadowoffset size_draw_offset_x size_draw_offset_y
+	size_depth_top size_depth_bottom size_weight size_pushfactor
+	velocity_air_gethit_airrecover_add_x
+	velocity_air_gethit_airrecover_add_y velocity_air_gethit_airrecover_back
+	velocity_air_gethit_airrecover_down velocity_air_gethit_airrecover_fwd
+	velocity_air_gethit_airrecover_mul_x
+	velocity_air_gethit_airrecover_mul_y velocity_air_gethit_airrecover_up
+	velocity_air_gethit_groundrecover_x velocity_air_gethit_groundrecover_y
+	velocity_air_gethit_ko_add_x velocity_air_gethit_ko_add_y
+	velocity_air_gethit_ko_ymin velocity_airjump_back_x
+	velocity_airjump_down_x velocity_airjump_down_y velocity_airjump_down_z
+	velocity_airjump_fwd_x velocity_airjump_neu_x velocity_airjump_up_x
+	velocity_airjump_up_y velocity_airjump_up_z velocity_airjump_y
+	velocity_ground_gethit_ko_add_x velocity_ground_gethit_ko_add_y
+	velocity_ground_gethit_ko_xmul velocity_ground_gethit_ko_ymin
+	velocity_jump_back_x velocity_jump_down_x velocity_jump_down_y
+	velocity_jump_down_z velocity_jump_fwd_x velocity_jump_neu_x
+	velocity_jump_up_x velocity_jump_up_y velocity_jump_up_z velocity_jump_y
+	velocity_run_back_x velocity_run_back_y velocity_run_down_x
+	velocity_run_down_y velocity_run_down_z velocity_run_fwd_x
+	velocity_run_fwd_y velocity_run_up_x velocity_run_up_y velocity_run_up_z
+	velocity_runjump_back_x velocity_runjump_back_y velocity_runjump_down_x
+	velocity_runjump_down_y velocity_runjump_down_z velocity_runjump_fwd_x
+	velocity_runjump_up_x velocity_runjump_up_y velocity_runjump_up_z
+	velocity_runjump_y velocity_walk_back_x velocity_walk_down_x
+	velocity_walk_down_y velocity_walk_down_z velocity_walk_fwd_x
+	velocity_walk_up_x velocity_walk_up_y velocity_walk_up_z
+	movement_airjump_num movement_airjump_height movement_yaccel
+	movement_stand_friction movement_crouch_friction
+	movement_stand_friction_threshold movement_crouch_friction_threshold
+	movement_air_gethit_groundlevel
+	movement_air_gethit_groundrecover_ground_threshold
+	movement_air_gethit_groundrecover_groundlevel
+	movement_air_gethit_airrecover_threshold
+	movement_air_gethit_airrecover_yaccel
+	movement_air_gethit_trip_groundlevel movement_down_bounce_offset_x
+	movement_down_bounce_offset_y movement_down_bounce_yaccel
+	movement_down_bounce_groundlevel movement_down_gethit_offset_x
+	movement_down_gethit_offset_y movement_down_friction_threshold name
+	p2name p3name p4name p5name p6name p7name p8name authorname displayname
+	stagevar_info_author stagevar_info_displayname
+	stagevar_info_ikemenversion stagevar_info_mugenversion
+	stagevar_info_name stagevar_camera_boundleft stagevar_camera_boundright
+	stagevar_camera_boundhigh stagevar_camera_boundlow
+	stagevar_camera_verticalfollow stagevar_camera_floortension
+	stagevar_camera_tensionhigh stagevar_camera_tensionlow
+	stagevar_camera_tension stagevar_camera_tensionvel
+	stagevar_camera_cuthigh stagevar_camera_cutlow stagevar_camera_startzoom
+	stagevar_camera_zoomout stagevar_camera_zoomin
+	stagevar_camera_zoomindelay stagevar_camera_zoominspeed
+	stagevar_camera_zoomoutspeed stagevar_camera_yscrollspeed
+	stagevar_camera_ytension_enable stagevar_camera_autocenter
+	stagevar_camera_lowestcap stagevar_playerinfo_leftbound
+	stagevar_playerinfo_rightbound stagevar_playerinfo_topbound
+	stagevar_playerinfo_botbound stagevar_playerinfo_p1startx
+	stagevar_playerinfo_p2startx stagevar_playerinfo_p1starty
+	stagevar_playerinfo_p2starty stagevar_playerinfo_p1startz
+	stagevar_playerinfo_p2startz stagevar_playerinfo_p1facing
+	stagevar_playerinfo_p2facing stagevar_scaling_topz stagevar_scaling_botz
+	stagevar_scaling_topscale stagevar_scaling_botscale
+	stagevar_bound_screenleft stagevar_bound_screenright
+	stagevar_stageinfo_autoturn stagevar_stageinfo_localcoord_x
+	stagevar_stageinfo_localcoord_y stagevar_stageinfo_resetbg
+	stagevar_stageinfo_xscale stagevar_stageinfo_yscale
+	stagevar_stageinfo_zoffset stagevar_stageinfo_zoffsetlink
+	stagevar_shadow_intensity stagevar_shadow_color_r
+	stagevar_shadow_color_g stagevar_shadow_color_b stagevar_shadow_yscale
+	stagevar_shadow_ydelta stagevar_shadow_fade_range_begin
+	stagevar_shadow_fade_range_end stagevar_shadow_xshear
+	stagevar_shadow_offset_x stagevar_shadow_offset_y
+	stagevar_reflection_intensity stagevar_reflection_ydelta
+	stagevar_reflection_yscale stagevar_reflection_offset_x
+	stagevar_reflection_offset_y stagevar_reflection_fade_range_begin
+	stagevar_reflection_fade_range_end stagevar_reflection_xshear
+	stagevar_reflection_color_r stagevar_reflection_color_g
+	stagevar_reflection_color_b gameoption motifvar constants
+	stage_constants`)
+
+var bcStNames = strings.Fields(`
+	var fvar sysvar sysfvar varadd fvaradd sysvaradd sysfvaradd map`)
+
+var bcExNames = strings.Fields(`
+	p2dist_x p2dist_y p2dist_z p2bodydist_x p2bodydist_y p2bodydist_z
+	parentdist_x parentdist_y parentdist_z rootdist_x rootdist_y rootdist_z
+	win winko wintime winclutch winperfect winspecial winhyper lose loseko
+	losetime drawgame matchover matchno roundno roundsexisted ishometeam
+	tickspersecond const240p const480p const720p const1080p
+	gethitvar_animtype gethitvar_air_animtype gethitvar_ground_animtype
+	gethitvar_fall_animtype gethitvar_type gethitvar_airtype
+	gethitvar_groundtype gethitvar_damage gethitvar_hitcount
+	gethitvar_fallcount gethitvar_hitshaketime gethitvar_hittime
+	gethitvar_slidetime gethitvar_ctrltime gethitvar_xoff gethitvar_yoff
+	gethitvar_zoff gethitvar_xvel gethitvar_yvel gethitvar_zvel
+	gethitvar_xaccel gethitvar_yaccel gethitvar_zaccel gethitvar_xveladd
+	gethitvar_yveladd gethitvar_chainid gethitvar_guarded gethitvar_isbound
+	gethitvar_fall gethitvar_fall_damage gethitvar_fall_xvel
+	gethitvar_fall_yvel gethitvar_fall_zvel gethitvar_fall_recover
+	gethitvar_fall_time gethitvar_fall_recovertime gethitvar_fall_kill
+	gethitvar_fall_envshake_time gethitvar_fall_envshake_freq
+	gethitvar_fall_envshake_ampl gethitvar_fall_envshake_phase
+	gethitvar_fall_envshake_mul gethitvar_fall_envshake_dir gethitvar_attr
+	gethitvar_dizzypoints gethitvar_guardpoints gethitvar_playerid
+	gethitvar_playerno gethitvar_projid gethitvar_teamside gethitvar_redlife
+	gethitvar_score gethitvar_hitdamage gethitvar_guarddamage
+	gethitvar_power gethitvar_hitpower gethitvar_guardpower gethitvar_kill
+	gethitvar_priority gethitvar_guardcount gethitvar_facing
+	gethitvar_ground_velocity_x gethitvar_ground_velocity_y
+	gethitvar_ground_velocity_z gethitvar_air_velocity_x
+	gethitvar_air_velocity_y gethitvar_air_velocity_z
+	gethitvar_down_velocity_x gethitvar_down_velocity_y
+	gethitvar_down_velocity_z gethitvar_guard_velocity_x
+	gethitvar_guard_velocity_y gethitvar_guard_velocity_z
+	gethitvar_airguard_velocity_x gethitvar_airguard_velocity_y
+	gethitvar_airguard_velocity_z gethitvar_frame gethitvar_down_recover
+	gethitvar_down_recovertime gethitvar_guardflag gethitvar_stand_friction
+	gethitvar_crouch_friction gethitvar_keepstate gethitvar_guardko ailevelf
+	animelemvar_alphadest animelemvar_angle animelemvar_alphasource
+	animelemvar_group animelemvar_hflip animelemvar_image animelemvar_time
+	animelemvar_vflip animelemvar_xoffset animelemvar_xscale
+	animelemvar_yoffset animelemvar_yscale animelemvar_numclsn1
+	animelemvar_numclsn2 animlength animplayerno spriteplayerno attack
+	clsnoverlap combocount consecutivewins decisiveround defence dizzy
+	dizzypoints dizzypointsmax fighttime firstattack float gamemode
+	groundangle guardbreak guardpoints guardpointsmax helperindexexist
+	helpername hitoverridden inputtime_B inputtime_D inputtime_F inputtime_U
+	inputtime_L inputtime_R inputtime_N inputtime_a inputtime_b inputtime_c
+	inputtime_x inputtime_y inputtime_z inputtime_s inputtime_d inputtime_w
+	inputtime_m movehitvar_frame movehitvar_cornerpush_veloff
+	movehitvar_overridden movehitvar_playerid movehitvar_playerno
+	movehitvar_power movehitvar_spark_x movehitvar_spark_y
+	movehitvar_uniqhit ikemenversion incustomanim incustomstate
+	isassertedchar isassertedglobal ishost jugglepoints localcoord_x
+	localcoord_y maparray max min numplayer clamp sign atan2 rad deg
+	lastplayerid lerp memberno movecountered mugenversion pausetime physics
+	playerno playerindexexist playernoexist randomrange ratiolevel
+	receiveddamage receivedhits redlife round roundtime score scoretotal
+	selfstatenoexist sprpriority stagebackedgedist stagefrontedgedist
+	stagetime standby teamleader teamsize timeelapsed timeremaining
+	timetotal pos_z vel_z prevanim prevmovetype prevstatetype
+	reversaldefattr envshakevar_time envshakevar_freq envshakevar_ampl
+	envshakevar_dir angle scale_x scale_y scale_z offset_x offset_y alpha_s
+	alpha_d selfcommand`)
+
+var bcEx2Names = strings.Fields(`
+	index fightscreenvar_info_author fightscreenvar_info_localcoord_x
+	fightscreenvar_info_localcoord_y fightscreenvar_info_name
+	fightscreenvar_round_ctrl_time fightscreenvar_round_over_hittime
+	fightscreenvar_round_over_time fightscreenvar_round_over_waittime
+	fightscreenvar_round_over_wintime fightscreenvar_round_slow_time
+	fightscreenvar_round_start_waittime fightscreenvar_round_callfight_time
+	fightscreenvar_time_framespercount groundlevel layerno runorder
+	palfxvar_time palfxvar_addr palfxvar_addg palfxvar_addb palfxvar_mulr
+	palfxvar_mulg palfxvar_mulb palfxvar_color palfxvar_hue
+	palfxvar_invertall palfxvar_invertblend palfxvar_bg_time
+	palfxvar_bg_addr palfxvar_bg_addg palfxvar_bg_addb palfxvar_bg_mulr
+	palfxvar_bg_mulg palfxvar_bg_mulb palfxvar_bg_color palfxvar_bg_hue
+	palfxvar_bg_invertall palfxvar_all_time palfxvar_all_addr
+	palfxvar_all_addg palfxvar_all_addb palfxvar_all_mulr palfxvar_all_mulg
+	palfxvar_all_mulb palfxvar_all_color palfxvar_all_hue
+	palfxvar_all_invertall palfxvar_all_invertblend introstate outrostate
+	angle_x angle_y bgmvar_filename bgmvar_freqmul bgmvar_length bgmvar_loop
+	bgmvar_loopcount bgmvar_loopend bgmvar_loopstart bgmvar_position
+	bgmvar_startposition bgmvar_volume clsnvar_left clsnvar_top
+	clsnvar_right clsnvar_bottom debugmode_accel debugmode_clsndisplay
+	debugmode_debugdisplay debugmode_lifebarhide debugmode_roundreset
+	debugmode_wireframedisplay drawpal_group drawpal_index explodvar_accel_x
+	explodvar_accel_y explodvar_accel_z explodvar_angle explodvar_angle_x
+	explodvar_angle_y explodvar_anim explodvar_animelem
+	explodvar_animelemtime explodvar_animplayerno explodvar_animtime
+	explodvar_spriteplayerno explodvar_bindid explodvar_bindtime
+	explodvar_drawpal_group explodvar_drawpal_index explodvar_facing
+	explodvar_friction_x explodvar_friction_y explodvar_friction_z
+	explodvar_id explodvar_layerno explodvar_pausemovetime explodvar_pos_x
+	explodvar_pos_y explodvar_pos_z explodvar_removetime explodvar_scale_x
+	explodvar_scale_y explodvar_sprpriority explodvar_time explodvar_vel_x
+	explodvar_vel_y explodvar_vel_z explodvar_xshear projvar_accel_x
+	projvar_accel_y projvar_accel_z projvar_animelem projvar_attr
+	projvar_drawpal_group projvar_drawpal_index projvar_facing
+	projvar_guardflag projvar_highbound projvar_hitflag projvar_lowbound
+	projvar_pausemovetime projvar_pos_x projvar_pos_y projvar_pos_z
+	projvar_projangle projvar_projyangle projvar_projxangle projvar_projanim
+	projvar_projcancelanim projvar_projedgebound projvar_projhitanim
+	projvar_projhits projvar_projhitsmax projvar_projid projvar_projlayerno
+	projvar_projmisstime projvar_projpriority projvar_projremanim
+	projvar_projremove projvar_projremovetime projvar_projscale_x
+	projvar_projscale_y projvar_projshadow_b projvar_projshadow_g
+	projvar_projshadow_r projvar_projsprpriority projvar_projstagebound
+	projvar_projxshear projvar_remvelocity_x projvar_remvelocity_y
+	projvar_remvelocity_z projvar_supermovetime projvar_teamside
+	projvar_time projvar_vel_x projvar_vel_y projvar_vel_z projvar_velmul_x
+	projvar_velmul_y projvar_velmul_z hitbyattr soundvar_group
+	soundvar_number soundvar_freqmul soundvar_isplaying soundvar_length
+	soundvar_loopcount soundvar_loopstart soundvar_loopend soundvar_pan
+	soundvar_position soundvar_priority soundvar_startposition
+	soundvar_volumescale fightscreenstate_fightdisplay
+	fightscreenstate_kodisplay fightscreenstate_rounddisplay
+	fightscreenstate_windisplay motifstate_challenger
+	motifstate_continuescreen motifstate_continueyes motifstate_continueno
+	motifstate_demo motifstate_dialogue motifstate_menu
+	motifstate_victoryscreen motifstate_winscreen motifstate_hiscore
+	gamevar_introtime gamevar_outrotime gamevar_pausetime gamevar_slowtime
+	gamevar_superpausetime gamevar_persistrounds gamevar_persistlife
+	gamevar_persistmusic topbounddist topboundbodydist botbounddist
+	botboundbodydist stagebgvar_actionno stagebgvar_delta_x
+	stagebgvar_delta_y stagebgvar_id stagebgvar_layerno stagebgvar_pos_x
+	stagebgvar_pos_y stagebgvar_start_x stagebgvar_start_y stagebgvar_tile_x
+	stagebgvar_tile_y stagebgvar_velocity_x stagebgvar_velocity_y numstagebg
+	xshear zoomvar_scale zoomvar_pos_x zoomvar_pos_y zoomvar_lag
+	zoomvar_endlag zoomvar_time projclsnoverlap attackmul defencemul
+	guardcount airjumpcount parentexist`)
+
+var bcEx3Names = strings.Fields(`
+	analog_leftx analog_lefty analog_rightx analog_righty analog_lefttrigger
+	analog_righttrigger helpervar_clsnproxy helpervar_helpertype
+	helpervar_id helpervar_keyctrl helpervar_ownclsnscale helpervar_ownpal
+	helpervar_preserve spritevar_group spritevar_height spritevar_image
+	spritevar_width spritevar_xoffset spritevar_yoffset
+	hitdefvar_guard_dist_depth_bottom hitdefvar_guard_dist_depth_top
+	hitdefvar_guard_dist_height_bottom hitdefvar_guard_dist_height_top
+	hitdefvar_guard_dist_width_back hitdefvar_guard_dist_width_front
+	hitdefvar_guard_pausetime hitdefvar_guard_shaketime
+	hitdefvar_guard_sparkno hitdefvar_guarddamage hitdefvar_guardflag
+	hitdefvar_guardsound_group hitdefvar_guardsound_number
+	hitdefvar_hitdamage hitdefvar_hitflag hitdefvar_hitsound_group
+	hitdefvar_hitsound_number hitdefvar_id hitdefvar_p1stateno
+	hitdefvar_p2stateno hitdefvar_pausetime hitdefvar_priority
+	hitdefvar_shaketime hitdefvar_sparkno hitdefvar_sparkx hitdefvar_sparky
+	hitdefvar_xaccel hitdefvar_yaccel hitdefvar_zaccel
+	hitdefvar_ground_velocity_x hitdefvar_ground_velocity_y
+	hitdefvar_ground_velocity_z hitdefvar_air_velocity_x
+	hitdefvar_air_velocity_y hitdefvar_air_velocity_z
+	hitdefvar_down_velocity_x hitdefvar_down_velocity_y
+	hitdefvar_down_velocity_z hitdefvar_guard_velocity_x
+	hitdefvar_guard_velocity_y hitdefvar_guard_velocity_z
+	hitdefvar_airguard_velocity_x hitdefvar_airguard_velocity_y
+	hitdefvar_airguard_velocity_z hitdefvar_ground_cornerpush_veloff
+	hitdefvar_air_cornerpush_veloff hitdefvar_down_cornerpush_veloff
+	hitdefvar_guard_cornerpush_veloff hitdefvar_airguard_cornerpush_veloff
+	hitdefvar_fall_xvelocity hitdefvar_fall_yvelocity
+	hitdefvar_fall_zvelocity`)
+
+// The name lists are kept by hand, so make sure they still match the OpCode
+// constants. Names would otherwise silently shift after an added OpCode
+func init() {
+	for _, g := range []struct {
+		prefix string
+		names  []string
+		last   OpCode
+	}{
+		{"OC_", bcOpNames, OC_localarray},
+		{"OC_const_", bcConstNames, OC_const_stage_constants},
+		{"OC_st_", bcStNames, OC_st_map},
+		{"OC_ex_", bcExNames, OC_ex_selfcommand},
+		{"OC_ex2_", bcEx2Names, OC_ex2_parentexist},
+		{"OC_ex3_", bcEx3Names, OC_ex3_hitdefvar_fall_zvelocity},
+	} {
+		if len(g.names) != int(g.last)+1 {
+			panic(fmt.Sprintf("%v disassembler names: %v names for %v OpCodes",
+				g.prefix, len(g.names), int(g.last)+1))
+		}
+	}
+}
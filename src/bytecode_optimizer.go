@@ -0,0 +1,721 @@
+package main
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Bytecode optimizer. The recursive-descent compiler already folds operators
+// whose operands are both literals. This pass works on a whole BytecodeExp
+// once it's emitted, so it also sees what only becomes constant later:
+// const() values of the compiling player, jumps over literals and jumps
+// landing on other jumps. It folds constant subexpressions, removes branches
+// that can never run and retargets OC_jz/OC_jmp chains to where they end up.
+//
+// Values are computed with the same BytecodeExp methods run uses, so results
+// are identical. Operations that print bytecode errors are never folded, and
+// anything the decoder doesn't fully understand is left as compiled.
+//
+// const() depends on the character running the code, which isn't the
+// compiling player in custom states. Expressions folded with const() are
+// emitted twice behind OC_specialize: the folded version for the compiling
+// player and the generic one for anyone else.
+
+// Decoded bytecode instruction
+type bcInstr struct {
+	code   BytecodeExp   // Opcode and operands. Jumps only keep their opcode
+	target int           // Index of the instruction a jump goes to, -1 if not a jump
+	value  BytecodeValue // Value pushed by a constant, VT_None otherwise
+	pinned bool          // Runs on a redirected character, left as is
+	player bool          // Value is a const() of the compiling player
+	mapped bool          // Value comes from the constants map
+}
+
+type bcOptimizer struct {
+	ins []bcInstr
+	gi  *CharGlobalInfo // Player whose const() values are folded, if any
+	pn  int
+}
+
+// Whether an OpCode is a redirection, applying to the code up to its target
+func bcIsRedirect(op OpCode) bool {
+	switch op {
+	case OC_player, OC_parent, OC_root, OC_helper, OC_target, OC_partner,
+		OC_enemy, OC_enemynear, OC_playerid, OC_playerindex, OC_helperindex,
+		OC_p2, OC_stateowner:
+		return true
+	}
+	return false
+}
+
+// Whether an OpCode is a branch that the optimizer can retarget
+func bcIsBranch(op OpCode) bool {
+	return op == OC_jmp || op == OC_jz || op == OC_jnz || op == OC_jsf8
+}
+
+func (be BytecodeExp) i32At(p int) int {
+	return int(*(*int32)(unsafe.Pointer(&be[p])))
+}
+
+// Folded constants have no code until they are encoded
+func (in bcInstr) op() OpCode {
+	if in.code == nil {
+		return OC_int
+	}
+	return in.code[0]
+}
+
+// Returns the length of the instruction at p and the byte position a jump
+// goes to (-1 if it isn't a jump). Lengths follow the operands that run and
+// its run_* helpers read
+func (be BytecodeExp) instrLen(p int) (n, target int, ok bool) {
+	op := be[p]
+	operand := func(n int) (int, int, bool) {
+		return n, -1, p+n <= len(be)
+	}
+	switch op {
+	case OC_jmp8, OC_jz8, OC_jnz8, OC_jsf8:
+		if p+2 > len(be) {
+			return 0, 0, false
+		}
+		// An offset of 0 jumps to the end of the whole expression
+		if be[p+1] == 0 {
+			return 2, len(be), true
+		}
+		return 2, p + 2 + int(uint8(be[p+1])), true
+	case OC_jmp, OC_jz, OC_jnz, OC_player, OC_parent, OC_root, OC_helper,
+		OC_target, OC_partner, OC_enemy, OC_enemynear, OC_playerid,
+		OC_playerindex, OC_helperindex, OC_p2, OC_stateowner:
+		if p+5 > len(be) {
+			return 0, 0, false
+		}
+		return 5, p + 5 + be.i32At(p+1), true
+	case OC_run, OC_nordrun:
+		if p+5 > len(be) {
+			return 0, 0, false
+		}
+		return operand(5 + be.i32At(p+1))
+	case OC_specialize:
+		if p+6 > len(be) {
+			return 0, 0, false
+		}
+		la := be.i32At(p + 2)
+		if la < 5 || p+6+la > len(be) {
+			return 0, 0, false
+		}
+		return operand(6 + la + be.i32At(p+6+la-4))
+	case OC_int8, OC_statetype, OC_movetype, OC_teammode, OC_localvar:
+		return operand(2)
+	case OC_localarray:
+		return operand(3)
+	case OC_int, OC_float, OC_command, OC_hitdefattr:
+		return operand(5)
+	case OC_int64:
+		return operand(9)
+	case OC_const_, OC_st_, OC_ex_, OC_ex2_, OC_ex3_:
+		if p+2 > len(be) {
+			return 0, 0, false
+		}
+		return operand(2 + bcSubOperands(op, be[p+1]))
+	}
+	if op > OC_localarray {
+		return 0, 0, false
+	}
+	return 1, -1, true
+}
+
+// Operand bytes after the sub OpCode of OC_const_, OC_st_ and OC_ex*_
+func bcSubOperands(op, sub OpCode) int {
+	switch op {
+	case OC_const_:
+		switch sub {
+		case OC_const_authorname, OC_const_displayname, OC_const_name,
+			OC_const_p2name, OC_const_p3name, OC_const_p4name, OC_const_p5name,
+			OC_const_p6name, OC_const_p7name, OC_const_p8name,
+			OC_const_stagevar_info_author, OC_const_stagevar_info_displayname,
+			OC_const_stagevar_info_name, OC_const_gameoption, OC_const_motifvar,
+			OC_const_constants, OC_const_stage_constants:
+			return 4
+		}
+	case OC_st_:
+		if sub == OC_st_map {
+			return 4
+		}
+	case OC_ex_:
+		switch sub {
+		case OC_ex_gethitvar_attr, OC_ex_gethitvar_guardflag, OC_ex_gamemode,
+			OC_ex_helpername, OC_ex_isassertedglobal, OC_ex_maparray,
+			OC_ex_reversaldefattr, OC_ex_selfcommand:
+			return 4
+		case OC_ex_isassertedchar:
+			return 8
+		case OC_ex_physics, OC_ex_prevmovetype, OC_ex_prevstatetype:
+			return 1
+		}
+	case OC_ex2_:
+		switch sub {
+		case OC_ex2_fightscreenvar_info_author, OC_ex2_fightscreenvar_info_name,
+			OC_ex2_bgmvar_filename, OC_ex2_hitbyattr:
+			return 4
+		}
+	case OC_ex3_:
+		switch sub {
+		case OC_ex3_hitdefvar_guardflag, OC_ex3_hitdefvar_hitflag:
+			return 4
+		}
+	}
+	return 0
+}
+
+// Returns the value pushed by a literal instruction
+func bcLiteral(code BytecodeExp) BytecodeValue {
+	switch code[0] {
+	case OC_int8:
+		return BytecodeInt(int32(int8(code[1])))
+	case OC_int:
+		return BytecodeInt(int32(code.i32At(1)))
+	case OC_int64:
+		return BytecodeInt64(*(*int64)(unsafe.Pointer(&code[1])))
+	case OC_float:
+		return BytecodeFloat(*(*float32)(unsafe.Pointer(&code[1])))
+	}
+	return bvNone()
+}
+
+// Splits an expression into instructions. Fails on anything unknown, and on
+// jumps that don't land on an instruction or go backwards
+func bcDecode(be BytecodeExp) ([]bcInstr, bool) {
+	var ins []bcInstr
+	var targets []int
+	at := make(map[int]int)
+	for p := 0; p < len(be); {
+		n, t, ok := be.instrLen(p)
+		if !ok || n <= 0 {
+			return nil, false
+		}
+		at[p] = len(ins)
+		in := bcInstr{code: be[p : p+n], target: -1, value: bvNone()}
+		switch op := be[p]; op {
+		case OC_jmp8:
+			in.code = BytecodeExp{OC_jmp}
+		case OC_jz8:
+			in.code = BytecodeExp{OC_jz}
+		case OC_jnz8:
+			in.code = BytecodeExp{OC_jnz}
+		default:
+			if t >= 0 {
+				in.code = BytecodeExp{op}
+			} else {
+				in.value = bcLiteral(in.code)
+			}
+		}
+		ins = append(ins, in)
+		targets = append(targets, t)
+		p += n
+	}
+	at[len(be)] = len(ins)
+	for i, t := range targets {
+		if t < 0 {
+			continue
+		}
+		idx, ok := at[t]
+		if !ok || idx <= i {
+			return nil, false
+		}
+		ins[i].target = idx
+	}
+	for i, in := range ins {
+		if bcIsRedirect(in.code[0]) {
+			for j := i + 1; j < in.target; j++ {
+				ins[j].pinned = true
+			}
+		}
+	}
+	return ins, true
+}
+
+// Returns the value of an expression that is a single literal
+func (be BytecodeExp) constValue() (BytecodeValue, bool) {
+	if len(be) == 0 {
+		return bvNone(), false
+	}
+	if n, t, ok := be.instrLen(0); !ok || n != len(be) || t >= 0 {
+		return bvNone(), false
+	}
+	v := bcLiteral(be)
+	return v, !v.IsNone()
+}
+
+// Value of a const() that only depends on the compiling player
+func (o *bcOptimizer) playerConst(code BytecodeExp) (v BytecodeValue, mapped, ok bool) {
+	d := &o.gi.data
+	switch code[1] {
+	case OC_const_data_life:
+		return BytecodeInt(d.life), false, true
+	case OC_const_data_power:
+		return BytecodeInt(d.power), false, true
+	case OC_const_data_dizzypoints:
+		return BytecodeInt(d.dizzypoints), false, true
+	case OC_const_data_guardpoints:
+		return BytecodeInt(d.guardpoints), false, true
+	case OC_const_data_attack:
+		return BytecodeInt(d.attack), false, true
+	case OC_const_data_defence:
+		return BytecodeInt(d.defence), false, true
+	case OC_const_data_fall_defence_up:
+		return BytecodeInt(d.fall.defence_up), false, true
+	case OC_const_data_fall_defence_mul:
+		return BytecodeFloat(1.0 / d.fall.defence_mul), false, true
+	case OC_const_data_liedown_time:
+		return BytecodeInt(d.liedown.time), false, true
+	case OC_const_data_airjuggle:
+		return BytecodeInt(d.airjuggle), false, true
+	case OC_const_data_sparkno:
+		return BytecodeInt(d.sparkno), false, true
+	case OC_const_data_guard_sparkno:
+		return BytecodeInt(d.guard.sparkno), false, true
+	case OC_const_data_hitsound_channel:
+		return BytecodeInt(d.hitsound_channel), false, true
+	case OC_const_data_guardsound_channel:
+		return BytecodeInt(d.guardsound_channel), false, true
+	case OC_const_data_ko_echo:
+		return BytecodeInt(d.ko.echo), false, true
+	case OC_const_data_volume:
+		return BytecodeInt(d.volume), false, true
+	case OC_const_data_intpersistindex:
+		return BytecodeInt(d.intpersistindex), false, true
+	case OC_const_data_floatpersistindex:
+		return BytecodeInt(d.floatpersistindex), false, true
+	case OC_const_constants:
+		pool := sys.stringPool[o.pn].List
+		if idx := code.i32At(2); idx >= 0 && idx < len(pool) {
+			return BytecodeFloat(o.gi.constants[pool[idx]]), true, true
+		}
+	}
+	return bvNone(), false, false
+}
+
+// Marks the instructions that jumps land on. The end is at len(o.ins)
+func (o *bcOptimizer) targeted() []bool {
+	t := make([]bool, len(o.ins)+1)
+	for _, in := range o.ins {
+		if in.target >= 0 {
+			t[in.target] = true
+		}
+	}
+	return t
+}
+
+// Removes n instructions at i. Jumps into them go to what follows
+func (o *bcOptimizer) remove(i, n int) {
+	o.ins = append(o.ins[:i], o.ins[i+n:]...)
+	for k := range o.ins {
+		if t := o.ins[k].target; t >= i+n {
+			o.ins[k].target = t - n
+		} else if t > i {
+			o.ins[k].target = i
+		}
+	}
+}
+
+func (o *bcOptimizer) constant(i int) bool {
+	return i >= 0 && !o.ins[i].pinned && !o.ins[i].value.IsNone()
+}
+
+// Replaces instruction i by a constant computed from instructions i to i+n
+func (o *bcOptimizer) replace(i, n int, v BytecodeValue) {
+	in := bcInstr{target: -1, value: v}
+	for k := i; k <= i+n; k++ {
+		in.player = in.player || o.ins[k].player
+		in.mapped = in.mapped || o.ins[k].mapped
+	}
+	o.ins[i] = in
+	o.remove(i+1, n)
+}
+
+// Folds operations on constants
+func (o *bcOptimizer) fold() bool {
+	var be BytecodeExp
+	t := o.targeted()
+	for i := range o.ins {
+		in := o.ins[i]
+		if in.pinned || in.target >= 0 || t[i] || in.value.vtype != VT_None {
+			continue
+		}
+		op := in.op()
+		if op == OC_pop && o.constant(i-1) {
+			o.remove(i-1, 2)
+			return true
+		}
+		// Unary operations
+		if o.constant(i - 1) {
+			v := o.ins[i-1].value
+			ok := true
+			switch op {
+			case OC_neg:
+				be.neg(&v)
+			case OC_not:
+				be.not(&v)
+			case OC_blnot:
+				be.blnot(&v)
+			case OC_abs:
+				be.abs(&v)
+			case OC_exp:
+				be.exp(&v)
+			case OC_cos:
+				be.cos(&v)
+			case OC_sin:
+				be.sin(&v)
+			case OC_tan:
+				be.tan(&v)
+			case OC_acos:
+				be.acos(&v)
+			case OC_asin:
+				be.asin(&v)
+			case OC_atan:
+				be.atan(&v)
+			case OC_floor:
+				be.floor(&v)
+			case OC_ceil:
+				be.ceil(&v)
+			default:
+				ok = false
+			}
+			if ok {
+				o.replace(i-1, 1, v)
+				return true
+			}
+		}
+		// Binary operations
+		if o.constant(i-2) && o.constant(i-1) && !t[i-1] {
+			v, v2 := o.ins[i-2].value, o.ins[i-1].value
+			ok := true
+			switch op {
+			case OC_add:
+				be.add(&v, v2)
+			case OC_sub:
+				be.sub(&v, v2)
+			case OC_mul:
+				be.mul(&v, v2)
+			case OC_div:
+				// Division by 0 prints an error each time it runs
+				if ok = v2.ToF() != 0; ok {
+					be.div(&v, v2)
+				}
+			case OC_mod:
+				if ok = v2.ToI() != 0; ok {
+					be.mod(&v, v2)
+				}
+			case OC_eq:
+				be.eq(&v, v2)
+			case OC_ne:
+				be.ne(&v, v2)
+			case OC_gt:
+				be.gt(&v, v2)
+			case OC_ge:
+				be.ge(&v, v2)
+			case OC_lt:
+				be.lt(&v, v2)
+			case OC_le:
+				be.le(&v, v2)
+			case OC_and:
+				be.and(&v, v2)
+			case OC_xor:
+				be.xor(&v, v2)
+			case OC_or:
+				be.or(&v, v2)
+			case OC_bland:
+				be.bland(&v, v2)
+			case OC_blxor:
+				be.blxor(&v, v2)
+			case OC_blor:
+				be.blor(&v, v2)
+			default:
+				ok = false
+			}
+			if ok {
+				o.replace(i-2, 2, v)
+				return true
+			}
+		}
+		// Ternary operations
+		if o.constant(i-3) && o.constant(i-2) && o.constant(i-1) && !t[i-2] && !t[i-1] {
+			v, v2, v3 := o.ins[i-3].value, o.ins[i-2].value, o.ins[i-1].value
+			switch op {
+			case OC_range_ii, OC_range_ie, OC_range_ei, OC_range_ee:
+				be.rangeCheck(&v, v2, v3, op)
+			case OC_ifelse:
+				if !v.ToB() {
+					v2 = v3
+				}
+				v = v2
+			default:
+				continue
+			}
+			o.replace(i-3, 3, v)
+			return true
+		}
+	}
+	return false
+}
+
+// Removes branches decided by a constant and jumps to the next instruction
+func (o *bcOptimizer) branches() bool {
+	t := o.targeted()
+	for i, in := range o.ins {
+		if in.pinned || in.target < 0 || !bcIsBranch(in.op()) {
+			continue
+		}
+		if in.target == i+1 {
+			o.remove(i, 1)
+			return true
+		}
+		// The stack top is only known if nothing else jumps here
+		if in.op() == OC_jmp || t[i] || !o.constant(i-1) {
+			continue
+		}
+		v := o.ins[i-1].value
+		var taken bool
+		switch in.op() {
+		case OC_jz:
+			taken = !v.ToB()
+		case OC_jnz:
+			taken = v.ToB()
+		case OC_jsf8:
+			taken = v.IsUndefined()
+		}
+		if taken {
+			o.ins[i].code = BytecodeExp{OC_jmp}
+		} else {
+			o.remove(i, 1)
+		}
+		return true
+	}
+	return false
+}
+
+// Retargets jumps landing on jumps that are known to be taken or not. The
+// conditional jumps don't pop the value they test, so a jump that lands on
+// another one tests the same value again
+func (o *bcOptimizer) thread() bool {
+	changed := false
+	for i, in := range o.ins {
+		if in.pinned || in.target < 0 || !bcIsBranch(in.op()) {
+			continue
+		}
+		op, t := in.op(), in.target
+		for t < len(o.ins) && !o.ins[t].pinned && bcIsBranch(o.ins[t].op()) {
+			next := o.ins[t].op()
+			switch {
+			case next == OC_jmp:
+				t = o.ins[t].target
+				continue
+			case op == OC_jmp:
+			case next == op, op == OC_jsf8 && next == OC_jz:
+				t = o.ins[t].target
+				continue
+			case op == OC_jz && next == OC_jnz, op == OC_jnz && next == OC_jz,
+				op == OC_jnz && next == OC_jsf8, op == OC_jsf8 && next == OC_jnz:
+				t++
+				continue
+			}
+			break
+		}
+		if t != in.target {
+			o.ins[i].target = t
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Removes instructions that can't be reached
+func (o *bcOptimizer) sweep() bool {
+	reached := make([]bool, len(o.ins)+1)
+	reached[0] = true
+	for i, in := range o.ins {
+		if !reached[i] {
+			continue
+		}
+		if in.target >= 0 {
+			reached[in.target] = true
+		}
+		if in.op() != OC_jmp || in.pinned {
+			reached[i+1] = true
+		}
+	}
+	for i := len(o.ins) - 1; i >= 0; i-- {
+		if !reached[i] {
+			n := 1
+			for i > 0 && !reached[i-1] {
+				i--
+				n++
+			}
+			o.remove(i, n)
+			return true
+		}
+	}
+	return false
+}
+
+// Encodes the instructions, using 8-bit jumps where they fit. With end set,
+// jumps to the end use the short form that ends the whole expression
+func (o *bcOptimizer) encode(end bool) (BytecodeExp, bool) {
+	long := make([]bool, len(o.ins))
+	size := func(i int) int {
+		in := o.ins[i]
+		switch {
+		case in.code == nil:
+			var be BytecodeExp
+			be.appendValue(in.value)
+			return len(be)
+		case in.target >= 0 && (long[i] || bcIsRedirect(in.code[0])):
+			return 5
+		case in.target >= 0:
+			return 2
+		}
+		return len(in.code)
+	}
+	pos := make([]int, len(o.ins)+1)
+	for {
+		for i := range o.ins {
+			pos[i+1] = pos[i] + size(i)
+		}
+		grew := false
+		for i, in := range o.ins {
+			if in.target < 0 || long[i] || bcIsRedirect(in.code[0]) {
+				continue
+			}
+			off := pos[in.target] - pos[i+1]
+			if end && in.target == len(o.ins) || off >= 1 && off <= math.MaxUint8 {
+				continue
+			}
+			if in.code[0] == OC_jsf8 {
+				return nil, false
+			}
+			long[i], grew = true, true
+		}
+		if !grew {
+			break
+		}
+	}
+	var be BytecodeExp
+	for i, in := range o.ins {
+		switch {
+		case in.code == nil:
+			be.appendValue(in.value)
+		case in.target >= 0:
+			off := pos[in.target] - pos[i+1]
+			if long[i] || bcIsRedirect(in.code[0]) {
+				be.appendI32Op(in.code[0], int32(off))
+				break
+			}
+			if end && in.target == len(o.ins) {
+				off = 0
+			}
+			switch in.code[0] {
+			case OC_jmp:
+				be.append(OC_jmp8, OpCode(off))
+			case OC_jz:
+				be.append(OC_jz8, OpCode(off))
+			case OC_jnz:
+				be.append(OC_jnz8, OpCode(off))
+			default:
+				be.append(in.code[0], OpCode(off))
+			}
+		default:
+			be.append(in.code...)
+		}
+	}
+	return be, true
+}
+
+// Optimizes an expression. With gi set, the const() values of that player
+// are folded too. Returns the new code, its number of instructions and
+// whether it uses const() values, or false if the code was left alone
+func bcOptimize(be BytecodeExp, end bool, gi *CharGlobalInfo, pn int) (BytecodeExp, int, bool, bool) {
+	ins, ok := bcDecode(be)
+	if !ok {
+		return be, 0, false, false
+	}
+	o := &bcOptimizer{ins: ins, gi: gi, pn: pn}
+	if gi != nil {
+		for i, in := range o.ins {
+			if in.pinned || in.target >= 0 || in.code[0] != OC_const_ {
+				continue
+			}
+			if v, mapped, ok := o.playerConst(in.code); ok {
+				o.ins[i] = bcInstr{target: -1, value: v, player: true, mapped: mapped}
+			}
+		}
+	}
+	for o.fold() || o.branches() || o.thread() || o.sweep() {
+	}
+	out, ok := o.encode(end)
+	if !ok {
+		return be, 0, false, false
+	}
+	player, mapped := false, false
+	for _, in := range o.ins {
+		player = player || in.player
+		mapped = mapped || in.mapped
+	}
+	// Lone const() values only pay off when they save a map lookup
+	return out, len(o.ins), player && (mapped || len(o.ins) < len(ins)), true
+}
+
+// Optimizes an expression compiled by c. A whole expression, like the
+// triggers of a controller, may jump straight to its end, parts of one may not
+func (c *Compiler) optimizeExp(be BytecodeExp, whole bool) BytecodeExp {
+	if !c.optimize || len(be) == 0 {
+		return be
+	}
+	generic, _, _, ok := bcOptimize(be, whole, nil, c.playerNo)
+	if !ok || whole {
+		return generic
+	}
+	spec, _, player, ok := bcOptimize(be, false, &sys.cgi[c.playerNo], c.playerNo)
+	if !ok || !player {
+		return generic
+	}
+	// OC_specialize, player number, length of the folded version and its
+	// jump over the generic one
+	out := BytecodeExp{OC_specialize, OpCode(c.playerNo)}
+	out.appendI32s(int32(len(spec) + 5))
+	out.append(spec...)
+	out.appendI32Op(OC_jmp, int32(len(generic)))
+	out.append(generic...)
+	return out
+}
+
+// Optimizes the triggers of the controllers and blocks, and removes those that
+// can never run, like the compiler does for triggers that are literally 0
+func (c *Compiler) optimizeCtrls(ctrls []StateController) []StateController {
+	if !c.optimize {
+		return ctrls
+	}
+	out := ctrls[:0]
+	for _, sc := range ctrls {
+		if b, ok := sc.(StateBlock); ok {
+			c.optimizeBlock(&b)
+			if v, ok := b.trigger.constValue(); ok && !b.loopBlock {
+				if v.ToB() {
+					b.trigger, b.elseBlock = nil, nil
+				} else if b.elseBlock == nil {
+					continue
+				}
+			}
+			sc = b
+		}
+		out = append(out, sc)
+	}
+	return out
+}
+
+func (c *Compiler) optimizeBlock(b *StateBlock) {
+	b.trigger = c.optimizeExp(b.trigger, true)
+	if b.elseBlock != nil {
+		c.optimizeBlock(b.elseBlock)
+	}
+	b.ctrls = c.optimizeCtrls(b.ctrls)
+}
@@ -2929,6 +2929,8 @@ type CharGlobalInfo struct {
 	movement                CharMovement
 	states                  map[int32]StateBytecode
 	callFuncs               map[string]bytecodeFunction
+	stateFiles              []string // Files the states and commands were compiled from
+	cnsFile                 string   // File the constants were read from
 	hitPauseToggleFlagCount int32
 	pctype                  ProjContact
 	pctime, pcid            int32
@@ -3448,214 +3450,64 @@ func (c *Char) ocd() *OverrideCharData {
 	return sys.sel.gameParams.ensureOverride(team, c.memberNo)
 }
 
-func (c *Char) load(def string) error {
-	gi := &sys.cgi[c.playerNo]
-
-	// Reset global info
-	gi.def = def
-	gi.displayname, gi.lifebarname, gi.author = "", "", ""
-	gi.palettedata, gi.snd, gi.quotes = nil, nil, [MaxQuotes]string{}
-	gi.animTable = NewAnimationTable()
-	gi.fnt = make(map[int]*Fnt)
-	gi.portraitscale = 1
-
-	for i := 0; i < sys.cfg.Config.PaletteMax; i++ {
-		pal := gi.palInfo[i]
-		pal.keyMap = int32(i)
-		gi.palInfo[i] = pal
-	}
-
-	// We don't nil the SFF so that loadSff() can reuse it if the same character is selected/reloaded
-	//gi.sff = nil
-
-	// Default localcoord
-	gi.localcoord = [2]int32{320, 240}
-
-	// Reset DEF file maps
-	c.mapDefault = make(map[string]float32)
-
-	// Helper to resolve paths relative to the .def file's logical location
-	resolvePathRelativeToDef := func(pathInDefFile string) string {
-		isZipDef, zipArchiveOfDef, defSubPathInZip := IsZipPath(gi.def)
-		pathInDefFile = filepath.ToSlash(pathInDefFile)
-
-		if filepath.IsAbs(pathInDefFile) {
-			return pathInDefFile
-		}
-		isEngineRootRelative := strings.HasPrefix(pathInDefFile, "data/") ||
-			strings.HasPrefix(pathInDefFile, "font/") ||
-			strings.HasPrefix(pathInDefFile, "stages/")
-
-		if isZipDef {
-			if isEngineRootRelative {
-				return pathInDefFile
-			}
-			baseDirWithinZip := filepath.ToSlash(filepath.Dir(defSubPathInZip))
-			if baseDirWithinZip == "." || baseDirWithinZip == "" {
-				return filepath.ToSlash(filepath.Join(zipArchiveOfDef, pathInDefFile))
+// The [Files] sections of a character's def file, in the order they apply.
+// The default section comes first, then the one for the configured
+// language, which overrides it. A language section that precedes the
+// default one is the only one used
+func charDefFiles(lines []string) []IniSection {
+	langPrefix := sys.cfg.Config.Language + "."
+	files, lanFiles := true, true
+	var sections []IniSection
+	for i := 0; i < len(lines); {
+		is, name, _ := ReadIniSection(lines, &i)
+		isLan := name == langPrefix+"files"
+		if (isLan && lanFiles) || (name == "files" && files) {
+			if isLan {
+				lanFiles = false
 			}
-			return filepath.ToSlash(filepath.Join(zipArchiveOfDef, baseDirWithinZip, pathInDefFile))
+			files = false
+			sections = append(sections, is)
 		}
-		return pathInDefFile
-	}
-
-	if err := c.loadFx(def); err != nil {
-		LogMessage("Error loading FX for %s: %v", def, err)
 	}
+	return sections
+}
 
-	str, err := LoadText(def)
-	if err != nil {
-		return err
-	}
+// Directories the files named in a character's def file are searched in
+func charFileDirs(def string) []string {
+	return []string{def, "", sys.motif.Def, "data/"}
+}
 
-	lines, lnidx := SplitAndTrim(str, "\n"), 0
-	cns, sprite, anim, sound := "", "", "", ""
-	info, files, keymap, mapArray := true, true, true, true
-	lanInfo, lanFiles, lanKeymap, lanMapArray := true, true, true, true
+// Resolves a path relative to the .def file's logical location
+func (gi *CharGlobalInfo) resolveDefPath(pathInDefFile string) string {
+	isZipDef, zipArchiveOfDef, defSubPathInZip := IsZipPath(gi.def)
+	pathInDefFile = filepath.ToSlash(pathInDefFile)
 
-	// Collect arbitrary number of fonts
-	type fontSpec struct {
-		path   string
-		height int32
-	}
-	fntSpecs := map[int]fontSpec{}
-	parseFonts := func(is IniSection) {
-		for k, v := range is {
-			if strings.HasPrefix(k, "font") {
-				rest := k[4:]
-				if rest == "" {
-					continue
-				}
-				// extract leading digits from the remainder (handles font12 and font12.height)
-				j := 0
-				for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
-					j++
-				}
-				if j == 0 {
-					continue
-				}
-				idx := int(Atoi(rest[:j]))
-				tail := rest[j:]
-				fs := fntSpecs[idx]
-				if tail == "" {
-					fs.path = v
-				} else if tail == ".height" {
-					fs.height = int32(Atoi(v))
-				}
-				fntSpecs[idx] = fs
-			}
-		}
+	if filepath.IsAbs(pathInDefFile) {
+		return pathInDefFile
 	}
+	isEngineRootRelative := strings.HasPrefix(pathInDefFile, "data/") ||
+		strings.HasPrefix(pathInDefFile, "font/") ||
+		strings.HasPrefix(pathInDefFile, "stages/")
 
-	langPrefix := sys.cfg.Config.Language + "."
-
-	// Load DEF file
-	for lnidx < len(lines) {
-		is, name, subname := ReadIniSection(lines, &lnidx)
-
-		// Determine if this is a localized section and get the base name
-		isLan := strings.HasPrefix(name, langPrefix)
-		baseName := name
-		if isLan {
-			baseName = name[len(langPrefix):]
+	if isZipDef {
+		if isEngineRootRelative {
+			return pathInDefFile
 		}
-
-		switch baseName {
-		case "info":
-			// Process the localized override or the default section
-			if (isLan && lanInfo) || (!isLan && info) {
-				if isLan {
-					lanInfo = false
-				}
-				info = false
-
-				c.name, _, _ = is.getText("name")
-				var ok bool
-				if gi.displayname, ok, _ = is.getText("displayname"); !ok {
-					gi.displayname = c.name
-				}
-				if gi.lifebarname, ok, _ = is.getText("lifebarname"); !ok {
-					gi.lifebarname = gi.displayname
-				}
-				gi.author, _, _ = is.getText("author")
-				gi.nameLow = strings.ToLower(c.name)
-				gi.displaynameLow = strings.ToLower(gi.displayname)
-				gi.authorLow = strings.ToLower(gi.author)
-				// In Mugen localcoord is clamped to 1. But that's already unplayable anyway so such a safeguard is useless
-				if is.ReadI32("localcoord", &gi.localcoord[0], &gi.localcoord[1]) {
-					gi.portraitscale = 320 / float32(gi.localcoord[0])
-					c.localcoord = float32(gi.localcoord[0]) / (float32(sys.gameWidth) / 320)
-					c.localscl = 320 / c.localcoord
-				}
-				is.ReadF32("portraitscale", &gi.portraitscale)
-			}
-
-		case "files":
-			if (isLan && lanFiles) || (!isLan && files) {
-				if isLan {
-					lanFiles = false
-				}
-				files = false
-
-				cns = decodeShiftJIS(is["cns"])
-				sprite = decodeShiftJIS(is["sprite"])
-				anim = decodeShiftJIS(is["anim"])
-				sound = decodeShiftJIS(is["sound"])
-				for i := 0; i < sys.cfg.Config.PaletteMax; i++ {
-					pal := gi.palInfo[i]
-					pal.filename = decodeShiftJIS(is[fmt.Sprintf("pal%v", i+1)])
-					gi.palInfo[i] = pal
-				}
-				parseFonts(is)
-			}
-
-		case "palette ":
-			isKeymap := len(subname) >= 6 && strings.ToLower(subname[:6]) == "keymap"
-			if isKeymap && ((isLan && lanKeymap) || (!isLan && keymap)) {
-				if isLan {
-					lanKeymap = false
-				}
-				keymap = false
-
-				for i, v := range [12]string{"a", "b", "c", "x", "y", "z",
-					"a2", "b2", "c2", "x2", "y2", "z2"} {
-					var i32 int32
-					if is.ReadI32(v, &i32) {
-						if i32 < 1 || int(i32) > sys.cfg.Config.PaletteMax {
-							i32 = 1
-						}
-						pal := gi.palInfo[i]
-						pal.keyMap = i32 - 1
-						gi.palInfo[i] = pal
-					}
-				}
-			}
-
-		case "map":
-			if (isLan && lanMapArray) || (!isLan && mapArray) {
-				if isLan {
-					lanMapArray = false
-				}
-				mapArray = false
-
-				for key, value := range is {
-					c.mapDefault[key] = float32(Atof(value))
-				}
-			}
+		baseDirWithinZip := filepath.ToSlash(filepath.Dir(defSubPathInZip))
+		if baseDirWithinZip == "." || baseDirWithinZip == "" {
+			return filepath.ToSlash(filepath.Join(zipArchiveOfDef, pathInDefFile))
 		}
+		return filepath.ToSlash(filepath.Join(zipArchiveOfDef, baseDirWithinZip, pathInDefFile))
 	}
+	return pathInDefFile
+}
 
-	// Reset maps in order to upload the freshly loaded defaults
-	c.mapReset(nil)
-
-	// Set constants to defaults
-	c.initConstants()
-
-	// Load common constants
+// Loads the common constant files of the config into the constants
+func (gi *CharGlobalInfo) loadCommonConstants() error {
 	for _, key := range SortedKeys(sys.cfg.Common.Const) {
 		for _, v := range sys.cfg.Common.Const[key] {
-			if err := LoadFile(&v, []string{def, sys.motif.Def, sys.fightScreen.def, "", "data/"}, func(filename string) error {
-				str, err = LoadText(filename)
+			if err := LoadFile(&v, []string{gi.def, sys.motif.Def, sys.fightScreen.def, "", "data/"}, func(filename string) error {
+				str, err := LoadText(filename)
 				if err != nil {
 					return err
 				}
@@ -3670,20 +3522,28 @@ func (c *Char) load(def string) error {
 			}
 		}
 	}
+	return nil
+}
 
+// Loads the cns file named in the def file: the data, size, velocity and
+// movement constants, quotes, [Constants] and remap presets
+func (c *Char) loadCns(cns string) error {
+	gi := c.gi()
+	gi.cnsFile = ""
 	gi.remapPreset = make(map[string]RemapPreset)
 
 	data, size, velocity, movement, quotes, lanQuotes, constants := true, true, true, true, true, true, true
+	langPrefix := sys.cfg.Config.Language + "."
 
-	// Load constants
 	if len(cns) > 0 {
-		cns_resolved := resolvePathRelativeToDef(cns)
-		if err := LoadFile(&cns_resolved, []string{def, "", sys.motif.Def, "data/"}, func(filename string) error {
+		cns_resolved := gi.resolveDefPath(cns)
+		if err := LoadFile(&cns_resolved, charFileDirs(gi.def), func(filename string) error {
 			str, err := LoadText(filename)
 			if err != nil {
 				return err
 			}
-			lines, lnidx = SplitAndTrim(str, "\n"), 0
+			gi.cnsFile = filename
+			lines, lnidx := SplitAndTrim(str, "\n"), 0
 			for lnidx < len(lines) {
 				is, name, subname := ReadIniSection(lines, &lnidx)
 
@@ -3944,10 +3804,196 @@ func (c *Char) load(def string) error {
 		}
 	}
 
+	return nil
+}
+
+func (c *Char) load(def string) error {
+	gi := &sys.cgi[c.playerNo]
+
+	// Reset global info
+	gi.def = def
+	gi.displayname, gi.lifebarname, gi.author = "", "", ""
+	gi.palettedata, gi.snd, gi.quotes = nil, nil, [MaxQuotes]string{}
+	gi.animTable = NewAnimationTable()
+	gi.fnt = make(map[int]*Fnt)
+	gi.portraitscale = 1
+
+	for i := 0; i < sys.cfg.Config.PaletteMax; i++ {
+		pal := gi.palInfo[i]
+		pal.keyMap = int32(i)
+		gi.palInfo[i] = pal
+	}
+
+	// We don't nil the SFF so that loadSff() can reuse it if the same character is selected/reloaded
+	//gi.sff = nil
+
+	// Default localcoord
+	gi.localcoord = [2]int32{320, 240}
+
+	// Reset DEF file maps
+	c.mapDefault = make(map[string]float32)
+
+	if err := c.loadFx(def); err != nil {
+		LogMessage("Error loading FX for %s: %v", def, err)
+	}
+
+	str, err := LoadText(def)
+	if err != nil {
+		return err
+	}
+
+	lines, lnidx := SplitAndTrim(str, "\n"), 0
+	cns, sprite, anim, sound := "", "", "", ""
+	info, keymap, mapArray := true, true, true
+	lanInfo, lanKeymap, lanMapArray := true, true, true
+
+	// Collect arbitrary number of fonts
+	type fontSpec struct {
+		path   string
+		height int32
+	}
+	fntSpecs := map[int]fontSpec{}
+	parseFonts := func(is IniSection) {
+		for k, v := range is {
+			if strings.HasPrefix(k, "font") {
+				rest := k[4:]
+				if rest == "" {
+					continue
+				}
+				// extract leading digits from the remainder (handles font12 and font12.height)
+				j := 0
+				for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+					j++
+				}
+				if j == 0 {
+					continue
+				}
+				idx := int(Atoi(rest[:j]))
+				tail := rest[j:]
+				fs := fntSpecs[idx]
+				if tail == "" {
+					fs.path = v
+				} else if tail == ".height" {
+					fs.height = int32(Atoi(v))
+				}
+				fntSpecs[idx] = fs
+			}
+		}
+	}
+
+	langPrefix := sys.cfg.Config.Language + "."
+
+	// Load DEF file
+	for lnidx < len(lines) {
+		is, name, subname := ReadIniSection(lines, &lnidx)
+
+		// Determine if this is a localized section and get the base name
+		isLan := strings.HasPrefix(name, langPrefix)
+		baseName := name
+		if isLan {
+			baseName = name[len(langPrefix):]
+		}
+
+		switch baseName {
+		case "info":
+			// Process the localized override or the default section
+			if (isLan && lanInfo) || (!isLan && info) {
+				if isLan {
+					lanInfo = false
+				}
+				info = false
+
+				c.name, _, _ = is.getText("name")
+				var ok bool
+				if gi.displayname, ok, _ = is.getText("displayname"); !ok {
+					gi.displayname = c.name
+				}
+				if gi.lifebarname, ok, _ = is.getText("lifebarname"); !ok {
+					gi.lifebarname = gi.displayname
+				}
+				gi.author, _, _ = is.getText("author")
+				gi.nameLow = strings.ToLower(c.name)
+				gi.displaynameLow = strings.ToLower(gi.displayname)
+				gi.authorLow = strings.ToLower(gi.author)
+				// In Mugen localcoord is clamped to 1. But that's already unplayable anyway so such a safeguard is useless
+				if is.ReadI32("localcoord", &gi.localcoord[0], &gi.localcoord[1]) {
+					gi.portraitscale = 320 / float32(gi.localcoord[0])
+					c.localcoord = float32(gi.localcoord[0]) / (float32(sys.gameWidth) / 320)
+					c.localscl = 320 / c.localcoord
+				}
+				is.ReadF32("portraitscale", &gi.portraitscale)
+			}
+
+		case "palette ":
+			isKeymap := len(subname) >= 6 && strings.ToLower(subname[:6]) == "keymap"
+			if isKeymap && ((isLan && lanKeymap) || (!isLan && keymap)) {
+				if isLan {
+					lanKeymap = false
+				}
+				keymap = false
+
+				for i, v := range [12]string{"a", "b", "c", "x", "y", "z",
+					"a2", "b2", "c2", "x2", "y2", "z2"} {
+					var i32 int32
+					if is.ReadI32(v, &i32) {
+						if i32 < 1 || int(i32) > sys.cfg.Config.PaletteMax {
+							i32 = 1
+						}
+						pal := gi.palInfo[i]
+						pal.keyMap = i32 - 1
+						gi.palInfo[i] = pal
+					}
+				}
+			}
+
+		case "map":
+			if (isLan && lanMapArray) || (!isLan && mapArray) {
+				if isLan {
+					lanMapArray = false
+				}
+				mapArray = false
+
+				for key, value := range is {
+					c.mapDefault[key] = float32(Atof(value))
+				}
+			}
+		}
+	}
+
+	// Files of the character
+	for _, is := range charDefFiles(lines) {
+		cns = decodeShiftJIS(is["cns"])
+		sprite = decodeShiftJIS(is["sprite"])
+		anim = decodeShiftJIS(is["anim"])
+		sound = decodeShiftJIS(is["sound"])
+		for i := 0; i < sys.cfg.Config.PaletteMax; i++ {
+			pal := gi.palInfo[i]
+			pal.filename = decodeShiftJIS(is[fmt.Sprintf("pal%v", i+1)])
+			gi.palInfo[i] = pal
+		}
+		parseFonts(is)
+	}
+
+	// Reset maps in order to upload the freshly loaded defaults
+	c.mapReset(nil)
+
+	// Set constants to defaults
+	c.initConstants()
+
+	// Load common constants
+	if err := gi.loadCommonConstants(); err != nil {
+		return err
+	}
+
+	// Load constants
+	if err := c.loadCns(cns); err != nil {
+		return err
+	}
+
 	// Load SFF
 	if len(sprite) > 0 {
-		sprite_resolved := resolvePathRelativeToDef(sprite)
-		if err := LoadFile(&sprite_resolved, []string{gi.def, "", sys.motif.Def, "data/"}, func(filename string) error {
+		sprite_resolved := gi.resolveDefPath(sprite)
+		if err := LoadFile(&sprite_resolved, charFileDirs(gi.def), func(filename string) error {
 			var err_sff error
 			gi.sff, err_sff = loadSff(filename, true, false, false) // loadSff uses OpenFile
 			return err_sff
@@ -3975,26 +4021,78 @@ func (c *Char) load(def string) error {
 	}
 
 	// Read animations
+	var anim_resolved string
+	if len(anim) > 0 {
+		anim_resolved = gi.resolveDefPath(anim)
+	}
+	if at, err := gi.readAnimations(def, anim_resolved); err != nil {
+		return err
+	} else {
+		gi.animTable = at
+	}
+
+	// Load sounds
+	if len(sound) > 0 {
+		sound_resolved := gi.resolveDefPath(sound)
+		if LoadFile(&sound_resolved, charFileDirs(def), func(filename string) error {
+			var err error
+			gi.snd, err = LoadSnd(filename)
+			return err
+		}); err != nil {
+			return err
+		}
+	} else {
+		gi.snd = newSnd()
+	}
+
+	// Load each declared font index into the font map.
+	for idx, spec := range fntSpecs {
+		if len(spec.path) == 0 {
+			continue
+		}
+		resolvedFntPath := gi.resolveDefPath(spec.path)
+		i := idx
+		LoadFile(&resolvedFntPath, []string{def, sys.motif.Def, "", "data/", "font/"}, func(filename string) error {
+			sys.mainThreadTask <- func() {
+				h := int32(-1)
+				if spec.height != 0 {
+					h = spec.height
+				}
+				if fnt, err := loadFnt(filename, h); err != nil {
+					LogMessage("Failed to load %v (char font): %v", filename, err)
+					gi.fnt[i] = newFnt()
+				} else {
+					gi.fnt[i] = fnt
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// Reads the character's animations, then the common ones. anim is the
+// resolved .air file, if any
+func (gi *CharGlobalInfo) readAnimations(def, anim string) (AnimationTable, error) {
 	var animFilename string
-	gi.animTable = NewAnimationTable()
+	at := NewAnimationTable()
 
 	if len(anim) > 0 {
-		anim_resolved := resolvePathRelativeToDef(anim)
-		if err := LoadFile(&anim_resolved, []string{def, "", sys.motif.Def, "data/"}, func(filename string) error {
+		if err := LoadFile(&anim, charFileDirs(def), func(filename string) error {
 			str, err := LoadText(filename)
 			if err != nil {
 				return err
 			}
 
 			animFilename = filename
-			gi.animTable.filename = filename
+			at.filename = filename
 
 			lines, i := SplitAndTrim(str, "\n"), 0
-			for gi.animTable.readAction(gi.sff, &gi.palettedata.palList, lines, &i, true) != nil {
+			for at.readAction(gi.sff, &gi.palettedata.palList, lines, &i, true) != nil {
 			}
 			return nil
 		}); err != nil {
-			return err
+			return at, err
 		}
 	}
 
@@ -4016,62 +4114,24 @@ func (c *Char) load(def string) error {
 
 				// Merge temporary table with the char's
 				for no, a := range tmp.anims {
-					if gi.animTable.anims[no] == nil {
-						gi.animTable.anims[no] = a
+					if at.anims[no] == nil {
+						at.anims[no] = a
 					}
 				}
 				return nil
 			}); err != nil {
-				return err
+				return at, err
 			}
 		}
 	}
 
 	// Resolve Copy Action after all sources have been merged
 	// This only works because we didn't use ReadAnimationTable here, which would've done it per file
-	gi.animTable.resolveCopyAction()
+	at.resolveCopyAction()
 
 	// Final merged table keeps the main filename
-	gi.animTable.filename = animFilename
-
-	// Load sounds
-	if len(sound) > 0 {
-		sound_resolved := resolvePathRelativeToDef(sound)
-		if LoadFile(&sound_resolved, []string{def, "", sys.motif.Def, "data/"}, func(filename string) error {
-			var err error
-			gi.snd, err = LoadSnd(filename)
-			return err
-		}); err != nil {
-			return err
-		}
-	} else {
-		gi.snd = newSnd()
-	}
-
-	// Load each declared font index into the font map.
-	for idx, spec := range fntSpecs {
-		if len(spec.path) == 0 {
-			continue
-		}
-		resolvedFntPath := resolvePathRelativeToDef(spec.path)
-		i := idx
-		LoadFile(&resolvedFntPath, []string{def, sys.motif.Def, "", "data/", "font/"}, func(filename string) error {
-			sys.mainThreadTask <- func() {
-				h := int32(-1)
-				if spec.height != 0 {
-					h = spec.height
-				}
-				if fnt, err := loadFnt(filename, h); err != nil {
-					LogMessage("Failed to load %v (char font): %v", filename, err)
-					gi.fnt[i] = newFnt()
-				} else {
-					gi.fnt[i] = fnt
-				}
-			}
-			return nil
-		})
-	}
-	return nil
+	at.filename = animFilename
+	return at, nil
 }
 
 // Loads all of the character's palettes. Selectable or not
@@ -6325,6 +6385,8 @@ func (c *Char) stateChange1(no int32, pn int) bool {
 		c.ss.sb = *newStateBytecode(pn)
 		c.ss.sb.stateType, c.ss.sb.moveType, c.ss.sb.physics = ST_U, MT_U, ST_U
 	}
+	// Typed locals start from their initial values
+	c.ss.sb.locals = append([]BytecodeValue(nil), c.ss.sb.locals...)
 	// Reset persistent counters for this state (Ikemen chars)
 	// This used to belong to (*StateBytecode).init(), but was moved outside there
 	// due to a MUGEN 1.1 problem where persistent was not getting reset until the end
@@ -390,7 +390,18 @@ func NormalizeNewlines(input string) string {
 	return input
 }
 
+// Unsaved files of the language server by absolute path, read instead of
+// the files on disk
+var textOverlay map[string]string
+
 func LoadText(filename string) (string, error) {
+	if textOverlay != nil {
+		if abs, err := filepath.Abs(filename); err == nil {
+			if str, ok := textOverlay[abs]; ok {
+				return str, nil
+			}
+		}
+	}
 	rc, err := OpenFile(filename)
 	if err != nil {
 		return "", err
@@ -512,9 +523,21 @@ func FileExist(filename string) string {
 	return ""
 }
 
+// Same as FileExist for directories outside zip archives
+func DirExist(dirname string) string {
+	dirname = filepath.ToSlash(dirname)
+	if isZip, _, _ := IsZipPath(dirname); isZip {
+		return ""
+	}
+	if info, err := os.Stat(dirname); err == nil && info.IsDir() {
+		return dirname
+	}
+	return ""
+}
+
 // SearchFile searches for 'file' in 'dirs'.
 // 'dirs' elements can be plain directory paths or logical paths to .def files (which might be inside zips).
-// 'file' is the filename to search (e.g., "kfm.sff").
+// 'file' is the filename to search (e.g., "kfm.sff"), or a directory if it ends with '/'.
 func SearchFile(file string, dirs []string) string {
 	file = strings.TrimSpace(file)
 	if sc := strings.Index(file, ";"); sc >= 0 {
@@ -524,14 +547,18 @@ func SearchFile(file string, dirs []string) string {
 	if file == "" {
 		return ""
 	}
+	exist := FileExist
+	if strings.HasSuffix(file, "/") {
+		exist = DirExist
+	}
 	if isZipFull, _, _ := IsZipPath(file); isZipFull {
-		if found := FileExist(file); found != "" {
+		if found := exist(file); found != "" {
 			return found
 		}
 	}
 
 	if filepath.IsAbs(file) {
-		if found := FileExist(file); found != "" {
+		if found := exist(file); found != "" {
 			return found
 		}
 	}
@@ -547,22 +574,22 @@ func SearchFile(file string, dirs []string) string {
 				baseDirInZip = ""
 			}
 			candidate = filepath.ToSlash(filepath.Join(zipFileCtx, baseDirInZip, file))
-			if found := FileExist(candidate); found != "" {
+			if found := exist(candidate); found != "" {
 				return found
 			}
 		} else {
 			candidate = filepath.ToSlash(filepath.Join(filepath.Dir(dirCtx), file))
-			if found := FileExist(candidate); found != "" {
+			if found := exist(candidate); found != "" {
 				return found
 			}
 			candidate2 := filepath.ToSlash(filepath.Join(dirCtx, file))
-			if found := FileExist(candidate2); found != "" {
+			if found := exist(candidate2); found != "" {
 				return found
 			}
 		}
 	}
 
-	if found := FileExist(file); found != "" {
+	if found := exist(file); found != "" {
 		return found
 	}
 	return file
@@ -1518,6 +1545,18 @@ func SortedKeys[V any](m map[string]V) []string {
 	return keys
 }
 
+// SortedKeysI32 returns the keys of a map keyed by int32, in ascending order.
+func SortedKeysI32[V any](m map[int32]V) []int32 {
+	keys := make([]int32, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
 func IsZipPath(path string) (isZip bool, zipFilePath string, pathInZip string) {
 	path = filepath.ToSlash(path) // Normalize to forward slashes
 
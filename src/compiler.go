@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"regexp"
@@ -27,14 +28,47 @@ type Compiler struct {
 	i                int
 	linechan         chan *string
 	vars             map[string]uint8
+	varTypes         map[string]*zssType // Types of the typed locals in vars
+	locals           *[]BytecodeValue    // Initial values of the typed locals of the state or function
+	localBase        int32               // Slot of the first typed local
 	funcs            map[string]bytecodeFunction
 	funcUsed         map[string]bool
 	stateNo          int32
 	zssMode          bool
+	lineBase         int             // Line of the source chunk being compiled, for ZSS lint resumes
+	errParam         string          // Parameter that failed in stateParam, to locate the error
+	paramNames       map[string]bool // If set, collects the parameters read by stateParam
+	lint             *LintReport
+	optimize         bool              // Run the bytecode optimizer on compiled expressions
+	imports          map[string]string // Import names of the ZSS file being compiled, to their function prefixes
+	modules          map[string]string // Function prefixes of the imported ZSS files, to their paths
+	modulePrefix     string            // Prefix of the functions of the imported file being compiled
+	moduleFuncs      map[string]bool   // Functions defined in the imported file being compiled
+	importing        []string          // ZSS files being compiled, to detect import cycles
+	files            []string          // Files read by Compile, watched by the hot reload
+}
+
+// Compile error located in a state file. Errors are printed in the same
+// format as before, the location is kept for lint reports
+type compileError struct {
+	file string
+	line int
+	col  int
+	err  error
+}
+
+func (e compileError) Error() string {
+	return fmt.Sprintf("%v:%v:\n%v", e.file, e.line, e.err.Error())
+}
+
+func (e compileError) Unwrap() error {
+	return e.err
 }
 
 func newCompiler() *Compiler {
-	c := &Compiler{funcs: make(map[string]bytecodeFunction)}
+	c := &Compiler{funcs: make(map[string]bytecodeFunction), modules: make(map[string]string)}
+	_, noopt := sys.cmdFlags["-nooptimize"]
+	c.optimize = !noopt
 	c.scmap = map[string]scFunc{
 		// Mugen state controllers
 		"afterimage":         c.afterImage,
@@ -5260,11 +5294,12 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			out.append(oldblock...)
 			return bvNone(), nil
 		} else if len(c.token) >= 2 && c.token[0] == '$' && c.token != "$_" {
-			vi, ok := c.vars[c.token[1:]]
-			if !ok {
+			if _, ok := c.vars[c.token[1:]]; !ok {
 				return bvNone(), Error(c.token + " is not defined")
 			}
-			out.append(OC_localvar, OpCode(vi))
+			if err := c.localValue(out, in, c.token[1:]); err != nil {
+				return bvNone(), err
+			}
 		} else {
 			return bvNone(), Error("Invalid data: " + c.token)
 		}
@@ -5746,7 +5781,7 @@ func (c *Compiler) typedExp(ef expFunc, in *string,
 		}
 		be.appendValue(bv)
 	}
-	return be, nil
+	return c.optimizeExp(be, false), nil
 }
 
 func (c *Compiler) argExpression(in *string, vt ValueType) (BytecodeExp, error) {
@@ -5965,9 +6000,13 @@ func (c *Compiler) stateSec(is IniSection, f func() error) error {
 }
 
 func (c *Compiler) stateParam(is IniSection, name string, mandatory bool, f func(string) error) error {
+	if c.paramNames != nil {
+		c.paramNames[name] = true
+	}
 	data, ok := is[name]
 	if ok {
 		if err := f(data); err != nil {
+			c.errParam = name
 			return Error(data + "\n" + name + ": " + err.Error())
 		}
 		delete(is, name)
@@ -6593,11 +6632,14 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return err
 			}
 			str = string(b)
-			return c.stateCompileZ(states, fnz, str, constants)
+			c.files = append(c.files, filename)
+			return c.stateCompileZ(states, fnz, str, append([]string{filename}, dirs...), constants)
 		}
 
 		// Try reading as an st file
-		str, err = LoadText(filename)
+		if str, err = LoadText(filename); err == nil {
+			c.files = append(c.files, filename)
+		}
 		return err
 	}); err != nil {
 		// If filename doesn't exist, see if a zss file exists
@@ -6610,18 +6652,34 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			str = string(b)
 			return nil
 		}); err == nil {
-			return c.stateCompileZ(states, fnz, str, constants)
+			c.files = append(c.files, fnz)
+			return c.stateCompileZ(states, fnz, str, append([]string{fnz}, dirs...), constants)
 		}
 		return err
 	}
 
 	c.lines, c.i = SplitAndTrim(str, "\n"), 0
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, c.i+1, err.Error()))
+		return compileError{file: filename, line: c.i + 1, err: err}
+	}
+	// Errors of sctrl parameters are located at the parameter's line rather
+	// than at the end of the section
+	sctrlErr := func(err error, sec int) error {
+		ce := compileError{file: filename, line: c.i + 1, err: err}
+		if c.errParam != "" {
+			if ln, col, ok := findParamLine(c.lines, sec, c.i+1, c.errParam); ok {
+				ce.line, ce.col = ln+1, col
+			}
+		}
+		return ce
+	}
+	if c.lint != nil {
+		c.lint.file = filename
 	}
 	// Keep a map of states that have already been found in this file
 	existInThisFile := make(map[int32]bool)
 	c.vars = make(map[string]uint8)
+	c.varTypes = make(map[string]*zssType)
 	// Loop through state file lines
 	for ; c.i < len(c.lines); c.i++ {
 		// Find a statedef, skipping over other lines until finding one
@@ -6638,6 +6696,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		line = line[10:]
 		var err error
 		if c.stateNo, err = c.scanStateDef(&line, constants); err != nil {
+			if c.lintError(errmes(err)) {
+				continue
+			}
 			return errmes(err)
 		}
 
@@ -6646,11 +6707,15 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			continue
 		}
 		existInThisFile[c.stateNo] = true
+		stateLine := c.i
 
 		c.i++
 		// Parse the statedef properties
 		is, _, err := c.parseSection(nil)
 		if err != nil {
+			if c.lintError(errmes(err)) {
+				continue
+			}
 			return errmes(err)
 		}
 		sbc := newStateBytecode(c.playerNo)
@@ -6658,8 +6723,12 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			*sbc = states[c.stateNo]
 		}
 		// Interpret the statedef properties
+		c.errParam = ""
 		if err := c.stateDef(is, sbc); err != nil {
-			return errmes(err)
+			if c.lintError(sctrlErr(err, stateLine)) {
+				continue
+			}
+			return sctrlErr(err, stateLine)
 		}
 		sctrl_index_counter := 0
 		// Continue looping through state file lines to define the current state
@@ -6675,6 +6744,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				c.i--
 				break
 			}
+			sctrlLine := c.i
 			c.i++
 
 			// Create this sctrl and get its properties
@@ -6755,6 +6825,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 								}
 							}
 							if _break {
+								c.lintWarning(errmes(err))
 								break
 							}
 						}
@@ -6777,6 +6848,10 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return nil
 			})
 			if err != nil {
+				if c.lintError(errmes(err)) {
+					c.skipSection()
+					continue
+				}
 				return errmes(err)
 			}
 			c.block.persistentIndex = int32(sctrl_index_counter)
@@ -6791,10 +6866,18 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			}
 			// Check that the sctrl has a valid type parameter
 			if scf == nil {
-				return errmes(Error("State controller type not specified"))
+				err := compileError{file: filename, line: sctrlLine + 1, err: Error("State controller type not specified")}
+				if c.lintError(err) {
+					continue
+				}
+				return err
 			}
 			if len(trexist) == 0 || (!allTerminated && trexist[0] == 0) {
-				return errmes(Error("Missing trigger1"))
+				err := compileError{file: filename, line: sctrlLine + 1, err: Error("Missing trigger1")}
+				if c.lintError(err) {
+					continue
+				}
+				return err
 			}
 
 			// Create trigger bytecode
@@ -6863,9 +6946,16 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			}
 
 			// For this sctrl type, call the function to construct the sctrl
+			c.errParam = ""
 			sctrl, err := scf(is, sc, _ihp)
 			if err != nil {
-				return errmes(err)
+				if c.lintError(sctrlErr(err, sctrlLine)) {
+					continue
+				}
+				return sctrlErr(err, sctrlLine)
+			}
+			if c.lint != nil {
+				c.lint.controller(sctrl, sctrlLine+1)
 			}
 
 			// Check if the triggers can ever be true before appending the new sctrl
@@ -6904,6 +6994,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 
 		// Skip appending if already declared. Exception for negative states present in CommonStates and files belonging to char flagged with ikemenversion
 		if _, ok := states[c.stateNo]; !ok || (!negoverride && c.stateNo < 0) {
+			if c.lint != nil && !ok {
+				c.lint.stateDef(c.stateNo, stateLine+1)
+			}
 			states[c.stateNo] = *sbc
 		}
 	}
@@ -7078,7 +7171,8 @@ func (c *Compiler) varNames(end string, line *string) ([]string, error) {
 			if name == "" || name == "," || name == end {
 				return nil, c.wrongClosureToken()
 			}
-			if err := c.varNameCheck(name); err != nil {
+			// Fields of local records are named record.field
+			if err := c.varNameCheck(name); err != nil && c.varTypes[name] == nil {
 				return nil, err
 			}
 			if name != "_" {
@@ -7480,6 +7574,11 @@ func (c *Compiler) callFunc(line *string, root bool,
 	if cf.name == "" || cf.name == "(" {
 		return c.wrongClosureToken()
 	}
+	if name, err := c.funcName(cf.name); err != nil {
+		return err
+	} else {
+		cf.name = name
+	}
 
 	// Lookup function definition
 	bf, ok := c.funcs[cf.name]
@@ -7500,6 +7599,10 @@ func (c *Compiler) callFunc(line *string, root bool,
 
 	if !ok {
 		// Undefined function path
+		// Calls of functions that are never defined are reported by the linter
+		if c.lint != nil {
+			c.lint.funcCall(cf.name, c.lineBase+c.i+1)
+		}
 		// We parse arguments blindly until we hit ')' to ensure the instruction is valid, even without a definition
 		tmp := expr
 		if c.tokenizer(&tmp) == ")" {
@@ -7533,7 +7636,7 @@ func (c *Compiler) callFunc(line *string, root bool,
 		}
 
 		// Parse arguments based on known count
-		if bf.numArgs == 0 {
+		if len(bf.params) == 0 {
 			c.token = c.tokenizer(&expr)
 			if c.token == "" {
 				c.token = otk
@@ -7542,13 +7645,21 @@ func (c *Compiler) callFunc(line *string, root bool,
 				return err
 			}
 		} else {
-			for i := 0; i < int(bf.numArgs); i++ {
+			for i, t := range bf.params {
 				var be BytecodeExp
-				if i < int(bf.numArgs)-1 {
-					// Argument followed by ','
-					if be, err = c.argExpression(&expr, VT_Undefined); err != nil {
+				if t != nil {
+					// Array or record argument
+					if be, err = c.localArg(&expr, t); err != nil {
 						return err
 					}
+				}
+				if i < len(bf.params)-1 {
+					// Argument followed by ','
+					if t == nil {
+						if be, err = c.argExpression(&expr, VT_Undefined); err != nil {
+							return err
+						}
+					}
 					if c.token == "" {
 						c.token = otk
 					}
@@ -7557,8 +7668,10 @@ func (c *Compiler) callFunc(line *string, root bool,
 					}
 				} else {
 					// Last argument followed by ')'
-					if be, err = c.typedExp(c.expBoolOr, &expr, VT_Undefined); err != nil {
-						return err
+					if t == nil {
+						if be, err = c.typedExp(c.expBoolOr, &expr, VT_Undefined); err != nil {
+							return err
+						}
 					}
 					if c.token == "" {
 						c.token = otk
@@ -7599,6 +7712,9 @@ func (c *Compiler) letAssign(line *string, root bool,
 	ctrls *[]StateController, numVars *int32, names []string, endLine bool) error {
 	varis := make([]uint8, len(names))
 	for i, n := range names {
+		if t := c.varTypes[n]; t != nil && !t.scalar() {
+			return Error(fmt.Sprintf("%v can't be assigned whole: %v", n, t))
+		}
 		vi, ok := c.vars[n]
 		if !ok {
 			vi = uint8(*numVars)
@@ -7643,7 +7759,11 @@ func (c *Compiler) letAssign(line *string, root bool,
 			if n == "_" {
 				*ctrls = append(*ctrls, StateExpr(be))
 			} else {
-				*ctrls = append(*ctrls, varAssign{vari: varis[i], be: be})
+				va := varAssign{vari: varis[i], be: be}
+				if t := c.varTypes[n]; t != nil {
+					va.vt = t.vt
+				}
+				*ctrls = append(*ctrls, va)
 			}
 		}
 		c.token = otk
@@ -7718,7 +7838,19 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				return Error(fmt.Sprintf("%v can only be used inside a loop block", c.token))
 			}
 			continue
+		case "local":
+			if err := c.localDecl(line, root, numVars); err != nil {
+				return err
+			}
+			continue
 		case "let":
+			// Elements of local arrays
+			if tmp := *line; c.varTypes[c.tokenizer(&tmp)] != nil && c.tokenizer(&tmp) == "[" {
+				if err := c.letElement(line, root, ctrls); err != nil {
+					return err
+				}
+				continue
+			}
 			names, err := c.varNames("=", line)
 			if err != nil {
 				return err
@@ -7779,6 +7911,9 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				if sctrl, err := scf(is, sc, -1); err != nil {
 					return err
 				} else {
+					if c.lint != nil {
+						c.lint.controller(sctrl, c.lineBase+c.i+1)
+					}
 					*ctrls = append(*ctrls, sctrl)
 				}
 				c.scan(line)
@@ -7817,8 +7952,152 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 	return c.wrongClosureToken()
 }
 
-// Compile a ZSS state
-func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src string, constants map[string]float32) error {
+// Compiles a ZSS file. dirs are the directories its imports are searched in,
+// starting with the file itself
+func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src string,
+	dirs []string, constants map[string]float32) error {
+	// Imported files are compiled first, so calls to them can be checked
+	defer func(imports map[string]string, importing []string) {
+		c.imports, c.importing = imports, importing
+	}(c.imports, c.importing)
+	c.imports = make(map[string]string)
+	c.importing = append(c.importing, dirs[0])
+	if err := c.zssImports(states, filename, src, dirs, constants); err != nil {
+		return err
+	}
+	if c.lint == nil {
+		return c.stateCompileZChunk(states, filename, src, 0, constants)
+	}
+	// In lint mode, compilation resumes at the next section after each error
+	c.lint.file = filename
+	lines := strings.Split(src, "\n")
+	for base := 0; ; {
+		err := c.stateCompileZChunk(states, filename, strings.Join(lines[base:], "\n"), base, constants)
+		var ce compileError
+		if err == nil || !errors.As(err, &ce) {
+			return err
+		}
+		c.lint.compileError(ce, lintSevError)
+		next := Max(ce.line, base+1)
+		for next < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[next]), "[") {
+			next++
+		}
+		if next >= len(lines) {
+			return nil
+		}
+		base = next
+	}
+}
+
+var zssImportRegexp = regexp.MustCompile(`(?i)^import\s+"([^"]*)"\s+as\s+([^\s;#]+)\s*;?\s*(#.*)?$`)
+
+// Compiles the files imported by a ZSS file, in the form:
+//
+//	import "file.zss" as name
+//
+// Their functions are then called as name.function(...). Files are searched
+// like other character files, starting from the directory of the importer
+func (c *Compiler) zssImports(states map[int32]StateBytecode, filename, src string,
+	dirs []string, constants map[string]float32) error {
+	for i, ln := range strings.Split(src, "\n") {
+		ln = strings.TrimSpace(ln)
+		if len(ln) < 6 || !strings.EqualFold(ln[:6], "import") ||
+			(len(ln) > 6 && ln[6] != ' ' && ln[6] != '\t' && ln[6] != '"') {
+			continue
+		}
+		if err := c.zssImport(states, ln, dirs, constants); err != nil {
+			err = compileError{file: filename, line: i + 1, err: err}
+			if c.lintError(err) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) zssImport(states map[int32]StateBytecode, ln string,
+	dirs []string, constants map[string]float32) error {
+	m := zssImportRegexp.FindStringSubmatch(ln)
+	if m == nil {
+		return Error("Invalid import, expected: import \"file.zss\" as name")
+	}
+	name := strings.ToLower(m[2])
+	if err := c.varNameCheck(name); err != nil {
+		return err
+	}
+	if _, ok := c.imports[name]; ok {
+		return Error("Import name already used in this file: " + name)
+	}
+	path := SearchFile(m[1], dirs)
+	if !HasExtension(path, ".zss") {
+		return Error("Imported file must be a .zss file: " + m[1])
+	}
+	if FileExist(path) == "" {
+		return Error("Imported file not found: " + m[1])
+	}
+	for i, f := range c.importing {
+		if f == path {
+			return Error("Import cycle: " + strings.Join(append(c.importing[i:], path), " -> "))
+		}
+	}
+	// The same file imported under the same name is only compiled once
+	prefix := c.modulePrefix + name + "."
+	if p, ok := c.modules[prefix]; ok {
+		if p != path {
+			return Error(fmt.Sprintf("Import name %v is already used for %v", name, p))
+		}
+		c.imports[name] = prefix
+		return nil
+	}
+	c.modules[prefix] = path
+	c.imports[name] = prefix
+	return c.zssModule(states, path, prefix, dirs, constants)
+}
+
+// Compiles an imported file, naming its functions after prefix
+func (c *Compiler) zssModule(states map[int32]StateBytecode, path, prefix string,
+	dirs []string, constants map[string]float32) error {
+	src, err := LoadText(path)
+	if err != nil {
+		return err
+	}
+	c.files = append(c.files, path)
+	defer func(prefix string, funcs map[string]bool) {
+		c.modulePrefix, c.moduleFuncs = prefix, funcs
+	}(c.modulePrefix, c.moduleFuncs)
+	// Functions of the file can call each other without the prefix, even
+	// before they are defined
+	c.modulePrefix, c.moduleFuncs = prefix, make(map[string]bool)
+	for _, m := range zssFunctionRegexp.FindAllStringSubmatch(src, -1) {
+		c.moduleFuncs[strings.ToLower(m[1])] = true
+	}
+	return c.stateCompileZ(states, path, src, append([]string{path}, dirs[1:]...), constants)
+}
+
+var zssFunctionRegexp = regexp.MustCompile(`(?im)^\s*\[\s*function\s+([a-z_][a-z0-9_]*)`)
+
+// Resolves the name of a called function. Names of imported functions are
+// given as import.function
+func (c *Compiler) funcName(name string) (string, error) {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		prefix, ok := c.imports[name[:i]]
+		if !ok {
+			return "", Error("Unknown import name: " + name[:i])
+		}
+		if _, ok := c.funcs[prefix+name[i+1:]]; !ok {
+			return "", Error(fmt.Sprintf("Function %v is not defined in %v", name[i+1:], c.modules[prefix]))
+		}
+		return prefix + name[i+1:], nil
+	}
+	if c.moduleFuncs[name] {
+		return c.modulePrefix + name, nil
+	}
+	return name, nil
+}
+
+// Compiles ZSS source starting at line base of the file
+func (c *Compiler) stateCompileZChunk(states map[int32]StateBytecode, filename, src string, base int, constants map[string]float32) error {
 	// ZSS states are compiled with a lower tolerance for mistakes
 	// TODO: Either merge this with our current c.zssMode checks or drop it
 	defer func(oime bool) {
@@ -7828,6 +8107,10 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 
 	c.block = nil
 	c.lines, c.i = SplitAndTrim(src, "\n"), 0
+	c.lineBase = base
+	defer func() {
+		c.lineBase = 0
+	}()
 	c.linechan = make(chan *string)
 	endchan := make(chan bool, 1)
 
@@ -7870,12 +8153,20 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 		}
 	})
 
+	var line string
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, stop(), err.Error()))
+		ln := stop()
+		ce := compileError{file: filename, line: base + ln, err: err}
+		// The column is found from what's left of the line being scanned
+		if ln >= 1 && ln <= len(c.lines) && strings.HasSuffix(c.lines[ln-1], line) {
+			raw := strings.Split(src, "\n")[ln-1]
+			indent := len(raw) - len(strings.TrimLeft(raw, " \t"))
+			ce.col = Max(1, indent+len(c.lines[ln-1])-len(line)-len(c.token)+1)
+		}
+		return ce
 	}
 	existInThisFile := make(map[int32]bool)
 	funcExistInThisFile := make(map[string]bool)
-	var line string
 	c.token = ""
 	for {
 		if c.token == "" {
@@ -7884,6 +8175,11 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 				break
 			}
 		}
+		if c.token == "import" {
+			// Already compiled by zssImports
+			line, c.token = "", ""
+			continue
+		}
 		if c.token != "[" {
 			return errmes(c.wrongClosureToken())
 		}
@@ -7891,6 +8187,9 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 		case "":
 			return errmes(c.wrongClosureToken())
 		case "statedef":
+			if c.modulePrefix != "" {
+				return errmes(Error("Imported files can only define functions"))
+			}
 			var err error
 			if c.stateNo, err = c.scanStateDef(&line, constants); err != nil {
 				return errmes(err)
@@ -7904,6 +8203,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 				}
 			}
 			existInThisFile[c.stateNo] = true
+			stateLine := base + c.i + 1
 			is := NewIniSection()
 			for c.token != "]" {
 				switch c.token {
@@ -7920,6 +8220,8 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 				*sbc = states[c.stateNo]
 			}
 			c.vars = make(map[string]uint8)
+			c.varTypes = make(map[string]*zssType)
+			c.locals, c.localBase = &sbc.locals, 0
 			if err := c.stateDef(is, sbc); err != nil {
 				return errmes(err)
 			}
@@ -7931,6 +8233,9 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 				return errmes(err)
 			}
 			if _, ok := states[c.stateNo]; !ok || c.stateNo < 0 {
+				if c.lint != nil && !ok {
+					c.lint.stateDef(c.stateNo, stateLine)
+				}
 				states[c.stateNo] = *sbc
 			}
 		case "function":
@@ -7950,7 +8255,11 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 
 			// Check if defined in a previous file
 			// We will allow this one because of common files
-			_, duplicate := c.funcs[name]
+			// Functions of imported files are named after the import
+			_, duplicate := c.funcs[c.modulePrefix+name]
+			if c.lint != nil && !duplicate && c.modulePrefix == "" {
+				c.lint.funcDef(name, base+c.i+1)
+			}
 
 			c.scan(&line)
 			if err := c.needToken("("); err != nil {
@@ -7960,18 +8269,27 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 			// Start compiling
 			fun := bytecodeFunction{}
 			c.vars = make(map[string]uint8)
+			c.varTypes = make(map[string]*zssType)
 
 			// Parse arguments
-			if args, err := c.varNames(")", &line); err != nil {
+			// Array and record arguments take one slot per value
+			if args, types, err := c.funcParams(&line); err != nil {
 				return errmes(err)
 			} else {
-				for _, a := range args {
+				for i, a := range args {
+					if types[i] != nil {
+						if err := c.declareLocal(a, types[i], &fun.numVars); err != nil {
+							return errmes(err)
+						}
+						continue
+					}
 					c.vars[a] = uint8(fun.numVars)
 					if err := c.inclNumVars(&fun.numVars); err != nil {
 						return errmes(err)
 					}
 				}
-				fun.numArgs = int32(len(args))
+				fun.numArgs = fun.numVars
+				fun.params = types
 			}
 
 			// Parse return values
@@ -7992,6 +8310,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 				}
 				fun.numRets = int32(len(rets))
 			}
+			c.locals, c.localBase = &fun.locals, fun.numVars
 
 			// Parse the body
 			if err := c.stateBlock(&line, nil, true, nil, &fun.ctrls, &fun.numVars); err != nil {
@@ -8001,7 +8320,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode, filename, src s
 			// Function is only actually saved if it's the first time we've seen this function name
 			// Otherwise the temp "fun" just goes out of scope and is garbage collected
 			if !duplicate {
-				c.funcs[name] = fun
+				c.funcs[c.modulePrefix+name] = fun
 			}
 		default:
 			return errmes(Error("Unrecognized section (group) name: " + c.token))
@@ -8072,6 +8391,9 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 
 	// Load the command file
 	str = ""
+	// Files making up the command text and their first lines, to locate errors
+	var cmdFiles []string
+	var cmdStarts []int
 	if len(cmd) > 0 {
 		if err := LoadFile(&cmd, []string{def, "", sys.motif.Def, "data/"}, func(filename string) error {
 			var err error
@@ -8079,6 +8401,7 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			if err != nil {
 				return err
 			}
+			cmdFiles, cmdStarts = append(cmdFiles, filename), append(cmdStarts, 0)
 			return nil
 		}); err != nil {
 			return nil, err
@@ -8091,6 +8414,8 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 				if err != nil {
 					return err
 				}
+				cmdFiles = append(cmdFiles, filename)
+				cmdStarts = append(cmdStarts, strings.Count(str, "\n")+1)
 				str += "\n" + txt
 				return nil
 			}); err != nil {
@@ -8115,8 +8440,10 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	remap, defaults, ckr := true, true, NewCommandKeyRemap()
 
 	var cmds []IniSection
+	var cmdLines []int
 	for lnidx < len(lines) {
 		// Read ini sections of command file
+		start := lnidx
 		is, name, _ := ReadIniSection(lines, &lnidx)
 		switch name {
 		case "remap":
@@ -8177,16 +8504,47 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			// Get command sections
 			if len(name) >= 7 && name[:7] == "command" {
 				cmds = append(cmds, is)
+				if c.lint != nil {
+					for start < lnidx {
+						if n, _ := SectionName(lines[start]); n != "" {
+							break
+						}
+						start++
+					}
+					cmdLines = append(cmdLines, start)
+				}
+			}
+		}
+	}
+	// In lint mode, command errors are reported at the line of the parameter
+	// and the remaining commands are still parsed
+	lintCmd := func(k int, param string, err error, severity string) bool {
+		if c.lint == nil {
+			return false
+		}
+		ce := compileError{line: cmdLines[k] + 1, err: err}
+		for j := len(cmdStarts) - 1; j >= 0; j-- {
+			if cmdLines[k] >= cmdStarts[j] {
+				ce.file, ce.line = cmdFiles[j], cmdLines[k]-cmdStarts[j]+1
+				if ln, col, ok := findParamLine(lines, cmdLines[k], len(lines), param); ok {
+					ce.line, ce.col = ln-cmdStarts[j]+1, col
+				}
+				break
 			}
 		}
+		c.lint.compileError(ce, severity)
+		return true
 	}
 	// Parse commands
-	for _, is := range cmds {
+	for k, is := range cmds {
 		cm := newCommand()
 
 		// Get name
 		name, _, err := is.getText("name")
 		if err != nil {
+			if lintCmd(k, "name", err, lintSevError) {
+				continue
+			}
 			return nil, Error(fmt.Sprintf("%v:\nname: %v\n%v",
 				cmd, name, err.Error()))
 		}
@@ -8221,7 +8579,8 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 		if err != nil {
 			if sys.ignoreMostErrors && sys.cgi[pn].ikemenver[0] == 0 && sys.cgi[pn].ikemenver[1] == 0 {
 				// Mugen characters ignore command definition errors
-			} else {
+				lintCmd(k, "command", err, lintSevWarning)
+			} else if !lintCmd(k, "command", err, lintSevError) {
 				return nil, Error(cmd + ":\nname = " + is["name"] +
 					"\ncommand = " + is["command"] + "\n" + err.Error())
 			}
@@ -8239,7 +8598,7 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 		if len(s) > 0 {
 			if err := c.stateCompile(states, s, []string{def, "", sys.motif.Def, "data/"},
 				sys.cgi[pn].ikemenver[0] == 0 &&
-					sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+					sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && !c.lintError(err) {
 				return nil, err
 			}
 		}
@@ -8248,15 +8607,19 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	if len(cmd) > 0 {
 		if err := c.stateCompile(states, cmd, []string{def, "", sys.motif.Def, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
-				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && !c.lintError(err) {
 			return nil, err
 		}
 	}
+	// Common states aren't checked for unused states
+	if c.lint != nil {
+		c.lint.common = true
+	}
 	// Compile states in stcommon state file
 	if len(stcommon) > 0 {
 		if err := c.stateCompile(states, stcommon, []string{def, "", sys.motif.Def, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
-				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && !c.lintError(err) {
 			return nil, err
 		}
 	}
@@ -8264,12 +8627,26 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	for _, key := range SortedKeys(sys.cfg.Common.States) {
 		for _, v := range sys.cfg.Common.States[key] {
 			if err := c.stateCompile(states, v, []string{def, sys.motif.Def, sys.fightScreen.def, "", "data/"},
-				false, constants); err != nil {
+				false, constants); err != nil && !c.lintError(err) {
 				return nil, err
 			}
 		}
 	}
+	// Optimize the triggers now that they are complete, and number the
+	// controllers for the profiler
+	for no, sb := range states {
+		sb.block.ctrls = c.optimizeCtrls(sb.block.ctrls)
+		sb.stateNo = no
+		sb.block.indexCtrls(new(int32))
+		states[no] = sb
+	}
+	for name, bf := range c.funcs {
+		bf.ctrls = c.optimizeCtrls(bf.ctrls)
+		bf.ctrlIndexes = indexCtrls(bf.ctrls, new(int32))
+		c.funcs[name] = bf
+	}
 	// Store functions in Global Info (static data), accessible to all instances
 	sys.cgi[pn].callFuncs = c.funcs
+	sys.cgi[pn].stateFiles = append(append([]string{def}, cmdFiles...), c.files...)
 	return states, nil
 }
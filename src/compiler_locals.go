@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Typed ZSS locals, declared at the start of a state or function with:
+//
+//	local{ hits: int[8]; combo: int; juggle: {points: int; time: float[4]} }
+//
+// Arrays are indexed with $hits[i] and assigned with let hits[i] = value;
+// while record fields are used as $juggle.points. They take consecutive
+// local variable slots, so arrays and records can be copied whole to function
+// parameters of the same type, as in [function f(hits: int[8])].
+//
+// Unlike let variables, the typed locals of a state keep their values from one
+// frame to the next until the character changes state. They are part of
+// StateState, so rollback saves and restores them. Those of functions and
+// negative states start from 0 each time they run.
+
+const zssMaxArrayLength = 256
+
+// Type of a typed local
+type zssType struct {
+	vt     ValueType  // Type of the value or of the array elements, VT_None for records
+	length int32      // Number of elements of arrays, 0 otherwise
+	fields []zssField // Fields of records
+}
+
+type zssField struct {
+	name string
+	typ  *zssType
+}
+
+// Number of local variable slots taken
+func (t *zssType) size() int32 {
+	if t.fields != nil {
+		var n int32
+		for _, f := range t.fields {
+			n += f.typ.size()
+		}
+		return n
+	}
+	return Max(1, t.length)
+}
+
+func (t *zssType) scalar() bool {
+	return t.fields == nil && t.length == 0
+}
+
+func (t *zssType) String() string {
+	if t.fields != nil {
+		fields := make([]string, len(t.fields))
+		for i, f := range t.fields {
+			fields[i] = f.name + ": " + f.typ.String()
+		}
+		return "{" + strings.Join(fields, "; ") + "}"
+	}
+	var name string
+	switch t.vt {
+	case VT_Int:
+		name = "int"
+	case VT_Float:
+		name = "float"
+	case VT_Bool:
+		name = "bool"
+	}
+	if t.length > 0 {
+		return fmt.Sprintf("%v[%v]", name, t.length)
+	}
+	return name
+}
+
+// Appends the initial values of the slots
+func (t *zssType) appendZero(vals *[]BytecodeValue) {
+	for _, f := range t.fields {
+		f.typ.appendZero(vals)
+	}
+	if t.fields == nil {
+		for i := int32(0); i < t.size(); i++ {
+			*vals = append(*vals, BytecodeValue{t.vt, 0})
+		}
+	}
+}
+
+func (c *Compiler) scanType(line *string) (*zssType, error) {
+	t := &zssType{}
+	switch c.scan(line) {
+	case "int":
+		t.vt = VT_Int
+	case "float":
+		t.vt = VT_Float
+	case "bool":
+		t.vt = VT_Bool
+	case "{":
+		for c.scan(line) != "}" {
+			name := c.token
+			if name == "" || name == ";" {
+				return nil, c.wrongClosureToken()
+			}
+			if err := c.varNameCheck(name); err != nil {
+				return nil, err
+			}
+			for _, f := range t.fields {
+				if f.name == name {
+					return nil, Error("Duplicate field: " + name)
+				}
+			}
+			c.scan(line)
+			if err := c.needToken(":"); err != nil {
+				return nil, err
+			}
+			ft, err := c.scanType(line)
+			if err != nil {
+				return nil, err
+			}
+			t.fields = append(t.fields, zssField{name, ft})
+			if c.scan(line) == "}" {
+				break
+			}
+			if err := c.needToken(";"); err != nil {
+				return nil, err
+			}
+		}
+		if t.fields == nil {
+			return nil, Error("Record without fields")
+		}
+	case "":
+		return nil, c.wrongClosureToken()
+	default:
+		return nil, Error("Invalid type: " + c.token)
+	}
+	// Array length
+	if tmp := *line; c.tokenizer(&tmp) == "[" {
+		if t.fields != nil {
+			return nil, Error("Arrays of records are not supported")
+		}
+		c.scan(line)
+		n, err := c.scanI32(line)
+		if err != nil {
+			return nil, Error("Invalid array length: " + c.token)
+		}
+		if n < 1 || n > zssMaxArrayLength {
+			return nil, Error(fmt.Sprintf("Array length must be from 1 to %v: %v", zssMaxArrayLength, n))
+		}
+		t.length = n
+		c.scan(line)
+		if err := c.needToken("]"); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Gives slots to a typed local, and to each field of records
+func (c *Compiler) declareLocal(name string, t *zssType, numVars *int32) error {
+	if _, ok := c.vars[name]; ok {
+		return Error("Duplicate name: " + name)
+	}
+	c.vars[name] = uint8(*numVars)
+	c.varTypes[name] = t
+	if t.fields != nil {
+		for _, f := range t.fields {
+			if err := c.declareLocal(name+"."+f.name, f.typ, numVars); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := int32(0); i < t.size(); i++ {
+		if err := c.inclNumVars(numVars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compiles a local{...} statement
+func (c *Compiler) localDecl(line *string, root bool, numVars *int32) error {
+	c.scan(line)
+	if err := c.needToken("{"); err != nil {
+		return err
+	}
+	for c.scan(line) != "}" {
+		name := c.token
+		if name == "" || name == ";" {
+			return c.wrongClosureToken()
+		}
+		if err := c.varNameCheck(name); err != nil {
+			return err
+		}
+		c.scan(line)
+		if err := c.needToken(":"); err != nil {
+			return err
+		}
+		t, err := c.scanType(line)
+		if err != nil {
+			return err
+		}
+		// Slots are restored from the initial values, so they must come first
+		if *numVars != c.localBase+int32(len(*c.locals)) {
+			return Error("Typed locals must be declared before let variables")
+		}
+		if err := c.declareLocal(name, t, numVars); err != nil {
+			return err
+		}
+		t.appendZero(c.locals)
+		if c.scan(line) == "}" {
+			break
+		}
+		if err := c.needToken(";"); err != nil {
+			return err
+		}
+	}
+	if root {
+		if err := c.statementEnd(line); err != nil {
+			return err
+		}
+	}
+	c.scan(line)
+	return nil
+}
+
+// Compiles a read of a typed local after its $name token. Arrays are read
+// through OC_localarray, which checks the index at runtime
+func (c *Compiler) localValue(out *BytecodeExp, in *string, name string) error {
+	vi := c.vars[name]
+	t := c.varTypes[name]
+	if t == nil || t.scalar() {
+		out.append(OC_localvar, OpCode(vi))
+		return nil
+	}
+	if t.fields != nil {
+		return Error("$" + name + " is a record, use its fields")
+	}
+	if tmp := *in; c.tokenizer(&tmp) != "[" {
+		return Error("$" + name + " is an array, index it with []")
+	}
+	c.tokenizer(in)
+	c.token = c.tokenizer(in)
+	var be BytecodeExp
+	bv, err := c.expBoolOr(&be, in)
+	if err != nil {
+		return err
+	}
+	if c.token != "]" {
+		return Error("Missing ']' after the index of $" + name)
+	}
+	if !bv.IsNone() {
+		i := bv.ToI()
+		if i < 0 || i >= t.length {
+			return Error(fmt.Sprintf("Index %v out of range of $%v: %v", i, name, t))
+		}
+		out.append(OC_localvar, OpCode(int32(vi)+i))
+		return nil
+	}
+	out.append(be...)
+	out.append(OC_localarray, OpCode(vi), OpCode(t.length-1))
+	return nil
+}
+
+// Compiles an argument passed to an array or record parameter. It must be a
+// local of the same type, whose slots are pushed in order
+func (c *Compiler) localArg(in *string, t *zssType) (BytecodeExp, error) {
+	c.token = c.tokenizer(in)
+	name := strings.TrimPrefix(c.token, "$")
+	if at, ok := c.varTypes[name]; !ok || name == c.token || at.String() != t.String() {
+		return nil, Error(fmt.Sprintf("Argument must be a local of type %v: %v", t, c.token))
+	}
+	var be BytecodeExp
+	for i := int32(0); i < t.size(); i++ {
+		be.append(OC_localvar, OpCode(int32(c.vars[name])+i))
+	}
+	c.token = c.tokenizer(in)
+	return be, nil
+}
+
+// Compiles let name[index] = value; for an element of a local array
+func (c *Compiler) letElement(line *string, root bool, ctrls *[]StateController) error {
+	name := c.scan(line)
+	t := c.varTypes[name]
+	if t.length == 0 {
+		return Error(name + " is not an array")
+	}
+	la := localArrayAssign{vari: c.vars[name], length: t.length, vt: t.vt}
+	expr, _, err := c.readSentence(line)
+	if err != nil {
+		return err
+	}
+	otk := c.token
+	if c.tokenizer(&expr) != "[" {
+		return Error("Missing '[' after " + name)
+	}
+	if la.index, err = c.typedExp(c.expBoolOr, &expr, VT_Int); err != nil {
+		return err
+	}
+	if c.token != "]" {
+		return Error("Missing ']' after the index of " + name)
+	}
+	if v, ok := la.index.constValue(); ok && (v.ToI() < 0 || v.ToI() >= t.length) {
+		return Error(fmt.Sprintf("Index %v out of range of %v: %v", v.ToI(), name, t))
+	}
+	if c.tokenizer(&expr) != "=" {
+		return Error("Missing '=' in assignment to " + name)
+	}
+	if la.be, err = c.fullExpression(&expr, t.vt); err != nil {
+		return err
+	}
+	*ctrls = append(*ctrls, la)
+	c.token = otk
+	if err := c.needToken(";"); err != nil {
+		return err
+	}
+	if root {
+		if err := c.statementEnd(line); err != nil {
+			return err
+		}
+	}
+	c.scan(line)
+	return nil
+}
+
+// Reads the parameters of a function, which may have an array or record type
+func (c *Compiler) funcParams(line *string) ([]string, []*zssType, error) {
+	var names []string
+	var types []*zssType
+	if c.scan(line) == ")" {
+		return names, types, nil
+	}
+	for {
+		name := c.token
+		if name == "" || name == "," || name == ")" {
+			return nil, nil, c.wrongClosureToken()
+		}
+		if err := c.varNameCheck(name); err != nil {
+			return nil, nil, err
+		}
+		if name != "_" {
+			for _, nm := range names {
+				if nm == name {
+					return nil, nil, Error("Duplicate name: " + name)
+				}
+			}
+		}
+		var t *zssType
+		if c.scan(line) == ":" {
+			var err error
+			if t, err = c.scanType(line); err != nil {
+				return nil, nil, err
+			}
+			if t.scalar() {
+				return nil, nil, Error("Only array and record parameters have a type: " + name)
+			}
+			c.scan(line)
+		}
+		names, types = append(names, name), append(types, t)
+		if c.token != "," {
+			if err := c.needToken(")"); err != nil {
+				return nil, nil, err
+			}
+			return names, types, nil
+		}
+		c.scan(line)
+	}
+}
@@ -159,6 +159,7 @@ type Config struct {
 		ForceStageZoomin    float32 `ini:"ForceStageZoomin" sync:"host"`
 		ForceStageAutoZoom  bool    `ini:"ForceStageAutoZoom" sync:"host"`
 		KeepSpritesOnReload bool    `ini:"KeepSpritesOnReload"`
+		HotReload           bool    `ini:"HotReload"`
 		MacOSUseCommandKey  bool    `ini:"MacOSUseCommandKey"`
 		SpeedTest           int     `ini:"SpeedTest"`
 	} `ini:"Debug"`
@@ -173,6 +174,8 @@ type Config struct {
 		Fullscreen              bool     `ini:"Fullscreen"`
 		Borderless              bool     `ini:"Borderless"`
 		RGBSpriteBilinearFilter bool     `ini:"RGBSpriteBilinearFilter"`
+		SpriteAtlas             bool     `ini:"SpriteAtlas"`
+		SpriteBatching          bool     `ini:"SpriteBatching"`
 		MSAA                    int32    `ini:"MSAA"`
 		WindowCentered          bool     `ini:"WindowCentered"`
 		ExternalShaders         []string `ini:"ExternalShaders"`
@@ -221,9 +224,16 @@ type Config struct {
 	} `ini:"Arcade"`
 	Netplay struct {
 		ListenPort      string             `ini:"ListenPort"`
+		PlayerName      string             `ini:"PlayerName"`
 		RollbackNetcode bool               `ini:"RollbackNetcode" sync:"strict"`
 		IP              map[string]string  `ini:"IP"`
 		Rollback        RollbackProperties `ini:"Rollback"`
+		SpectatorPort   string             `ini:"SpectatorPort"`
+		MaxSpectators   int                `ini:"MaxSpectators"`
+		SpectatorDelay  int32              `ini:"SpectatorDelay"`
+		LobbyServer     string             `ini:"LobbyServer"`
+		Participants    int                `ini:"Participants"`
+		NetSim          string             `ini:"NetSim"`
 	} `ini:"Netplay"`
 	Input struct {
 		ButtonAssist               bool    `ini:"ButtonAssist" sync:"host"`
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Debug console input. While it's open, the lines typed during a match are
+// compiled for the character selected in the debug display, then run between
+// two frames:
+//
+//	p2,stateno                 Prints the value of a trigger expression
+//	let a = 1; PosAdd{x: a}    Runs ZSS statements, which end with ';' or '}'
+//	watch enemynear,vel x > 2  Pins an expression to the debug display
+//	unwatch 1                  Removes a watch, or all of them without a number
+//
+// Expressions use the CNS trigger syntax, redirections included. Watches keep
+// the character they were added for, and are evaluated every frame.
+
+// Name of the function ZSS statements are compiled into
+const debugConsoleFunc = "__console"
+
+// Lines kept for Up and Down
+const debugConsoleHistory = 32
+
+type debugWatch struct {
+	text  string
+	ref   [2]int // player number, helper index
+	be    BytecodeExp
+	value string
+}
+
+type DebugConsole struct {
+	active  bool
+	input   string
+	pending []string // Lines entered, run on the next frame
+	history []string
+	histPos int
+	watches []debugWatch
+}
+
+func (dc *DebugConsole) toggle(on bool) {
+	dc.active, dc.input = on, ""
+	dc.histPos = len(dc.history)
+	if on {
+		sys.debugDisplay = true
+	}
+}
+
+// Edits the input line. Typed text is added by OnTextEntered
+func (dc *DebugConsole) keyPressed(key Key) {
+	switch key {
+	case KeyEscape:
+		dc.toggle(false)
+	case KeyEnter:
+		if line := strings.TrimSpace(dc.input); line != "" {
+			dc.pending = append(dc.pending, line)
+			if len(dc.history) == 0 || dc.history[len(dc.history)-1] != line {
+				dc.history = append(dc.history, line)
+				if len(dc.history) > debugConsoleHistory {
+					dc.history = dc.history[1:]
+				}
+			}
+		}
+		dc.input, dc.histPos = "", len(dc.history)
+	case KeyBackspace:
+		if r := []rune(dc.input); len(r) > 0 {
+			dc.input = string(r[:len(r)-1])
+		}
+	case KeyUp:
+		if dc.histPos > 0 {
+			dc.histPos--
+			dc.input = dc.history[dc.histPos]
+		}
+	case KeyDown:
+		if dc.histPos < len(dc.history)-1 {
+			dc.histPos++
+			dc.input = dc.history[dc.histPos]
+		} else {
+			dc.histPos, dc.input = len(dc.history), ""
+		}
+	case KeyInsert:
+		dc.input += sys.window.GetClipboardString()
+	}
+}
+
+// Character of a debug reference, nil if it no longer exists
+func debugConsoleChar(ref [2]int) *Char {
+	if ref[0] < 0 || ref[0] >= len(sys.chars) || ref[1] < 0 || ref[1] >= len(sys.chars[ref[0]]) {
+		return nil
+	}
+	if c := sys.chars[ref[0]][ref[1]]; c != nil && !c.csf(CSF_destroy) {
+		return c
+	}
+	return nil
+}
+
+// Compiler set up with the commands and functions of a character
+func debugConsoleCompiler(c *Char) *Compiler {
+	comp := newCompiler()
+	comp.playerNo = c.playerNo
+	if root := sys.chars[c.playerNo][0]; len(root.cmd) > c.playerNo {
+		comp.cmdl = &root.cmd[c.playerNo]
+	} else {
+		comp.cmdl = NewCommandList(NewInputBuffer())
+	}
+	for name, f := range sys.cgi[c.playerNo].callFuncs {
+		if name != debugConsoleFunc {
+			comp.funcs[name] = f
+		}
+	}
+	comp.funcUsed = make(map[string]bool)
+	comp.vars = make(map[string]uint8)
+	comp.varTypes = make(map[string]*zssType)
+	return comp
+}
+
+func debugConsoleExpression(c *Char, text string) (BytecodeExp, error) {
+	return debugConsoleCompiler(c).fullExpression(&text, VT_None)
+}
+
+// Runs code on a character, as if it were in one of its own states
+func debugConsoleRun(c *Char, f func()) {
+	owc, ows := sys.workingChar, sys.workingState
+	sys.workingChar, sys.workingState = c, newStateBytecode(c.playerNo)
+	sys.bcStack.Clear()
+	f()
+	sys.bcStack.Clear()
+	sys.workingChar, sys.workingState = owc, ows
+}
+
+func debugConsoleValue(c *Char, be BytecodeExp) (s string) {
+	debugConsoleRun(c, func() {
+		s = fmt.Sprint(be.run(c).ToAny())
+	})
+	return
+}
+
+func (dc *DebugConsole) exec(line string) {
+	sys.appendToConsole("> " + line)
+	c := debugConsoleChar(sys.debugRef)
+	if c == nil {
+		sys.appendToConsole("No character selected")
+		return
+	}
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch {
+	case cmd == "watch" && arg != "":
+		be, err := debugConsoleExpression(c, arg)
+		if err != nil {
+			sys.appendToConsole(err.Error())
+			return
+		}
+		dc.watches = append(dc.watches, debugWatch{text: arg, ref: sys.debugRef, be: be})
+	case cmd == "unwatch":
+		if arg == "" {
+			dc.watches = nil
+			return
+		}
+		i, err := strconv.Atoi(arg)
+		if err != nil || i < 1 || i > len(dc.watches) {
+			sys.appendToConsole("No watch " + arg)
+			return
+		}
+		dc.watches = append(dc.watches[:i-1], dc.watches[i:]...)
+	case strings.HasSuffix(line, ";") || strings.HasSuffix(line, "}"):
+		comp := debugConsoleCompiler(c)
+		states := make(map[int32]StateBytecode)
+		if err := comp.stateCompileZChunk(states, "console",
+			"[Function "+debugConsoleFunc+"()]\n"+line, 0, nil); err != nil {
+			if ce, ok := err.(compileError); ok {
+				err = ce.err
+			}
+			sys.appendToConsole(err.Error())
+			return
+		}
+		bf := comp.funcs[debugConsoleFunc]
+		debugConsoleRun(c, func() {
+			bf.run(c, nil)
+		})
+	default:
+		be, err := debugConsoleExpression(c, line)
+		if err != nil {
+			sys.appendToConsole(err.Error())
+			return
+		}
+		sys.appendToConsole(debugConsoleValue(c, be))
+	}
+}
+
+// Compiles the watches again, after the characters were reloaded
+func (dc *DebugConsole) recompile() {
+	for i := range dc.watches {
+		w := &dc.watches[i]
+		w.be = nil
+		if c := debugConsoleChar(w.ref); c != nil {
+			var err error
+			if w.be, err = debugConsoleExpression(c, w.text); err != nil {
+				w.value = err.Error()
+			}
+		}
+	}
+}
+
+// Runs the lines entered since the last frame and updates the watches
+func (dc *DebugConsole) update() {
+	if !sys.debugModeAllowed() {
+		dc.active, dc.pending = false, nil
+		return
+	}
+	for _, line := range dc.pending {
+		dc.exec(line)
+	}
+	dc.pending = nil
+	for i := range dc.watches {
+		w := &dc.watches[i]
+		if w.be == nil {
+			continue
+		}
+		if c := debugConsoleChar(w.ref); c != nil {
+			w.value = debugConsoleValue(c, w.be)
+		} else {
+			w.value = "-"
+		}
+	}
+}
+
+// Lines shown in the debug display
+func (dc *DebugConsole) lines() []string {
+	var lines []string
+	for i, w := range dc.watches {
+		owner := fmt.Sprintf("P%v", w.ref[0]+1)
+		if w.ref[1] > 0 {
+			owner += fmt.Sprintf(" helper %v", w.ref[1])
+		}
+		lines = append(lines, fmt.Sprintf("%v. %v: %v = %v", i+1, owner, w.text, w.value))
+	}
+	if dc.active {
+		lines = append(lines, "> "+dc.input+"_")
+	}
+	return lines
+}
@@ -538,7 +538,7 @@ func (f *Fnt) drawChar(
 	}
 
 	// Update only the render parameters that change between each character
-	rp.tex = spr.Tex
+	rp.tex, rp.uv = spr.Tex, spr.uv
 	if spr.coldepth <= 8 {
 		rp.paltex = f.paltex
 	} else {
@@ -687,6 +687,7 @@ func (f *Fnt) DrawTtf(txt string, x, y, xscl, yscl float32, align int32,
 	//	(*window)[2], (*window)[3]}
 
 	f.ttf.SetColor(frgba[0], frgba[1], frgba[2], frgba[3])
+	spriteBatch.flush()
 	f.ttf.Printf(x, y, (xscl+yscl)/2, spacingXAdd, align, blend, *window, "%s", txt) //x, y, scale, spacingXAdd, align, blend, window, string, printf args
 }
 
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Hot reload of characters in debug mode. The state, constant, command and
+// animation files of each character are checked for changes during the
+// match, then recompiled and swapped in between frames. The constants are
+// reread before the states are compiled, since the compiler folds them into
+// the code. Characters keep their position,
+// life and current state. When a file fails to compile, the error is printed
+// to the debug console and the character keeps running its previous code.
+
+// Time between two checks of the files
+const hotReloadInterval = 500 * time.Millisecond
+
+type HotReload struct {
+	defs      [MaxPlayerNo]string               // Character whose files are watched
+	modTimes  [MaxPlayerNo]map[string]time.Time // Modification time of each file
+	lastCheck time.Time
+}
+
+// Modification times of the files a character was loaded from. Files that
+// can't be read, such as those in zip archives, are not watched
+func hotReloadFiles(pn int) map[string]time.Time {
+	files := make(map[string]time.Time)
+	watch := func(filename string) {
+		if fi, err := os.Stat(filename); err == nil {
+			files[filename] = fi.ModTime()
+		}
+	}
+	for _, f := range sys.cgi[pn].stateFiles {
+		watch(f)
+	}
+	if f := sys.cgi[pn].cnsFile; f != "" {
+		watch(f)
+	}
+	if f := sys.cgi[pn].animTable.filename; f != "" {
+		watch(f)
+	}
+	return files
+}
+
+// Checks the files of every character, and reloads those that changed. Only
+// while debug mode is on
+func (hr *HotReload) update() {
+	if !sys.cfg.Debug.HotReload || !sys.debugModeAllowed() || !sys.debugDisplay ||
+		time.Since(hr.lastCheck) < hotReloadInterval {
+		return
+	}
+	hr.lastCheck = time.Now()
+	for pn := range hr.modTimes {
+		if len(sys.chars[pn]) == 0 {
+			continue
+		}
+		// Start watching characters that were just loaded
+		if hr.modTimes[pn] == nil || hr.defs[pn] != sys.cgi[pn].def {
+			hr.defs[pn], hr.modTimes[pn] = sys.cgi[pn].def, hotReloadFiles(pn)
+			continue
+		}
+		var states, anims bool
+		for f, t := range hr.modTimes[pn] {
+			// Editors may remove a file while saving it, so missing files are skipped
+			if fi, err := os.Stat(f); err != nil || fi.ModTime().Equal(t) {
+				continue
+			}
+			if f == sys.cgi[pn].animTable.filename {
+				anims = true
+			} else {
+				states = true
+			}
+		}
+		if states {
+			hr.reloadStates(pn)
+		}
+		if anims {
+			hr.reloadAnims(pn)
+		}
+		// A failed reload is not retried until the files are saved again
+		if states || anims {
+			hr.modTimes[pn] = hotReloadFiles(pn)
+		}
+	}
+}
+
+func (hr *HotReload) reloadError(pn int, what string, err error) {
+	sys.appendToConsole(fmt.Sprintf("%v: failed to reload %v", sys.cgi[pn].displayname, what))
+	for _, line := range strings.Split(err.Error(), "\n") {
+		sys.appendToConsole(line)
+	}
+	LogMessage("Hot reload of %v failed: %v", sys.cgi[pn].def, err)
+}
+
+// Rereads the constants of a character from its common constant and cns
+// files, as Char.load does. Returns a function that restores the previous
+// ones, for when the reload fails
+func (hr *HotReload) reloadConstants(pn int) (func(), error) {
+	gi := &sys.cgi[pn]
+	root := sys.chars[pn][0]
+	data, attackBase, defenceBase := gi.data, gi.attackBase, gi.defenceBase
+	velocity, movement, size := gi.velocity, gi.movement, root.size
+	constants, remapPreset, quotes, cnsFile := gi.constants, gi.remapPreset, gi.quotes, gi.cnsFile
+	lifeMax, powerMax := root.lifeMax, root.powerMax
+	dizzyPointsMax, guardPointsMax := root.dizzyPointsMax, root.guardPointsMax
+	restore := func() {
+		gi.data, gi.attackBase, gi.defenceBase = data, attackBase, defenceBase
+		gi.velocity, gi.movement, root.size = velocity, movement, size
+		gi.constants, gi.remapPreset, gi.quotes, gi.cnsFile = constants, remapPreset, quotes, cnsFile
+		root.lifeMax, root.powerMax = lifeMax, powerMax
+		root.dizzyPointsMax, root.guardPointsMax = dizzyPointsMax, guardPointsMax
+	}
+
+	str, err := LoadText(gi.def)
+	if err == nil {
+		var cns string
+		for _, is := range charDefFiles(SplitAndTrim(str, "\n")) {
+			cns = decodeShiftJIS(is["cns"])
+		}
+		root.initConstants()
+		if err = gi.loadCommonConstants(); err == nil {
+			err = root.loadCns(cns)
+		}
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// Recompiles the constants, states and commands of a character
+func (hr *HotReload) reloadStates(pn int) {
+	gi := &sys.cgi[pn]
+	root := sys.chars[pn][0]
+	restoreConstants, err := hr.reloadConstants(pn)
+	if err != nil {
+		hr.reloadError(pn, "constants", err)
+		return
+	}
+	// Compile adds the commands to the root's lists and rebuilds the string
+	// pool, so the old ones are restored if it fails
+	oldCmd, oldPool := root.cmd, sys.stringPool[pn]
+	oldFlagCount := gi.hitPauseToggleFlagCount
+	oldMugenver, oldIkemenver := gi.mugenver, gi.ikemenver
+	if len(oldCmd) > pn {
+		root.cmd = append([]CommandList(nil), oldCmd...)
+		root.cmd[pn] = *NewCommandList(oldCmd[pn].Buffer)
+	}
+	states, err := newCompiler().Compile(pn, gi.def, gi.constants)
+	if err != nil {
+		restoreConstants()
+		root.cmd, sys.stringPool[pn] = oldCmd, oldPool
+		gi.hitPauseToggleFlagCount = oldFlagCount
+		gi.mugenver, gi.ikemenver = oldMugenver, oldIkemenver
+		hr.reloadError(pn, "states", err)
+		return
+	}
+	gi.states = states
+	sys.debugConsole.recompile()
+
+	for _, p := range sys.chars {
+		for _, c := range p {
+			// Helpers without keyctrl share the root's command lists, while
+			// other characters have copies of them
+			if c != root && len(c.cmd) > pn {
+				if len(oldCmd) > 0 && &c.cmd[0] == &oldCmd[0] {
+					c.cmd = root.cmd
+				} else {
+					c.cmd[pn].CopyList(root.cmd[pn])
+				}
+			}
+			if f := c.ss.hitPauseExecutionToggleFlags[pn]; len(f) < int(gi.hitPauseToggleFlagCount) {
+				c.ss.hitPauseExecutionToggleFlags[pn] = append(f, make([]bool, int(gi.hitPauseToggleFlagCount)-len(f))...)
+			}
+			// Swap the code of the current state. If it was removed, the old
+			// code keeps running until the character changes state
+			if c.ss.sb.playerNo != pn {
+				continue
+			}
+			sb, ok := states[c.ss.no]
+			if !ok {
+				continue
+			}
+			// Persistent counters and typed locals are kept if the state has
+			// as many as before
+			if len(sb.ctrlsps) == len(c.ss.sb.ctrlsps) {
+				sb.ctrlsps = c.ss.sb.ctrlsps
+			} else {
+				sb.ctrlsps = make([]int32, len(sb.ctrlsps))
+			}
+			if len(sb.locals) == len(c.ss.sb.locals) {
+				sb.locals = c.ss.sb.locals
+			} else {
+				sb.locals = append([]BytecodeValue(nil), sb.locals...)
+			}
+			c.ss.sb = sb
+		}
+	}
+	sys.appendToConsole(fmt.Sprintf("%v: constants, states and commands reloaded", gi.displayname))
+}
+
+// Rereads the animations of a character
+func (hr *HotReload) reloadAnims(pn int) {
+	gi := &sys.cgi[pn]
+	at, err := gi.readAnimations(gi.def, gi.animTable.filename)
+	if err != nil {
+		hr.reloadError(pn, "animations", err)
+		return
+	}
+	gi.animTable = at
+
+	// Characters playing one of these animations switch to the new version,
+	// from the same element and time
+	for _, p := range sys.chars {
+		for _, c := range p {
+			if c.animPN != pn || c.anim == nil {
+				continue
+			}
+			elem, elemtime, prevAnimNo := c.anim.curelem+1, c.anim.curelemtime, c.prevAnimNo
+			c.changeAnimEx(c.animNo, c.animPN, c.spritePN, "")
+			c.prevAnimNo = prevAnimNo
+			c.anim.SetAnimElem(elem, elemtime)
+			c.updateCurFrame()
+		}
+	}
+	sys.appendToConsole(fmt.Sprintf("%v: animations reloaded", gi.displayname))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"image"
@@ -10,7 +11,9 @@ import (
 	"math"
 	"os"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -552,9 +555,8 @@ func readActPalette(filename string) ([]uint32, error) {
 	return pal, nil
 }
 
-// Loads a char's selectable palettes for the motif/scripts
-// Used by things like palette selection and Turns faces colors
-func loadCharPalettes(sff *Sff, filename string, ref int) error {
+// Reads the selectable palettes, group 1, of an SFF v2
+func loadSffCharPalettes(sff *Sff, filename string, maxPal int) error {
 	f, err := OpenFile(filename)
 	if err != nil {
 		return err
@@ -568,8 +570,6 @@ func loadCharPalettes(sff *Sff, filename string, ref int) error {
 	if err := h.Read(f, &lofs, &tofs); err != nil {
 		return err
 	}
-	maxPal := int(sys.cfg.Config.PaletteMax)
-	c := sys.sel.charlist[ref]
 
 	// SFF v2
 	uniquePals := make(map[[2]uint16]int)
@@ -636,6 +636,24 @@ func loadCharPalettes(sff *Sff, filename string, ref int) error {
 			sff.palList.numcols[[2]uint16{gn_[0], gn_[1]}] = int(gn_[2])
 		}
 	}
+	return nil
+}
+
+// Loads a char's selectable palettes for the motif/scripts
+// Used by things like palette selection and Turns faces colors
+func loadCharPalettes(sff *Sff, filename string, ref int) error {
+	maxPal := int(sys.cfg.Config.PaletteMax)
+	c := sys.sel.charlist[ref]
+
+	var err error
+	if manifest, ok := sffManifestPath(filename); ok {
+		err = loadFolderCharPalettes(sff, manifest, maxPal)
+	} else {
+		err = loadSffCharPalettes(sff, filename, maxPal)
+	}
+	if err != nil {
+		return err
+	}
 
 	// SFFv1 and Act Overrides
 	// TODO: External .ACTs on SFFv2 without palette slots may cause color bleeding,
@@ -684,6 +702,8 @@ type Sprite struct {
 	coldepth byte
 	paltemp  []uint32
 	PalTex   Texture
+	uv       [4]float32   // Rect of Tex the sprite is in when packed, zero if Tex is its own
+	atlas    *SpriteAtlas // Where the pixels go when they're set, nil for a texture of its own
 }
 
 func (s *Sprite) isBlank() bool {
@@ -759,7 +779,7 @@ func newSprite() *Sprite {
 						return nil, err
 					}
 				case 2:
-					if err := s.readV2(f, int64(xofs), size); err != nil {
+					if err := s.readV2(f, int64(xofs), size, nil); err != nil {
 						return nil, err
 					}
 				}
@@ -834,7 +854,7 @@ func (s *Sprite) shareCopy(src *Sprite) {
 	// We must defer copying the texture during the main thread
 	// Otherwise we can end up copying a nil texture over the good one or other race condition bugs
 	sys.mainThreadTask <- func() {
-		s.Tex = src.Tex
+		s.Tex, s.uv = src.Tex, src.uv
 	}
 
 	//s.paltemp = src.paltemp
@@ -885,6 +905,9 @@ func (s *Sprite) SetPxl(px []byte) {
 		return
 	}
 	sys.mainThreadTask <- func() {
+		if s.atlas.add(s, px, int32(s.Size[0]), int32(s.Size[1]), 8, false) {
+			return
+		}
 		s.Tex = gfx.newTexture(int32(s.Size[0]), int32(s.Size[1]), 8, false)
 		s.Tex.SetData(px)
 	}
@@ -892,11 +915,61 @@ func (s *Sprite) SetPxl(px []byte) {
 
 func (s *Sprite) SetRaw(data []byte, sprWidth int32, sprHeight int32, sprDepth int32) {
 	sys.mainThreadTask <- func() {
+		if s.atlas.add(s, data, sprWidth, sprHeight, sprDepth, sys.cfg.Video.RGBSpriteBilinearFilter) {
+			return
+		}
 		s.Tex = gfx.newTexture(sprWidth, sprHeight, sprDepth, sys.cfg.Video.RGBSpriteBilinearFilter)
 		s.Tex.SetData(data)
 	}
 }
 
+// Size of the textures sprites are packed into, and of the largest sprites
+// packed. Bigger ones, like most stage backgrounds, keep their own texture
+const (
+	spriteAtlasSize      = 2048
+	spriteAtlasMaxSprite = 512
+)
+
+// Shared textures the sprites of an SFF are packed into, when
+// Video.SpriteAtlas is enabled. Sprites drawn from the same page don't need
+// a texture bind between them
+type SpriteAtlas struct {
+	pages map[int32][]*TextureAtlas // By color depth
+}
+
+func newSpriteAtlas() *SpriteAtlas {
+	if !sys.cfg.Video.SpriteAtlas {
+		return nil
+	}
+	return &SpriteAtlas{pages: make(map[int32][]*TextureAtlas)}
+}
+
+// Packs the pixels of a sprite into a page, adding one if none has room.
+// Returns false if the sprite needs a texture of its own. Filtered sprites
+// would sample their neighbors at the edges, so they're never packed.
+// Must run on the main thread
+func (sa *SpriteAtlas) add(s *Sprite, data []byte, width, height, depth int32, filter bool) bool {
+	if sa == nil || filter || width <= 0 || height <= 0 ||
+		width > spriteAtlasMaxSprite || height > spriteAtlasMaxSprite {
+		return false
+	}
+	for _, ta := range sa.pages[depth] {
+		if uv, ok := ta.AddImage(width, height, 0, data); ok {
+			s.Tex, s.uv = ta.texture, uv
+			return true
+		}
+	}
+	ta := CreateTextureAtlas(spriteAtlasSize, spriteAtlasSize, depth, false)
+	// The space around sprites must be transparent
+	ta.texture.SetData(make([]byte, spriteAtlasSize*spriteAtlasSize*Max(depth, 8)/8))
+	sa.pages[depth] = append(sa.pages[depth], ta)
+	uv, ok := ta.AddImage(width, height, 0, data)
+	if ok {
+		s.Tex, s.uv = ta.texture, uv
+	}
+	return ok
+}
+
 func (s *Sprite) readHeader(r io.Reader, ofs, size *uint32, link *uint16) error {
 	read := func(x interface{}) error {
 		return binary.Read(r, binary.LittleEndian, x)
@@ -1279,9 +1352,10 @@ func (s *Sprite) Lz5Decode(rle []byte) (p []byte) {
 	return
 }
 
-func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
+// Reads the data of a v2 sprite. If dec isn't nil, it's decoded there,
+// otherwise right away
+func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32, dec *spriteDecoder) error {
 	var px []byte
-	var isRaw bool = false
 
 	if s.rle > 0 {
 		return nil
@@ -1291,6 +1365,31 @@ func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
 		px = make([]uint8, datasize)
 		binary.Read(f, binary.LittleEndian, px)
 
+	} else {
+		f.Seek(offset+4, 0)
+		if datasize < 4 {
+			datasize = 4
+		}
+		px = make([]byte, datasize-4)
+		if err := binary.Read(f, binary.LittleEndian, px); err != nil {
+			return err
+		}
+	}
+
+	if dec != nil {
+		dec.decode(func() error {
+			return s.decodeV2(px)
+		})
+		return nil
+	}
+	return s.decodeV2(px)
+}
+
+// Decodes the data read by readV2 and uploads the pixels
+func (s *Sprite) decodeV2(px []byte) error {
+	var isRaw bool = false
+
+	if s.rle == 0 {
 		switch s.coldepth {
 		case 8:
 			// Do nothing, px is already in the expected format
@@ -1302,23 +1401,11 @@ func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
 		}
 
 	} else {
-		f.Seek(offset+4, 0)
 		format := -s.rle
 
 		var rgba *image.RGBA
 		var rect image.Rectangle
 
-		if 2 <= format && format <= 4 {
-			if datasize < 4 {
-				datasize = 4
-			}
-			px = make([]byte, datasize-4)
-			if err := binary.Read(f, binary.LittleEndian, px); err != nil {
-				panic(err)
-				//return err
-			}
-		}
-
 		switch format {
 		case 2:
 			px = s.Rle8Decode(px)
@@ -1327,7 +1414,7 @@ func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
 		case 4:
 			px = s.Lz5Decode(px)
 		case 10:
-			img, err := png.Decode(f)
+			img, err := png.Decode(bytes.NewReader(px))
 			if err != nil {
 				return err
 			}
@@ -1340,7 +1427,7 @@ func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
 			isRaw = true
 
 			// Decode PNG image to RGBA
-			img, err := png.Decode(f)
+			img, err := png.Decode(bytes.NewReader(px))
 			if err != nil {
 				return err
 			}
@@ -1364,6 +1451,69 @@ func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) error {
 	return nil
 }
 
+// Pool of goroutines decoding the sprites of an SFF, while the file is read
+// on the loading one. Decoded sprites still go to the main thread to be
+// uploaded, through sys.mainThreadTask, in whatever order they finish. When
+// loading on the main thread, the tasks are run after each sprite read and
+// during wait, so the channel only holds the uploads of the few queued jobs,
+// and the workers never block on it while the main thread blocks on them
+type spriteDecoder struct {
+	jobs  chan func() error
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	err   error
+	asset *LoadAsset // Counts the decoded sprites
+}
+
+func newSpriteDecoder(asset *LoadAsset) *spriteDecoder {
+	n := runtime.NumCPU()
+	d := &spriteDecoder{jobs: make(chan func() error, n*2), asset: asset}
+	d.wg.Add(n)
+	for i := 0; i < n; i++ {
+		SafeGo(func() {
+			defer d.wg.Done()
+			for job := range d.jobs {
+				if err := job(); err != nil {
+					d.mu.Lock()
+					if d.err == nil {
+						d.err = err
+					}
+					d.mu.Unlock()
+				}
+				d.asset.add(1)
+			}
+		})
+	}
+	return d
+}
+
+// Queues a sprite, waiting while all the workers are busy
+func (d *spriteDecoder) decode(job func() error) {
+	d.jobs <- job
+}
+
+// Waits for the queued sprites. On the main thread, their uploads are run
+// meanwhile, since the workers may be waiting for room to send them.
+// Returns the first error
+func (d *spriteDecoder) wait(isMainThread bool) error {
+	close(d.jobs)
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	for isMainThread {
+		select {
+		case <-done:
+			isMainThread = false
+		case f := <-sys.mainThreadTask:
+			f()
+		}
+	}
+	<-done
+	return d.err
+}
+
 // Update the cached palette for the sprite then return it
 // Next time the sprite is drawn, it will only need a new texture if the reference changed
 // This should always be called when updating a PalTex
@@ -1385,6 +1535,8 @@ func (s *Sprite) CachePalTex(pal []uint32) Texture {
 		if s.PalTex == nil {
 			s.PalTex = NewTextureFromPalette(pal)
 		} else {
+			// Sprites waiting in a batch must still be drawn with the old colors
+			spriteBatch.flush()
 			s.PalTex.SetData(Pal32ToBytes(pal))
 		}
 		// Update cache reference for the next comparison
@@ -1414,6 +1566,7 @@ func (s *Sprite) Draw(x, y, xscale, yscale float32, rxadd float32, rot Rotation,
 	rp := RenderParams{
 		tex:            s.Tex,
 		paltex:         s.PalTex,
+		uv:             s.uv,
 		size:           s.Size,
 		x:              -x * sys.widthScale,
 		y:              -y * sys.heightScale,
@@ -1539,6 +1692,7 @@ type Sff struct {
 	palList      PaletteList
 	filename     string
 	debugMissing map[[2]uint16]bool // Sprites not found by animations
+	atlas        *SpriteAtlas       // Textures the sprites are packed into, nil if they aren't
 }
 
 func newSff() (s *Sff) {
@@ -1596,15 +1750,33 @@ func findActiveSff(filename string) *Sff {
 	return nil
 }
 
+// Sets palette i of an SFF v2, with the colors of palette idx
+func (s *Sff) setPalette(i, idx int, gn [3]uint16, pal []uint32) {
+	s.palList.SetSource(i, pal)
+	s.palList.PalTable[[...]uint16{gn[0], gn[1]}] = idx
+	// Number of colors as specified in the SFF
+	// We'll use a length check later instead because that's more reliable
+	s.palList.numcols[[...]uint16{gn[0], gn[1]}] = int(gn[2])
+	if i <= sys.cfg.Config.PaletteMax &&
+		s.palList.PalTable[[...]uint16{1, uint16(i + 1)}] == s.palList.PalTable[[...]uint16{gn[0], gn[1]}] &&
+		gn[0] != 1 && gn[1] != uint16(i+1) {
+		s.palList.PalTable[[...]uint16{1, uint16(i + 1)}] = -1
+	}
+}
+
 // Loads the full SFF file
 func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff, error) {
 	// Borrow an existing SFF if possible
 	if s := findActiveSff(filename); s != nil {
 		return s, nil
 	}
+	if manifest, ok := sffManifestPath(filename); ok {
+		return loadSffFolder(filename, manifest, isMainThread)
+	}
 
 	s := newSff()
 	s.filename = filename
+	s.atlas = newSpriteAtlas()
 
 	f, err := OpenFile(filename)
 	if err != nil {
@@ -1619,6 +1791,7 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 	if err := s.header.Read(f, &lofs, &tofs); err != nil {
 		return nil, err
 	}
+	asset := trackLoad("sff", filename, int64(s.header.NumberOfSprites))
 
 	read := func(x interface{}) error {
 		return binary.Read(f, binary.LittleEndian, x)
@@ -1663,25 +1836,32 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 				idx = i
 			}
 			uniquePals[[2]uint16{gn_[0], gn_[1]}] = idx
-			s.palList.SetSource(i, pal)
-			s.palList.PalTable[[...]uint16{gn_[0], gn_[1]}] = idx
-			// Number of colors as specified in the SFF
-			// We'll use a length check later instead because that's more reliable
-			s.palList.numcols[[...]uint16{gn_[0], gn_[1]}] = int(gn_[2])
-			if i <= sys.cfg.Config.PaletteMax &&
-				s.palList.PalTable[[...]uint16{1, uint16(i + 1)}] == s.palList.PalTable[[...]uint16{gn_[0], gn_[1]}] &&
-				gn_[0] != 1 && gn_[1] != uint16(i+1) {
-				s.palList.PalTable[[...]uint16{1, uint16(i + 1)}] = -1
-			}
+			s.setPalette(i, idx, gn_, pal)
 		}
 	}
 	// Load sprites
+	// SFFv2 sprites are decoded by a pool of workers. Linked sprites must wait
+	// for them, so that they don't copy a texture that isn't there yet. Once
+	// wait returns, every upload has been queued, and the texture copies
+	// queued after them by shareCopy run later on the same channel
 	spriteList := make([]*Sprite, int(s.header.NumberOfSprites))
 	var prev *Sprite
+	var dec *spriteDecoder
+	var links [][2]int
+	if s.header.Version[0] == 2 {
+		dec = newSpriteDecoder(asset)
+		// Stop the workers if reading fails
+		defer func() {
+			if dec != nil {
+				dec.wait(isMainThread)
+			}
+		}()
+	}
 	shofs := int64(s.header.FirstSpriteHeaderOffset)
 	for i := 0; i < len(spriteList); i++ {
 		f.Seek(shofs, 0)
 		spriteList[i] = newSprite()
+		spriteList[i].atlas = s.atlas
 		var xofs, size uint32
 		var indexOfPrevious uint16
 		switch s.header.Version[0] {
@@ -1698,14 +1878,11 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 		}
 		if size == 0 {
 			if int(indexOfPrevious) < i {
-				dst, src := spriteList[i], spriteList[int(indexOfPrevious)]
-				// Moved to shareCopy() itself
-				//sys.mainThreadTask <- func() {
-				dst.shareCopy(src)
-				//}
+				links = append(links, [2]int{i, int(indexOfPrevious)})
 			} else {
 				spriteList[i].palidx = 0 // index out of range
 			}
+			asset.add(1)
 		} else {
 			switch s.header.Version[0] {
 			case 1:
@@ -1719,8 +1896,9 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 						spriteList[i].palidx = 0
 					}
 				}
+				asset.add(1)
 			case 2:
-				if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
+				if err := spriteList[i].readV2(f, int64(xofs), size, dec); err != nil {
 					return nil, err
 				}
 			}
@@ -1740,6 +1918,23 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 			sys.runMainThreadTask()
 		}
 	}
+	if dec != nil {
+		err := dec.wait(isMainThread)
+		dec = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range links {
+		// Moved to shareCopy() itself
+		//sys.mainThreadTask <- func() {
+		spriteList[l[0]].shareCopy(spriteList[l[1]])
+		//}
+	}
+	if isMainThread {
+		sys.runMainThreadTask()
+	}
+	asset.finish()
 
 	/*
 		SffCache[filename] = &SffCacheEntry{*s, 1}
@@ -1758,6 +1953,9 @@ func loadSff(filename string, char bool, isMainThread bool, isActPal bool) (*Sff
 
 // Loads a SFF with only specific sprites
 func preloadSff(filename string, char bool, preloadSpr map[[2]uint16]bool) (*Sff, []int32, error) {
+	if manifest, ok := sffManifestPath(filename); ok {
+		return preloadSffFolder(filename, manifest, char, preloadSpr)
+	}
 	sff := newSff()
 
 	f, err := OpenFile(filename)
@@ -1894,7 +2092,7 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]uint16]bool) (*Sff
 							err = spriteList[base].read(
 								f, h, headerShofs32[base], bsize, bxofs, prev, pl)
 						case 2:
-							err = spriteList[base].readV2(f, int64(bxofs), bsize)
+							err = spriteList[base].readV2(f, int64(bxofs), bsize, nil)
 						}
 						if err != nil {
 							return nil, nil, err
@@ -1914,7 +2112,7 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]uint16]bool) (*Sff
 						return nil, nil, err
 					}
 				case 2:
-					if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
+					if err := spriteList[i].readV2(f, int64(xofs), size, nil); err != nil {
 						return nil, nil, err
 					}
 				}
@@ -2044,18 +2242,10 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]uint16]bool) (*Sff
 	return sff, selPal, nil
 }
 
-// Read SFFv2 palettes
-func (s *Sff) ReadPalette(f io.ReadSeeker, offset int64, size uint32) ([]uint32, error) {
-	if _, err := f.Seek(offset, io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	// Check how many colors are actually in the palette
-	rawCount := int(size) / 4
-
-	// Calculate necessary color depth in powers of 2 (optional)
+// Number of colors allocated for a palette, in powers of 2 from 16 to 256
+func paletteDepth(numColors int) int {
 	depth := 1
-	for depth < rawCount {
+	for depth < numColors {
 		depth *= 2
 	}
 
@@ -2066,10 +2256,21 @@ func (s *Sff) ReadPalette(f io.ReadSeeker, offset int64, size uint32) ([]uint32,
 	if depth > 256 {
 		depth = 256
 	}
+	return depth
+}
+
+// Read SFFv2 palettes
+func (s *Sff) ReadPalette(f io.ReadSeeker, offset int64, size uint32) ([]uint32, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Check how many colors are actually in the palette
+	rawCount := int(size) / 4
 
 	// Allocate only what we need
 	// Previously Ikemen always allocated 256 colors, but because of RemapPal we must respect the original color count
-	pal := make([]uint32, depth)
+	pal := make([]uint32, paletteDepth(rawCount))
 
 	// Read the actual data
 	// Loop through the entire allocated palette, not just the colors found in the file
@@ -2123,6 +2324,7 @@ func captureScreen() {
 	width, height := sys.window.GetSize()
 	pixdata := make([]uint8, 4*width*height)
 	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	spriteBatch.flush()
 	gfx.ReadPixels(pixdata, width, height)
 	for i := 0; i < 4*width*height; i++ {
 		j := i
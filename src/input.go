@@ -128,6 +128,11 @@ func OnKeyPressed(key Key, mk ModifierKey) {
 			return
 		}
 		sys.keyState[key] = true
+		// Keys without Ctrl or Alt go to the open debug console, other hotkeys still work
+		if sys.debugConsole.active && (mk&ModCtrlAlt) == 0 {
+			sys.debugConsole.keyPressed(key)
+			return
+		}
 		sys.keyInput = key
 		sys.esc = sys.esc ||
 			key == KeyEscape && (mk&ModCtrlAlt) == 0
@@ -160,6 +165,10 @@ func OnKeyPressed(key Key, mk ModifierKey) {
 }
 
 func OnTextEntered(s string) {
+	if sys.debugConsole.active {
+		sys.debugConsole.input += s
+		return
+	}
 	sys.keyString = s
 }
 
@@ -167,8 +176,9 @@ func OnTextEntered(s string) {
 func GetKeyboardState(kc KeyConfig) [14]bool {
 	var out [14]bool
 
-	// If this config is for a joystick, return no input
-	if kc.Joy >= 0 {
+	// If this config is for a joystick, or the keys are typed into the debug
+	// console, return no input
+	if kc.Joy >= 0 || sys.debugConsole.active {
 		return out
 	}
 
@@ -2621,6 +2631,8 @@ func (cl *CommandList) InputUpdate(char *Char, controller int) bool {
 				char.analogAxes = [6]float32{0, 0, 0, 0, 0, 0}
 			}
 		}
+	} else if sys.scenario != nil && char != nil {
+		buttons = sys.scenario.buttons(char)
 	} else if sys.replayFile != nil {
 		buttons = sys.replayFile.readReplayInput(controller)
 		rawAxes := sys.replayFile.readReplayInputAnalog(controller)
@@ -29,6 +29,9 @@ const (
 	KeyUnknown    = sdl.K_UNKNOWN
 	KeyEscape     = sdl.K_ESCAPE
 	KeyEnter      = sdl.K_RETURN
+	KeyBackspace  = sdl.K_BACKSPACE
+	KeyUp         = sdl.K_UP
+	KeyDown       = sdl.K_DOWN
 	KeyInsert     = sdl.K_INSERT
 	KeyF5         = sdl.K_F5
 	KeyF12        = sdl.K_F12
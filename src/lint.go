@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Linting (-lint <char.def>) runs the whole character compiler without a
+// window: .cmd commands, every state file (CNS and ZSS) and the .air file.
+// Unlike a character load, errors don't stop it. Each error is reported and
+// compilation resumes at the next sctrl or section. Once everything is
+// compiled, the states are checked for ChangeState style targets that don't
+// exist and for states that nothing can change to.
+//
+// Reports are printed as text (file:line:column: severity: message) or as
+// JSON with -lintformat json. The exit code is 1 if there are errors, so it
+// can be used in pre-commit hooks.
+
+const (
+	lintExitOK     = 0
+	lintExitErrors = 1
+	lintExitFailed = 2
+
+	lintSevError   = "error"
+	lintSevWarning = "warning"
+)
+
+type LintMessage struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+type lintLocation struct {
+	file   string
+	line   int
+	common bool
+}
+
+type LintReport struct {
+	Def      string        `json:"def"`
+	Errors   int           `json:"errors"`
+	Warnings int           `json:"warnings"`
+	Messages []LintMessage `json:"messages"`
+	// Compilation state
+	file    string // State file being compiled
+	common  bool   // Compiling common states
+	states  map[int32]lintLocation
+	targets map[int32][]lintTarget
+	funcs   map[string]lintLocation
+	calls   map[string][]lintLocation
+}
+
+type lintTarget struct {
+	lintLocation
+	sctrl string
+}
+
+func newLintReport(def string) *LintReport {
+	return &LintReport{
+		Def:      def,
+		Messages: []LintMessage{},
+		states:   make(map[int32]lintLocation),
+		targets:  make(map[int32][]lintTarget),
+		funcs:    make(map[string]lintLocation),
+		calls:    make(map[string][]lintLocation),
+	}
+}
+
+func (lr *LintReport) add(file string, line, col int, severity, code, msg string) {
+	lr.Messages = append(lr.Messages, LintMessage{File: file, Line: line, Column: col,
+		Severity: severity, Code: code, Message: msg})
+	if severity == lintSevError {
+		lr.Errors++
+	} else {
+		lr.Warnings++
+	}
+}
+
+// Adds an error returned by the compiler, classifying the usual ones
+func (lr *LintReport) compileError(err error, severity string) {
+	var ce compileError
+	if !errors.As(err, &ce) {
+		ce = compileError{file: lr.file, err: err}
+	}
+	// Parameter errors are prefixed with the parameter data, the actual
+	// error is on the last line
+	lines := SplitAndTrim(ce.err.Error(), "\n")
+	msg := lines[len(lines)-1]
+	code := "compile"
+	if i := strings.Index(msg, "Invalid data: "); i >= 0 {
+		if tok := msg[i+len("Invalid data: "):]; lintIsName(tok) {
+			code = "unknown-trigger"
+			msg = msg[:i] + "Unknown trigger: " + tok
+		}
+	} else if strings.HasPrefix(msg, "Invalid state controller: ") {
+		code = "unknown-sctrl"
+	} else if strings.Contains(msg, " is not defined") {
+		code = "undefined-variable"
+	}
+	lr.add(ce.file, ce.line, ce.col, severity, code, msg)
+}
+
+func lintIsName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return s[0] < '0' || s[0] > '9'
+}
+
+func (lr *LintReport) location(line int) lintLocation {
+	return lintLocation{file: lr.file, line: line, common: lr.common}
+}
+
+func (lr *LintReport) stateDef(no int32, line int) {
+	lr.states[no] = lr.location(line)
+}
+
+func (lr *LintReport) funcDef(name string, line int) {
+	lr.funcs[name] = lr.location(line)
+}
+
+func (lr *LintReport) funcCall(name string, line int) {
+	lr.calls[name] = append(lr.calls[name], lr.location(line))
+}
+
+// Collects the states a controller changes to, when they are constant
+func (lr *LintReport) controller(sctrl StateController, line int) {
+	add := func(name string, v int32) {
+		lr.targets[v] = append(lr.targets[v], lintTarget{lr.location(line), name})
+	}
+	switch sc := sctrl.(type) {
+	case changeState:
+		lintChangeState(StateControllerBase(sc), "ChangeState", add)
+	case selfState:
+		lintChangeState(StateControllerBase(sc), "SelfState", add)
+	case targetState:
+		lintParams(StateControllerBase(sc), func(id byte, exp []BytecodeExp) {
+			if v, ok := lintConstInt(exp); ok && id == targetState_value {
+				add("TargetState", v)
+			}
+		})
+	case helper:
+		redirected, v, ok := false, int32(0), false
+		lintParams(StateControllerBase(sc), func(id byte, exp []BytecodeExp) {
+			switch id {
+			case helper_redirectid:
+				redirected = true
+			case helper_stateno:
+				v, ok = lintConstInt(exp)
+			}
+		})
+		if ok && !redirected {
+			add("Helper", v)
+		}
+	case hitOverride:
+		lintParams(StateControllerBase(sc), func(id byte, exp []BytecodeExp) {
+			if v, ok := lintConstInt(exp); ok && id == hitOverride_stateno {
+				add("HitOverride", v)
+			}
+		})
+	case hitDef:
+		lintHitDef(StateControllerBase(sc), "HitDef", hitDef_redirectid, add)
+	case reversalDef:
+		lintHitDef(StateControllerBase(sc), "ReversalDef", reversalDef_redirectid, add)
+	}
+}
+
+func lintChangeState(scb StateControllerBase, name string, add func(string, int32)) {
+	other, v, ok := false, int32(0), false
+	lintParams(scb, func(id byte, exp []BytecodeExp) {
+		switch id {
+		case changeState_redirectid, changeState_readplayerid:
+			other = true
+		case changeState_value:
+			v, ok = lintConstInt(exp)
+		}
+	})
+	// States of other players can't be checked
+	if ok && !other {
+		add(name, v)
+	}
+}
+
+func lintHitDef(scb StateControllerBase, name string, redirectid byte, add func(string, int32)) {
+	redirected := false
+	var nos []int32
+	lintParams(scb, func(id byte, exp []BytecodeExp) {
+		switch id {
+		case redirectid:
+			redirected = true
+		case hitDef_p1stateno, hitDef_p2stateno:
+			if v, ok := lintConstInt(exp); ok {
+				nos = append(nos, v)
+			}
+		}
+	})
+	if !redirected {
+		for _, v := range nos {
+			add(name, v)
+		}
+	}
+}
+
+// Same layout as StateControllerBase.run, without a character to run on
+func lintParams(scb StateControllerBase, f func(id byte, exp []BytecodeExp)) {
+	for i := 0; i+1 < len(scb); {
+		id, n := scb[i], int(scb[i+1])
+		i += 2
+		exp := make([]BytecodeExp, n)
+		for m := 0; m < n; m++ {
+			l := int(*(*int32)(unsafe.Pointer(&scb[i])))
+			i += 4
+			exp[m] = (*(*BytecodeExp)(unsafe.Pointer(&scb)))[i : i+l]
+			i += l
+		}
+		f(id, exp)
+	}
+}
+
+// Returns the value of a parameter that is a single integer constant
+func lintConstInt(exp []BytecodeExp) (int32, bool) {
+	if len(exp) == 0 {
+		return 0, false
+	}
+	be := exp[0]
+	switch {
+	case len(be) == 2 && be[0] == OC_int8:
+		return int32(int8(be[1])), true
+	case len(be) == 5 && be[0] == OC_int:
+		i := 1
+		return be.ReadIntAt(&i), true
+	}
+	return 0, false
+}
+
+// States the engine changes to by itself, which don't need a ChangeState
+func lintEngineState(no int32) bool {
+	return no < 200 || no >= 5000 && no < 6000
+}
+
+// Checks the compiled states and functions as a whole
+func (lr *LintReport) checkStates(states map[int32]StateBytecode, funcs map[string]bytecodeFunction, funcUsed map[string]bool) {
+	for _, no := range SortedKeysI32(lr.targets) {
+		if _, ok := states[no]; ok {
+			continue
+		}
+		for _, t := range lr.targets[no] {
+			lr.add(t.file, t.line, 0, lintSevWarning, "missing-state",
+				fmt.Sprintf("%v to state %v, which doesn't exist", t.sctrl, no))
+		}
+	}
+	for _, no := range SortedKeysI32(lr.states) {
+		loc := lr.states[no]
+		if loc.common || lintEngineState(no) || len(lr.targets[no]) > 0 {
+			continue
+		}
+		lr.add(loc.file, loc.line, 0, lintSevWarning, "unused-state",
+			fmt.Sprintf("State %v is never changed to with a constant state number", no))
+	}
+	for _, name := range SortedKeys(lr.calls) {
+		if _, ok := funcs[name]; ok {
+			continue
+		}
+		for _, loc := range lr.calls[name] {
+			lr.add(loc.file, loc.line, 0, lintSevError, "undefined-function",
+				"Call of undefined function: "+name)
+		}
+	}
+	for _, name := range SortedKeys(lr.funcs) {
+		if loc := lr.funcs[name]; !loc.common && !funcUsed[name] {
+			lr.add(loc.file, loc.line, 0, lintSevWarning, "unused-function",
+				"Function is never called: "+name)
+		}
+	}
+}
+
+// Checks an .air file. ReadAnimationTable keeps going on anything it doesn't
+// understand, so the file is checked line by line first
+func (lr *LintReport) checkAir(filename, str string) {
+	lines := SplitAndTrim(str, "\n")
+	actions := make(map[int32]int)
+	var no int32
+	frames, open := 0, false
+	closeAction := func() {
+		if open && frames == 0 {
+			lr.add(filename, actions[no]+1, 0, lintSevWarning, "empty-action",
+				fmt.Sprintf("Action %v has no frames", no))
+		}
+	}
+	for i, line := range lines {
+		line = strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		if line == "" {
+			continue
+		}
+		if name, sub := SectionName(line); name != "" {
+			closeAction()
+			open = false
+			if name != "begin " || !strings.HasPrefix(strings.ToLower(sub), "action ") {
+				continue
+			}
+			n64, err := strconv.ParseInt(strings.TrimSpace(sub[7:]), 10, 32)
+			n := int32(n64)
+			if err != nil {
+				lr.add(filename, i+1, 1, lintSevError, "air", "Invalid action number: "+sub[7:])
+				continue
+			}
+			if first, ok := actions[n]; ok {
+				lr.add(filename, i+1, 1, lintSevWarning, "duplicate-action",
+					fmt.Sprintf("Action %v already defined at line %v (ignored)", n, first+1))
+				continue
+			}
+			no, actions[n], frames, open = n, i, 0, true
+			continue
+		}
+		if !open {
+			continue
+		}
+		low := strings.ToLower(line)
+		switch {
+		case strings.HasPrefix(low, "copy action "):
+			if _, err := strconv.ParseInt(strings.TrimSpace(low[12:]), 10, 32); err != nil {
+				lr.add(filename, i+1, 13, lintSevError, "air", "Invalid Copy Action number: "+line[12:])
+			}
+			frames++
+		case strings.HasPrefix(low, "clsn"), strings.HasPrefix(low, "loopstart"),
+			strings.HasPrefix(low, "interpolate "):
+		case ReadAnimFrame(low) != nil:
+			frames++
+		default:
+			lr.add(filename, i+1, 1, lintSevError, "air", "Invalid animation frame: "+line)
+		}
+	}
+	closeAction()
+
+	// Copy Action chains are only resolved by the actual reader
+	i := 0
+	at := ReadAnimationTable(filename, nil, nil, lines, &i, false)
+	for _, n := range SortedKeysI32(actions) {
+		if _, ok := at.anims[n]; !ok {
+			lr.add(filename, actions[n]+1, 0, lintSevWarning, "copy-action",
+				fmt.Sprintf("Copy Action of action %v can't be resolved", n))
+		}
+	}
+}
+
+// Finds the line of parameter name in the section starting at line start.
+// Returns the line index and the column where its value starts
+func findParamLine(lines []string, start, end int, name string) (int, int, bool) {
+	for i := start + 1; i < end && i < len(lines); i++ {
+		line := strings.SplitN(lines[i], ";", 2)[0]
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			break
+		}
+		ia := strings.Index(line, "=")
+		if ia <= 0 || strings.ToLower(strings.TrimSpace(line[:ia])) != name {
+			continue
+		}
+		col := ia + 1
+		for col < len(line) && (line[col] == ' ' || line[col] == '\t') {
+			col++
+		}
+		return i, col + 1, true
+	}
+	return 0, 0, false
+}
+
+// Reports a compile error in lint mode, where compilation carries on after it
+func (c *Compiler) lintError(err error) bool {
+	if c.lint == nil {
+		return false
+	}
+	c.lint.compileError(err, lintSevError)
+	return true
+}
+
+// Reports an error that the compiler ignores for Mugen characters
+func (c *Compiler) lintWarning(err error) {
+	if c.lint != nil {
+		c.lint.compileError(err, lintSevWarning)
+	}
+}
+
+// Skips the rest of the current CNS section
+func (c *Compiler) skipSection() {
+	for c.i+1 < len(c.lines) && !strings.HasPrefix(c.lines[c.i+1], "[") {
+		c.i++
+	}
+}
+
+// Lints a character and prints the report. Returns the process exit code
+func runLint(def, format string) int {
+	if format != "" && format != "text" && format != "json" {
+		fmt.Printf("Invalid -lintformat: %v (text or json)\n", format)
+		return lintExitFailed
+	}
+	lr, err := lintChar(def)
+	if err != nil {
+		fmt.Printf("Lint failed: %v\n", err)
+		return lintExitFailed
+	}
+	if format == "json" {
+		b, _ := json.MarshalIndent(lr, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		for _, m := range lr.Messages {
+			fmt.Printf("%v:%v:%v: %v: %v [%v]\n", m.File, m.Line, m.Column, m.Severity, m.Message, m.Code)
+		}
+		fmt.Printf("%v: %v error(s), %v warning(s)\n", def, lr.Errors, lr.Warnings)
+	}
+	if lr.Errors > 0 {
+		return lintExitErrors
+	}
+	return lintExitOK
+}
+
+// Prepares player 1's global info for compiling a character, without
+// loading any sprites or sounds
+func lintSetup(def string) *CharGlobalInfo {
+	for i := range sys.stringPool {
+		sys.stringPool[i] = *NewStringPool()
+	}
+	c := newChar(0, 0)
+	sys.chars[0] = []*Char{c}
+	gi := &sys.cgi[0]
+	gi.def = def
+	c.initConstants()
+	return gi
+}
+
+// Loads the constants of a character with the same helpers as Char.load:
+// the common constant files, then its cns file. Returns the resolved anim
+// file of the character
+func lintConstants(def string, gi *CharGlobalInfo) (string, error) {
+	str, err := LoadText(def)
+	if err != nil {
+		return "", err
+	}
+	var cns, anim string
+	for _, is := range charDefFiles(SplitAndTrim(str, "\n")) {
+		cns, anim = decodeShiftJIS(is["cns"]), decodeShiftJIS(is["anim"])
+	}
+	if err := gi.loadCommonConstants(); err != nil {
+		return "", err
+	}
+	if err := sys.chars[0][0].loadCns(cns); err != nil {
+		return "", err
+	}
+	if anim != "" {
+		anim = gi.resolveDefPath(anim)
+	}
+	return anim, nil
+}
+
+// Compiles a character's states, commands and animations, collecting every
+// problem found. Only fails if the def file can't be read
+func lintChar(def string) (*LintReport, error) {
+	gi := lintSetup(def)
+	anim, err := lintConstants(def, gi)
+	if err != nil {
+		return nil, err
+	}
+	lr := newLintReport(def)
+
+	comp := newCompiler()
+	comp.lint = lr
+	states, err := comp.Compile(0, def, gi.constants)
+	if err != nil {
+		lr.file = def
+		lr.compileError(err, lintSevError)
+	} else {
+		lr.checkStates(states, comp.funcs, comp.funcUsed)
+	}
+
+	if anim != "" {
+		if err := LoadFile(&anim, charFileDirs(def), func(filename string) error {
+			str, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			lr.checkAir(filename, str)
+			return nil
+		}); err != nil {
+			lr.add(def, 0, 0, lintSevError, "air", err.Error())
+		}
+	}
+
+	sort.SliceStable(lr.Messages, func(i, j int) bool {
+		a, b := lr.Messages[i], lr.Messages[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return lr, nil
+}
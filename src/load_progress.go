@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Progress of a file the loader is reading. Counted in sprites for SFF, and
+// in bytes for SND and models. Safe to update from any goroutine, and a nil
+// asset ignores updates, so that loads outside of the loader need no checks
+type LoadAsset struct {
+	kind     string // "sff", "snd" or "model"
+	filename string
+	done     atomic.Int64
+	total    atomic.Int64
+}
+
+func (a *LoadAsset) add(n int64) {
+	if a != nil {
+		a.done.Add(n)
+	}
+}
+
+func (a *LoadAsset) setTotal(n int64) {
+	if a != nil {
+		a.total.Store(n)
+	}
+}
+
+// Marks the asset as fully read, whatever was counted so far
+func (a *LoadAsset) finish() {
+	if a != nil {
+		a.done.Store(Max(a.total.Load(), a.done.Load()))
+	}
+}
+
+// Reads as done
+func (a *LoadAsset) fraction() float32 {
+	total := a.total.Load()
+	if total <= 0 {
+		return 0
+	}
+	return Min(float32(a.done.Load())/float32(total), 1)
+}
+
+// Files read by the current match load, in the order they were started
+type LoadProgress struct {
+	mu     sync.Mutex
+	assets []*LoadAsset
+}
+
+func (lp *LoadProgress) reset() {
+	lp.mu.Lock()
+	lp.assets = nil
+	lp.mu.Unlock()
+}
+
+func (lp *LoadProgress) add(kind, filename string, total int64) *LoadAsset {
+	a := &LoadAsset{kind: kind, filename: filename}
+	a.total.Store(total)
+	lp.mu.Lock()
+	lp.assets = append(lp.assets, a)
+	lp.mu.Unlock()
+	return a
+}
+
+// Average of the assets read so far. Characters and stages are loaded one
+// after another, so the files of the next ones aren't known in advance
+func (lp *LoadProgress) fraction() float32 {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if len(lp.assets) == 0 {
+		return 0
+	}
+	var sum float32
+	for _, a := range lp.assets {
+		sum += a.fraction()
+	}
+	return sum / float32(len(lp.assets))
+}
+
+// Lua table of the progress, as returned by loadProgress()
+func (lp *LoadProgress) table(l *lua.LState) *lua.LTable {
+	lp.mu.Lock()
+	assets := append([]*LoadAsset{}, lp.assets...)
+	lp.mu.Unlock()
+	tbl := l.NewTable()
+	list := l.NewTable()
+	for i, a := range assets {
+		t := l.NewTable()
+		t.RawSetString("kind", lua.LString(a.kind))
+		t.RawSetString("file", lua.LString(a.filename))
+		t.RawSetString("done", lua.LNumber(a.done.Load()))
+		t.RawSetString("total", lua.LNumber(a.total.Load()))
+		list.RawSetInt(i+1, t)
+	}
+	tbl.RawSetString("progress", lua.LNumber(lp.fraction()))
+	tbl.RawSetString("assets", list)
+	return tbl
+}
+
+// Starts tracking a file, if the loader is loading a match. Returns nil
+// otherwise
+func trackLoad(kind, filename string, total int64) *LoadAsset {
+	if sys.loader.state != LS_Loading {
+		return nil
+	}
+	return sys.loader.progress.add(kind, filename, total)
+}
+
+// Size of a file being read, leaving it where it was
+func loadFileSize(f io.Seeker) int64 {
+	cur, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	f.Seek(cur, io.SeekStart)
+	return size
+}
+
+// Reader that counts the bytes read into an asset
+type loadReader struct {
+	r     io.Reader
+	asset *LoadAsset
+}
+
+func (lr *loadReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.asset.add(int64(n))
+	return n, err
+}
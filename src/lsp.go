@@ -0,0 +1,980 @@
+package main
+
+import (
+	"bufio"
+	_ "embed" // Support for go:embed resources
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Language server (-lsp) for CNS and ZSS state files, spoken over stdin and
+// stdout. Editors start it as "Ikemen_GO -lsp", or as ikemen-lsp when the
+// executable is named so, from the engine's directory, so that common states
+// and data/ files are found like in the game.
+//
+// Diagnostics come from the linter: on every change, the character owning
+// the file (the .def next to it listing the file) is compiled with the
+// editor's unsaved buffers. Hover and completion use the compiler's own
+// trigger and controller tables, and the parameters each controller reads.
+// Definitions and references of state numbers and ZSS functions are found by
+// scanning the character's state files.
+
+//go:embed resources/lspdocs.ini
+var lspDocsIni string
+
+const (
+	lspSevError   = 1
+	lspSevWarning = 2
+
+	lspKindFunction = 3
+	lspKindProperty = 10
+	lspKindKeyword  = 14
+	lspKindClass    = 7
+)
+
+// Parameters holding the number of a state of the character, by controller
+var lspStateParams = map[string][]string{
+	"changestate": {"value"},
+	"selfstate":   {"value"},
+	"targetstate": {"value"},
+	"hitdef":      {"p1stateno", "p2stateno"},
+	"reversaldef": {"p1stateno", "p2stateno"},
+	"helper":      {"stateno"},
+	"hitoverride": {"stateno"},
+}
+
+// Values tried when finding the parameters of a controller
+var lspParamValues = []string{"0", "1", "S", "A", "SCA, NA", "\"a\"", "0, 0", "N"}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspCompletionItem struct {
+	Label         string `json:"label"`
+	Kind          int    `json:"kind"`
+	Detail        string `json:"detail,omitempty"`
+	Documentation string `json:"documentation,omitempty"`
+}
+
+// Location of a name in a file. Columns are byte offsets in the line
+type lspLoc struct {
+	path     string
+	line     int
+	col, end int
+}
+
+// Definitions and references of a character's state files
+type lspIndex struct {
+	states    map[int32]lspLoc
+	funcs     map[string]lspLoc
+	stateRefs map[int32][]lspLoc
+	funcRefs  map[string][]lspLoc
+}
+
+type LSPServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	docs      map[string]string // Open documents by path
+	published map[string][]string
+	comp      *Compiler
+	triggers  map[string]string
+	sctrls    map[string]string
+	params    map[string][]string
+	shutdown  bool
+}
+
+func newLSPServer(in io.Reader, out io.Writer) *LSPServer {
+	s := &LSPServer{
+		in:        bufio.NewReader(in),
+		out:       out,
+		docs:      make(map[string]string),
+		published: make(map[string][]string),
+		comp:      newCompiler(),
+		triggers:  make(map[string]string),
+		sctrls:    make(map[string]string),
+		params:    make(map[string][]string),
+	}
+	lines, i := SplitAndTrim(lspDocsIni, "\n"), 0
+	for i < len(lines) {
+		is, name, _ := ReadIniSection(lines, &i)
+		switch name {
+		case "triggers":
+			s.triggers = is
+		case "controllers":
+			s.sctrls = is
+		}
+	}
+	return s
+}
+
+// Whether the command line runs the language server
+func lspArgs(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if strings.HasPrefix(strings.ToLower(filepath.Base(args[0])), "ikemen-lsp") {
+		return true
+	}
+	for _, a := range args[1:] {
+		if a == "-lsp" {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the language server until the client exits, writing its messages to
+// out. Returns the process exit code
+func runLSP(out *os.File) int {
+	textOverlay = make(map[string]string)
+	lintSetup("")
+	s := newLSPServer(os.Stdin, out)
+	for {
+		body, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				LogMessage("LSP: %v", err)
+			}
+			return 1
+		}
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			LogMessage("LSP: %v", err)
+			continue
+		}
+		if req.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+		s.handle(req)
+	}
+}
+
+func (s *LSPServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, Error("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *LSPServer) write(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		LogMessage("LSP: %v", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(b), b)
+}
+
+func (s *LSPServer) reply(id *json.RawMessage, result interface{}) {
+	s.write(lspResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *LSPServer) handle(req lspRequest) {
+	var pos lspTextDocumentPosition
+	switch req.Method {
+	case "initialize":
+		s.reply(req.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    1, // Full documents
+					"save":      true,
+				},
+				"hoverProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"=", "{", ";", ","},
+				},
+				"definitionProvider": true,
+				"referencesProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "ikemen-lsp", "version": Version},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.reply(req.ID, nil)
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didSave", "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return
+		}
+		path := lspPath(p.TextDocument.URI)
+		switch req.Method {
+		case "textDocument/didOpen":
+			s.setDoc(path, p.TextDocument.Text)
+		case "textDocument/didChange":
+			if len(p.ContentChanges) == 0 {
+				return
+			}
+			s.setDoc(path, p.ContentChanges[len(p.ContentChanges)-1].Text)
+		case "textDocument/didClose":
+			delete(s.docs, path)
+			delete(textOverlay, path)
+			return
+		}
+		s.diagnose(path)
+	case "textDocument/hover":
+		if json.Unmarshal(req.Params, &pos) == nil {
+			s.reply(req.ID, s.hover(lspPath(pos.TextDocument.URI), pos.Position))
+		}
+	case "textDocument/completion":
+		if json.Unmarshal(req.Params, &pos) == nil {
+			s.reply(req.ID, s.complete(lspPath(pos.TextDocument.URI), pos.Position))
+		}
+	case "textDocument/definition":
+		if json.Unmarshal(req.Params, &pos) == nil {
+			s.reply(req.ID, s.definition(lspPath(pos.TextDocument.URI), pos.Position))
+		}
+	case "textDocument/references":
+		if json.Unmarshal(req.Params, &pos) == nil {
+			s.reply(req.ID, s.references(lspPath(pos.TextDocument.URI), pos.Position, pos.Context.IncludeDeclaration))
+		}
+	default:
+		// Requests need an answer, notifications don't
+		if req.ID != nil {
+			var r lspErrorResponse
+			r.JSONRPC, r.ID = "2.0", req.ID
+			r.Error.Code, r.Error.Message = -32601, "Method not found: "+req.Method
+			s.write(r)
+		}
+	}
+}
+
+func (s *LSPServer) setDoc(path, text string) {
+	text = NormalizeNewlines(text)
+	s.docs[path] = text
+	textOverlay[path] = text
+}
+
+// Returns the text of a file, open in the editor or on disk
+func (s *LSPServer) text(path string) string {
+	if t, ok := s.docs[path]; ok {
+		return t
+	}
+	t, _ := LoadText(path)
+	return NormalizeNewlines(t)
+}
+
+func lspPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	p := u.Path
+	// file:///C:/dir on Windows
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.Clean(filepath.FromSlash(p))
+}
+
+func lspURI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		abs = "/" + abs
+	}
+	return (&url.URL{Scheme: "file", Path: abs}).String()
+}
+
+// Finds the character def listing a state file, next to it or one directory
+// up. Returns the def and the character's state files
+func lspCharFiles(path string) (string, []string) {
+	dir := filepath.Dir(path)
+	defs, _ := filepath.Glob(filepath.Join(dir, "*.def"))
+	up, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "*.def"))
+	for _, def := range append(defs, up...) {
+		str, err := LoadText(def)
+		if err != nil {
+			continue
+		}
+		var files []string
+		found := false
+		lines, i := SplitAndTrim(str, "\n"), 0
+		for i < len(lines) {
+			is, name, _ := ReadIniSection(lines, &i)
+			if name != "files" {
+				continue
+			}
+			for _, k := range SortedKeys(is) {
+				if k != "cmd" && k != "stcommon" && !regexp.MustCompile(`^st[0-9]*$`).MatchString(k) {
+					continue
+				}
+				f := SearchFile(decodeShiftJIS(is[k]), []string{def, ""})
+				if abs, err := filepath.Abs(f); err == nil && FileExist(f) != "" {
+					files = append(files, abs)
+					found = found || abs == path
+				}
+			}
+			break
+		}
+		if found {
+			return def, files
+		}
+	}
+	return "", []string{path}
+}
+
+// Lints a state file that doesn't belong to any character
+func lspLintFile(path string) *LintReport {
+	lr := newLintReport(path)
+	gi := lintSetup(path)
+	c := newCompiler()
+	c.lint = lr
+	c.funcUsed = make(map[string]bool)
+	c.cmdl = NewCommandList(NewInputBuffer())
+	states := make(map[int32]StateBytecode)
+	if err := c.stateCompile(states, path, []string{""}, true, gi.constants); err != nil {
+		c.lintError(err)
+	}
+	// Without the character's .cmd file, commands can't be checked
+	msgs := lr.Messages[:0]
+	for _, m := range lr.Messages {
+		if !strings.Contains(m.Message, "Command doesn't exist") {
+			msgs = append(msgs, m)
+		}
+	}
+	lr.Messages = msgs
+	return lr
+}
+
+func (s *LSPServer) diagnose(path string) {
+	def, files := lspCharFiles(path)
+	var lr *LintReport
+	if def != "" {
+		var err error
+		if lr, err = lintChar(def); err != nil {
+			LogMessage("LSP: %v", err)
+			return
+		}
+	} else {
+		lr = lspLintFile(path)
+	}
+	diags := make(map[string][]lspDiagnostic)
+	for _, f := range files {
+		diags[f] = []lspDiagnostic{}
+	}
+	for _, m := range lr.Messages {
+		f, err := filepath.Abs(m.File)
+		if err != nil {
+			continue
+		}
+		if _, ok := diags[f]; !ok {
+			// Common states and .air files aren't edited with the character
+			continue
+		}
+		line := Max(m.Line-1, 0)
+		start, end := 0, 0
+		if text := lspLine(s.text(f), line); m.Column > 0 {
+			start, end = lspUTF16(text, m.Column-1), lspUTF16(text, len(text))
+		} else {
+			end = lspUTF16(text, len(text))
+		}
+		sev := lspSevWarning
+		if m.Severity == lintSevError {
+			sev = lspSevError
+		}
+		diags[f] = append(diags[f], lspDiagnostic{
+			Range:    lspRange{lspPosition{line, start}, lspPosition{line, end}},
+			Severity: sev, Code: m.Code, Source: "ikemen", Message: m.Message,
+		})
+	}
+	// Files of the character that had diagnostics before are cleared too
+	for _, f := range s.published[def] {
+		if _, ok := diags[f]; !ok {
+			diags[f] = []lspDiagnostic{}
+		}
+	}
+	s.published[def] = s.published[def][:0]
+	for _, f := range SortedKeys(diags) {
+		s.published[def] = append(s.published[def], f)
+		s.write(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics",
+			Params: map[string]interface{}{"uri": lspURI(f), "diagnostics": diags[f]}})
+	}
+}
+
+func lspLine(text string, line int) string {
+	lines := strings.Split(text, "\n")
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return lines[line]
+}
+
+// Converts a byte offset in a line to UTF-16 code units, as LSP counts them
+func lspUTF16(line string, b int) int {
+	if b > len(line) {
+		b = len(line)
+	}
+	return len(utf16.Encode([]rune(line[:b])))
+}
+
+// Converts a position in UTF-16 code units to a byte offset in the line
+func lspByte(line string, ch int) int {
+	n := 0
+	for i, r := range line {
+		if n >= ch {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func lspIsWordByte(b byte) bool {
+	return b == '_' || b == '.' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// Returns the word at a position and its start and end byte offsets
+func lspWord(line string, col int) (string, int, int) {
+	start, end := col, col
+	for start > 0 && lspIsWordByte(line[start-1]) {
+		start--
+	}
+	for end < len(line) && lspIsWordByte(line[end]) {
+		end++
+	}
+	// A trailing dot is punctuation, eg. in "fvar(1)."
+	for end > start && line[end-1] == '.' {
+		end--
+	}
+	return line[start:end], start, end
+}
+
+// Returns the parameters a controller reads, found by compiling it until it
+// stops asking for new ones. The statedef parameters are under "statedef"
+func (s *LSPServer) sctrlParams(name string) []string {
+	if p, ok := s.params[name]; ok {
+		return p
+	}
+	c := s.comp
+	var compile func(is IniSection) error
+	if name == "statedef" {
+		compile = func(is IniSection) error {
+			return c.stateDef(is, newStateBytecode(0))
+		}
+	} else if scf, ok := c.scmap[name]; ok {
+		compile = func(is IniSection) error {
+			_, err := scf(is, newStateControllerBase(), -1)
+			return err
+		}
+	} else {
+		return nil
+	}
+	c.paramNames = make(map[string]bool)
+	values := make(map[string]int)
+	for round := 0; round < 256; round++ {
+		is := NewIniSection()
+		for n := range c.paramNames {
+			is[n] = lspParamValues[values[n]]
+		}
+		known := len(c.paramNames)
+		c.errParam = ""
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = Error(fmt.Sprint(r))
+				}
+			}()
+			return compile(is)
+		}()
+		if len(c.paramNames) > known {
+			continue
+		}
+		// Nothing new was read, so try another value for the parameter
+		// that stopped the compilation
+		if err == nil || c.errParam == "" || values[c.errParam]+1 >= len(lspParamValues) {
+			break
+		}
+		values[c.errParam]++
+	}
+	params := SortedKeys(c.paramNames)
+	c.paramNames = nil
+	s.params[name] = params
+	return params
+}
+
+func (s *LSPServer) sctrlDoc(name string) string {
+	doc := "**" + name + "** (state controller)"
+	if d := s.sctrls[name]; d != "" {
+		doc += "\n\n" + d
+	}
+	if p := s.sctrlParams(name); len(p) > 0 {
+		doc += "\n\nParameters: " + strings.Join(p, ", ")
+	}
+	return doc
+}
+
+func (s *LSPServer) triggerDoc(name string) string {
+	doc := "**" + name + "** (trigger)"
+	if d := s.triggers[name]; d != "" {
+		doc += "\n\n" + d
+	}
+	return doc
+}
+
+// Builds the definitions and references of a character's state files
+func (s *LSPServer) index(files []string) *lspIndex {
+	idx := &lspIndex{
+		states:    make(map[int32]lspLoc),
+		funcs:     make(map[string]lspLoc),
+		stateRefs: make(map[int32][]lspLoc),
+		funcRefs:  make(map[string][]lspLoc),
+	}
+	for _, f := range files {
+		if HasExtension(f, ".zss") {
+			idx.scanZSS(f, s.text(f))
+		} else {
+			idx.scanCNS(f, s.text(f))
+		}
+	}
+	return idx
+}
+
+var (
+	lspStateDefRe = regexp.MustCompile(`(?i)^(\s*\[\s*statedef\s+)(-?\d+)`)
+	lspFunctionRe = regexp.MustCompile(`(?im)^(\s*\[\s*function\s+)(\w+)`)
+	lspCallRe     = regexp.MustCompile(`(?i)\b(call\s+)(\w+)\s*\(`)
+	lspSctrlRe    = regexp.MustCompile(`(\w+)\s*\{([^{}]*)\}`)
+	lspZSSParamRe = regexp.MustCompile(`(\w+)\s*:\s*(-?\d+)\b`)
+)
+
+func (idx *lspIndex) scanCNS(path, text string) {
+	sctrl, inState := "", false
+	for i, line := range strings.Split(text, "\n") {
+		code := strings.SplitN(line, ";", 2)[0]
+		trimmed := strings.TrimSpace(code)
+		if strings.HasPrefix(trimmed, "[") {
+			sctrl, inState = "", false
+			if m := lspStateDefRe.FindStringSubmatchIndex(code); m != nil {
+				if n, err := strconv.ParseInt(code[m[4]:m[5]], 10, 32); err == nil {
+					if _, ok := idx.states[int32(n)]; !ok {
+						idx.states[int32(n)] = lspLoc{path, i, m[4], m[5]}
+					}
+				}
+			} else {
+				inState = strings.HasPrefix(strings.ToLower(trimmed), "[state ")
+			}
+			continue
+		}
+		ia := strings.Index(code, "=")
+		if !inState || ia < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(code[:ia]))
+		value := strings.TrimSpace(code[ia+1:])
+		if key == "type" {
+			sctrl = strings.ToLower(value)
+			continue
+		}
+		for _, p := range lspStateParams[sctrl] {
+			if key != p {
+				continue
+			}
+			if n, err := strconv.ParseInt(value, 10, 32); err == nil {
+				col := ia + 1 + strings.Index(code[ia+1:], value)
+				idx.stateRefs[int32(n)] = append(idx.stateRefs[int32(n)], lspLoc{path, i, col, col + len(value)})
+			}
+		}
+	}
+}
+
+func (idx *lspIndex) scanZSS(path, text string) {
+	// Comments are blanked out, keeping the offsets
+	b := []byte(text)
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' {
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		}
+	}
+	code := string(b)
+	starts := []int{0}
+	for i := range code {
+		if code[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	loc := func(start, end int) lspLoc {
+		line := sort.Search(len(starts), func(i int) bool { return starts[i] > start }) - 1
+		return lspLoc{path, line, start - starts[line], end - starts[line]}
+	}
+	for i, line := range strings.Split(code, "\n") {
+		if m := lspStateDefRe.FindStringSubmatchIndex(line); m != nil {
+			if n, err := strconv.ParseInt(line[m[4]:m[5]], 10, 32); err == nil {
+				if _, ok := idx.states[int32(n)]; !ok {
+					idx.states[int32(n)] = lspLoc{path, i, m[4], m[5]}
+				}
+			}
+		}
+	}
+	for _, m := range lspFunctionRe.FindAllStringSubmatchIndex(code, -1) {
+		name := strings.ToLower(code[m[4]:m[5]])
+		if _, ok := idx.funcs[name]; !ok {
+			idx.funcs[name] = loc(m[4], m[5])
+		}
+	}
+	for _, m := range lspCallRe.FindAllStringSubmatchIndex(code, -1) {
+		name := strings.ToLower(code[m[4]:m[5]])
+		idx.funcRefs[name] = append(idx.funcRefs[name], loc(m[4], m[5]))
+	}
+	for _, m := range lspSctrlRe.FindAllStringSubmatchIndex(code, -1) {
+		params := lspStateParams[strings.ToLower(code[m[2]:m[3]])]
+		if params == nil {
+			continue
+		}
+		body := code[m[4]:m[5]]
+		for _, pm := range lspZSSParamRe.FindAllStringSubmatchIndex(body, -1) {
+			key := strings.ToLower(body[pm[2]:pm[3]])
+			for _, p := range params {
+				if key != p {
+					continue
+				}
+				if n, err := strconv.ParseInt(body[pm[4]:pm[5]], 10, 32); err == nil {
+					idx.stateRefs[int32(n)] = append(idx.stateRefs[int32(n)], loc(m[4]+pm[4], m[4]+pm[5]))
+				}
+			}
+		}
+	}
+}
+
+// What the cursor is on: a state number, a ZSS function or a plain word
+type lspTarget struct {
+	word     string
+	state    int32
+	isState  bool
+	function string
+	idx      *lspIndex
+}
+
+func (s *LSPServer) target(path string, pos lspPosition) (t lspTarget) {
+	line := lspLine(s.text(path), pos.Line)
+	col := lspByte(line, pos.Character)
+	word, start, _ := lspWord(line, col)
+	t.word = strings.ToLower(word)
+	if word == "" {
+		return
+	}
+	_, files := lspCharFiles(path)
+	t.idx = s.index(files)
+	at := func(l lspLoc) bool {
+		return l.path == path && l.line == pos.Line && start >= l.col && start < l.end
+	}
+	if n, err := strconv.ParseInt(word, 10, 32); err == nil {
+		if d, ok := t.idx.states[int32(n)]; ok && at(d) {
+			t.state, t.isState = int32(n), true
+			return
+		}
+		for _, r := range t.idx.stateRefs[int32(n)] {
+			if at(r) {
+				t.state, t.isState = int32(n), true
+				return
+			}
+		}
+		return
+	}
+	if HasExtension(path, ".zss") {
+		if _, ok := t.idx.funcs[t.word]; ok {
+			t.function = t.word
+		}
+	}
+	return
+}
+
+func (s *LSPServer) hover(path string, pos lspPosition) interface{} {
+	t := s.target(path, pos)
+	var doc string
+	switch {
+	case t.word == "":
+		return nil
+	case t.isState:
+		if d, ok := t.idx.states[t.state]; ok {
+			doc = fmt.Sprintf("**State %v**\n\n`%v`\n\n%v:%v", t.state,
+				strings.TrimSpace(lspLine(s.text(d.path), d.line)), filepath.Base(d.path), d.line+1)
+		} else {
+			doc = fmt.Sprintf("**State %v** isn't defined in the character's files", t.state)
+		}
+	case t.function != "":
+		d := t.idx.funcs[t.function]
+		doc = fmt.Sprintf("`%v`\n\n%v:%v", strings.TrimSpace(lspLine(s.text(d.path), d.line)),
+			filepath.Base(d.path), d.line+1)
+	default:
+		_, isSctrl := s.comp.scmap[t.word]
+		_, isTrigger := triggerMap[t.word]
+		line := lspLine(s.text(path), pos.Line)
+		// Names used for both (eg. helper) are told apart by their context
+		if isSctrl && (!isTrigger || lspIsSctrlContext(line, t.word)) {
+			doc = s.sctrlDoc(t.word)
+		} else if isTrigger {
+			doc = s.triggerDoc(t.word)
+		} else {
+			return nil
+		}
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": doc},
+	}
+}
+
+// Whether a controller name on a line is used as a controller, as in
+// "type = Helper" or "helper{"
+func lspIsSctrlContext(line, name string) bool {
+	low := strings.ToLower(line)
+	return regexp.MustCompile(`^\s*type\s*=\s*`+regexp.QuoteMeta(name)+`\b`).MatchString(low) ||
+		regexp.MustCompile(`\b`+regexp.QuoteMeta(name)+`\s*\{`).MatchString(low)
+}
+
+func (s *LSPServer) complete(path string, pos lspPosition) []lspCompletionItem {
+	text := s.text(path)
+	lines := strings.Split(text, "\n")
+	if pos.Line >= len(lines) {
+		return nil
+	}
+	line := lines[pos.Line]
+	prefix := line[:lspByte(line, pos.Character)]
+	if HasExtension(path, ".zss") {
+		offset := len(strings.Join(lines[:pos.Line], "\n")) + len(prefix)
+		if pos.Line > 0 {
+			offset++
+		}
+		return s.completeZSS(text[:offset])
+	}
+	if i := strings.Index(prefix, ";"); i >= 0 {
+		return nil
+	}
+	// Find the section and the controller type
+	section, sctrl := "", ""
+	start := pos.Line
+	for ; start >= 0; start-- {
+		if t := strings.TrimSpace(lines[start]); strings.HasPrefix(t, "[") {
+			section = strings.ToLower(t)
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	for i := start + 1; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "["); i++ {
+		code := strings.SplitN(lines[i], ";", 2)[0]
+		if k, v, ok := strings.Cut(code, "="); ok && strings.ToLower(strings.TrimSpace(k)) == "type" {
+			sctrl = strings.ToLower(strings.TrimSpace(v))
+		}
+	}
+	k, _, hasValue := strings.Cut(prefix, "=")
+	switch {
+	case hasValue && strings.ToLower(strings.TrimSpace(k)) == "type":
+		return s.sctrlItems()
+	case hasValue:
+		return s.triggerItems()
+	case strings.HasPrefix(section, "[statedef"):
+		return s.paramItems("statedef")
+	case strings.HasPrefix(section, "[state "):
+		items := s.paramItems(sctrl)
+		for _, p := range []string{"type", "triggerall", "trigger1", "persistent", "ignorehitpause"} {
+			items = append(items, lspCompletionItem{Label: p, Kind: lspKindKeyword})
+		}
+		return items
+	}
+	return nil
+}
+
+func (s *LSPServer) completeZSS(before string) []lspCompletionItem {
+	// Find the innermost block the cursor is in
+	depth := 0
+	for i := len(before) - 1; i >= 0; i-- {
+		switch before[i] {
+		case '}':
+			depth++
+		case '{':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			name, _, _ := lspWord(before[:i], len(strings.TrimRight(before[:i], " \t\r\n")))
+			name = strings.ToLower(name)
+			if _, ok := s.comp.scmap[name]; !ok {
+				i = 0
+				break
+			}
+			// Inside a controller: parameter names, or triggers after "name:"
+			stmt := before[i+1:]
+			if j := strings.LastIndex(stmt, ";"); j >= 0 {
+				stmt = stmt[j+1:]
+			}
+			if strings.Contains(stmt, ":") {
+				return s.triggerItems()
+			}
+			return s.paramItems(name)
+		}
+	}
+	items := append(s.sctrlItems(), s.triggerItems()...)
+	for _, k := range []string{"if", "else", "switch", "case", "default", "for", "while",
+		"break", "continue", "let", "call", "persistent", "ignorehitpause"} {
+		items = append(items, lspCompletionItem{Label: k, Kind: lspKindKeyword})
+	}
+	return items
+}
+
+func (s *LSPServer) paramItems(sctrl string) []lspCompletionItem {
+	var items []lspCompletionItem
+	for _, p := range s.sctrlParams(sctrl) {
+		items = append(items, lspCompletionItem{Label: p, Kind: lspKindProperty, Detail: sctrl + " parameter"})
+	}
+	return items
+}
+
+func (s *LSPServer) sctrlItems() []lspCompletionItem {
+	var items []lspCompletionItem
+	for _, n := range SortedKeys(s.comp.scmap) {
+		items = append(items, lspCompletionItem{Label: n, Kind: lspKindClass,
+			Detail: "state controller", Documentation: s.sctrls[n]})
+	}
+	return items
+}
+
+func (s *LSPServer) triggerItems() []lspCompletionItem {
+	var items []lspCompletionItem
+	for _, n := range SortedKeys(triggerMap) {
+		items = append(items, lspCompletionItem{Label: n, Kind: lspKindFunction,
+			Detail: "trigger", Documentation: s.triggers[n]})
+	}
+	return items
+}
+
+func (s *LSPServer) location(l lspLoc) lspLocation {
+	line := lspLine(s.text(l.path), l.line)
+	return lspLocation{URI: lspURI(l.path), Range: lspRange{
+		lspPosition{l.line, lspUTF16(line, l.col)}, lspPosition{l.line, lspUTF16(line, l.end)}}}
+}
+
+func (s *LSPServer) definition(path string, pos lspPosition) interface{} {
+	t := s.target(path, pos)
+	if t.isState {
+		if d, ok := t.idx.states[t.state]; ok {
+			return s.location(d)
+		}
+	} else if t.function != "" {
+		return s.location(t.idx.funcs[t.function])
+	}
+	return nil
+}
+
+func (s *LSPServer) references(path string, pos lspPosition, decl bool) []lspLocation {
+	t := s.target(path, pos)
+	var locs []lspLocation
+	if t.isState {
+		if d, ok := t.idx.states[t.state]; ok && decl {
+			locs = append(locs, s.location(d))
+		}
+		for _, r := range t.idx.stateRefs[t.state] {
+			locs = append(locs, s.location(r))
+		}
+	} else if t.function != "" {
+		if decl {
+			locs = append(locs, s.location(t.idx.funcs[t.function]))
+		}
+		for _, r := range t.idx.funcRefs[t.function] {
+			locs = append(locs, s.location(r))
+		}
+	}
+	return locs
+}
@@ -119,6 +119,20 @@ func realMain() {
 		sys.baseDir = "./"
 	}
 
+	// SFF tool, nothing else is loaded. Its arguments aren't flags, so it runs
+	// before the command line is processed
+	if args, ok := sffToolArgs(os.Args); ok {
+		os.Exit(runSffTool(args))
+	}
+
+	// Language server for editors, talking over stdin and stdout. Anything
+	// printed by the engine would corrupt the protocol, so stdout is
+	// redirected before the command line and config are processed
+	lspOut, lsp := os.Stdout, lspArgs(os.Args)
+	if lsp {
+		os.Stdout = os.Stderr
+	}
+
 	// Handle Permissions and Directory Creation
 	permission := os.FileMode(0755)
 	if runtime.GOOS != "android" {
@@ -137,6 +151,17 @@ func realMain() {
 		sys.cmdFlags = make(map[string]string)
 	}
 
+	// Lobby server mode, nothing else is loaded
+	if port, ok := sys.cmdFlags["-lobbyserver"]; ok {
+		runLobbyServer(port)
+		return
+	}
+
+	// Desync dump comparison, nothing else is loaded
+	if dump, ok := sys.cmdFlags["-desyncdiff"]; ok {
+		os.Exit(runDesyncDiff(dump, sys.cmdFlags["-desyncref"]))
+	}
+
 	// Stats file path
 	if _, ok := sys.cmdFlags["-stats"]; !ok {
 		sys.cmdFlags["-stats"] = filepath.Join(sys.baseDir, "save/stats.json")
@@ -177,7 +202,45 @@ func realMain() {
 	if runtime.GOOS == "android" {
 		cfg.Video.RenderMode = "OpenGL ES 3.2"
 	}
+	// Headless runs use the Null renderer, no window or GPU is created
+	_, headless := sys.cmdFlags["-headless"]
+	_, verifyReplay := sys.cmdFlags["-verifyreplay"]
+	_, syncTest := sys.cmdFlags["-synctest"]
+	_, scenario := sys.cmdFlags["-scenario"]
+	if headless || verifyReplay || syncTest || scenario {
+		cfg.Video.RenderMode = "Null"
+	}
 	sys.cfg = *cfg
+	// Character lint, only the character's files are loaded
+	if def, ok := sys.cmdFlags["-lint"]; ok {
+		os.Exit(runLint(def, sys.cmdFlags["-lintformat"]))
+	}
+	// Language server, nothing else is loaded
+	if lsp {
+		os.Exit(runLSP(lspOut))
+	}
+	// Listing of the compiled states of a character
+	if def, ok := sys.cmdFlags["-disasm"]; ok {
+		os.Exit(runDisasm(def, sys.cmdFlags["-disasmstate"]))
+	}
+	if sys.syncTest, err = newSyncTester(sys.cmdFlags, &sys.cfg.Netplay.Rollback); err != nil {
+		fmt.Printf("Sync test failed: %v\n", err)
+		os.Exit(syncTestExitError)
+	}
+	if sys.scenario, err = newScenarioRunner(sys.cmdFlags); err != nil {
+		fmt.Printf("Scenario failed: %v\n", err)
+		os.Exit(scenarioExitError)
+	}
+	// Network simulator, the command line overriding the config
+	netSim := sys.cfg.Netplay.NetSim
+	if v, ok := sys.cmdFlags["-netsim"]; ok {
+		netSim = v
+	}
+	if sys.netSim, err = newNetSim(netSim); err != nil {
+		fmt.Printf("Network simulator disabled: %v\n", err)
+	} else if sys.netSim != nil {
+		fmt.Printf("Network simulator enabled: %v\n", sys.netSim)
+	}
 	// Logcat("LOG: Config Loaded. System Script: " + sys.cfg.Config.System)
 
 	if sys.cfg.Debug.DumpLuaTables {
@@ -195,6 +258,7 @@ func realMain() {
 	// Initialize game and create window
 	// This is where the window is born!
 	sys.luaLState = sys.init(sys.gameWidth, sys.gameHeight)
+	sys.replayVerify = newReplayVerifier(sys.cmdFlags)
 	//defer sys.shutdown()
 
 	// Begin processing game using its lua scripts
@@ -239,6 +303,9 @@ func processCommandLine() {
 			"-nojoy":          true,
 			"-nomusic":        true,
 			"-nosound":        true,
+			"-headless":       true,
+			"-lsp":            true,
+			"-nooptimize":     true,
 		}
 		key := ""
 		player := 1
@@ -271,6 +338,9 @@ func processCommandLine() {
 -width <num>            Sets game width
 -height <num>           Sets game height
 -setvolume <num>        Sets master volume to <num> (0-100)
+-spectate <ip[:port]>   Watches the netplay session hosted at <ip>
+-lobby <ip[:port]>      Opens the netplay lobby of the lobby server at <ip>
+-lobbyserver [port]     Runs a netplay lobby and relay server (default port 7700)
 	
 Quick VS Options:
 -p<n> <playername>      Loads player n, eg. -p3 kfm
@@ -288,6 +358,23 @@ Debug Options:
 -nojoy                  Disables joysticks
 -nomusic                Disables music
 -nosound                Disables all sound effects and music
+-headless               Runs without a window, GPU or audio device (Null renderer)
+-verifyreplay <file>    Plays <file> headless at max speed and checks that it is deterministic
+-verifytrace <file>     Writes the replay checksum trace to <file> (default: <replay>.trace)
+-verifyref <file>       Compares the replay checksum trace against reference trace <file>
+-verifyruns <num>       Number of replay verification runs (default: 2)
+-desyncdiff <file>      Shows the first fields that differ between two rollback desync dumps
+-desyncref <file>       Desync dump of the other player, compared by -desyncdiff
+-netsim <settings>      Degrades netplay connections, eg. -netsim latency=80,jitter=15,loss=2
+-synctest <frames>      Plays the Quick VS match AI vs AI headless, rolling back every <frames> frames (1-8)
+-scenario <file>        Plays the match scripted in <file> headless and checks its trigger assertions
+-lint <char.def>        Compiles the character's states, commands and animations and reports every problem
+-lintformat <format>    Format of the -lint report: text (default) or json
+-lsp                    Runs a language server for CNS and ZSS files over stdin and stdout (or name the executable ikemen-lsp)
+-disasm <char.def>      Prints the bytecode the character's states and functions compile to
+-disasmstate <states>   Only prints these states with -disasm, eg. -disasmstate 0,200,-1
+-sff <command>          Packs, unpacks, lists or compares SFF files, run -sff alone for its commands
+-nooptimize             Disables the bytecode optimizer, to compare against unoptimized states
 -togglelifebars         Disables display of the Life and Power bars
 -maxpowermode           Enables auto-refill of Power bars
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
@@ -425,9 +425,15 @@ func loadglTFModel(filepath string) (*Model, error) {
 			return nil, fmt.Errorf("Failed to open GLB file '%s' in ZIP '%s': %w", pathInZip, zipPath, errOpen)
 		}
 		defer glbFile.Close()
+		var size int64
+		if fi, err := glbFile.Stat(); err == nil {
+			size = fi.Size()
+		}
+		asset := trackLoad("model", filepath, size)
+		defer asset.finish()
 
 		// Create a new decoder with the file stream and the zip archive as the file system
-		decoder := gltf.NewDecoderFS(glbFile, fsys)
+		decoder := gltf.NewDecoderFS(&loadReader{glbFile, asset}, fsys)
 		doc = new(gltf.Document)
 		if err = decoder.Decode(doc); err != nil {
 			return nil, fmt.Errorf("failed to decode gltf from zip '%s': %w", filepath, err)
@@ -439,10 +445,12 @@ func loadglTFModel(filepath string) (*Model, error) {
 			return nil, errOpen
 		}
 		defer f.Close()
+		asset := trackLoad("model", filepath, loadFileSize(f))
+		defer asset.finish()
 
 		// Use the directory of the file as the file system for resolving relative resources
 		fsm := os.DirFS(path.Dir(filepath))
-		decoder := gltf.NewDecoderFS(f, fsm)
+		decoder := gltf.NewDecoderFS(&loadReader{f, asset}, fsm)
 		doc = new(gltf.Document)
 		if err = decoder.Decode(doc); err != nil {
 			return nil, fmt.Errorf("failed to decode gltf from file '%s': %w", filepath, err)
@@ -2086,6 +2094,7 @@ func drawNodeShadow(mdl *Model, scene *Scene, n *Node, camOffset [3]float32, dra
 }
 
 func (model *Model) drawShadow(bufferIndex uint32, sceneNumber int, offset [3]float32) {
+	spriteBatch.flush()
 	scene := model.scenes[sceneNumber]
 	gfx.prepareShadowMapPipeline(bufferIndex)
 	numLights := 0
@@ -2220,6 +2229,7 @@ func (model *Model) draw(bufferIndex uint32, sceneNumber int, layerNumber int, d
 		}
 
 	}
+	spriteBatch.flush()
 	if model.environment != nil {
 		gfx.prepareModelPipeline(bufferIndex, model.environment)
 	} else {
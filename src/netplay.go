@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"reflect"
@@ -25,9 +27,9 @@ const (
 	REPLAY_NUM_INPUTS  = MaxSimul * 2
 	REPLAY_INPUT_BYTES = 2 + 6
 
-	syncConfigVersion   uint16 = 1
-	replayFormatVersion uint16 = 1
-	replayMagic                = "IKRPLCFG"
+	syncConfigVersion uint16 = 1
+	replayMagic              = "IKRPLCFG"
+	netplayMagic             = "IKEMENGO"
 )
 
 type NetState int
@@ -57,6 +59,7 @@ type SyncHandshake struct {
 	Strict             []SyncSetting `json:"strict,omitempty"`
 	Host               []SyncSetting `json:"host,omitempty"`
 	ContentFingerprint string        `json:"content_fingerprint,omitempty"`
+	PlayerName         string        `json:"player_name,omitempty"`
 }
 
 type ReplayHeader struct {
@@ -65,6 +68,9 @@ type ReplayHeader struct {
 	Strict             []SyncSetting `json:"strict,omitempty"`
 	Host               []SyncSetting `json:"host,omitempty"`
 	ContentFingerprint string        `json:"content_fingerprint,omitempty"`
+	Created            string        `json:"created,omitempty"`
+	Players            []string      `json:"players,omitempty"`      // Host first
+	Participants       int           `json:"participants,omitempty"` // Only set for parties
 }
 
 type SessionConfigOverride struct {
@@ -164,16 +170,21 @@ type NetConnection struct {
 	buf              [MaxSimul * 2]NetBuffer // We skip attached characters here because they never have human inputs
 	locIn            int
 	remIn            int
+	remotes          []int // Input slots of all remote participants
 	time             int32
 	stoppedcnt       int32
 	delay            int32
-	recording        *os.File
+	recording        *ReplayWriter
 	host             bool
 	preMatchTime     int32
 	closing          chan struct{}
 	closeOnce        sync.Once
 	uiInputDebounced bool
 	headerWritten    bool
+	spectators       *SpectatorServer
+	relay            *LobbyRelay
+	party            *NetParty
+	connMu           sync.Mutex
 }
 
 func NewNetConnection() *NetConnection {
@@ -193,6 +204,20 @@ func NewNetConnection() *NetConnection {
 	return nc
 }
 
+// Resets the session state and creates the connection for a new netplay
+// session, along with the rollback session if enabled
+func (s *System) beginNetPlay() {
+	s.sessionWarning = ""
+	s.chars = [len(s.chars)][]*Char{}
+	s.netConnection = NewNetConnection()
+
+	//Rollback only
+	if s.cfg.Netplay.RollbackNetcode {
+		rs := NewRollbackSession(s.cfg.Netplay.Rollback)
+		s.rollback.session = &rs
+	}
+}
+
 func (nc *NetConnection) isClosing() bool {
 	if nc == nil || nc.closing == nil {
 		return true
@@ -223,9 +248,15 @@ func (nc *NetConnection) Close() {
 		nc.ln.Close()
 		nc.ln = nil
 	}
+	if nc.spectators != nil {
+		nc.spectators.Close()
+		nc.spectators = nil
+	}
 	if nc.conn != nil {
 		nc.conn.Close()
 	}
+	nc.relay.Close()
+	nc.party.close()
 	if nc.sendEnd != nil {
 		<-nc.sendEnd
 		close(nc.sendEnd)
@@ -298,6 +329,12 @@ func (nc *NetConnection) Accept(port string) error {
 	nc.conn = nil // Make sure this is a new connection
 	nc.locIn, nc.remIn = nc.GetHostGuestRemap()
 
+	if sys.cfg.Netplay.MaxSpectators > 0 {
+		if nc.spectators, err = NewSpectatorServer(sys.cfg.Netplay.SpectatorPort, sys.cfg.Netplay.MaxSpectators); err != nil {
+			log.Printf("Failed to accept spectators: %v", err)
+		}
+	}
+
 	lnLocal := nc.ln
 	SafeGo(func() {
 		defer lnLocal.Close()
@@ -312,36 +349,19 @@ func (nc *NetConnection) Accept(port string) error {
 			return
 		}
 
-		// Don't allow the handshake to block forever (important when shutting down).
-		_ = tempConn.SetDeadline(time.Now().Add(2 * time.Second))
-
 		if sys.cfg.Netplay.RollbackNetcode {
 			sys.rollback.session.remoteIp = tempConn.RemoteAddr().(*net.TCPAddr).IP.String()
 		}
 
-		//Send handshake
-		if _, err := tempConn.Write([]byte("IKEMENGO")); err != nil {
+		if _, err := netplayHandshake(tempConn, netplayMagic); err != nil {
 			tempConn.Close()
 			return
 		}
 
-		// Wait for client acknowledgment
-		ack := make([]byte, 8) // Length of our "password"
-		_, err = io.ReadFull(tempConn, ack)
-		if err != nil || string(ack) != "IKEMENGO" {
-			tempConn.Close()
-			return
-		}
-
-		// Handshake complete; clear deadlines for normal play.
-		_ = tempConn.SetDeadline(time.Time{})
-
 		// Handshake complete. Make temp connection permanent
-		if nc.isClosing() {
+		if !nc.setConn(tempConn, nil) {
 			tempConn.Close()
-			return
 		}
-		nc.conn = tempConn
 	})
 
 	return nil
@@ -353,61 +373,107 @@ func (nc *NetConnection) Connect(server, port string) {
 	nc.remIn, nc.locIn = nc.GetHostGuestRemap()
 
 	SafeGo(func() {
-		d := net.Dialer{Timeout: 1 * time.Second}
-		for {
-			if nc.isClosing() {
-				return
-			}
-			tempConn, err := d.Dial("tcp", server+":"+port)
-			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-
-			tcpConn := tempConn.(*net.TCPConn)
-			if nc.isClosing() {
-				tcpConn.Close()
-				return
-			}
+		nc.dialHost(server, port, time.Time{})
+	})
+}
 
-			// Don't allow the handshake to block forever (important when shutting down).
-			_ = tcpConn.SetDeadline(time.Now().Add(2 * time.Second))
+// Keeps trying to connect to the host until closed, or until the deadline if
+// it isn't zero. Returns true once connected.
+func (nc *NetConnection) dialHost(server, port string, deadline time.Time) bool {
+	d := net.Dialer{Timeout: 1 * time.Second}
+	for deadline.IsZero() || time.Now().Before(deadline) {
+		if nc.isClosing() {
+			return false
+		}
+		tempConn, err := d.Dial("tcp", server+":"+port)
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
 
-			// Wait for host handshake
-			buf := make([]byte, 8)
-			_, err = io.ReadFull(tcpConn, buf)
-			if err != nil || string(buf) != "IKEMENGO" {
-				tcpConn.Close()
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
+		tcpConn := tempConn.(*net.TCPConn)
+		if nc.isClosing() {
+			tcpConn.Close()
+			return false
+		}
 
-			// Send acknowledgment
-			if _, err := tcpConn.Write([]byte("IKEMENGO")); err != nil {
+		magic, err := netplayHandshake(tcpConn, "")
+		if err != nil {
+			tcpConn.Close()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if magic == partyMagic {
+			if err := nc.joinParty(tcpConn); err != nil {
+				log.Printf("Failed to join the netplay party: %v", err)
 				tcpConn.Close()
-				time.Sleep(100 * time.Millisecond)
-				continue
+				return false
 			}
+		}
 
-			// Handshake complete; clear deadlines for normal play.
-			_ = tcpConn.SetDeadline(time.Time{})
+		// Handshake complete. Make temp connection permanent
+		if !nc.setConn(tcpConn, nil) {
+			tcpConn.Close()
+			return false
+		}
+		return true
+	}
+	return false
+}
 
-			// Handshake complete. Make temp connection permanent
-			if nc.isClosing() {
-				tcpConn.Close()
-				return
-			}
-			nc.conn = tcpConn
-			return
+// Exchanges the "IKEMENGO" password, the host speaking first. Hosts pass the
+// password they send, guests pass "" and get back the one they received, which
+// is partyMagic when joining a party.
+func netplayHandshake(conn *net.TCPConn, hostMagic string) (string, error) {
+	// Don't allow the handshake to block forever (important when shutting down).
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 8) // Length of our "password"
+	if hostMagic != "" {
+		if _, err := conn.Write([]byte(hostMagic)); err != nil {
+			return "", err
 		}
-	})
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	magic := string(buf)
+	if magic != netplayMagic && (hostMagic != "" || magic != partyMagic) {
+		return "", Error("netplay handshake failed")
+	}
+	if hostMagic == "" {
+		if _, err := conn.Write([]byte(netplayMagic)); err != nil {
+			return "", err
+		}
+	}
+	// Handshake complete; clear deadlines for normal play.
+	return magic, conn.SetDeadline(time.Time{})
+}
+
+// Keeps the first connection that completes the handshake, along with the
+// lobby relay it goes through, if any. Returns false if the connection wasn't
+// used.
+func (nc *NetConnection) setConn(conn *net.TCPConn, relay *LobbyRelay) bool {
+	nc.connMu.Lock()
+	defer nc.connMu.Unlock()
+	if nc.isClosing() || nc.conn != nil {
+		return false
+	}
+	nc.conn = sys.netSim.wrapTCP(conn)
+	nc.relay = relay
+	return true
+}
+
+func (nc *NetConnection) hasConn() bool {
+	nc.connMu.Lock()
+	defer nc.connMu.Unlock()
+	return nc.conn != nil
 }
 
 func (nc *NetConnection) IsConnected() bool {
 	if nc == nil {
 		return false
 	}
-	connected := nc.conn != nil
+	connected := nc.conn != nil || nc.party.complete()
 	// Stop a held button from registering as a fresh press and auto-accepting the first menu.
 	if connected && !nc.uiInputDebounced {
 		nc.uiInputDebounced = true
@@ -452,31 +518,46 @@ func (nc *NetConnection) writeI16(i16 int16) error {
 }
 
 func (nc *NetConnection) readI32() (int32, error) {
+	return readNetI32(nc.conn)
+}
+
+func (nc *NetConnection) writeI32(i32 int32) error {
+	return writeNetI32(nc.conn, i32)
+}
+
+func (nc *NetConnection) writeJSON(v interface{}) error {
+	return writeNetJSON(nc.conn, v)
+}
+
+func (nc *NetConnection) readJSON(v interface{}) error {
+	return readNetJSON(nc.conn, v)
+}
+
+// The same primitives over any connection, used by the party links too
+func readNetI32(r io.Reader) (int32, error) {
 	b := [4]byte{}
-	if _, err := nc.conn.Read(b[:]); err != nil {
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return 0, err
 	}
 	return int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16 | int32(b[3])<<24, nil
 }
 
-func (nc *NetConnection) writeI32(i32 int32) error {
+func writeNetI32(w io.Writer, i32 int32) error {
 	b := [...]byte{byte(i32), byte(i32 >> 8), byte(i32 >> 16), byte(i32 >> 24)}
-	if _, err := nc.conn.Write(b[:]); err != nil {
-		return err
-	}
-	return nil
+	_, err := w.Write(b[:])
+	return err
 }
 
-func (nc *NetConnection) writeBytes(data []byte) error {
-	if err := nc.writeI32(int32(len(data))); err != nil {
+func writeNetBytes(w io.Writer, data []byte) error {
+	if err := writeNetI32(w, int32(len(data))); err != nil {
 		return err
 	}
-	_, err := nc.conn.Write(data)
+	_, err := w.Write(data)
 	return err
 }
 
-func (nc *NetConnection) readBytes() ([]byte, error) {
-	n, err := nc.readI32()
+func readNetBytes(r io.Reader) ([]byte, error) {
+	n, err := readNetI32(r)
 	if err != nil {
 		return nil, err
 	}
@@ -484,20 +565,20 @@ func (nc *NetConnection) readBytes() ([]byte, error) {
 		return nil, Error("Invalid synchronization payload")
 	}
 	buf := make([]byte, n)
-	_, err = io.ReadFull(nc.conn, buf)
+	_, err = io.ReadFull(r, buf)
 	return buf, err
 }
 
-func (nc *NetConnection) writeJSON(v interface{}) error {
+func writeNetJSON(w io.Writer, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return nc.writeBytes(data)
+	return writeNetBytes(w, data)
 }
 
-func (nc *NetConnection) readJSON(v interface{}) error {
-	data, err := nc.readBytes()
+func readNetJSON(r io.Reader, v interface{}) error {
+	data, err := readNetBytes(r)
 	if err != nil {
 		return err
 	}
@@ -539,17 +620,18 @@ func (nc *NetConnection) Synchronize() error {
 		return err
 	}
 	if nc.recording != nil && !nc.headerWritten && header != nil {
-		if err := writeReplayHeader(nc.recording, header); err != nil {
+		if err := nc.recording.WriteHeader(header); err != nil {
 			return err
 		}
 		nc.headerWritten = true
 	}
+	nc.spectators.WriteHeader(header)
 
 	// Synchronize to host's random seed
 	var seed int32
 	if nc.host {
 		seed = Random()
-		if err := nc.writeI32(seed); err != nil {
+		if err := nc.writePeersI32(seed); err != nil {
 			return err
 		}
 	} else {
@@ -564,7 +646,7 @@ func (nc *NetConnection) Synchronize() error {
 	var pmTime int32
 	if nc.host {
 		pmTime = sys.preMatchTime
-		if err := nc.writeI32(pmTime); err != nil {
+		if err := nc.writePeersI32(pmTime); err != nil {
 			return err
 		}
 	} else {
@@ -576,30 +658,52 @@ func (nc *NetConnection) Synchronize() error {
 	nc.preMatchTime = pmTime
 
 	// Write seed and pre-match time to replay file
-	if nc.recording != nil {
-		binary.Write(nc.recording, binary.LittleEndian, &seed)
-		binary.Write(nc.recording, binary.LittleEndian, &pmTime)
-	}
+	nc.recording.WriteSync(seed, pmTime)
+	nc.spectators.WriteSync(seed, pmTime)
 
 	// Verify connection time synchronization
-	if err := nc.writeI32(nc.time); err != nil {
+	if err := nc.writePeersI32(nc.time); err != nil {
 		return err
 	}
-	if tmp, err := nc.readI32(); err != nil {
+	if times, err := nc.readPeersI32(); err != nil {
 		return err
-	} else if tmp != nc.time {
-		return Error("Synchronization error")
+	} else {
+		for _, tmp := range times {
+			if tmp != nc.time {
+				return Error("Synchronization error")
+			}
+		}
 	}
 	if sys.rollback.session != nil {
 		sys.rollback.session.netTime = nc.time
 	}
 
 	// Reset local and remote input buffers for the current time
+	nc.remotes = nc.remoteInputs()
 	nc.buf[nc.locIn].reset(nc.time)
-	nc.buf[nc.remIn].reset(nc.time)
+	for _, r := range nc.remotes {
+		nc.buf[r].reset(nc.time)
+	}
 	nc.st = NS_Playing
 
-	// Start sending inputs to remote peer in a goroutine
+	if nc.party != nil {
+		nc.party.startInputs(nc)
+	} else {
+		nc.startSending()
+		nc.startReceiving()
+	}
+
+	// Update game state after synchronization
+	nc.Update()
+
+	// Log status
+	log.Printf("Network synchronized: seed=%d pmTime=%d time=%d host=%v", seed, pmTime, nc.time, nc.host)
+
+	return nil
+}
+
+// Starts sending local inputs to the remote peer (or to the party host)
+func (nc *NetConnection) startSending() {
 	sendBuf := &nc.buf[nc.locIn]
 	<-nc.sendEnd
 	SafeGo(func() {
@@ -630,8 +734,10 @@ func (nc *NetConnection) Synchronize() error {
 		// Write termination signal to indicate no more input frames
 		nc.writeI16(-1)
 	})
+}
 
-	// Start receiving inputs from remote peer in a goroutine
+// Starts receiving inputs from the remote peer
+func (nc *NetConnection) startReceiving() {
 	recvBuf := &nc.buf[nc.remIn]
 	<-nc.recvEnd
 	SafeGo(func() {
@@ -678,14 +784,6 @@ func (nc *NetConnection) Synchronize() error {
 			}
 		}
 	})
-
-	// Update game state after synchronization
-	nc.Update()
-
-	// Log status
-	log.Printf("Network synchronized: seed=%d pmTime=%d time=%d host=%v", seed, pmTime, nc.time, nc.host)
-
-	return nil
 }
 
 func (nc *NetConnection) Update() bool {
@@ -705,10 +803,16 @@ func (nc *NetConnection) Update() bool {
 		case NS_Playing:
 			for {
 				// Determine the earliest frame that has been processed by both local and remote buffers
-				foo := Min(nc.buf[nc.locIn].senT, nc.buf[nc.remIn].senT)
+				foo := nc.buf[nc.locIn].senT
+				remInpT := int32(math.MaxInt32)
+				for _, r := range nc.remotes {
+					foo = Min(foo, nc.buf[r].senT)
+					remInpT = Min(remInpT, nc.buf[r].inpT)
+				}
 
 				// Calculate network delay difference between local and remote input buffers
-				tmp := nc.buf[nc.remIn].inpT + nc.delay>>3 - nc.buf[nc.locIn].inpT
+				// In a party, this is the slowest remote participant
+				tmp := remInpT + nc.delay>>3 - nc.buf[nc.locIn].inpT
 
 				// Adjust local buffer to synchronize with remote
 				if tmp >= 0 {
@@ -732,18 +836,24 @@ func (nc *NetConnection) Update() bool {
 
 				// Update current frame time for local and remote buffers
 				nc.buf[nc.locIn].curT = nc.time
-				nc.buf[nc.remIn].curT = nc.time
+				for _, r := range nc.remotes {
+					nc.buf[r].curT = nc.time
+				}
 
-				// Write inputs to replay file
-				if nc.recording != nil {
+				// Write inputs to replay file and spectators
+				if nc.recording != nil || nc.spectators != nil {
+					var ibit [REPLAY_NUM_INPUTS]InputBits
+					var axes [REPLAY_NUM_INPUTS][6]int8
+					ringIdx := nc.time & (NETBUF_NUM_FRAMES - 1)
 					for i := range nc.buf {
-						ringIdx := nc.time & (NETBUF_NUM_FRAMES - 1)
-						if err := writeReplayInput(nc.recording, nc.buf[i].buf[ringIdx], nc.buf[i].axisBuf[ringIdx]); err != nil {
-							log.Printf("Error while writing replay input for controller %d: %v", i, err)
-							nc.recording = nil
-							break
-						}
+						ibit[i] = nc.buf[i].buf[ringIdx]
+						axes[i] = nc.buf[i].axisBuf[ringIdx]
+					}
+					if err := nc.recording.WriteFrame(&ibit, &axes); err != nil {
+						log.Printf("Error while writing replay input: %v", err)
+						nc.recording = nil
 					}
+					nc.spectators.WriteFrame(&ibit, &axes)
 				}
 
 				nc.time++
@@ -771,7 +881,7 @@ func (nc *NetConnection) Update() bool {
 // Replay file handling
 // -----------------------------------------------------------------------------
 
-func writeReplayHeader(w io.Writer, header *ReplayHeader) error {
+func writeReplayHeader(w io.Writer, header *ReplayHeader, version uint16) error {
 	if header == nil {
 		return nil
 	}
@@ -782,7 +892,7 @@ func writeReplayHeader(w io.Writer, header *ReplayHeader) error {
 	if _, err := w.Write([]byte(replayMagic)); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, uint16(replayFormatVersion)); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, version); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, uint32(len(body))); err != nil {
@@ -792,7 +902,7 @@ func writeReplayHeader(w io.Writer, header *ReplayHeader) error {
 	return err
 }
 
-func readReplayHeader(f *os.File) (*ReplayHeader, error) {
+func readReplayHeader(f io.ReadSeeker) (*ReplayHeader, error) {
 	if f == nil {
 		return nil, nil
 	}
@@ -835,22 +945,37 @@ func readReplayHeader(f *os.File) (*ReplayHeader, error) {
 }
 
 type ReplayFile struct {
-	file               *os.File
+	file               io.ReadSeekCloser
+	stream             *SpectatorStream
 	ibit               [REPLAY_NUM_INPUTS]InputBits
 	iaxes              [REPLAY_NUM_INPUTS][6]int8
 	preMatchTime       int32
 	strictSettings     []SyncSetting
 	hostSettings       []SyncSetting
 	contentFingerprint string
+	players            []string
+	participants       int
+	matches            []ReplayMatchInfo
 	warning            string
+	frame              int32
+	dataOffset         int64
+	size               int64
+	seek               ReplaySeekState
+	// Spectators that joined late start matches from a keyframe
+	keyframe      *SpectatorKeyframe
+	keyframeState []byte
 }
 
 func OpenReplayFile(filename string) *ReplayFile {
-	rf, err := os.Open(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		log.Printf("Failed to open replay file %s: %v", filename, err)
 		return nil
 	}
+	return newReplayFile(f, filename)
+}
+
+func newReplayFile(rf io.ReadSeekCloser, filename string) *ReplayFile {
 	header, err := readReplayHeader(rf)
 	if err != nil {
 		log.Printf("Failed to read replay header %s: %v", filename, err)
@@ -859,10 +984,36 @@ func OpenReplayFile(filename string) *ReplayFile {
 	}
 
 	out := &ReplayFile{file: rf}
+	out.seek.target = -1
+	if header != nil && header.FormatVersion > replayFormatVersion {
+		log.Printf("Replay %s uses format version %d, newer than supported (%d)", filename, header.FormatVersion, replayFormatVersion)
+		rf.Close()
+		return nil
+	}
+	if header != nil && header.FormatVersion >= 2 {
+		// Decode all input chunks up front so seeking works as with v1 files
+		var raw bytes.Buffer
+		if out.matches, err = readReplayChunks(rf, &raw); err != nil {
+			log.Printf("Replay %s is truncated, playing back what could be read: %v", filename, err)
+		}
+		rf.Close()
+		out.file = replayPayload{bytes.NewReader(raw.Bytes())}
+	}
+	out.dataOffset, _ = out.file.Seek(0, io.SeekCurrent)
+	if out.size, err = out.file.Seek(0, io.SeekEnd); err == nil {
+		_, err = out.file.Seek(out.dataOffset, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Failed to read replay file %s: %v", filename, err)
+		out.file.Close()
+		return nil
+	}
 	if header != nil {
 		out.strictSettings = cloneSyncSettings(header.Strict)
 		out.hostSettings = cloneSyncSettings(header.Host)
 		out.contentFingerprint = header.ContentFingerprint
+		out.players = header.Players
+		out.participants = header.Participants
 		if header.SyncVersion != syncConfigVersion {
 			out.warning = fmt.Sprintf(
 				"replay sync config version mismatch (replay=%d engine=%d); playback is best-effort",
@@ -878,6 +1029,7 @@ func OpenReplayFile(filename string) *ReplayFile {
 }
 
 func (rf *ReplayFile) Close() {
+	rf.clearKeyframes()
 	if rf.file != nil {
 		rf.file.Close()
 		rf.file = nil
@@ -915,7 +1067,11 @@ func (rf *ReplayFile) AnyButton() bool {
 
 // Read system variables from replay file
 func (rf *ReplayFile) Synchronize() {
-	if rf.file != nil {
+	// Spectators that joined late aren't sent the syncs outside of matches
+	if rf.stream != nil && rf.stream.Late() && (!sys.gameRunning || rf.joinKeyframe()) {
+		return
+	}
+	if rf.file != nil && rf.waitForData(8) {
 		// Read random seed
 		var seed int32
 		if err := binary.Read(rf.file, binary.LittleEndian, &seed); err == nil {
@@ -940,7 +1096,7 @@ func (rf *ReplayFile) Update() bool {
 	if rf.file == nil {
 		sys.esc = true
 	} else {
-		if sys.oldNextAddTime > 0 {
+		if sys.oldNextAddTime > 0 && rf.waitForData(replayFrameBytes) {
 			rf.ibit = [REPLAY_NUM_INPUTS]InputBits{}
 			rf.iaxes = [REPLAY_NUM_INPUTS][6]int8{}
 
@@ -955,6 +1111,9 @@ func (rf *ReplayFile) Update() bool {
 					break
 				}
 			}
+			if !sys.esc {
+				rf.frame++
+			}
 		}
 
 		if sys.esc {
@@ -965,6 +1124,26 @@ func (rf *ReplayFile) Update() bool {
 	return !sys.gameEnd
 }
 
+// Waits until n bytes can be read. Only spectator streams ever have to wait.
+func (rf *ReplayFile) waitForData(n int64) bool {
+	if rf.stream == nil {
+		return true
+	}
+	for !rf.stream.Available(n) {
+		if rf.stream.OutsideMatch(n) {
+			return false
+		}
+		// await returns immediately while seeking
+		if rf.Seeking() {
+			time.Sleep(time.Millisecond)
+		}
+		if sys.esc || !sys.await(sys.gameRenderSpeed()) {
+			return false
+		}
+	}
+	return true
+}
+
 // -----------------------------------------------------------------------------
 // Deterministic config helpers
 // -----------------------------------------------------------------------------
@@ -1385,35 +1564,43 @@ func (s *System) synchronizeNetplayConfig(nc *NetConnection) (*ReplayHeader, err
 			Strict:             localStrict,
 			Host:               localHost,
 			ContentFingerprint: localFingerprint,
+			PlayerName:         s.cfg.Netplay.PlayerName,
 		}
 		log.Printf("Netplay sync config host->peer: sending strict=%d host=%d fingerprint=%q",
 			len(localStrict), len(localHost), localFingerprint)
-		if err := nc.writeJSON(hostPayload); err != nil {
-			return nil, err
-		}
-
-		var guestPayload SyncHandshake
-		if err := nc.readJSON(&guestPayload); err != nil {
-			return nil, err
-		}
-		log.Printf("Netplay sync config peer->host ack: strict=%d host=%d fingerprint=%q",
-			len(guestPayload.Strict), len(guestPayload.Host), guestPayload.ContentFingerprint)
-		if guestPayload.SyncVersion != syncConfigVersion {
-			return nil, Error("Sync config version mismatch")
-		}
-		if err := validateHostSignature(localHost, guestPayload.Host); err != nil {
-			return nil, err
-		}
-		if err := validateStrictCompatibility(localStrict, guestPayload.Strict, false); err != nil {
+		guestPayloads, err := nc.exchangeSyncHandshake(hostPayload)
+		if err != nil {
 			return nil, err
 		}
-		if err := validateContentFingerprint(localFingerprint, guestPayload.ContentFingerprint); err != nil {
-			return nil, err
+		players := []string{hostPayload.PlayerName}
+		for _, guestPayload := range guestPayloads {
+			log.Printf("Netplay sync config peer->host ack: strict=%d host=%d fingerprint=%q",
+				len(guestPayload.Strict), len(guestPayload.Host), guestPayload.ContentFingerprint)
+			if guestPayload.SyncVersion != syncConfigVersion {
+				return nil, Error("Sync config version mismatch")
+			}
+			if err := validateHostSignature(localHost, guestPayload.Host); err != nil {
+				return nil, err
+			}
+			if err := validateStrictCompatibility(localStrict, guestPayload.Strict, false); err != nil {
+				return nil, err
+			}
+			if err := validateContentFingerprint(localFingerprint, guestPayload.ContentFingerprint); err != nil {
+				return nil, err
+			}
+			players = append(players, guestPayload.PlayerName)
 		}
 		if err := s.beginSessionOverride("netplay", localStrict, localHost, localFingerprint); err != nil {
 			return nil, err
 		}
-		return s.currentReplayHeader(), nil
+		header := s.currentReplayHeader()
+		if header != nil {
+			header.Players = players
+			if nc.party != nil {
+				header.Participants = nc.party.info.Size
+			}
+		}
+		return header, nil
 	}
 
 	var hostPayload SyncHandshake
@@ -1428,6 +1615,7 @@ func (s *System) synchronizeNetplayConfig(nc *NetConnection) (*ReplayHeader, err
 		Strict:             localStrict,
 		Host:               localHost,
 		ContentFingerprint: localFingerprint,
+		PlayerName:         s.cfg.Netplay.PlayerName,
 	}
 	sendGuestPayload := func() error {
 		log.Printf("Netplay sync config peer->host ack: sending strict=%d host=%d fingerprint=%q",
@@ -1467,7 +1655,15 @@ func (s *System) synchronizeNetplayConfig(nc *NetConnection) (*ReplayHeader, err
 		return nil, err
 	}
 
-	return s.currentReplayHeader(), nil
+	header := s.currentReplayHeader()
+	if header != nil {
+		header.Players = []string{hostPayload.PlayerName, guestPayload.PlayerName}
+		if nc.party != nil {
+			header.Players = nc.party.info.Names
+			header.Participants = nc.party.info.Size
+		}
+	}
+	return header, nil
 }
 
 func (s *System) beginReplaySession(rf *ReplayFile) error {
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The lobby server lets players find each other without exchanging IP
+// addresses. Clients keep a TCP connection to it and exchange one JSON
+// LobbyMessage per line. A host creates a room, which is listed to other
+// clients until a guest joins it. Both sides then receive the endpoint of the
+// other side and a relay token, and the room is closed.
+//
+// The guest first tries to reach the host directly. If that fails, both sides
+// go through the relay on the same port:
+//   - a TCP connection whose first line is a "relay" message is paired with
+//     the other connection using the same token, and bytes are piped between
+//     them; the netplay connection then runs over it unchanged.
+//   - UDP datagrams starting with the raw token and a role byte are forwarded,
+//     without that prefix, to the last address seen for the other role. The
+//     game runs a local proxy (lobbyUDPProxy) so that GGPO talks to it as if
+//     it was the remote peer.
+//
+// Everything works on a single machine: run "-lobbyserver" in one process and
+// point several game processes at 127.0.0.1.
+
+const (
+	lobbyDefaultPort     = "7700"
+	lobbyProtocolVersion = 1
+
+	lobbyTokenBytes = 8
+	// Time the guest spends trying to reach the host before using the relay
+	lobbyDirectTimeout = 3 * time.Second
+	// Unused relay tokens are forgotten after this long
+	lobbyTokenTimeout = 2 * time.Minute
+	// Interval of the UDP proxy keepalive, which also registers it with the relay
+	lobbyUDPKeepalive = 1 * time.Second
+	lobbyMaxRooms     = 256
+	lobbyMaxLine      = 4096
+)
+
+// LobbyRoom is a joinable room, as listed to clients
+type LobbyRoom struct {
+	ID       int32  `json:"id"`
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Rollback bool   `json:"rollback"`
+}
+
+// LobbyPeer is sent to both sides of a room when a guest joins it
+type LobbyPeer struct {
+	Player  string `json:"player"`
+	Address string `json:"address"`
+	Port    string `json:"port,omitempty"`
+	Token   string `json:"token"`
+	Host    bool   `json:"host"`
+}
+
+// LobbyMessage is the single message type of the lobby protocol.
+//
+// Client requests: "list", "create" (Name, Player, Port, Rollback), "join"
+// (Room, Player), "leave" and, on a separate connection, "relay" (Token, Host).
+// Server replies: "rooms" (Rooms), "created" (Room, Name), "matched" (Peer), "left",
+// "relay" once a relay connection is paired, and "error" (Error).
+type LobbyMessage struct {
+	Op       string      `json:"op"`
+	Version  int         `json:"version,omitempty"`
+	Room     int32       `json:"room,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Player   string      `json:"player,omitempty"`
+	Port     string      `json:"port,omitempty"`
+	Rollback bool        `json:"rollback,omitempty"`
+	Rooms    []LobbyRoom `json:"rooms,omitempty"`
+	Peer     *LobbyPeer  `json:"peer,omitempty"`
+	Token    string      `json:"token,omitempty"`
+	Host     bool        `json:"host,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Writes a message as a single line
+func writeLobbyMessage(w io.Writer, msg *LobbyMessage) error {
+	msg.Version = lobbyProtocolVersion
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Reads a message one byte at a time, so that nothing after the line is
+// consumed. Used where the connection is handed over to netplay afterwards.
+func readLobbyLine(r io.Reader) (*LobbyMessage, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= lobbyMaxLine {
+			return nil, fmt.Errorf("lobby message too long")
+		}
+		line = append(line, b[0])
+	}
+	msg := &LobbyMessage{}
+	if err := json.Unmarshal(line, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Adds the default lobby port to addresses without one
+func lobbyAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, lobbyDefaultPort)
+}
+
+// -----------------------------------------------------------------------------
+// Server
+// -----------------------------------------------------------------------------
+
+type lobbyServerRoom struct {
+	LobbyRoom
+	owner *lobbyServerClient
+	port  string
+}
+
+type lobbyServerClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+	room *lobbyServerRoom
+}
+
+func (c *lobbyServerClient) send(msg *LobbyMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := writeLobbyMessage(c.conn, msg); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *lobbyServerClient) ip() string {
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// One side of a relayed TCP connection. The reader holds whatever was sent
+// after the relay request.
+type lobbyRelayEnd struct {
+	conn *net.TCPConn
+	r    *bufio.Reader
+}
+
+// A relay token issued for a matched room
+type lobbyRelayToken struct {
+	tcp      [2]*lobbyRelayEnd // Waiting relay connections, host first
+	paired   bool
+	udp      [2]*net.UDPAddr
+	lastSeen time.Time
+}
+
+type LobbyServer struct {
+	ln     *net.TCPListener
+	udp    *net.UDPConn
+	mu     sync.Mutex
+	nextID int32
+	rooms  map[int32]*lobbyServerRoom
+	tokens map[string]*lobbyRelayToken
+	closed bool
+}
+
+func NewLobbyServer(port string) (*LobbyServer, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	ls := &LobbyServer{
+		ln:     ln.(*net.TCPListener),
+		udp:    udp,
+		rooms:  make(map[int32]*lobbyServerRoom),
+		tokens: make(map[string]*lobbyRelayToken),
+	}
+	SafeGo(ls.acceptLoop)
+	SafeGo(ls.udpLoop)
+	SafeGo(ls.expireTokens)
+	return ls, nil
+}
+
+func (ls *LobbyServer) Close() {
+	ls.mu.Lock()
+	ls.closed = true
+	for _, t := range ls.tokens {
+		for _, e := range t.tcp {
+			if e != nil {
+				e.conn.Close()
+			}
+		}
+	}
+	ls.mu.Unlock()
+	ls.ln.Close()
+	ls.udp.Close()
+}
+
+func (ls *LobbyServer) acceptLoop() {
+	for {
+		conn, err := ls.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		SafeGo(func() { ls.serve(conn) })
+	}
+}
+
+func (ls *LobbyServer) serve(conn *net.TCPConn) {
+	r := bufio.NewReaderSize(conn, lobbyMaxLine)
+	c := &lobbyServerClient{conn: conn}
+	relayed := false
+	defer func() {
+		ls.leave(c)
+		if !relayed {
+			conn.Close()
+		}
+	}()
+	first := true
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return
+		}
+		var msg LobbyMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			c.send(&LobbyMessage{Op: "error", Error: "invalid message"})
+			return
+		}
+		if msg.Version > lobbyProtocolVersion {
+			c.send(&LobbyMessage{Op: "error", Error: fmt.Sprintf("unsupported lobby protocol version %d", msg.Version)})
+			return
+		}
+		switch msg.Op {
+		case "relay":
+			if !first {
+				c.send(&LobbyMessage{Op: "error", Error: "relay must be the first message"})
+				return
+			}
+			// The connection belongs to the relay from now on
+			relayed = ls.relay(conn, r, &msg)
+			return
+		case "list":
+			c.send(&LobbyMessage{Op: "rooms", Rooms: ls.list()})
+		case "create":
+			ls.create(c, &msg)
+		case "join":
+			ls.join(c, &msg)
+		case "leave":
+			ls.leave(c)
+			c.send(&LobbyMessage{Op: "left"})
+		default:
+			c.send(&LobbyMessage{Op: "error", Error: "unknown request " + msg.Op})
+		}
+		first = false
+	}
+}
+
+func (ls *LobbyServer) list() []LobbyRoom {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	rooms := make([]LobbyRoom, 0, len(ls.rooms))
+	for _, r := range ls.rooms {
+		rooms = append(rooms, r.LobbyRoom)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms
+}
+
+func (ls *LobbyServer) create(c *lobbyServerClient, msg *LobbyMessage) {
+	ls.mu.Lock()
+	if c.room != nil {
+		ls.mu.Unlock()
+		c.send(&LobbyMessage{Op: "error", Error: "already hosting a room"})
+		return
+	}
+	if len(ls.rooms) >= lobbyMaxRooms {
+		ls.mu.Unlock()
+		c.send(&LobbyMessage{Op: "error", Error: "too many rooms"})
+		return
+	}
+	ls.nextID++
+	room := &lobbyServerRoom{
+		LobbyRoom: LobbyRoom{
+			ID:       ls.nextID,
+			Name:     msg.Name,
+			Host:     msg.Player,
+			Rollback: msg.Rollback,
+		},
+		owner: c,
+		port:  msg.Port,
+	}
+	if room.Host == "" {
+		room.Host = "Anonymous"
+	}
+	if room.Name == "" {
+		room.Name = fmt.Sprintf("%s's room", room.Host)
+	}
+	c.room = room
+	ls.rooms[room.ID] = room
+	ls.mu.Unlock()
+	log.Printf("Lobby: %s created room %d (%s)", c.conn.RemoteAddr(), room.ID, room.Name)
+	c.send(&LobbyMessage{Op: "created", Room: room.ID, Name: room.Name})
+}
+
+func (ls *LobbyServer) join(c *lobbyServerClient, msg *LobbyMessage) {
+	ls.mu.Lock()
+	room := ls.rooms[msg.Room]
+	if room == nil || room.owner == c {
+		ls.mu.Unlock()
+		c.send(&LobbyMessage{Op: "error", Error: "room not found"})
+		return
+	}
+	token, err := newLobbyToken()
+	if err != nil {
+		ls.mu.Unlock()
+		c.send(&LobbyMessage{Op: "error", Error: err.Error()})
+		return
+	}
+	delete(ls.rooms, room.ID)
+	room.owner.room = nil
+	ls.tokens[token] = &lobbyRelayToken{lastSeen: time.Now()}
+	ls.mu.Unlock()
+
+	log.Printf("Lobby: %s joined room %d (%s)", c.conn.RemoteAddr(), room.ID, room.Name)
+	room.owner.send(&LobbyMessage{Op: "matched", Room: room.ID, Peer: &LobbyPeer{
+		Player:  msg.Player,
+		Address: c.ip(),
+		Token:   token,
+		Host:    true,
+	}})
+	c.send(&LobbyMessage{Op: "matched", Room: room.ID, Peer: &LobbyPeer{
+		Player:  room.Host,
+		Address: room.owner.ip(),
+		Port:    room.port,
+		Token:   token,
+	}})
+}
+
+// Closes the room hosted by the client, if any
+func (ls *LobbyServer) leave(c *lobbyServerClient) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if c.room != nil {
+		delete(ls.rooms, c.room.ID)
+		c.room = nil
+	}
+}
+
+func newLobbyToken() (string, error) {
+	b := make([]byte, lobbyTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Pairs a relay connection with the other side of its token and pipes them
+// together. Returns false if the connection wasn't taken over.
+func (ls *LobbyServer) relay(conn *net.TCPConn, r *bufio.Reader, msg *LobbyMessage) bool {
+	role := 1
+	if msg.Host {
+		role = 0
+	}
+	ls.mu.Lock()
+	t := ls.tokens[msg.Token]
+	if t == nil || t.paired || t.tcp[role] != nil {
+		ls.mu.Unlock()
+		writeLobbyMessage(conn, &LobbyMessage{Op: "error", Error: "invalid relay token"})
+		return false
+	}
+	t.lastSeen = time.Now()
+	end := &lobbyRelayEnd{conn: conn, r: r}
+	other := t.tcp[1-role]
+	if other == nil {
+		// Kept until the other side shows up or the token expires
+		t.tcp[role] = end
+		ls.mu.Unlock()
+		return true
+	}
+	t.tcp = [2]*lobbyRelayEnd{}
+	t.paired = true
+	ls.mu.Unlock()
+
+	closeBoth := func() {
+		other.conn.Close()
+		conn.Close()
+	}
+	for _, e := range []*lobbyRelayEnd{other, end} {
+		if err := writeLobbyMessage(e.conn, &LobbyMessage{Op: "relay"}); err != nil {
+			closeBoth()
+			return true
+		}
+	}
+	log.Printf("Lobby: relaying %v <-> %v", other.conn.RemoteAddr(), conn.RemoteAddr())
+	SafeGo(func() {
+		io.Copy(other.conn, end.r)
+		closeBoth()
+	})
+	SafeGo(func() {
+		io.Copy(conn, other.r)
+		closeBoth()
+	})
+	return true
+}
+
+// Forwards UDP datagrams between the two registered peers of a token. Every
+// datagram, including empty keepalives, updates the address of its sender.
+func (ls *LobbyServer) udpLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := ls.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n <= lobbyTokenBytes {
+			continue
+		}
+		token := hex.EncodeToString(buf[:lobbyTokenBytes])
+		role := int(buf[lobbyTokenBytes] & 1)
+		var dst *net.UDPAddr
+		ls.mu.Lock()
+		if t := ls.tokens[token]; t != nil {
+			t.udp[role] = addr
+			t.lastSeen = time.Now()
+			dst = t.udp[1-role]
+		}
+		ls.mu.Unlock()
+		if dst != nil && n > lobbyTokenBytes+1 {
+			ls.udp.WriteToUDP(buf[lobbyTokenBytes+1:n], dst)
+		}
+	}
+}
+
+func (ls *LobbyServer) expireTokens() {
+	ticker := time.NewTicker(lobbyTokenTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		ls.mu.Lock()
+		if ls.closed {
+			ls.mu.Unlock()
+			return
+		}
+		for k, t := range ls.tokens {
+			if time.Since(t.lastSeen) < lobbyTokenTimeout {
+				continue
+			}
+			for _, e := range t.tcp {
+				if e != nil {
+					e.conn.Close()
+				}
+			}
+			delete(ls.tokens, k)
+		}
+		ls.mu.Unlock()
+	}
+}
+
+// Runs the lobby server until interrupted (-lobbyserver [port])
+func runLobbyServer(port string) {
+	if port == "" || port == "true" {
+		port = lobbyDefaultPort
+	}
+	ls, err := NewLobbyServer(port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the lobby server: %v\n", err)
+		os.Exit(1)
+	}
+	log.Printf("Lobby server listening on port %s (TCP and UDP)", port)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	ls.Close()
+}
+
+// -----------------------------------------------------------------------------
+// Client
+// -----------------------------------------------------------------------------
+
+// LobbyClient is the game's connection to a lobby server. Replies are read
+// in the background, Lua polls the resulting state.
+type LobbyClient struct {
+	addr     string
+	conn     net.Conn
+	mu       sync.Mutex
+	wmu      sync.Mutex
+	state    string // "idle", "hosting", "joining", "matched" or "closed"
+	rooms    []LobbyRoom
+	room     int32
+	roomName string
+	peer     *LobbyPeer
+	err      string
+}
+
+func DialLobby(addr string) (*LobbyClient, error) {
+	addr = lobbyAddress(addr)
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	lc := &LobbyClient{addr: addr, conn: conn, state: "idle"}
+	SafeGo(lc.readLoop)
+	if err := lc.send(&LobbyMessage{Op: "list"}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return lc, nil
+}
+
+func (lc *LobbyClient) readLoop() {
+	dec := json.NewDecoder(lc.conn)
+	for {
+		var msg LobbyMessage
+		if err := dec.Decode(&msg); err != nil {
+			lc.mu.Lock()
+			if lc.state != "closed" {
+				lc.state = "closed"
+				lc.err = "lost connection to the lobby server"
+			}
+			lc.mu.Unlock()
+			return
+		}
+		lc.mu.Lock()
+		switch msg.Op {
+		case "rooms":
+			lc.rooms = msg.Rooms
+		case "created":
+			lc.room = msg.Room
+			lc.roomName = msg.Name
+		case "matched":
+			lc.state = "matched"
+			lc.room = msg.Room
+			lc.peer = msg.Peer
+		case "left":
+			if lc.state != "matched" {
+				lc.state = "idle"
+			}
+		case "error":
+			lc.err = msg.Error
+			if lc.state == "hosting" || lc.state == "joining" {
+				lc.state = "idle"
+			}
+		}
+		lc.mu.Unlock()
+	}
+}
+
+func (lc *LobbyClient) send(msg *LobbyMessage) error {
+	if lc == nil {
+		return Error("not connected to a lobby server")
+	}
+	lc.wmu.Lock()
+	defer lc.wmu.Unlock()
+	_ = lc.conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	return writeLobbyMessage(lc.conn, msg)
+}
+
+// Starts a request that changes the lobby state
+func (lc *LobbyClient) request(state string, msg *LobbyMessage) error {
+	if lc == nil {
+		return Error("not connected to a lobby server")
+	}
+	lc.mu.Lock()
+	if lc.state == "closed" {
+		lc.mu.Unlock()
+		return Error(lc.err)
+	}
+	lc.state = state
+	lc.room = msg.Room
+	lc.roomName = msg.Name
+	lc.peer = nil
+	lc.err = ""
+	lc.mu.Unlock()
+	return lc.send(msg)
+}
+
+// Asks for a new room list
+func (lc *LobbyClient) Refresh() error {
+	return lc.send(&LobbyMessage{Op: "list"})
+}
+
+// Creates a room for the netplay session hosted on port
+func (lc *LobbyClient) Create(name, player, port string, rollback bool) error {
+	return lc.request("hosting", &LobbyMessage{Op: "create", Name: name, Player: player, Port: port, Rollback: rollback})
+}
+
+func (lc *LobbyClient) Join(room int32, player string) error {
+	name := ""
+	lc.mu.Lock()
+	for _, r := range lc.rooms {
+		if r.ID == room {
+			name = r.Name
+		}
+	}
+	lc.mu.Unlock()
+	return lc.request("joining", &LobbyMessage{Op: "join", Room: room, Name: name, Player: player})
+}
+
+// Closes the hosted room, or forgets the current match
+func (lc *LobbyClient) Leave() error {
+	return lc.request("idle", &LobbyMessage{Op: "leave"})
+}
+
+func (lc *LobbyClient) Close() {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	lc.state = "closed"
+	lc.mu.Unlock()
+	lc.conn.Close()
+}
+
+func (lc *LobbyClient) Rooms() []LobbyRoom {
+	if lc == nil {
+		return nil
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return append([]LobbyRoom(nil), lc.rooms...)
+}
+
+// State, room, room name, matched peer and last error
+func (lc *LobbyClient) Status() (state string, room int32, name string, peer *LobbyPeer, err string) {
+	if lc == nil {
+		return "closed", 0, "", nil, ""
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.state, lc.room, lc.roomName, lc.peer, lc.err
+}
+
+// -----------------------------------------------------------------------------
+// Relay client
+// -----------------------------------------------------------------------------
+
+// LobbyRelay is the relay route of a netplay connection matched by the lobby
+type LobbyRelay struct {
+	addr  string
+	token []byte
+	host  bool
+	proxy *lobbyUDPProxy
+}
+
+func newLobbyRelay(addr string, peer *LobbyPeer) (*LobbyRelay, error) {
+	token, err := hex.DecodeString(peer.Token)
+	if err != nil || len(token) != lobbyTokenBytes {
+		return nil, Error("invalid lobby relay token")
+	}
+	return &LobbyRelay{addr: addr, token: token, host: peer.Host}, nil
+}
+
+// Opens a relayed TCP connection and waits until the other side does the
+// same. Gives up when cancel returns true.
+func (lr *LobbyRelay) dial(cancel func() bool) (*net.TCPConn, error) {
+	conn, err := net.DialTimeout("tcp", lr.addr, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn := conn.(*net.TCPConn)
+	msg := &LobbyMessage{Op: "relay", Token: hex.EncodeToString(lr.token), Host: lr.host}
+	if err := writeLobbyMessage(tcpConn, msg); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	for {
+		_ = tcpConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		reply, err := readLobbyLine(tcpConn)
+		if err == nil {
+			if reply.Op != "relay" {
+				tcpConn.Close()
+				return nil, Error(reply.Error)
+			}
+			_ = tcpConn.SetReadDeadline(time.Time{})
+			return tcpConn, nil
+		}
+		// The reply comes in one piece, so a timeout leaves the stream intact
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			if cancel() {
+				tcpConn.Close()
+				return nil, Error("relay connection cancelled")
+			}
+			continue
+		}
+		tcpConn.Close()
+		return nil, err
+	}
+}
+
+// Hosts a lobby match. The guest is accepted directly and through the relay
+// at the same time, and the first connection to complete the handshake wins.
+func (nc *NetConnection) AcceptLobby(port string, relay *LobbyRelay) {
+	if err := nc.Accept(port); err != nil {
+		log.Printf("Lobby: can't accept direct connections on port %s, using the relay: %v", port, err)
+		nc.host = true
+		nc.conn = nil
+		nc.locIn, nc.remIn = nc.GetHostGuestRemap()
+	}
+	SafeGo(func() {
+		conn, err := relay.dial(func() bool { return nc.isClosing() || nc.hasConn() })
+		if err != nil {
+			return
+		}
+		if _, err := netplayHandshake(conn, netplayMagic); err != nil || !nc.setConn(conn, relay) {
+			conn.Close()
+		}
+	})
+}
+
+// Joins a lobby match, falling back to the relay if the host can't be
+// reached directly
+func (nc *NetConnection) ConnectLobby(server, port string, relay *LobbyRelay) {
+	nc.host = false
+	nc.conn = nil
+	nc.remIn, nc.locIn = nc.GetHostGuestRemap()
+
+	SafeGo(func() {
+		if nc.dialHost(server, port, time.Now().Add(lobbyDirectTimeout)) || nc.isClosing() {
+			return
+		}
+		log.Printf("Lobby: can't reach %s:%s directly, using the relay", server, port)
+		conn, err := relay.dial(nc.isClosing)
+		if err != nil {
+			log.Printf("Lobby: relay connection failed: %v", err)
+			return
+		}
+		if _, err := netplayHandshake(conn, ""); err != nil || !nc.setConn(conn, relay) {
+			conn.Close()
+		}
+	})
+}
+
+// Address of the remote GGPO peer. Relayed connections go through the local
+// UDP proxy instead.
+func (nc *NetConnection) ggpoRemote(ip string, port, localPort int) (string, int) {
+	if nc == nil || nc.relay == nil {
+		return ip, port
+	}
+	proxyIp, proxyPort, err := nc.relay.ggpoEndpoint(localPort)
+	if err != nil {
+		log.Printf("Lobby: failed to start the UDP relay proxy: %v", err)
+		return ip, port
+	}
+	return proxyIp, proxyPort
+}
+
+// Returns the address GGPO should use to reach the remote player through
+// the relay, starting the local UDP proxy for localPort on first use.
+func (lr *LobbyRelay) ggpoEndpoint(localPort int) (string, int, error) {
+	if lr.proxy == nil {
+		p, err := newLobbyUDPProxy(lr, localPort)
+		if err != nil {
+			return "", 0, err
+		}
+		lr.proxy = p
+	}
+	return "127.0.0.1", lr.proxy.port(), nil
+}
+
+func (lr *LobbyRelay) Close() {
+	if lr != nil && lr.proxy != nil {
+		lr.proxy.close()
+		lr.proxy = nil
+	}
+}
+
+// lobbyUDPProxy stands in for the remote player on the local machine. It
+// wraps datagrams from the local GGPO port with the relay token, and unwraps
+// datagrams coming back from the relay.
+type lobbyUDPProxy struct {
+	conn   *net.UDPConn
+	relay  *net.UDPAddr
+	local  *net.UDPAddr
+	prefix []byte
+	done   chan struct{}
+}
+
+func newLobbyUDPProxy(lr *LobbyRelay, localPort int) (*lobbyUDPProxy, error) {
+	relay, err := net.ResolveUDPAddr("udp", lr.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	role := byte(1)
+	if lr.host {
+		role = 0
+	}
+	p := &lobbyUDPProxy{
+		conn:   conn,
+		relay:  relay,
+		local:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort},
+		prefix: append(append([]byte(nil), lr.token...), role),
+		done:   make(chan struct{}),
+	}
+	SafeGo(p.forward)
+	SafeGo(p.keepalive)
+	return p, nil
+}
+
+func (p *lobbyUDPProxy) port() int {
+	return p.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (p *lobbyUDPProxy) forward() {
+	buf := make([]byte, 65536)
+	copy(buf, p.prefix)
+	payload := buf[len(p.prefix):]
+	for {
+		n, addr, err := p.conn.ReadFromUDP(payload)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if addr.Port == p.relay.Port && addr.IP.Equal(p.relay.IP) {
+			p.conn.WriteToUDP(payload[:n], p.local)
+		} else if addr.Port == p.local.Port && addr.IP.IsLoopback() {
+			p.conn.WriteToUDP(buf[:len(p.prefix)+n], p.relay)
+		}
+	}
+}
+
+// Registers the proxy with the relay and keeps NAT mappings open
+func (p *lobbyUDPProxy) keepalive() {
+	ticker := time.NewTicker(lobbyUDPKeepalive)
+	defer ticker.Stop()
+	for {
+		p.conn.WriteToUDP(p.prefix, p.relay)
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *lobbyUDPProxy) close() {
+	close(p.done)
+	p.conn.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikemen-engine/ggpo/transport"
+)
+
+// The network simulator (-netsim or Netplay.NetSim) degrades the connections
+// of netplay sessions, to reproduce a poor connection on a single machine. It
+// is set as a list of comma separated settings, eg. latency=80,jitter=15,loss=2:
+//
+//	latency  delay added to everything received, in milliseconds
+//	jitter   random variation of the delay, in milliseconds
+//	loss     percentage of packets lost
+//	seed     seed of the random numbers, for reproducible runs
+//
+// Only received data is impaired, so each side of a session has settings of
+// its own. Rollback packets delayed by different amounts can arrive out of
+// order, and lost ones are gone, as with real UDP. The TCP connections of
+// delay netcode and parties stay in order: a lost segment holds up the data
+// behind it until it would have been retransmitted.
+
+// Lowest TCP retransmission timeout
+const netsimRetransmit = 200 * time.Millisecond
+
+type NetSim struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64 // 0-1
+	mu      sync.Mutex
+	rand    *rand.Rand
+}
+
+// Parses the network simulator settings. Returns nil if spec is empty.
+func newNetSim(spec string) (*NetSim, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	ns := &NetSim{}
+	seed := time.Now().UnixNano()
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value setting", setting)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		switch key {
+		case "latency":
+			ns.Latency = time.Duration(n * float64(time.Millisecond))
+		case "jitter":
+			ns.Jitter = time.Duration(n * float64(time.Millisecond))
+		case "loss":
+			if n > 100 {
+				return nil, fmt.Errorf("invalid loss: %s", value)
+			}
+			ns.Loss = n / 100
+		case "seed":
+			seed = int64(n)
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	ns.rand = rand.New(rand.NewSource(seed))
+	return ns, nil
+}
+
+func (ns *NetSim) String() string {
+	return fmt.Sprintf("latency %v, jitter %v, loss %g%%", ns.Latency, ns.Jitter, ns.Loss*100)
+}
+
+// Draws the delay of a packet, and whether it is lost
+func (ns *NetSim) sample() (time.Duration, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	lost := ns.Loss > 0 && ns.rand.Float64() < ns.Loss
+	delay := ns.Latency
+	if ns.Jitter > 0 {
+		delay += time.Duration((ns.rand.Float64()*2 - 1) * float64(ns.Jitter))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, lost
+}
+
+// Puts conn behind a pair of loopback sockets, delaying the data received
+// from it. The returned connection is used in place of conn, and closing it
+// closes conn. Its RemoteAddr is the loopback socket's, so conn's must be read
+// before. Returns conn itself if the simulator is off.
+func (ns *NetSim) wrapTCP(conn *net.TCPConn) *net.TCPConn {
+	if ns == nil {
+		return conn
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Printf("Network simulator unavailable: %v", err)
+		return conn
+	}
+	defer ln.Close()
+	inner, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		log.Printf("Network simulator unavailable: %v", err)
+		return conn
+	}
+	outer, err := ln.AcceptTCP()
+	if err != nil {
+		inner.Close()
+		log.Printf("Network simulator unavailable: %v", err)
+		return conn
+	}
+
+	type segment struct {
+		data []byte
+		at   time.Time
+	}
+	queue := make(chan segment, 1024)
+	SafeGo(func() {
+		defer close(queue)
+		var last time.Time
+		for {
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				delay, lost := ns.sample()
+				if lost {
+					if retransmit := 2 * ns.Latency; retransmit > netsimRetransmit {
+						delay += retransmit
+					} else {
+						delay += netsimRetransmit
+					}
+				}
+				at := time.Now().Add(delay)
+				if at.Before(last) {
+					at = last
+				}
+				last = at
+				queue <- segment{buf[:n], at}
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	SafeGo(func() {
+		defer outer.Close()
+		for s := range queue {
+			time.Sleep(time.Until(s.at))
+			if _, err := outer.Write(s.data); err != nil {
+				conn.Close()
+				for range queue {
+				}
+				return
+			}
+		}
+	})
+	// Sent data goes through untouched
+	SafeGo(func() {
+		io.Copy(conn, outer)
+		conn.Close()
+	})
+	return inner
+}
+
+// GGPO transport whose received packets go through the simulator
+type netsimConnection struct {
+	transport.Connection
+	ns   *NetSim
+	done chan struct{}
+	once sync.Once
+}
+
+func (ns *NetSim) wrapUDP(c transport.Connection) transport.Connection {
+	return &netsimConnection{Connection: c, ns: ns, done: make(chan struct{})}
+}
+
+func (c *netsimConnection) Close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	c.Connection.Close()
+}
+
+func (c *netsimConnection) Read(messageChan chan transport.MessageChannelItem) {
+	received := make(chan transport.MessageChannelItem, cap(messageChan))
+	SafeGo(func() {
+		c.Connection.Read(received)
+	})
+	for {
+		select {
+		case <-c.done:
+			return
+		case item := <-received:
+			delay, lost := c.ns.sample()
+			if lost {
+				continue
+			}
+			time.AfterFunc(delay, func() {
+				select {
+				case messageChan <- item:
+				case <-c.done:
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Netplay parties let 3 or 4 players take part in a session, each on their
+// own machine. Outside of rollback matches, the host is the hub of a star of
+// TCP connections: guests send their inputs to the host, which forwards the
+// inputs of every participant to all the other guests, so every machine runs
+// the same frames as in a 2 player session. Rollback matches use a full mesh
+// of GGPO peers instead, participant n listening on UDP port partyBasePort+n.
+//
+// Participant n always controls input slot n, the host being participant 0.
+
+const (
+	partyMagic    = "IKEMENGP"
+	partyBasePort = 7600
+	MaxPartySize  = 4
+)
+
+// Sent by each guest right after the handshake
+type PartyHello struct {
+	PlayerName string `json:"player_name,omitempty"`
+	FrameDelay int    `json:"frame_delay"`
+}
+
+// Sent by the host to every guest once the party is full
+type PartyInfo struct {
+	Size       int      `json:"size"`
+	Slot       int      `json:"slot"`
+	Addresses  []string `json:"addresses"` // As seen by the host, host first
+	Names      []string `json:"names"`
+	FrameDelay int      `json:"frame_delay"` // Highest of all participants
+}
+
+// Connection from the party host to one of the guests
+type partyLink struct {
+	conn  *net.TCPConn
+	addr  string
+	hello PartyHello
+	slot  int
+	sent  [MaxPartySize]int32 // Frames of each slot forwarded to this guest
+}
+
+type NetParty struct {
+	mu    sync.Mutex
+	info  PartyInfo
+	links []*partyLink // Host only
+	ready bool
+}
+
+// Hosts a party of size participants. Unlike Accept, the connection is only
+// ready once every guest has joined.
+func (nc *NetConnection) AcceptParty(port string, size int) error {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return Error("failed to cast net.Listener to *net.TCPListener")
+	}
+
+	np := &NetParty{info: PartyInfo{Size: size}}
+	nc.ln = tcpLn
+	nc.host = true
+	nc.conn = nil
+	nc.party = np
+	nc.locIn, nc.remIn = 0, 1
+
+	if sys.cfg.Netplay.MaxSpectators > 0 {
+		if nc.spectators, err = NewSpectatorServer(sys.cfg.Netplay.SpectatorPort, sys.cfg.Netplay.MaxSpectators); err != nil {
+			log.Printf("Failed to accept spectators: %v", err)
+		}
+	}
+
+	lnLocal := nc.ln
+	SafeGo(func() {
+		defer lnLocal.Close()
+
+		for np.guests() < size-1 {
+			conn, err := lnLocal.AcceptTCP()
+			if err != nil {
+				return
+			}
+			if nc.isClosing() {
+				conn.Close()
+				return
+			}
+			if err := np.addGuest(conn); err != nil {
+				log.Printf("Netplay party: guest rejected: %v", err)
+				conn.Close()
+			}
+		}
+		np.start()
+	})
+
+	return nil
+}
+
+func (np *NetParty) guests() int {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return len(np.links)
+}
+
+func (np *NetParty) addGuest(conn *net.TCPConn) error {
+	if _, err := netplayHandshake(conn, partyMagic); err != nil {
+		return err
+	}
+	var hello PartyHello
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := readNetJSON(conn, &hello); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	np.links = append(np.links, &partyLink{
+		addr:  conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+		hello: hello,
+	})
+	log.Printf("Netplay party: %s joined (%d/%d)", conn.RemoteAddr(), len(np.links)+1, np.info.Size)
+	np.links[len(np.links)-1].conn = sys.netSim.wrapTCP(conn)
+	return nil
+}
+
+// Assigns the slots in joining order and tells every guest about the party.
+// A guest that can't be reached makes the first synchronization fail.
+func (np *NetParty) start() {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	np.info.Addresses = []string{""}
+	np.info.Names = []string{sys.cfg.Netplay.PlayerName}
+	np.info.FrameDelay = sys.cfg.Netplay.Rollback.FrameDelay
+	for i, l := range np.links {
+		l.slot = i + 1
+		np.info.Addresses = append(np.info.Addresses, l.addr)
+		np.info.Names = append(np.info.Names, l.hello.PlayerName)
+		np.info.FrameDelay = Max(np.info.FrameDelay, l.hello.FrameDelay)
+	}
+	for _, l := range np.links {
+		info := np.info
+		info.Slot = l.slot
+		_ = l.conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := writeNetJSON(l.conn, info); err != nil {
+			log.Printf("Netplay party: failed to reach %s: %v", l.addr, err)
+		}
+		_ = l.conn.SetDeadline(time.Time{})
+	}
+	np.ready = true
+}
+
+// Joins the party of the host at the other end of conn, waiting for the
+// party to be full
+func (nc *NetConnection) joinParty(conn *net.TCPConn) error {
+	hello := PartyHello{
+		PlayerName: sys.cfg.Netplay.PlayerName,
+		FrameDelay: sys.cfg.Netplay.Rollback.FrameDelay,
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeNetJSON(conn, hello); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Waiting for the other guests may take a while, so only stop when closed
+	done := make(chan struct{})
+	defer close(done)
+	SafeGo(func() {
+		select {
+		case <-nc.closing:
+			conn.Close()
+		case <-done:
+		}
+	})
+
+	var info PartyInfo
+	if err := readNetJSON(conn, &info); err != nil {
+		return err
+	}
+	if info.Size < 3 || info.Size > MaxPartySize || info.Slot < 1 || info.Slot >= info.Size ||
+		len(info.Addresses) != info.Size || len(info.Names) != info.Size {
+		return Error("invalid party info")
+	}
+	// Participants playing on the host's machine are reached at its address
+	hostIp := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	for i, addr := range info.Addresses {
+		if ip := net.ParseIP(addr); i == 0 || ip == nil || ip.IsLoopback() {
+			info.Addresses[i] = hostIp
+		}
+	}
+	nc.party = &NetParty{info: info, ready: true}
+	nc.locIn, nc.remIn = info.Slot, 0
+	log.Printf("Netplay party: joined as participant %d/%d", info.Slot+1, info.Size)
+	return nil
+}
+
+func (np *NetParty) complete() bool {
+	if np == nil {
+		return false
+	}
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return np.ready
+}
+
+func (np *NetParty) close() {
+	if np == nil {
+		return
+	}
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	for _, l := range np.links {
+		l.conn.Close()
+	}
+}
+
+// Number of players taking part in the current netplay session or replay, 0
+// when offline
+func (s *System) netplayParticipants() int {
+	nc := s.netConnection
+	if nc == nil {
+		nc = s.rollback.netConnection
+	}
+	if nc != nil {
+		if nc.party != nil {
+			return nc.party.info.Size
+		}
+		return 2
+	}
+	if s.replayFile != nil {
+		return Max(2, s.replayFile.participants)
+	}
+	return 0
+}
+
+// Input slots of the other participants
+func (nc *NetConnection) remoteInputs() []int {
+	if nc.party == nil {
+		return []int{nc.remIn}
+	}
+	var remotes []int
+	for i := 0; i < nc.party.info.Size; i++ {
+		if i != nc.locIn {
+			remotes = append(remotes, i)
+		}
+	}
+	return remotes
+}
+
+// Connections to the peers this side synchronizes with: the guests for a
+// party host, the host otherwise
+func (nc *NetConnection) peerConns() []*net.TCPConn {
+	if nc.party == nil || !nc.host {
+		return []*net.TCPConn{nc.conn}
+	}
+	conns := make([]*net.TCPConn, len(nc.party.links))
+	for i, l := range nc.party.links {
+		conns[i] = l.conn
+	}
+	return conns
+}
+
+func (nc *NetConnection) writePeersI32(i32 int32) error {
+	for _, c := range nc.peerConns() {
+		if err := writeNetI32(c, i32); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nc *NetConnection) readPeersI32() ([]int32, error) {
+	conns := nc.peerConns()
+	values := make([]int32, len(conns))
+	for i, c := range conns {
+		var err error
+		if values[i], err = readNetI32(c); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Sends the host's sync config to every guest and returns their replies
+func (nc *NetConnection) exchangeSyncHandshake(hostPayload SyncHandshake) ([]SyncHandshake, error) {
+	conns := nc.peerConns()
+	for _, c := range conns {
+		if err := writeNetJSON(c, hostPayload); err != nil {
+			return nil, err
+		}
+	}
+	replies := make([]SyncHandshake, len(conns))
+	for i, c := range conns {
+		if err := readNetJSON(c, &replies[i]); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// Starts exchanging inputs for the frames after nc.time. Guests send their
+// own inputs as in a 2 player session, and receive the others' from the
+// host as [slot][digital inputs][analog inputs] messages.
+func (np *NetParty) startInputs(nc *NetConnection) {
+	if !nc.host {
+		nc.startSending()
+		np.startReceiving(nc)
+		return
+	}
+
+	<-nc.sendEnd
+	<-nc.recvEnd
+	var wg sync.WaitGroup
+	for _, l := range np.links {
+		l := l
+		for i := range l.sent {
+			l.sent[i] = nc.time
+		}
+		wg.Add(2)
+		SafeGo(func() {
+			defer wg.Done()
+			np.receiveFrom(nc, l)
+		})
+		SafeGo(func() {
+			defer wg.Done()
+			np.forwardTo(nc, l)
+		})
+	}
+	SafeGo(func() {
+		wg.Wait()
+		nc.sendEnd <- true
+		nc.recvEnd <- true
+	})
+}
+
+// Stores one frame of digital and analog inputs in wire format
+func (nb *NetBuffer) pushFrame(b []byte) {
+	i := nb.inpT & (NETBUF_NUM_FRAMES - 1)
+	nb.buf[i] = InputBits(int16(b[0]) | int16(b[1])<<8)
+	for j := range nb.axisBuf[i] {
+		nb.axisBuf[i][j] = int8(b[2+j])
+	}
+	nb.inpT++
+}
+
+func (np *NetParty) startReceiving(nc *NetConnection) {
+	<-nc.recvEnd
+	SafeGo(func() {
+		defer func() {
+			nc.recvEnd <- true
+		}()
+		var msg [1 + REPLAY_INPUT_BYTES]byte
+		for nc.st == NS_Playing {
+			if _, err := io.ReadFull(nc.conn, msg[:1]); err != nil {
+				nc.st = NS_Error
+				return
+			}
+			slot := int(int8(msg[0]))
+			if slot < 0 {
+				// If the host sent termination signal
+				nc.st = NS_Stopped
+				return
+			}
+			if _, err := io.ReadFull(nc.conn, msg[1:]); err != nil {
+				nc.st = NS_Error
+				return
+			}
+			if slot >= np.info.Size || slot == np.info.Slot {
+				nc.st = NS_Error
+				return
+			}
+			nb := &nc.buf[slot]
+			for nb.inpT-nb.curT >= NETBUF_NUM_FRAMES && nc.st == NS_Playing {
+				time.Sleep(time.Millisecond)
+			}
+			if nc.st != NS_Playing {
+				break
+			}
+			nb.pushFrame(msg[1:])
+			nb.senT = nb.inpT
+		}
+
+		// Skip what's left up to the termination signal
+		for {
+			if _, err := io.ReadFull(nc.conn, msg[:1]); err != nil || int8(msg[0]) < 0 {
+				break
+			}
+			if _, err := io.ReadFull(nc.conn, msg[1:]); err != nil {
+				break
+			}
+		}
+	})
+}
+
+// Receives the inputs of one guest
+func (np *NetParty) receiveFrom(nc *NetConnection, l *partyLink) {
+	nb := &nc.buf[l.slot]
+	var msg [REPLAY_INPUT_BYTES]byte
+	for nc.st == NS_Playing {
+		// Check if there is space in the input buffer
+		if nb.inpT-nb.curT < NETBUF_NUM_FRAMES {
+			if _, err := io.ReadFull(l.conn, msg[:2]); err != nil {
+				nc.st = NS_Error
+				return
+			}
+			if int8(msg[1]) < 0 {
+				// If the guest sent termination signal
+				nc.st = NS_Stopped
+				return
+			}
+			if _, err := io.ReadFull(l.conn, msg[2:]); err != nil {
+				nc.st = NS_Error
+				return
+			}
+			nb.pushFrame(msg[:])
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Skip what's left up to the termination signal
+	for {
+		if _, err := io.ReadFull(l.conn, msg[:2]); err != nil || int8(msg[1]) < 0 {
+			break
+		}
+		if _, err := io.ReadFull(l.conn, msg[2:]); err != nil {
+			break
+		}
+	}
+}
+
+// Sends the inputs of every other participant to one guest
+func (np *NetParty) forwardTo(nc *NetConnection, l *partyLink) {
+	var msg [1 + REPLAY_INPUT_BYTES]byte
+	for nc.st == NS_Playing {
+		for slot := 0; slot < np.info.Size; slot++ {
+			if slot == l.slot {
+				continue
+			}
+			nb := &nc.buf[slot]
+			for sent := l.sent[slot]; sent < nb.inpT; sent++ {
+				i := sent & (NETBUF_NUM_FRAMES - 1)
+				msg[0] = byte(slot)
+				msg[1], msg[2] = byte(nb.buf[i]), byte(nb.buf[i]>>8)
+				for j, a := range nb.axisBuf[i] {
+					msg[3+j] = byte(a)
+				}
+				if _, err := l.conn.Write(msg[:]); err != nil {
+					nc.st = NS_Error
+					return
+				}
+				np.mu.Lock()
+				l.sent[slot] = sent + 1
+				np.mu.Unlock()
+			}
+		}
+		np.updateSent(nc)
+		time.Sleep(time.Millisecond)
+	}
+	// Write termination signal to indicate no more input frames
+	l.conn.Write([]byte{0xff})
+}
+
+// On the host, a frame of inputs counts as sent once every guest that needs
+// it has it
+func (np *NetParty) updateSent(nc *NetConnection) {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	for slot := 0; slot < np.info.Size; slot++ {
+		senT := nc.buf[slot].inpT
+		for _, l := range np.links {
+			if l.slot != slot {
+				senT = Min(senT, l.sent[slot])
+			}
+		}
+		nc.buf[slot].senT = senT
+	}
+}
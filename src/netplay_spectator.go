@@ -0,0 +1,995 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	ggpo "github.com/ikemen-engine/ggpo"
+)
+
+// Spectators are read-only connections to the netplay host. The host keeps
+// the session's replay stream in memory, in the uncompressed v1 format (sync
+// header, per-match seed and pre-match time, confirmed inputs), and sends it to
+// the spectators as new data is confirmed. Spectators play that stream back
+// as a replay, a configurable number of frames behind the players.
+//
+// Spectators that connect while the host still has the whole stream receive
+// all of it, and play back the menus between matches too. Joining later works
+// by fast-forwarding through it, without rendering, until playback reaches the
+// live delay.
+//
+// During matches, the host also takes a keyframe every few seconds: the game
+// state serialized with encodeGameState, along with the selection and settings
+// the match was loaded with and its seed. Data before the latest keyframe is
+// dropped once every connected spectator has received it. Spectators that
+// connect after that join at the latest keyframe instead. They load the match
+// from the context, replace the game state with the keyframe's, and play back
+// the inputs from that frame on. The menus aren't sent to them; after a match
+// ends, they wait for the next one to start.
+//
+// Such spectators receive records of 1 byte type + uint32 length + data:
+// stream data, keyframes (uint32 context length, JSON context, game state),
+// and the end of a match.
+
+const (
+	spectatorMagic     = "IKSPECTR"
+	spectatorFullMagic = "IKSPFULL"
+	spectatorJoinMagic = "IKSPJOIN"
+
+	spectatorRecordData     = 'D'
+	spectatorRecordKeyframe = 'K'
+	spectatorRecordEnd      = 'E'
+
+	// Size of one frame of inputs for all controllers
+	replayFrameBytes = REPLAY_NUM_INPUTS * REPLAY_INPUT_BYTES
+	// Playback fast-forwards while more than this many frames beyond the
+	// configured delay are buffered
+	spectatorCatchUpFrames = 30
+	// Frames between two keyframes
+	spectatorKeyframeInterval = 300
+	// State ID used for keyframes of delay netplay matches. Kept away from the
+	// IDs used by rollback and replay seeking.
+	spectatorKeyframeStateID = replayKeyframeStateBase - 3
+)
+
+// -----------------------------------------------------------------------------
+// Host side
+// -----------------------------------------------------------------------------
+
+// SpectatorServer accepts spectators and broadcasts the replay stream to them
+type SpectatorServer struct {
+	ln     *net.TCPListener
+	mu     sync.Mutex
+	cond   *sync.Cond
+	header []byte
+	data   []byte
+	base   int // Stream offset of data[0]
+	conns  map[*net.TCPConn]*spectatorConn
+	count  int
+	max    int
+	closed bool
+	// Keyframes for spectators that join late
+	keep     int                // Stream offset of the latest keyframe
+	keyframe *spectatorKeyframe // Latest keyframe of the match in progress
+	ends     map[int]int        // Stream offset where each finished match ends
+	// Only used by the game thread
+	match        int // Number of matches started
+	inMatch      bool
+	context      SpectatorMatchContext
+	frames       int32 // Number of frames written
+	nextKeyframe int32
+	keyframeErr  bool
+}
+
+type spectatorConn struct {
+	pos   int  // Stream offset reached, -1 if no data is needed
+	late  bool // Joins at keyframes
+	match int  // Match of the last keyframe sent
+}
+
+type spectatorKeyframe struct {
+	match  int
+	offset int // Stream offset of the keyframe's inputs
+	record []byte
+}
+
+func NewSpectatorServer(port string, max int) (*SpectatorServer, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("failed to cast net.Listener to *net.TCPListener")
+	}
+	ss := &SpectatorServer{ln: tcpLn, max: max,
+		conns: make(map[*net.TCPConn]*spectatorConn), ends: make(map[int]int)}
+	ss.cond = sync.NewCond(&ss.mu)
+	SafeGo(ss.acceptLoop)
+	log.Printf("Accepting up to %d spectators on port %s", max, port)
+	return ss, nil
+}
+
+func (ss *SpectatorServer) acceptLoop() {
+	for {
+		conn, err := ss.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		ss.mu.Lock()
+		full := ss.count >= ss.max
+		closed := ss.closed
+		// Reserve the stream from the start before unlocking, so that it
+		// isn't dropped while the handshake is in progress. Once the start
+		// is gone, the spectator joins at the next keyframe.
+		sc := &spectatorConn{late: ss.base > 0}
+		if sc.late {
+			sc.pos = -1
+		}
+		if !full && !closed {
+			ss.count++
+			ss.conns[conn] = sc
+		}
+		ss.mu.Unlock()
+		if closed {
+			conn.Close()
+			return
+		}
+		if full {
+			_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+			conn.Write([]byte(spectatorFullMagic))
+			conn.Close()
+			continue
+		}
+		SafeGo(func() {
+			defer func() {
+				ss.mu.Lock()
+				ss.count--
+				delete(ss.conns, conn)
+				ss.trim()
+				ss.mu.Unlock()
+			}()
+			ss.serve(conn, sc)
+		})
+	}
+}
+
+func (ss *SpectatorServer) serve(conn *net.TCPConn, sc *spectatorConn) {
+	defer conn.Close()
+
+	// Don't allow the handshake to block forever
+	magic := spectatorMagic
+	if sc.late {
+		magic = spectatorJoinMagic
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(magic)); err != nil {
+		return
+	}
+	ack := make([]byte, len(spectatorMagic))
+	if _, err := io.ReadFull(conn, ack); err != nil || string(ack) != spectatorMagic {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	log.Printf("Spectator connected: %v", conn.RemoteAddr())
+
+	var err error
+	if sc.late {
+		err = ss.serveKeyframes(conn, sc)
+	} else {
+		err = ss.serveStream(conn, sc)
+	}
+	if err != nil {
+		log.Printf("Spectator disconnected: %v", conn.RemoteAddr())
+	}
+}
+
+// Sends the whole stream so far to a spectator, then keeps it up to date
+func (ss *SpectatorServer) serveStream(conn *net.TCPConn, sc *spectatorConn) error {
+	for {
+		ss.mu.Lock()
+		pos := sc.pos
+		for pos == ss.base+len(ss.data) && !ss.closed {
+			ss.cond.Wait()
+		}
+		// Data is only ever appended, and trimming copies what is kept, so
+		// the chunk stays valid after unlocking
+		chunk := ss.data[pos-ss.base:]
+		closed := ss.closed
+		ss.mu.Unlock()
+
+		if len(chunk) == 0 && closed {
+			return nil
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return err
+		}
+		ss.mu.Lock()
+		sc.pos = pos + len(chunk)
+		ss.trim()
+		ss.mu.Unlock()
+	}
+}
+
+// Sends the latest keyframe of each match to a spectator, followed by the
+// match's inputs from that frame on
+func (ss *SpectatorServer) serveKeyframes(conn *net.TCPConn, sc *spectatorConn) error {
+	ss.mu.Lock()
+	header := ss.header
+	ss.mu.Unlock()
+	if err := writeSpectatorRecord(conn, spectatorRecordData, header); err != nil {
+		return err
+	}
+	for {
+		ss.mu.Lock()
+		for !ss.closed && (ss.keyframe == nil || ss.keyframe.match == sc.match) {
+			ss.cond.Wait()
+		}
+		if ss.closed {
+			ss.mu.Unlock()
+			return nil
+		}
+		kf := ss.keyframe
+		sc.match = kf.match
+		sc.pos = kf.offset
+		ss.mu.Unlock()
+		if err := writeSpectatorRecord(conn, spectatorRecordKeyframe, kf.record); err != nil {
+			return err
+		}
+
+		for {
+			ss.mu.Lock()
+			end, ended := ss.ends[sc.match]
+			for sc.pos == ss.base+len(ss.data) && !ended && !ss.closed {
+				ss.cond.Wait()
+				end, ended = ss.ends[sc.match]
+			}
+			limit := ss.base + len(ss.data)
+			if ended {
+				limit = end
+			}
+			chunk := ss.data[sc.pos-ss.base : limit-ss.base]
+			ss.mu.Unlock()
+
+			if len(chunk) > 0 {
+				if err := writeSpectatorRecord(conn, spectatorRecordData, chunk); err != nil {
+					return err
+				}
+				ss.mu.Lock()
+				sc.pos += len(chunk)
+				ss.trim()
+				ss.mu.Unlock()
+				continue
+			}
+			if !ended {
+				// Closed
+				return nil
+			}
+			if err := writeSpectatorRecord(conn, spectatorRecordEnd, nil); err != nil {
+				return err
+			}
+			ss.mu.Lock()
+			sc.pos = -1
+			ss.trim()
+			ss.mu.Unlock()
+			break
+		}
+	}
+}
+
+func writeSpectatorRecord(w io.Writer, kind byte, p []byte) error {
+	buf := make([]byte, 5, 5+len(p))
+	buf[0] = kind
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(p)))
+	_, err := w.Write(append(buf, p...))
+	return err
+}
+
+// Drops the data before the latest keyframe that every connection has
+// received. Nothing is dropped before the first keyframe, so spectators that
+// connect early get the whole stream. Only done when at least half of the
+// buffer can go, so that the kept data isn't copied on every frame. Must be
+// called with ss.mu held.
+func (ss *SpectatorServer) trim() {
+	end := ss.keep
+	for _, sc := range ss.conns {
+		if sc.pos >= 0 {
+			end = Min(end, sc.pos)
+		}
+	}
+	if n := end - ss.base; n > 0 && n >= len(ss.data)/2 {
+		ss.data = append([]byte(nil), ss.data[n:]...)
+		ss.base = end
+	}
+}
+
+// Appends raw replay stream data and wakes up the spectator connections
+func (ss *SpectatorServer) Write(p []byte) (int, error) {
+	if ss == nil {
+		return len(p), nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return 0, io.ErrClosedPipe
+	}
+	ss.data = append(ss.data, p...)
+	ss.cond.Broadcast()
+	return len(p), nil
+}
+
+// The sync header is only sent once per session
+func (ss *SpectatorServer) WriteHeader(header *ReplayHeader) {
+	if ss == nil || ss.header != nil || header == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeReplayHeader(&buf, header, replayFormatV1); err != nil {
+		log.Printf("Error while writing spectator header: %v", err)
+		return
+	}
+	ss.mu.Lock()
+	ss.header = buf.Bytes()
+	ss.mu.Unlock()
+	ss.Write(buf.Bytes())
+}
+
+// A sync written while game() runs starts a match, or the next fight of a
+// Turns mode match. The one written when game() returns ends the match.
+func (ss *SpectatorServer) WriteSync(seed, pmTime int32) {
+	if ss == nil {
+		return
+	}
+	if sys.gameRunning {
+		if !ss.inMatch {
+			ss.match++
+			ss.inMatch = true
+			ss.keyframeErr = false
+		}
+		ss.context = newSpectatorMatchContext(seed, pmTime)
+		ss.nextKeyframe = ss.frames
+	} else if ss.inMatch {
+		ss.inMatch = false
+		ss.mu.Lock()
+		ss.ends[ss.match] = ss.base + len(ss.data)
+		ss.keyframe = nil
+		ss.cond.Broadcast()
+		ss.mu.Unlock()
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(seed))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(pmTime))
+	ss.Write(buf[:])
+}
+
+func (ss *SpectatorServer) WriteFrame(ibit *[REPLAY_NUM_INPUTS]InputBits, axes *[REPLAY_NUM_INPUTS][6]int8) {
+	if ss == nil {
+		return
+	}
+	var buf bytes.Buffer
+	buf.Grow(replayFrameBytes)
+	for i := range ibit {
+		writeReplayInput(&buf, ibit[i], axes[i])
+	}
+	ss.Write(buf.Bytes())
+	ss.frames++
+}
+
+// Whether a keyframe should be taken
+func (ss *SpectatorServer) keyframeDue() bool {
+	return ss != nil && ss.inMatch && !ss.keyframeErr && ss.frames >= ss.nextKeyframe
+}
+
+// Makes a saved state the keyframe that spectators join at. The inputs of
+// the frame it was taken before start back bytes before the end of the stream.
+func (ss *SpectatorServer) writeKeyframe(gs *GameState, back int) {
+	ss.nextKeyframe = ss.frames + spectatorKeyframeInterval
+	state, err := encodeGameState(gs)
+	if err != nil {
+		// The same data would fail again, so spectators can't join this match
+		log.Printf("Failed to take a spectator keyframe: %v", err)
+		ss.keyframeErr = true
+		return
+	}
+	context, err := json.Marshal(&ss.context)
+	if err != nil {
+		log.Printf("Failed to take a spectator keyframe: %v", err)
+		ss.keyframeErr = true
+		return
+	}
+	record := make([]byte, 4, 4+len(context)+len(state))
+	binary.LittleEndian.PutUint32(record, uint32(len(context)))
+	record = append(append(record, context...), state...)
+
+	ss.mu.Lock()
+	offset := Max(ss.base, ss.base+len(ss.data)-back)
+	ss.keyframe = &spectatorKeyframe{match: ss.match, offset: offset, record: record}
+	ss.keep = offset
+	ss.trim()
+	ss.cond.Broadcast()
+	ss.mu.Unlock()
+}
+
+// Takes keyframes during delay netplay matches, at the start of a frame. The
+// inputs of that frame are the last ones written.
+func (ss *SpectatorServer) stepKeyframe() {
+	if !ss.keyframeDue() {
+		return
+	}
+	prevID := sys.savePool.curStateID
+	sys.savePool.curStateID = spectatorKeyframeStateID
+	gs := NewGameState()
+	gs.quiet = true
+	gs.SaveState(spectatorKeyframeStateID)
+	ss.writeKeyframe(gs, replayFrameBytes)
+	if a, ok := sys.arenaSaveMap[spectatorKeyframeStateID]; ok {
+		a.Free()
+		delete(sys.arenaSaveMap, spectatorKeyframeStateID)
+	}
+	sys.savePool.Free(spectatorKeyframeStateID)
+	sys.savePool.curStateID = prevID
+}
+
+// Stops accepting spectators. Connected spectators still receive the rest of
+// the stream before being disconnected.
+func (ss *SpectatorServer) Close() {
+	if ss == nil {
+		return
+	}
+	ss.mu.Lock()
+	ss.closed = true
+	ss.cond.Broadcast()
+	ss.mu.Unlock()
+	ss.ln.Close()
+}
+
+// Sends rollback frames that can no longer be rolled back to the spectators.
+// When final is set, every recorded frame is sent. Keyframes are taken from
+// the states rollback keeps.
+func (rs *RollbackSession) flushSpectatorFrames(final bool) {
+	if rs == nil || rs.spectators == nil {
+		return
+	}
+	limit := int(rs.netTime) - ggpo.MaxPredictionFrames - 1
+	if final {
+		limit = int(rs.netTime)
+	}
+	limit = Min(limit, len(rs.replayInputs), len(rs.replayAnalogInputs))
+	for ; rs.spectatorFrame < limit; rs.spectatorFrame++ {
+		if rs.spectators.keyframeDue() {
+			if gs := rs.desync.stateBefore(int32(rs.spectatorFrame)); gs != nil {
+				rs.spectators.writeKeyframe(gs, 0)
+			}
+		}
+		rs.spectators.WriteFrame(&rs.replayInputs[rs.spectatorFrame], &rs.replayAnalogInputs[rs.spectatorFrame])
+	}
+}
+
+// SpectatorMatchContext is what a spectator that joins late needs to load a
+// match like the players did. The rest comes from the game state.
+type SpectatorMatchContext struct {
+	GameMode       string
+	Selected       [2][][2]int
+	Stage          int
+	Params         []string
+	CdefOverwrite  map[int]string
+	PalOverwrite   map[int]int
+	SdefOverwrite  string
+	TeamMode       [2]TeamMode
+	NumSimul       [2]int32
+	NumTurns       [2]int32
+	MatchWins      [2]int32
+	MaxDraws       [2]int32
+	Wins           [2]int32
+	Match          int32
+	RoundTime      int32
+	FramesPerCount int32
+	AiLevel        [MaxPlayerNo]float32
+	InputRemap     [MaxPlayerNo]int
+	Seed           int32
+	PreMatchTime   int32
+}
+
+func newSpectatorMatchContext(seed, pmTime int32) SpectatorMatchContext {
+	mc := SpectatorMatchContext{
+		GameMode:       sys.gameMode,
+		Stage:          sys.sel.selectedStageNo,
+		CdefOverwrite:  make(map[int]string),
+		PalOverwrite:   make(map[int]int),
+		SdefOverwrite:  sys.sel.sdefOverwrite,
+		TeamMode:       sys.tmode,
+		NumSimul:       sys.numSimul,
+		NumTurns:       sys.numTurns,
+		MatchWins:      sys.matchWins,
+		MaxDraws:       sys.maxDraws,
+		Wins:           sys.wins,
+		Match:          sys.match,
+		RoundTime:      sys.maxRoundTime,
+		FramesPerCount: sys.curFramesPerCount,
+		AiLevel:        sys.aiLevel,
+		InputRemap:     sys.inputRemap,
+		Seed:           seed,
+		PreMatchTime:   pmTime,
+	}
+	for i := range sys.sel.selected {
+		mc.Selected[i] = append([][2]int(nil), sys.sel.selected[i]...)
+	}
+	if sys.sel.gameParams != nil {
+		mc.Params = append([]string(nil), sys.sel.gameParams.Raw...)
+	}
+	for k, v := range sys.sel.cdefOverwrite {
+		mc.CdefOverwrite[k] = v
+	}
+	for k, v := range sys.sel.palOverwrite {
+		mc.PalOverwrite[k] = v
+	}
+	return mc
+}
+
+// Selects the match and starts loading it, like the loadStart Lua function
+func (mc *SpectatorMatchContext) apply() error {
+	if mc.Stage < 0 || mc.Stage > len(sys.sel.stagelist) {
+		return Error("The host selected a stage that isn't in the select list")
+	}
+	sys.gameMode = mc.GameMode
+	sys.tmode = mc.TeamMode
+	sys.numSimul = mc.NumSimul
+	sys.numTurns = mc.NumTurns
+	sys.sel.ClearSelected()
+	for tn := range mc.Selected {
+		for _, c := range mc.Selected[tn] {
+			if c[0] < 0 || c[0] >= len(sys.sel.charlist) || !sys.sel.AddSelectedChar(tn, c[0], c[1]) {
+				return Error("The host selected a character that isn't in the select list")
+			}
+		}
+	}
+	sys.sel.SelectStage(mc.Stage)
+	sys.sel.cdefOverwrite = mc.CdefOverwrite
+	sys.sel.palOverwrite = mc.PalOverwrite
+	sys.sel.sdefOverwrite = mc.SdefOverwrite
+	sys.matchWins = mc.MatchWins
+	sys.maxDraws = mc.MaxDraws
+	sys.match = mc.Match
+	sys.maxRoundTime = mc.RoundTime
+	sys.curFramesPerCount = mc.FramesPerCount
+	sys.aiLevel = mc.AiLevel
+	sys.inputRemap = mc.InputRemap
+
+	sys.sel.gameParams.ResetFromMotif(&sys.motif)
+	sys.sel.music = make(Music)
+	if len(mc.Params) > 0 {
+		sys.sel.gameParams.AppendParams(mc.Params)
+		sys.sel.music.AppendParams(sys.sel.gameParams.MusicEntries())
+	}
+
+	// Turns mode loads the member that is up next
+	sys.loaderReset()
+	sys.wins = mc.Wins
+	sys.loader.runTread()
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Spectator side
+// -----------------------------------------------------------------------------
+
+// SpectatorStream receives the host's replay stream. It is read like a replay
+// file; reads block until enough data arrives, and seeking is possible within
+// everything received so far.
+type SpectatorStream struct {
+	conn       net.Conn
+	mu         sync.Mutex
+	cond       *sync.Cond
+	data       []byte
+	pos        int64
+	delay      int32
+	connected  bool
+	ended      bool
+	closed     bool
+	catchingUp bool
+	err        error
+	// Joined at keyframes. data then holds the header, followed by the inputs
+	// of each keyframe received.
+	late      bool
+	keyframes []*SpectatorKeyframe
+	next      int // Keyframe returned by NextKeyframe next
+	cur       int // Keyframe being played back, -1 before the first
+}
+
+// SpectatorKeyframe is where a spectator that joined late starts a match
+type SpectatorKeyframe struct {
+	context SpectatorMatchContext
+	state   []byte
+	index   int
+	offset  int64 // Where its inputs start in the received data
+	end     int64 // Where the match's inputs end, -1 until it is over
+}
+
+func parseSpectatorKeyframe(p []byte) (*SpectatorKeyframe, error) {
+	if len(p) < 4 || int(binary.LittleEndian.Uint32(p)) > len(p)-4 {
+		return nil, Error("Invalid spectator keyframe")
+	}
+	n := 4 + int(binary.LittleEndian.Uint32(p))
+	kf := &SpectatorKeyframe{state: p[n:], end: -1}
+	if err := json.Unmarshal(p[4:n], &kf.context); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+// Starts connecting to a host in the background
+func DialSpectatorStream(server, port string, delay int32) *SpectatorStream {
+	ss := &SpectatorStream{delay: Max(0, delay), catchingUp: true, cur: -1}
+	ss.cond = sync.NewCond(&ss.mu)
+	SafeGo(func() {
+		d := net.Dialer{Timeout: 1 * time.Second}
+		for {
+			if ss.isClosed() {
+				return
+			}
+			conn, err := d.Dial("tcp", server+":"+port)
+			if err != nil {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			// Wait for host handshake
+			_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, len(spectatorMagic))
+			if _, err = io.ReadFull(conn, buf); err != nil {
+				conn.Close()
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if string(buf) == spectatorFullMagic {
+				conn.Close()
+				ss.end(Error("The host does not accept more spectators"))
+				return
+			}
+			late := string(buf) == spectatorJoinMagic
+			if string(buf) != spectatorMagic && !late {
+				conn.Close()
+				ss.end(Error("The host is not accepting spectators"))
+				return
+			}
+			if _, err := conn.Write([]byte(spectatorMagic)); err != nil {
+				conn.Close()
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			_ = conn.SetDeadline(time.Time{})
+
+			ss.mu.Lock()
+			if ss.closed {
+				ss.mu.Unlock()
+				conn.Close()
+				return
+			}
+			ss.conn = conn
+			ss.connected = true
+			ss.late = late
+			ss.mu.Unlock()
+			if late {
+				ss.receiveRecords(conn)
+			} else {
+				ss.receive(conn)
+			}
+			return
+		}
+	})
+	return ss
+}
+
+func (ss *SpectatorStream) receive(conn net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			ss.mu.Lock()
+			ss.data = append(ss.data, buf[:n]...)
+			ss.cond.Broadcast()
+			ss.mu.Unlock()
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			ss.end(err)
+			return
+		}
+	}
+}
+
+func (ss *SpectatorStream) receiveRecords(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var head [5]byte
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			ss.end(err)
+			return
+		}
+		p := make([]byte, binary.LittleEndian.Uint32(head[1:]))
+		if _, err := io.ReadFull(r, p); err != nil {
+			ss.end(err)
+			return
+		}
+		var kf *SpectatorKeyframe
+		if head[0] == spectatorRecordKeyframe {
+			var err error
+			if kf, err = parseSpectatorKeyframe(p); err != nil {
+				ss.end(err)
+				return
+			}
+		}
+		ss.mu.Lock()
+		switch head[0] {
+		case spectatorRecordData:
+			ss.data = append(ss.data, p...)
+		case spectatorRecordKeyframe:
+			kf.index = len(ss.keyframes)
+			kf.offset = int64(len(ss.data))
+			ss.keyframes = append(ss.keyframes, kf)
+		case spectatorRecordEnd:
+			if n := len(ss.keyframes); n > 0 {
+				ss.keyframes[n-1].end = int64(len(ss.data))
+			}
+		}
+		ss.cond.Broadcast()
+		ss.mu.Unlock()
+	}
+}
+
+func (ss *SpectatorStream) end(err error) {
+	ss.mu.Lock()
+	ss.ended = true
+	if ss.err == nil && !ss.closed {
+		ss.err = err
+	}
+	ss.cond.Broadcast()
+	ss.mu.Unlock()
+}
+
+func (ss *SpectatorStream) isClosed() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.closed
+}
+
+// Whether the sync header has been received, or the connection has failed
+func (ss *SpectatorStream) Ready() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.ended {
+		return true
+	}
+	if !ss.connected || len(ss.data) < len(replayMagic) {
+		return false
+	}
+	if string(ss.data[:len(replayMagic)]) != replayMagic {
+		return true
+	}
+	n := len(replayMagic) + 2 + 4
+	if len(ss.data) < n {
+		return false
+	}
+	return len(ss.data) >= n+int(binary.LittleEndian.Uint32(ss.data[n-4:n]))
+}
+
+func (ss *SpectatorStream) Err() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.err == nil && ss.ended && len(ss.data) == 0 {
+		return Error("The host closed the connection")
+	}
+	return ss.err
+}
+
+// Total amount of data received so far
+func (ss *SpectatorStream) Size() int64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return int64(len(ss.data))
+}
+
+// Amount of data received but not read yet
+func (ss *SpectatorStream) Buffered() int64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return int64(len(ss.data)) - ss.pos
+}
+
+// Whether n bytes can be read while staying the configured delay behind the
+// live stream. Once the host is gone or the match is over, the delay no
+// longer applies.
+func (ss *SpectatorStream) Available(n int64) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.late {
+		if ss.cur < 0 {
+			return false
+		}
+		if end := ss.keyframes[ss.cur].end; end >= 0 {
+			return ss.pos+n <= end
+		}
+	}
+	if ss.ended || ss.closed {
+		return true
+	}
+	return int64(len(ss.data))-ss.pos >= n+int64(ss.delay)*replayFrameBytes
+}
+
+// Whether reading n bytes would go past the inputs of the current match, for
+// spectators that joined late, which only receive the inputs of matches
+func (ss *SpectatorStream) OutsideMatch(n int64) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.late {
+		return false
+	}
+	if ss.cur < 0 {
+		return true
+	}
+	end := ss.keyframes[ss.cur].end
+	return end >= 0 && ss.pos+n > end
+}
+
+// Whether the spectator joined at keyframes
+func (ss *SpectatorStream) Late() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.late
+}
+
+// Returns the next keyframe received, if any. ended is set once no more can
+// arrive.
+func (ss *SpectatorStream) NextKeyframe() (kf *SpectatorKeyframe, ended bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.next < len(ss.keyframes) {
+		kf = ss.keyframes[ss.next]
+		ss.next++
+		return kf, false
+	}
+	return nil, ss.ended || ss.closed
+}
+
+// Moves playback to the inputs of a keyframe, then catches up from there
+func (ss *SpectatorStream) Join(kf *SpectatorKeyframe) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.cur = kf.index
+	ss.pos = kf.offset
+	ss.catchingUp = true
+}
+
+// Whether playback should fast-forward to reach the live delay. This only
+// happens after joining; rewinding later on plays back at normal speed.
+func (ss *SpectatorStream) CatchingUp() bool {
+	if !ss.catchingUp {
+		return false
+	}
+	if ss.Buffered() <= int64(ss.delay+spectatorCatchUpFrames)*replayFrameBytes {
+		ss.catchingUp = false
+	}
+	return ss.catchingUp
+}
+
+func (ss *SpectatorStream) Read(p []byte) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for ss.pos >= int64(len(ss.data)) && !ss.ended && !ss.closed {
+		ss.cond.Wait()
+	}
+	if ss.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if ss.pos >= int64(len(ss.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, ss.data[ss.pos:])
+	ss.pos += int64(n)
+	return n, nil
+}
+
+func (ss *SpectatorStream) Seek(offset int64, whence int) (int64, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ss.pos
+	case io.SeekEnd:
+		offset += int64(len(ss.data))
+	default:
+		return ss.pos, Error("Invalid seek whence")
+	}
+	if offset < 0 || offset > int64(len(ss.data)) {
+		return ss.pos, Error("Seek outside of the received spectator stream")
+	}
+	ss.pos = offset
+	return ss.pos, nil
+}
+
+func (ss *SpectatorStream) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return nil
+	}
+	ss.closed = true
+	ss.cond.Broadcast()
+	if ss.conn != nil {
+		ss.conn.Close()
+	}
+	return nil
+}
+
+// Opens the stream for playback once Ready returns true
+func OpenSpectatorReplay(ss *SpectatorStream) (*ReplayFile, error) {
+	if err := ss.Err(); err != nil {
+		ss.Close()
+		return nil, err
+	}
+	rf := newReplayFile(ss, "spectator stream")
+	if rf == nil {
+		ss.Close()
+		return nil, Error("Invalid spectator stream")
+	}
+	rf.stream = ss
+	return rf, nil
+}
+
+// Starts the match of the keyframe a late spectator joined at, instead of
+// reading a sync. Returns false if no keyframe is pending.
+func (rf *ReplayFile) joinKeyframe() bool {
+	kf := rf.keyframe
+	if kf == nil {
+		return false
+	}
+	rf.keyframe = nil
+	rf.stream.Join(kf)
+	Srand(kf.context.Seed)
+	rf.preMatchTime = kf.context.PreMatchTime
+	rf.frame = 0
+	rf.keyframeState = kf.state
+	rf.Update()
+	log.Printf("Spectator joined at a keyframe: seed=%d pmTime=%d", kf.context.Seed, kf.context.PreMatchTime)
+	return true
+}
+
+// Replaces the game state with the keyframe's, at the start of the first frame
+func (rf *ReplayFile) loadKeyframeState() {
+	gs, err := decodeGameState(rf.keyframeState)
+	rf.keyframeState = nil
+	if err == nil && len(gs.commandLists) < len(sys.commandLists) {
+		err = Error("The host uses fewer controllers")
+	}
+	if err != nil {
+		log.Printf("Failed to load spectator keyframe: %v", err)
+		sys.sessionWarning = "Failed to join the match: " + err.Error()
+		sys.esc = true
+		return
+	}
+	gs.quiet = true
+	rf.loadState(gs)
+}
+
+// Splits "host[:port]", falling back to the configured spectator port
+func spectatorAddress(addr string) (host, port string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+	return addr, sys.cfg.Netplay.SpectatorPort
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Debug mode profiler for character code. While on, it counts how many times
+// each controller of each state runs and how long it takes, so creators can
+// find the states that slow a match down.
+//
+// Controllers are numbered from 0 in the order they appear in their state or
+// ZSS function. The triggers of a block are timed apart from its controllers,
+// under the number of the first controller they guard. Function calls include
+// the time of the controllers of the function.
+
+// Rows shown in the debug display
+const profilerRows = 12
+
+type profKey struct {
+	playerNo int    // Player owning the code
+	stateNo  int32  // Not used in functions
+	function string // ZSS function the controller is in
+	index    int32
+	ctrl     string // Controller type, or "trigger"
+	call     string // Function called by callFunction
+}
+
+type profEntry struct {
+	profKey
+	char  string
+	count int64
+	time  time.Duration
+}
+
+type Profiler struct {
+	active   bool
+	entries  map[profKey]*profEntry
+	frames   int64
+	function string // ZSS function being run
+}
+
+func (pr *Profiler) reset() {
+	pr.entries = make(map[profKey]*profEntry)
+	pr.frames = 0
+}
+
+func (pr *Profiler) toggle(on bool) {
+	pr.active = on
+	if on && pr.entries == nil {
+		pr.reset()
+	}
+}
+
+// Numbers the controllers of a state or function for the profiler. Returns
+// the number of each controller in ctrls
+func indexCtrls(ctrls []StateController, n *int32) []int32 {
+	indexes := make([]int32, len(ctrls))
+	for i, sc := range ctrls {
+		indexes[i] = *n
+		if b, ok := sc.(StateBlock); ok {
+			b.indexCtrls(n)
+			ctrls[i] = b
+		} else {
+			*n++
+		}
+	}
+	return indexes
+}
+
+func (b *StateBlock) indexCtrls(n *int32) {
+	b.ctrlIndex = *n
+	b.ctrlIndexes = indexCtrls(b.ctrls, n)
+	if b.elseBlock != nil {
+		b.elseBlock.indexCtrls(n)
+	}
+}
+
+func (pr *Profiler) add(index int32, ctrl, call string, d time.Duration) {
+	k := profKey{playerNo: sys.workingState.playerNo, index: index, ctrl: ctrl, call: call}
+	if pr.function != "" {
+		k.function = pr.function
+	} else {
+		k.stateNo = sys.workingState.stateNo
+	}
+	e, ok := pr.entries[k]
+	if !ok {
+		e = &profEntry{profKey: k, char: sys.cgi[k.playerNo].displayname}
+		pr.entries[k] = e
+	}
+	e.count++
+	e.time += d
+}
+
+// Evaluates the triggers of a block
+func (pr *Profiler) trigger(b *StateBlock, c *Char) bool {
+	if !pr.active {
+		return b.trigger.evalB(c)
+	}
+	start := time.Now()
+	ok := b.trigger.evalB(c)
+	pr.add(b.ctrlIndex, "trigger", "", time.Since(start))
+	return ok
+}
+
+// Runs the controller at ctrls[i]. indexes holds the numbers indexCtrls gave
+// the controllers
+func (pr *Profiler) run(c *Char, ps []int32, ctrls []StateController, indexes []int32, i int) bool {
+	sc := ctrls[i]
+	if !pr.active {
+		return sc.Run(c, ps)
+	}
+	// Blocks time their own triggers and controllers
+	if _, ok := sc.(StateBlock); ok {
+		return sc.Run(c, ps)
+	}
+	start := time.Now()
+	changeState := sc.Run(c, ps)
+	d := time.Since(start)
+	var call string
+	if cf, ok := sc.(callFunction); ok {
+		call = cf.name
+	}
+	pr.add(indexes[i], reflect.TypeOf(sc).Name(), call, d)
+	return changeState
+}
+
+// Entries sorted by total time
+func (pr *Profiler) sorted() []*profEntry {
+	list := make([]*profEntry, 0, len(pr.entries))
+	for _, e := range pr.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].time != list[j].time {
+			return list[i].time > list[j].time
+		}
+		return list[i].count > list[j].count
+	})
+	return list
+}
+
+func (e *profEntry) location() string {
+	if e.function != "" {
+		return "Function " + e.function
+	}
+	return fmt.Sprintf("State %v", e.stateNo)
+}
+
+func (e *profEntry) name() string {
+	if e.call != "" {
+		return e.ctrl + " " + e.call
+	}
+	return e.ctrl
+}
+
+// Time per frame the profiler was on
+func (pr *Profiler) perFrame(d time.Duration) time.Duration {
+	if pr.frames == 0 {
+		return 0
+	}
+	return d / time.Duration(pr.frames)
+}
+
+// Lines for the debug display
+func (pr *Profiler) lines() []string {
+	var total time.Duration
+	list := pr.sorted()
+	for _, e := range list {
+		if e.ctrl != "callFunction" {
+			total += e.time
+		}
+	}
+	out := []string{fmt.Sprintf("Profiler: %v frames, %v per frame", pr.frames, pr.perFrame(total))}
+	for i, e := range list {
+		if i >= profilerRows {
+			break
+		}
+		out = append(out, fmt.Sprintf("P%v %v %v #%v %v: %vx %v (%v per frame)", e.playerNo+1, e.char,
+			e.location(), e.index, e.name(), e.count, e.time.Round(time.Microsecond),
+			pr.perFrame(e.time).Round(time.Nanosecond*100)))
+	}
+	return out
+}
+
+// Writes the entries to a .json file, or a .csv file for other extensions
+func (pr *Profiler) dump(filename string) error {
+	list := pr.sorted()
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	us := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Microsecond)
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		type jsonEntry struct {
+			Player     int     `json:"player"`
+			Char       string  `json:"char"`
+			State      *int32  `json:"state,omitempty"`
+			Function   string  `json:"function,omitempty"`
+			Index      int32   `json:"index"`
+			Controller string  `json:"controller"`
+			Call       string  `json:"call,omitempty"`
+			Count      int64   `json:"count"`
+			TotalUs    float64 `json:"total_us"`
+			PerFrameUs float64 `json:"per_frame_us"`
+			PerRunUs   float64 `json:"per_run_us"`
+		}
+		d := struct {
+			Frames  int64       `json:"frames"`
+			Entries []jsonEntry `json:"entries"`
+		}{Frames: pr.frames, Entries: []jsonEntry{}}
+		for _, e := range list {
+			je := jsonEntry{Player: e.playerNo + 1, Char: e.char, Function: e.function, Index: e.index,
+				Controller: e.ctrl, Call: e.call, Count: e.count, TotalUs: us(e.time),
+				PerFrameUs: us(pr.perFrame(e.time)), PerRunUs: us(e.time) / float64(e.count)}
+			if e.function == "" {
+				stateNo := e.stateNo
+				je.State = &stateNo
+			}
+			d.Entries = append(d.Entries, je)
+		}
+		body, err := json.MarshalIndent(d, "", " ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filename, body, 0666)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"player", "char", "state", "function", "index", "controller", "call",
+		"count", "total_us", "per_frame_us", "per_run_us"})
+	ftoa := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	for _, e := range list {
+		state := ""
+		if e.function == "" {
+			state = strconv.Itoa(int(e.stateNo))
+		}
+		w.Write([]string{strconv.Itoa(e.playerNo + 1), e.char, state, e.function,
+			strconv.Itoa(int(e.index)), e.ctrl, e.call, strconv.FormatInt(e.count, 10),
+			ftoa(us(e.time)), ftoa(us(pr.perFrame(e.time))), ftoa(us(e.time) / float64(e.count))})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -76,6 +76,7 @@ type Renderer interface {
 	SetModelIndexData(bufferIndex uint32, values ...uint32)
 
 	RenderQuad()
+	RenderQuads(count int) // Quads set as one strip, joined by degenerate triangles
 	RenderElements(mode PrimitiveMode, count, offset int)
 	RenderShadowMapElements(mode PrimitiveMode, count, offset int)
 	RenderCubeMap(envTexture Texture, cubeTexture Texture)
@@ -187,8 +188,9 @@ var notiling = Tiling{}
 
 // RenderParams holds the common data for all sprite rendering functions
 type RenderParams struct {
-	tex            Texture // Sprite
-	paltex         Texture // Palette
+	tex            Texture    // Sprite
+	paltex         Texture    // Palette
+	uv             [4]float32 // Rect of tex to draw, zero for all of it
 	size           [2]uint16
 	x, y           float32 // Position
 	tile           Tiling
@@ -215,19 +217,46 @@ func (rp *RenderParams) IsValid() bool {
 		IsFinite(rp.x+rp.y+rp.xts+rp.xbs+rp.ys+rp.vs+rp.rxadd+rp.rot.angle+rp.rcx+rp.rcy)
 }
 
-func drawQuads(modelview mgl.Mat4, x1, y1, x2, y2, x3, y3, x4, y4 float32) {
+func drawQuads(modelview mgl.Mat4, uv [4]float32, x1, y1, x2, y2, x3, y3, x4, y4 float32) {
+	if spriteBatch.capture {
+		spriteBatch.addQuad(uv, x1, y1, x2, y2, x3, y3, x4, y4)
+		return
+	}
 	gfx.SetUniformMatrix("modelview", modelview[:])
-	gfx.SetUniformF("x1x2x4x3", x1, x2, x4, x3) // this uniform is optional
+	b := trapezBounds(uv, x1, x2, x4, x3)
+	gfx.SetUniformF("x1x2x4x3", b[0], b[1], b[2], b[3]) // this uniform is optional
 	gfx.SetVertexData(
-		x2, y2, 1, 1,
-		x3, y3, 1, 0,
-		x1, y1, 0, 1,
-		x4, y4, 0, 0,
+		x2, y2, uv[2], uv[3],
+		x3, y3, uv[2], uv[1],
+		x1, y1, uv[0], uv[3],
+		x4, y4, uv[0], uv[1],
 	)
 
 	gfx.RenderQuad()
 }
 
+// Bounds the sprite shader maps the rows of a trapezoid with. It maps the
+// bottom row, x1 to x2, and the top row, x4 to x3, to texture x 0 to 1, with
+// texture y 1 and 0. For sprites in an atlas, the bounds are moved so that the
+// rows map to the rect uv instead
+func trapezBounds(uv [4]float32, x1, x2, x4, x3 float32) [4]float32 {
+	if uv == [4]float32{0, 0, 1, 1} {
+		return [4]float32{x1, x2, x4, x3}
+	}
+	du, dv := uv[2]-uv[0], uv[3]-uv[1]
+	row := func(l, r float32) (float32, float32) {
+		w := (r - l) / du
+		return l - uv[0]*w, l + (1-uv[0])*w
+	}
+	bl, br := row(x1, x2)
+	tl, tr := row(x4, x3)
+	// Rows at texture y 0 and 1, past the top and bottom of the rect
+	at := func(top, bottom, y float32) float32 {
+		return top + (bottom-top)*(y-uv[1])/dv
+	}
+	return [4]float32{at(tl, bl, 1), at(tr, br, 1), at(tl, bl, 0), at(tr, br, 0)}
+}
+
 func applyRotation(modelview mgl.Mat4, rp RenderParams) mgl.Mat4 {
 	aspectGame := sys.getCurrentAspect()
 	aspectWindow := float32(sys.scrrect[2]) / float32(sys.scrrect[3])
@@ -351,7 +380,7 @@ func renderSpriteHTile(modelview mgl.Mat4, x1, y1, x2, y2, x3, y3, x4, y4, dy, w
 			mat = mat.Mul4(mgl.Translate3D(-(rp.rcx + float32(n)*botdist), -(rp.rcy + dy), 0))
 		}
 
-		drawQuads(mat, x1d, y1, x2d, y2, x3d, y3, x4d, y4)
+		drawQuads(mat, rp.uv, x1d, y1, x2d, y2, x3d, y3, x4d, y4)
 	}
 }
 
@@ -387,7 +416,7 @@ func renderSpriteQuad(modelview mgl.Mat4, rp RenderParams) {
 		modelview = applyRotation(modelview, rp)
 		modelview = modelview.Mul4(mgl.Translate3D(-rp.rcx, -rp.rcy, 0))
 
-		drawQuads(modelview, x1, y1, x2, y2, x3, y3, x4, y4)
+		drawQuads(modelview, rp.uv, x1, y1, x2, y2, x3, y3, x4, y4)
 		return
 	}
 	if rp.tile.yflag == 1 && rp.xbs != 0 {
@@ -491,12 +520,76 @@ func initRenderSpriteQuad(rp *RenderParams) {
 	rp.y += rp.rcy
 }
 
+// Shader state of a sprite, other than its blending passes
+type spriteDrawState struct {
+	tex, paltex Texture
+	window      [4]int32
+	mask        int32
+	isTrapez    bool
+	gray, hue   float32
+	tint        [4]float32
+}
+
+// Sets the pipeline, scissor, textures and uniforms to draw a sprite with
+func (st *spriteDrawState) begin() {
+	proj := gfx.OrthographicProjectionMatrix(0, float32(sys.scrrect[2]), 0, float32(sys.scrrect[3]), -65535, 65535)
+
+	gfx.SetPipeline()
+	gfx.EnableScissor(st.window[0], st.window[1], st.window[2], st.window[3])
+
+	// Static uniforms
+	gfx.SetUniformMatrix("projection", proj[:])
+	gfx.SetUniformI("isFlat", 0)
+	gfx.SetUniformI("mask", int(st.mask))
+	gfx.SetUniformI("isTrapez", int(Btoi(st.isTrapez)))
+
+	gfx.SetUniformF("gray", st.gray)
+	gfx.SetUniformF("hue", st.hue)
+	gfx.SetUniformFv("tint", st.tint[:])
+
+	if st.paltex == nil {
+		gfx.SetUniformI("isRgba", 1)
+	} else {
+		gfx.SetUniformI("isRgba", 0)
+	}
+
+	// Texture binding
+	gfx.SetTexture("tex", st.tex)
+	if st.paltex != nil {
+		gfx.SetTexture("pal", st.paltex)
+	}
+}
+
+// One blending pass of a sprite, with the colors renderWithBlending() set
+// for it
+type spritePass struct {
+	eq        BlendEquation
+	src, dst  BlendFunc
+	alpha     float32
+	neg       bool
+	add, mult [3]float32
+}
+
+func (p *spritePass) begin() {
+	// Lightweight state change
+	gfx.EnableBlending(p.eq, p.src, p.dst)
+
+	// Dynamic uniforms
+	gfx.SetUniformI("neg", int(Btoi(p.neg)))
+	gfx.SetUniformFv("add", p.add[:])
+	gfx.SetUniformFv("mult", p.mult[:])
+	gfx.SetUniformF("alpha", p.alpha)
+}
+
 func RenderSprite(rp RenderParams) {
 	if !rp.IsValid() {
 		return
 	}
 
 	initRenderSpriteQuad(&rp)
+	if rp.uv == [4]float32{} {
+		rp.uv = [4]float32{0, 0, 1, 1}
+	}
 
 	// PalFX and color setup
 	neg, grayscale, padd, pmul, invblend, hue := false, float32(0), [3]float32{0, 0, 0}, [3]float32{1, 1, 1}, int32(0), float32(0)
@@ -511,53 +604,127 @@ func RenderSprite(rp RenderParams) {
 		float32(rp.tint>>24&0xff) / 255,
 	}
 
-	proj := gfx.OrthographicProjectionMatrix(0, float32(sys.scrrect[2]), 0, float32(sys.scrrect[3]), -65535, 65535)
+	st := spriteDrawState{
+		tex:      rp.tex,
+		paltex:   rp.paltex,
+		window:   *rp.window,
+		mask:     rp.mask,
+		isTrapez: Abs(Abs(rp.xts)-Abs(rp.xbs)) > 0.001,
+		gray:     grayscale,
+		hue:      hue,
+		tint:     tint,
+	}
 	modelview := mgl.Translate3D(0, float32(sys.scrrect[3]), 0)
 
-	// Heavy state change
-	// Because renderWithBlending() sometimes needs 2 passes, we'll do most of the setup outside of render()
-	gfx.SetPipeline()
-	gfx.EnableScissor(rp.window[0], rp.window[1], rp.window[2], rp.window[3])
+	// Gather the passes first, so that sprites with a single one can be batched
+	// We must include the parameters that renderWithBlending() may have changed
+	var passes []spritePass
+	renderWithBlending(func(eq BlendEquation, src, dst BlendFunc, a float32) {
+		passes = append(passes, spritePass{eq, src, dst, a, neg, padd, pmul})
+	}, rp.blendMode, rp.blendAlpha, rp.paltex != nil, invblend, &neg, &padd, &pmul, rp.paltex == nil)
+	if len(passes) == 0 || spriteBatch.add(&st, passes, modelview, rp) {
+		return
+	}
 
-	// Static uniforms
-	gfx.SetUniformMatrix("projection", proj[:])
-	gfx.SetUniformI("isFlat", 0)
-	gfx.SetUniformI("mask", int(rp.mask))
-	gfx.SetUniformI("isTrapez", int(Btoi(Abs(Abs(rp.xts)-Abs(rp.xbs)) > 0.001)))
+	// Heavy state change
+	// Because renderWithBlending() sometimes needs 2 passes, we'll do most of the setup outside of the passes
+	st.begin()
+	for i := range passes {
+		passes[i].begin()
+		renderSpriteQuad(modelview, rp)
+	}
+	gfx.DisableScissor()
+}
 
-	gfx.SetUniformF("gray", grayscale)
-	gfx.SetUniformF("hue", hue)
-	gfx.SetUniformFv("tint", tint[:])
+// Most quads in a sprite batch. They must fit in a Vulkan vertex buffer
+const spriteBatchMaxQuads = 1024
+
+// Sprite batching. While active, consecutive sprites with the same shader
+// state, blending and textures are gathered, then drawn with a single vertex
+// upload and draw call, their quads joined by degenerate triangles. Sprites
+// drawn with a modelview of their own, rotated or in perspective, trapezoids,
+// and sprites that need more than one blending pass, like some PalFX
+// inversions, flush the batch and are drawn on their own.
+// Pending sprites must be drawn before anything else reaches the renderer,
+// so every draw that doesn't go through RenderSprite, and every write to a
+// texture a sprite may use, calls flush() first. The batch is also flushed
+// when DrawList.draw ends, so it never spans frames.
+type SpriteBatch struct {
+	active    bool
+	capture   bool // drawQuads adds its quad to the batch instead of drawing it
+	state     spriteDrawState
+	pass      spritePass
+	modelview mgl.Mat4
+	quads     int
+	vertices  []float32
+}
 
-	if rp.paltex == nil {
-		gfx.SetUniformI("isRgba", 1)
-	} else {
-		gfx.SetUniformI("isRgba", 0)
-	}
+var spriteBatch SpriteBatch
 
-	// Texture binding
-	gfx.SetTexture("tex", rp.tex)
-	if rp.paltex != nil {
-		gfx.SetTexture("pal", rp.paltex)
-	}
+// Starts batching sprites, if enabled
+func (sb *SpriteBatch) begin() {
+	sb.active = sys.cfg.Video.SpriteBatching
+}
 
-	// Local function called for each blending pass
-	renderPass := func(eq BlendEquation, src, dst BlendFunc, a float32) {
-		// Lightweight state change
-		gfx.EnableBlending(eq, src, dst)
+// Draws the pending batch and stops batching
+func (sb *SpriteBatch) end() {
+	sb.flush()
+	sb.active = false
+}
 
-		// Dynamic uniforms
-		// We must include the parameters that renderWithBlending() may have changed
-		gfx.SetUniformI("neg", int(Btoi(neg)))
-		gfx.SetUniformFv("add", padd[:])
-		gfx.SetUniformFv("mult", pmul[:])
-		gfx.SetUniformF("alpha", a)
+// Adds a sprite to the batch, drawing the pending one first if the state
+// differs. Returns false if the sprite must be drawn on its own
+func (sb *SpriteBatch) add(st *spriteDrawState, passes []spritePass, modelview mgl.Mat4, rp RenderParams) bool {
+	if !sb.active {
+		return false
+	}
+	if len(passes) != 1 || st.isTrapez || !rp.rot.IsZero() || rp.projectionMode != 0 {
+		sb.flush()
+		return false
+	}
+	if sb.quads > 0 && (*st != sb.state || passes[0] != sb.pass || modelview != sb.modelview) {
+		sb.flush()
+	}
+	sb.state, sb.pass, sb.modelview = *st, passes[0], modelview
+	sb.capture = true
+	renderSpriteQuad(modelview, rp)
+	sb.capture = false
+	return true
+}
 
-		renderSpriteQuad(modelview, rp)
+func (sb *SpriteBatch) addQuad(uv [4]float32, x1, y1, x2, y2, x3, y3, x4, y4 float32) {
+	if sb.quads >= spriteBatchMaxQuads {
+		sb.flush()
+	}
+	if sb.quads > 0 {
+		// Repeat the last vertex and the next one, so the strip continues with
+		// triangles of no area
+		last := len(sb.vertices) - 4
+		sb.vertices = append(sb.vertices, sb.vertices[last:last+4]...)
+		sb.vertices = append(sb.vertices, x2, y2, uv[2], uv[3])
 	}
+	sb.vertices = append(sb.vertices,
+		x2, y2, uv[2], uv[3],
+		x3, y3, uv[2], uv[1],
+		x1, y1, uv[0], uv[3],
+		x4, y4, uv[0], uv[1],
+	)
+	sb.quads++
+}
 
-	renderWithBlending(renderPass, rp.blendMode, rp.blendAlpha, rp.paltex != nil, invblend, &neg, &padd, &pmul, rp.paltex == nil)
+// Draws the sprites gathered so far. Also needed before changing the data of
+// a texture they may use
+func (sb *SpriteBatch) flush() {
+	if sb.quads == 0 {
+		return
+	}
+	sb.state.begin()
+	sb.pass.begin()
+	gfx.SetUniformMatrix("modelview", sb.modelview[:])
+	gfx.SetVertexData(sb.vertices...)
+	gfx.RenderQuads(sb.quads)
 	gfx.DisableScissor()
+	sb.quads, sb.vertices = 0, sb.vertices[:0]
 }
 
 func renderWithBlending(
@@ -672,6 +839,7 @@ func renderWithBlending(
 }
 
 func FillRect(rect [4]int32, color uint32, alpha [2]int32, fx *PalFX) {
+	spriteBatch.flush()
 	r := float32(color>>16&0xff) / 255
 	g := float32(color>>8&0xff) / 255
 	b := float32(color&0xff) / 255
@@ -797,6 +965,8 @@ func (ta *TextureAtlas) AddImage(width, height, stride int32, data []byte) ([4]f
 	}
 
 	// Otherwise upload and return
+	// Batched sprites may be drawn from this texture
+	spriteBatch.flush()
 	ta.texture.SetSubData(data, x, y, width, height, stride)
 
 	return [4]float32{
@@ -872,6 +1042,7 @@ func (ta *TextureAtlas) Resize(width, height int32) {
 	if height < ta.height {
 		panic("New height cannot be smaller than old height")
 	}
+	spriteBatch.flush()
 	t := gfx.newTexture(width, height, ta.depth, ta.filter)
 	t.CopyData(&ta.texture)
 	ta.skyline.PushBack([2]int32{ta.width, 0})
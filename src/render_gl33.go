@@ -2076,6 +2076,10 @@ func (r *Renderer_GL33) RenderQuad() {
 	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
 }
 
+func (r *Renderer_GL33) RenderQuads(count int) {
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, int32(count*6-2))
+}
+
 func (r *Renderer_GL33) RenderElements(mode PrimitiveMode, count, offset int) {
 	gl.DrawElementsWithOffset(r.MapPrimitiveMode(mode), int32(count), gl.UNSIGNED_INT, uintptr(offset))
 }
@@ -2079,6 +2079,10 @@ func (r *Renderer_GLES32) RenderQuad() {
 	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
 }
 
+func (r *Renderer_GLES32) RenderQuads(count int) {
+	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, int32(count*6-2))
+}
+
 func (r *Renderer_GLES32) RenderElements(mode PrimitiveMode, count, offset int) {
 	gl.DrawElementsWithOffset(r.MapPrimitiveMode(mode), int32(count), gl.UNSIGNED_INT, uintptr(offset))
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// The Null renderer implements the Renderer interface without a window or GPU.
+// Every call is counted but nothing is drawn, which lets matches, replays and
+// stress tests run on build boxes and servers.
+
+type Texture_Null struct {
+	width  int32
+	height int32
+	depth  int32
+	filter bool
+	serial uint64
+}
+
+func newTexture_Null(width, height, depth int32, filter bool) *Texture_Null {
+	textureSerialNumber++
+	nullRenderStats.Textures++
+	return &Texture_Null{
+		width:  width,
+		height: height,
+		depth:  depth,
+		filter: filter,
+		serial: textureSerialNumber,
+	}
+}
+
+func (t *Texture_Null) SetData(data []byte) {
+	nullRenderStats.TextureUploads++
+	nullRenderStats.TextureBytes += uint64(len(data))
+}
+
+func (t *Texture_Null) SetSubData(data []byte, x, y, width, height, stride int32) {
+	nullRenderStats.TextureUploads++
+	nullRenderStats.TextureBytes += uint64(len(data))
+}
+
+func (t *Texture_Null) SetDataG(data []byte, mag, min, ws, wt TextureSamplingParam) {
+	nullRenderStats.TextureUploads++
+	nullRenderStats.TextureBytes += uint64(len(data))
+}
+
+func (t *Texture_Null) SetPixelData(data []float32) {
+	nullRenderStats.TextureUploads++
+	nullRenderStats.TextureBytes += uint64(len(data) * 4)
+}
+
+func (t *Texture_Null) CopyData(src *Texture) {
+}
+
+// Textures never hold data, but report valid sizes so the sprite path runs in full
+func (t *Texture_Null) IsValid() bool {
+	return t.width != 0 && t.height != 0
+}
+
+func (t *Texture_Null) GetWidth() int32 {
+	return t.width
+}
+
+func (t *Texture_Null) GetHeight() int32 {
+	return t.height
+}
+
+// NullRenderStats holds what the game asked the Null renderer to do
+type NullRenderStats struct {
+	Frames         uint64
+	Textures       uint64
+	TextureUploads uint64
+	TextureBytes   uint64
+	UniformSets    uint64
+	TextureBinds   uint64
+	PipelineSets   uint64
+	BlendChanges   uint64
+	VertexUploads  uint64
+	DrawCalls      uint64
+	Vertices       uint64
+	FontDraws      uint64
+}
+
+var nullRenderStats NullRenderStats
+
+func (st NullRenderStats) String() string {
+	return fmt.Sprintf("frames=%d textures=%d uploads=%d (%d bytes) uniforms=%d binds=%d pipelines=%d blends=%d vertexuploads=%d draws=%d vertices=%d fontdraws=%d",
+		st.Frames, st.Textures, st.TextureUploads, st.TextureBytes, st.UniformSets, st.TextureBinds,
+		st.PipelineSets, st.BlendChanges, st.VertexUploads, st.DrawCalls, st.Vertices, st.FontDraws)
+}
+
+type Renderer_Null struct {
+	scissor [4]int32
+}
+
+func (r *Renderer_Null) GetName() string {
+	return "Null"
+}
+
+func (r *Renderer_Null) Init() {
+	nullRenderStats = NullRenderStats{}
+}
+
+func (r *Renderer_Null) Close() {
+	LogMessage("Null renderer: %v", nullRenderStats)
+}
+
+func (r *Renderer_Null) BeginFrame(clearColor bool) {
+}
+
+func (r *Renderer_Null) EndFrame() {
+	nullRenderStats.Frames++
+}
+
+func (r *Renderer_Null) Await() {
+}
+
+// Models and shadows need real geometry processing, so keep them disabled
+func (r *Renderer_Null) IsModelEnabled() bool {
+	return false
+}
+
+func (r *Renderer_Null) IsShadowEnabled() bool {
+	return false
+}
+
+func (r *Renderer_Null) SetPipeline() {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) EnableBlending(eq BlendEquation, src, dst BlendFunc) {
+	nullRenderStats.BlendChanges++
+}
+
+func (r *Renderer_Null) DisableBlending() {
+	nullRenderStats.BlendChanges++
+}
+
+func (r *Renderer_Null) prepareShadowMapPipeline(bufferIndex uint32) {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) setShadowMapPipeline(doubleSided, invertFrontFace, useUV, useNormal, useTangent, useVertColor, useJoint0, useJoint1 bool, numVertices, vertAttrOffset uint32) {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) ReleaseShadowPipeline() {
+}
+
+func (r *Renderer_Null) prepareModelPipeline(bufferIndex uint32, env *Environment) {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) SetModelPipeline(eq BlendEquation, src, dst BlendFunc, depthTest, depthMask, doubleSided, invertFrontFace, useUV, useNormal, useTangent, useVertColor, useJoint0, useJoint1, useOutlineAttribute bool, numVertices, vertAttrOffset uint32) {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) SetMeshOutlinePipeline(invertFrontFace bool, meshOutline float32) {
+	nullRenderStats.PipelineSets++
+}
+
+func (r *Renderer_Null) ReleaseModelPipeline() {
+}
+
+func (r *Renderer_Null) newTexture(width, height, depth int32, filter bool) Texture {
+	return newTexture_Null(width, height, depth, filter)
+}
+
+func (r *Renderer_Null) newPaletteTexture() Texture {
+	return newTexture_Null(256, 1, 32, false)
+}
+
+func (r *Renderer_Null) newModelTexture(width, height, depth int32, filter bool) Texture {
+	return newTexture_Null(width, height, depth, filter)
+}
+
+func (r *Renderer_Null) newDataTexture(width, height int32) Texture {
+	return newTexture_Null(width, height, 128, false)
+}
+
+func (r *Renderer_Null) newHDRTexture(width, height int32) Texture {
+	return newTexture_Null(width, height, 96, false)
+}
+
+func (r *Renderer_Null) newCubeMapTexture(widthHeight int32, mipmap bool, lowestMipLevel int32) Texture {
+	return newTexture_Null(widthHeight, widthHeight, 24, false)
+}
+
+// There is no framebuffer, so screenshots come out black
+func (r *Renderer_Null) ReadPixels(data []uint8, width, height int) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+func (r *Renderer_Null) EnableScissor(x, y, width, height int32) {
+	r.scissor = [4]int32{x, y, width, height}
+}
+
+func (r *Renderer_Null) DisableScissor() {
+	r.scissor = [4]int32{}
+}
+
+func (r *Renderer_Null) SetUniformI(name string, val int) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetUniformF(name string, values ...float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetUniformFv(name string, values []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetUniformMatrix(name string, value []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetTexture(name string, tex Texture) {
+	nullRenderStats.TextureBinds++
+}
+
+func (r *Renderer_Null) SetModelUniformI(name string, val int) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetModelUniformF(name string, values ...float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetModelUniformFv(name string, values []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetModelUniformMatrix(name string, value []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetModelUniformMatrix3(name string, value []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetModelTexture(name string, t Texture) {
+	nullRenderStats.TextureBinds++
+}
+
+func (r *Renderer_Null) SetShadowMapUniformI(name string, val int) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetShadowMapUniformF(name string, values ...float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetShadowMapUniformFv(name string, values []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetShadowMapUniformMatrix(name string, value []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetShadowMapUniformMatrix3(name string, value []float32) {
+	nullRenderStats.UniformSets++
+}
+
+func (r *Renderer_Null) SetShadowMapTexture(name string, t Texture) {
+	nullRenderStats.TextureBinds++
+}
+
+func (r *Renderer_Null) SetShadowFrameTexture(i uint32) {
+	nullRenderStats.TextureBinds++
+}
+
+func (r *Renderer_Null) SetShadowFrameCubeTexture(i uint32) {
+	nullRenderStats.TextureBinds++
+}
+
+func (r *Renderer_Null) SetVertexData(values ...float32) {
+	nullRenderStats.VertexUploads++
+}
+
+func (r *Renderer_Null) SetModelVertexData(bufferIndex uint32, values []byte) {
+	nullRenderStats.VertexUploads++
+}
+
+func (r *Renderer_Null) SetModelIndexData(bufferIndex uint32, values ...uint32) {
+	nullRenderStats.VertexUploads++
+}
+
+func (r *Renderer_Null) RenderQuad() {
+	nullRenderStats.DrawCalls++
+	nullRenderStats.Vertices += 4
+}
+
+func (r *Renderer_Null) RenderQuads(count int) {
+	nullRenderStats.DrawCalls++
+	nullRenderStats.Vertices += uint64(count*6 - 2)
+}
+
+func (r *Renderer_Null) RenderElements(mode PrimitiveMode, count, offset int) {
+	nullRenderStats.DrawCalls++
+	nullRenderStats.Vertices += uint64(count)
+}
+
+func (r *Renderer_Null) RenderShadowMapElements(mode PrimitiveMode, count, offset int) {
+	nullRenderStats.DrawCalls++
+	nullRenderStats.Vertices += uint64(count)
+}
+
+func (r *Renderer_Null) RenderCubeMap(envTexture Texture, cubeTexture Texture) {
+	nullRenderStats.DrawCalls++
+}
+
+func (r *Renderer_Null) RenderFilteredCubeMap(distribution int32, cubeTexture Texture, filteredTexture Texture, mipmapLevel, sampleCount int32, roughness float32) {
+	nullRenderStats.DrawCalls++
+}
+
+func (r *Renderer_Null) RenderLUT(distribution int32, cubeTexture Texture, lutTexture Texture, sampleCount int32) {
+	nullRenderStats.DrawCalls++
+}
+
+func (r *Renderer_Null) PerspectiveProjectionMatrix(angle, aspect, near, far float32) mgl.Mat4 {
+	return mgl.Perspective(angle, aspect, near, far)
+}
+
+func (r *Renderer_Null) OrthographicProjectionMatrix(left, right, bottom, top, near, far float32) mgl.Mat4 {
+	return mgl.Ortho(left, right, bottom, top, near, far)
+}
+
+func (r *Renderer_Null) SetVSync(interval int) {
+}
+
+func (r *Renderer_Null) NewWorkerThread() bool {
+	return false
+}
+
+// Font rendering counterpart. Glyph metrics are approximated from the font
+// height so that text layout code keeps producing sensible widths.
+type Font_Null struct {
+	scale        int32
+	windowWidth  int
+	windowHeight int
+	color        color
+}
+
+type FontRenderer_Null struct{}
+
+func (r *FontRenderer_Null) Init(renderer interface{}) {
+}
+
+func (r *FontRenderer_Null) LoadFont(file string, scale int32, windowWidth int, windowHeight int) (interface{}, error) {
+	return &Font_Null{scale: scale, windowWidth: windowWidth, windowHeight: windowHeight}, nil
+}
+
+func (f *Font_Null) SetColor(red float32, green float32, blue float32, alpha float32) {
+	f.color.r = red
+	f.color.g = green
+	f.color.b = blue
+	f.color.a = alpha
+}
+
+func (f *Font_Null) UpdateResolution(windowWidth int, windowHeight int) {
+	f.windowWidth = windowWidth
+	f.windowHeight = windowHeight
+}
+
+func (f *Font_Null) Printf(x, y float32, scale float32, spacingXAdd float32,
+	align int32, blend bool, window [4]int32, fs string, argv ...interface{}) error {
+	nullRenderStats.FontDraws++
+	return nil
+}
+
+func (f *Font_Null) Width(scale float32, spacingXAdd float32, fs string, argv ...interface{}) float32 {
+	n := len([]rune(fmt.Sprintf(fs, argv...)))
+	if n == 0 {
+		return 0
+	}
+	return float32(n)*float32(f.scale)*0.5*scale + float32(n-1)*spacingXAdd*scale
+}
@@ -6147,6 +6147,10 @@ func (r *Renderer_VK) SetModelIndexData(bufferIndex uint32, values ...uint32) {
 }
 
 func (r *Renderer_VK) RenderQuad() {
+	r.RenderQuads(1)
+}
+
+func (r *Renderer_VK) RenderQuads(count int) {
 	switchedProgram := r.VKState.currentProgram != r.spriteProgram
 	r.VKState.currentProgram = r.spriteProgram
 	pipelineIndex, ok := r.spriteProgram.pipelineIndexMap[r.VKState.VulkanPipelineState.VulkanBlendState]
@@ -6298,7 +6302,11 @@ func (r *Renderer_VK) RenderQuad() {
 	scissors := []vk.Rect2D{r.VKState.scissor}
 	vk.CmdSetViewport(r.commandBuffers[0], 0, 1, viewports)
 	vk.CmdSetScissor(r.commandBuffers[0], 0, 1, scissors)
-	vk.CmdDraw(r.commandBuffers[0], 4, 1, uint32(r.vertexBufferOffset%r.vertexBuffers[0].size)/16-4, 0)
+	// The vertices end at the current offset. When they fill their buffer up
+	// to its end, that offset is a multiple of the buffer size
+	n := uint32(count*6 - 2)
+	end := (r.vertexBufferOffset-1)%r.vertexBuffers[0].size + 1
+	vk.CmdDraw(r.commandBuffers[0], n, 1, uint32(end)/16-n, 0)
 }
 func (r *Renderer_VK) RenderElements(mode PrimitiveMode, count, offset int) {
 	switchedProgram := r.VKState.currentProgram != r.modelProgram
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Replay format v2 keeps the v1 header (magic, version, JSON ReplayHeader) and
+// splits the rest of the file into chunks of 1 byte type + uint32 length +
+// data. Input chunks hold deflate-compressed v1 payload (seed, pre-match time
+// and input frames), and match chunks hold the JSON ReplayMatchInfo of each
+// finished match. Match chunks can be read without decompressing or
+// simulating anything, which is what the replay browser does.
+//
+// Chunks are only written once complete, so a session that ends abruptly
+// still leaves a readable replay up to the last chunk.
+
+const (
+	replayFormatV1      uint16 = 1
+	replayFormatVersion uint16 = 2
+
+	replayChunkInputs byte = 'I'
+	replayChunkMatch  byte = 'M'
+
+	// Uncompressed input data gathered before an input chunk is written
+	replayChunkSize = 64 * 1024
+	// Sanity limit when reading chunk sizes
+	replayMaxChunkSize = 1 << 28
+)
+
+type ReplayCharInfo struct {
+	Name string `json:"name"`
+	Def  string `json:"def"`
+	Pal  int32  `json:"pal"`
+}
+
+type ReplayRoundInfo struct {
+	Round      int32 `json:"round"`
+	StartFrame int32 `json:"start_frame"`
+	EndFrame   int32 `json:"end_frame"`
+}
+
+// ReplayMatchInfo describes one match of a recorded session. Frames count
+// input frames from the start of the replay, like ReplayFile.Frame.
+type ReplayMatchInfo struct {
+	Match      int32               `json:"match"`
+	StartFrame int32               `json:"start_frame"`
+	EndFrame   int32               `json:"end_frame"`
+	Stage      string              `json:"stage"`
+	StageName  string              `json:"stage_name"`
+	TeamModes  [2]int32            `json:"team_modes"`
+	Sides      [2][]ReplayCharInfo `json:"sides"`
+	Rounds     []ReplayRoundInfo   `json:"rounds"`
+	Result     *StatsMatch         `json:"result,omitempty"`
+}
+
+// ReplayInfo is what the replay browser shows for a file
+type ReplayInfo struct {
+	FormatVersion      uint16
+	Created            string
+	Players            []string
+	ContentFingerprint string
+	Matches            []ReplayMatchInfo
+}
+
+// Reads the header and match chunks of a replay without decoding its inputs
+func ReadReplayInfo(filename string) (*ReplayInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := readReplayHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	info := &ReplayInfo{}
+	if header == nil {
+		return info, nil
+	}
+	info.FormatVersion = header.FormatVersion
+	info.Created = header.Created
+	info.Players = header.Players
+	info.ContentFingerprint = header.ContentFingerprint
+	if header.FormatVersion >= 2 {
+		info.Matches, err = readReplayChunks(f, nil)
+		if err != nil {
+			log.Printf("Replay %s is truncated: %v", filename, err)
+		}
+	}
+	return info, nil
+}
+
+// Reads the chunks of a v2 replay. Input chunks are decompressed into inputs,
+// or skipped if it is nil. On error, everything read so far is kept.
+func readReplayChunks(r io.ReadSeeker, inputs *bytes.Buffer) ([]ReplayMatchInfo, error) {
+	var matches []ReplayMatchInfo
+	var hdr [5]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return matches, nil
+			}
+			return matches, err
+		}
+		size := binary.LittleEndian.Uint32(hdr[1:])
+		if size > replayMaxChunkSize {
+			return matches, fmt.Errorf("invalid replay chunk size %d", size)
+		}
+		if hdr[0] != replayChunkMatch && (hdr[0] != replayChunkInputs || inputs == nil) {
+			if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+				return matches, err
+			}
+			continue
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return matches, err
+		}
+		switch hdr[0] {
+		case replayChunkInputs:
+			zr := flate.NewReader(bytes.NewReader(body))
+			_, err := io.Copy(inputs, zr)
+			zr.Close()
+			if err != nil {
+				return matches, err
+			}
+		case replayChunkMatch:
+			var m ReplayMatchInfo
+			if err := json.Unmarshal(body, &m); err != nil {
+				return matches, err
+			}
+			matches = append(matches, m)
+		}
+	}
+}
+
+// Decoded input payload of a v2 replay, played back like a v1 file
+type replayPayload struct {
+	*bytes.Reader
+}
+
+func (replayPayload) Close() error {
+	return nil
+}
+
+// ReplayWriter records a netplay session to a v2 replay file
+type ReplayWriter struct {
+	f             *os.File
+	raw           bytes.Buffer
+	frames        int32
+	headerWritten bool
+	matchNo       int32
+	match         *ReplayMatchInfo
+	closed        bool
+}
+
+func CreateReplayWriter(filename string) (*ReplayWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayWriter{f: f}, nil
+}
+
+// The header is only written once. Without one, an empty header is written
+// before the first chunk.
+func (rw *ReplayWriter) WriteHeader(header *ReplayHeader) error {
+	if rw == nil || rw.headerWritten {
+		return nil
+	}
+	var h ReplayHeader
+	if header != nil {
+		h = *header
+	}
+	h.FormatVersion = replayFormatVersion
+	if h.Created == "" {
+		h.Created = time.Now().Format(time.RFC3339)
+	}
+	if err := writeReplayHeader(rw.f, &h, replayFormatVersion); err != nil {
+		return err
+	}
+	rw.headerWritten = true
+	return nil
+}
+
+func (rw *ReplayWriter) WriteSync(seed, pmTime int32) error {
+	if rw == nil {
+		return nil
+	}
+	binary.Write(&rw.raw, binary.LittleEndian, seed)
+	binary.Write(&rw.raw, binary.LittleEndian, pmTime)
+	return nil
+}
+
+func (rw *ReplayWriter) WriteFrame(ibit *[REPLAY_NUM_INPUTS]InputBits, axes *[REPLAY_NUM_INPUTS][6]int8) error {
+	if rw == nil {
+		return nil
+	}
+	for i := range ibit {
+		writeReplayInput(&rw.raw, ibit[i], axes[i])
+	}
+	rw.frames++
+	if rw.raw.Len() >= replayChunkSize {
+		return rw.flushInputs()
+	}
+	return nil
+}
+
+// Compresses the buffered inputs into a chunk
+func (rw *ReplayWriter) flushInputs() error {
+	if rw.raw.Len() == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(rw.raw.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	rw.raw.Reset()
+	return rw.writeChunk(replayChunkInputs, buf.Bytes())
+}
+
+func (rw *ReplayWriter) writeChunk(kind byte, data []byte) error {
+	if err := rw.WriteHeader(nil); err != nil {
+		return err
+	}
+	var hdr [5]byte
+	hdr[0] = kind
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err := rw.f.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := rw.f.Write(data)
+	return err
+}
+
+// Current input frame of the recording. Rollback frames are only written at
+// the end of a match, so they are counted separately.
+func (rw *ReplayWriter) position() int32 {
+	if rs := sys.rollback.session; rs != nil && rs.recording == rw {
+		return rw.frames + rs.netTime
+	}
+	return rw.frames
+}
+
+// Called before a match is loaded
+func (rw *ReplayWriter) beginMatch() {
+	if rw == nil {
+		return
+	}
+	rw.matchNo++
+	rw.match = &ReplayMatchInfo{
+		Match:      rw.matchNo,
+		StartFrame: rw.position(),
+		EndFrame:   -1,
+		TeamModes:  [2]int32{int32(sys.tmode[0]), int32(sys.tmode[1])},
+	}
+	for side := range rw.match.Sides {
+		for _, sel := range sys.sel.selected[side] {
+			if c := sys.sel.GetChar(sel[0]); c != nil {
+				rw.match.Sides[side] = append(rw.match.Sides[side], ReplayCharInfo{Name: c.name, Def: c.def, Pal: int32(sel[1])})
+			}
+		}
+	}
+}
+
+// A restarted round replaces the earlier attempt
+func (rw *ReplayWriter) roundStart(round int32) {
+	if rw == nil || rw.match == nil {
+		return
+	}
+	for i := range rw.match.Rounds {
+		if rw.match.Rounds[i].Round == round {
+			rw.match.Rounds[i].StartFrame = rw.position()
+			rw.match.Rounds[i].EndFrame = -1
+			return
+		}
+	}
+	rw.match.Rounds = append(rw.match.Rounds, ReplayRoundInfo{Round: round, StartFrame: rw.position(), EndFrame: -1})
+}
+
+func (rw *ReplayWriter) roundEnd(round int32) {
+	if rw == nil || rw.match == nil {
+		return
+	}
+	for i := range rw.match.Rounds {
+		if rw.match.Rounds[i].Round == round {
+			rw.match.Rounds[i].EndFrame = rw.position()
+		}
+	}
+}
+
+// Writes the match chunk. result is nil if the match didn't finish.
+func (rw *ReplayWriter) endMatch(result *StatsMatch) error {
+	if rw == nil || rw.match == nil {
+		return nil
+	}
+	m := rw.match
+	rw.match = nil
+	m.EndFrame = rw.position()
+	if sys.stage != nil {
+		m.Stage = sys.stage.def
+		m.StageName = sys.stage.displayname
+	}
+	if result != nil {
+		r := *result
+		m.Result = &r
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// Keep the inputs of the match ahead of its description
+	if err := rw.flushInputs(); err != nil {
+		return err
+	}
+	return rw.writeChunk(replayChunkMatch, body)
+}
+
+func (rw *ReplayWriter) Close() error {
+	if rw == nil || rw.closed {
+		return nil
+	}
+	rw.closed = true
+	err := rw.endMatch(nil)
+	if ferr := rw.flushInputs(); err == nil {
+		err = ferr
+	}
+	if cerr := rw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Replay recording of the current session, if any
+func (s *System) replayRecorder() *ReplayWriter {
+	if s.rollback.session != nil && s.rollback.session.recording != nil {
+		return s.rollback.session.recording
+	}
+	if s.netConnection != nil {
+		return s.netConnection.recording
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math"
+)
+
+// Replay seeking works by taking periodic keyframes (GameState snapshots) while
+// a replay match is being played. Rewinding loads the closest keyframe before
+// the target and silently simulates forward to it, while seeking forward just
+// fast-forwards. Keyframes only cover the match currently being played, since
+// menus and loading are driven by Lua and can't be restored.
+
+const (
+	// Frames between two regular keyframes at the start of a match
+	replayKeyframeInterval = 120
+	// Once this many keyframes exist, every other one is dropped and the
+	// interval doubles, so memory use stays bounded on long matches
+	replayMaxKeyframes = 64
+	// State IDs used for keyframe arenas. Kept well away from the IDs used by
+	// rollback and the debug save state.
+	replayKeyframeStateBase = 1 << 20
+	replaySeekLoadStateBase = replayKeyframeStateBase - 2
+)
+
+type ReplayKeyframe struct {
+	frame   int32
+	offset  int64
+	ibit    [REPLAY_NUM_INPUTS]InputBits
+	iaxes   [REPLAY_NUM_INPUTS][6]int8
+	stateID int
+	state   *GameState
+	round   bool
+}
+
+type ReplayRoundMarker struct {
+	Round int32
+	Frame int32
+}
+
+type ReplaySeekState struct {
+	keyframes   []ReplayKeyframe
+	markers     []ReplayRoundMarker
+	interval    int32
+	nextStateID int
+	loads       int
+	lastRound   int32
+	// Pending request, applied at the start of the next match loop iteration
+	pending      bool
+	pendingFrame int32
+	pendingRound int32
+	pendingPause bool
+	// Fast-forward in progress
+	target      int32
+	targetRound int32
+	pauseAfter  bool
+}
+
+// Number of input frames read so far
+func (rf *ReplayFile) Frame() int32 {
+	return rf.frame
+}
+
+// Approximate number of input frames in the whole file. Each match also stores
+// its own seed and pre-match time, so this slightly overestimates.
+func (rf *ReplayFile) Length() int32 {
+	size := rf.size
+	if rf.stream != nil {
+		size = rf.stream.Size()
+	}
+	if size <= rf.dataOffset {
+		return 0
+	}
+	return int32((size - rf.dataOffset) / replayFrameBytes)
+}
+
+// Also true while a spectator that joined late catches up with the players
+func (rf *ReplayFile) Seeking() bool {
+	return rf.seek.pending || rf.seek.target >= 0 || (rf.stream != nil && rf.stream.CatchingUp())
+}
+
+func (rf *ReplayFile) RoundMarkers() []ReplayRoundMarker {
+	return rf.seek.markers
+}
+
+// Requests a seek to the given frame. Returns false if the frame is before the
+// current match, in which case playback goes to the earliest available frame.
+func (rf *ReplayFile) RequestSeek(frame int32, pause bool) bool {
+	st := &rf.seek
+	ok := true
+	if frame < rf.frame && (len(st.keyframes) == 0 || frame < st.keyframes[0].frame) {
+		ok = false
+		if len(st.keyframes) > 0 {
+			frame = st.keyframes[0].frame
+		} else {
+			frame = rf.frame
+		}
+	}
+	st.pending = true
+	st.pendingFrame = Max(0, frame)
+	st.pendingRound = 0
+	st.pendingPause = pause
+	return ok
+}
+
+// Requests a jump to the start of a round of the current match. Rounds that
+// haven't been reached yet are found by fast-forwarding.
+func (rf *ReplayFile) RequestSeekRound(round int32, pause bool) bool {
+	st := &rf.seek
+	for _, m := range st.markers {
+		if m.Round == round {
+			return rf.RequestSeek(m.Frame, pause)
+		}
+	}
+	if round <= sys.round {
+		return false
+	}
+	st.pending = true
+	st.pendingFrame = math.MaxInt32
+	st.pendingRound = round
+	st.pendingPause = pause
+	return true
+}
+
+// Called at match start, before the first frame is simulated
+func (rf *ReplayFile) beginMatch() {
+	rf.clearKeyframes()
+	st := &rf.seek
+	st.interval = replayKeyframeInterval
+	st.lastRound = 0
+	st.markers = st.markers[:0]
+	st.target = -1
+	st.targetRound = 0
+}
+
+// Called at the start of every match loop iteration
+func (rf *ReplayFile) stepSeek() {
+	st := &rf.seek
+	if rf.file == nil {
+		st.pending = false
+		st.target = -1
+		return
+	}
+
+	if rf.keyframeState != nil {
+		rf.loadKeyframeState()
+	}
+
+	if st.pending {
+		st.pending = false
+		rf.applySeek(st.pendingFrame, st.pendingRound, st.pendingPause)
+	}
+
+	// New round reached
+	isNewRound := sys.round != st.lastRound
+	if isNewRound {
+		st.lastRound = sys.round
+		if len(st.markers) == 0 || st.markers[len(st.markers)-1].Frame < rf.frame {
+			st.markers = append(st.markers, ReplayRoundMarker{Round: sys.round, Frame: rf.frame})
+		}
+	}
+
+	// Fast-forward until the target is reached
+	if st.target >= 0 {
+		if rf.frame >= st.target || (st.targetRound > 0 && isNewRound && sys.round == st.targetRound) {
+			st.target = -1
+			st.targetRound = 0
+			sys.paused = st.pauseAfter
+		} else {
+			sys.paused = false
+		}
+		sys.frameStepFlag = false
+	}
+
+	rf.captureKeyframe(isNewRound)
+}
+
+func (rf *ReplayFile) applySeek(frame, round int32, pause bool) {
+	st := &rf.seek
+	st.pauseAfter = pause
+	st.targetRound = round
+	if frame >= rf.frame {
+		st.target = frame
+		return
+	}
+
+	// Find the closest keyframe at or before the target
+	idx := -1
+	for i := range st.keyframes {
+		if st.keyframes[i].frame <= frame {
+			idx = i
+		} else {
+			break
+		}
+	}
+	if idx < 0 {
+		st.target = -1
+		return
+	}
+	kf := &st.keyframes[idx]
+	if _, err := rf.file.Seek(kf.offset, io.SeekStart); err != nil {
+		log.Printf("Replay seek failed: %v", err)
+		st.target = -1
+		return
+	}
+	rf.frame = kf.frame
+	rf.ibit = kf.ibit
+	rf.iaxes = kf.iaxes
+	rf.loadState(kf.state)
+	st.target = frame
+}
+
+func (rf *ReplayFile) loadState(gs *GameState) {
+	st := &rf.seek
+	// Alternate between two load arenas so the one currently in use is never freed
+	loadID := replaySeekLoadStateBase + st.loads%2
+	st.loads++
+	sys.loadPool.curStateID = loadID
+	if a, ok := sys.arenaLoadMap[loadID]; ok {
+		a.Free()
+		delete(sys.arenaLoadMap, loadID)
+	}
+	sys.loadPool.Free(loadID)
+	gs.LoadState(loadID)
+
+	// The round that the state belongs to is already known
+	st.lastRound = sys.round
+}
+
+func (rf *ReplayFile) captureKeyframe(force bool) {
+	st := &rf.seek
+	if n := len(st.keyframes); n > 0 {
+		last := st.keyframes[n-1].frame
+		if rf.frame <= last || (!force && rf.frame < last+st.interval) {
+			return
+		}
+	}
+
+	offset, err := rf.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	stateID := replayKeyframeStateBase + st.nextStateID
+	st.nextStateID++
+	sys.savePool.curStateID = stateID
+	gs := NewGameState()
+	gs.quiet = true
+	gs.SaveState(stateID)
+
+	st.keyframes = append(st.keyframes, ReplayKeyframe{
+		frame:   rf.frame,
+		offset:  offset,
+		ibit:    rf.ibit,
+		iaxes:   rf.iaxes,
+		stateID: stateID,
+		state:   gs,
+		round:   force,
+	})
+
+	if len(st.keyframes) > replayMaxKeyframes {
+		rf.thinKeyframes()
+	}
+}
+
+// Drops every other regular keyframe. Round start keyframes are always kept.
+func (rf *ReplayFile) thinKeyframes() {
+	st := &rf.seek
+	kept := st.keyframes[:0]
+	regular := 0
+	for _, kf := range st.keyframes {
+		if !kf.round {
+			regular++
+			if regular%2 == 0 {
+				rf.freeKeyframe(&kf)
+				continue
+			}
+		}
+		kept = append(kept, kf)
+	}
+	st.keyframes = kept
+	st.interval *= 2
+}
+
+func (rf *ReplayFile) freeKeyframe(kf *ReplayKeyframe) {
+	if a, ok := sys.arenaSaveMap[kf.stateID]; ok {
+		a.Free()
+		delete(sys.arenaSaveMap, kf.stateID)
+	}
+	sys.savePool.Free(kf.stateID)
+	kf.state = nil
+}
+
+func (rf *ReplayFile) clearKeyframes() {
+	st := &rf.seek
+	for i := range st.keyframes {
+		rf.freeKeyframe(&st.keyframes[i])
+	}
+	st.keyframes = st.keyframes[:0]
+	st.pending = false
+}
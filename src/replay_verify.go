@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Replay verification (-verifyreplay) plays a replay headless and as fast as
+// possible, writing one checksum per consumed input frame to a trace file.
+// The trace is then compared against a second, independent run of the same
+// replay and optionally against a reference trace (-verifyref). Any mismatch
+// makes the process exit with a non-zero code.
+//
+// Unlike RollbackSession.LiveChecksum this hash includes positions and
+// velocities, so traces are only comparable between builds running on the
+// same platform.
+
+const (
+	verifyExitOK       = 0
+	verifyExitDiverged = 1
+	verifyExitError    = 2
+
+	replayTraceHeader = "# ikemen replay trace v1"
+)
+
+type ReplayTraceEntry struct {
+	Frame      int32
+	MatchTime  int32
+	RoundState int32
+	Checksum   uint32
+}
+
+func (e ReplayTraceEntry) String() string {
+	return fmt.Sprintf("%d\t%d\t%d\t%08x", e.Frame, e.MatchTime, e.RoundState, e.Checksum)
+}
+
+type ReplayVerifier struct {
+	replayPath string
+	tracePath  string
+	refPath    string
+	runs       int
+	trace      []ReplayTraceEntry
+	out        *bufio.Writer
+	file       *os.File
+	err        error
+}
+
+// Creates a verifier from the -verifyreplay family of command line flags
+func newReplayVerifier(flags map[string]string) *ReplayVerifier {
+	replay, ok := flags["-verifyreplay"]
+	if !ok {
+		return nil
+	}
+	rv := &ReplayVerifier{
+		replayPath: replay,
+		tracePath:  replay + ".trace",
+		refPath:    flags["-verifyref"],
+		runs:       2,
+	}
+	if v, ok := flags["-verifytrace"]; ok && v != "" && v != "true" {
+		rv.tracePath = v
+	}
+	if v, ok := flags["-verifyruns"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			rv.runs = n
+		}
+	}
+	rv.file, rv.err = os.Create(rv.tracePath)
+	if rv.err == nil {
+		rv.out = bufio.NewWriter(rv.file)
+		fmt.Fprintf(rv.out, "%s %s\n", replayTraceHeader, replay)
+	}
+	return rv
+}
+
+// Records the state reached before the next replay input frame is consumed
+func (rv *ReplayVerifier) record() {
+	e := ReplayTraceEntry{
+		Frame:      int32(len(rv.trace)),
+		MatchTime:  sys.matchTime,
+		RoundState: sys.roundState(),
+		Checksum:   replayStateChecksum(),
+	}
+	rv.trace = append(rv.trace, e)
+	if rv.out != nil {
+		fmt.Fprintln(rv.out, e.String())
+	}
+}
+
+// Closes the trace, runs the remaining passes and compares the results.
+// Returns the process exit code.
+func (rv *ReplayVerifier) finish() int {
+	if rv.out != nil {
+		if err := rv.out.Flush(); err != nil && rv.err == nil {
+			rv.err = err
+		}
+		rv.file.Close()
+		rv.out = nil
+	}
+	if rv.err != nil {
+		fmt.Printf("Replay verification failed: %v\n", rv.err)
+		return verifyExitError
+	}
+	if len(rv.trace) == 0 {
+		fmt.Printf("Replay verification failed: no frames were played from %s\n", rv.replayPath)
+		return verifyExitError
+	}
+	fmt.Printf("Replay verification: %d frames, trace written to %s\n", len(rv.trace), rv.tracePath)
+
+	code := verifyExitOK
+	if rv.refPath != "" {
+		ref, err := readReplayTrace(rv.refPath)
+		if err != nil {
+			fmt.Printf("Replay verification failed: %v\n", err)
+			return verifyExitError
+		}
+		if !rv.compare(ref, rv.refPath) {
+			code = verifyExitDiverged
+		}
+	}
+	if rv.runs > 1 {
+		if c := rv.runNextPass(); c != verifyExitOK && code == verifyExitOK {
+			code = c
+		}
+	}
+	if code == verifyExitOK {
+		fmt.Println("Replay verification passed")
+	}
+	return code
+}
+
+// Runs the replay again in a fresh process, using this run's trace as its reference
+func (rv *ReplayVerifier) runNextPass() int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Replay verification failed: %v\n", err)
+		return verifyExitError
+	}
+	skip := map[string]bool{"-verifyreplay": true, "-verifyref": true, "-verifytrace": true, "-verifyruns": true}
+	var args []string
+	for i := 1; i < len(os.Args); i++ {
+		if skip[os.Args[i]] {
+			if i+1 < len(os.Args) && !strings.HasPrefix(os.Args[i+1], "-") {
+				i++
+			}
+			continue
+		}
+		args = append(args, os.Args[i])
+	}
+	args = append(args,
+		"-verifyreplay", rv.replayPath,
+		"-verifyref", rv.tracePath,
+		"-verifytrace", fmt.Sprintf("%s.run%d", rv.tracePath, rv.runs),
+		"-verifyruns", strconv.Itoa(rv.runs-1))
+
+	fmt.Printf("Replay verification: starting pass %d\n", rv.runs)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Printf("Replay verification failed: %v\n", err)
+		return verifyExitError
+	}
+	return verifyExitOK
+}
+
+// Reports the first frame where the trace differs from ref
+func (rv *ReplayVerifier) compare(ref []ReplayTraceEntry, name string) bool {
+	n := Min(len(rv.trace), len(ref))
+	for i := 0; i < n; i++ {
+		if rv.trace[i] != ref[i] {
+			fmt.Printf("Replay verification: divergence from %s at frame %d\n  expected: %v\n  got:      %v\n",
+				name, i, ref[i], rv.trace[i])
+			return false
+		}
+	}
+	if len(rv.trace) != len(ref) {
+		fmt.Printf("Replay verification: length differs from %s (expected %d frames, got %d)\n",
+			name, len(ref), len(rv.trace))
+		return false
+	}
+	return true
+}
+
+func readReplayTrace(filename string) ([]ReplayTraceEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []ReplayTraceEntry
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var e ReplayTraceEntry
+		if _, err := fmt.Sscanf(text, "%d\t%d\t%d\t%x", &e.Frame, &e.MatchTime, &e.RoundState, &e.Checksum); err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed trace line: %v", filename, line, err)
+		}
+		trace = append(trace, e)
+	}
+	return trace, scanner.Err()
+}
+
+// Hashes the simulation state that replays are expected to reproduce exactly
+func replayStateChecksum() uint32 {
+	buf := make([]byte, 0, 512)
+	i32 := func(v int32) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(v))
+	}
+	f32 := func(v float32) {
+		buf = binary.BigEndian.AppendUint32(buf, math.Float32bits(v))
+	}
+
+	i32(sys.randseed)
+	i32(sys.matchTime)
+	i32(sys.curRoundTime)
+	i32(sys.round)
+	i32(sys.roundState())
+	i32(sys.wins[0])
+	i32(sys.wins[1])
+
+	for i := range sys.chars {
+		i32(int32(len(sys.chars[i])))
+		for _, c := range sys.chars[i] {
+			if c == nil {
+				continue
+			}
+			i32(c.id)
+			i32(c.ss.no)
+			i32(c.ss.time)
+			i32(c.animNo)
+			i32(c.life)
+			i32(c.power)
+			for k := 0; k < 3; k++ {
+				f32(c.pos[k])
+				f32(c.vel[k])
+			}
+			f32(c.facing)
+		}
+		i32(int32(len(sys.projs[i])))
+		for _, p := range sys.projs[i] {
+			if p == nil {
+				continue
+			}
+			i32(p.id)
+			i32(p.animNo)
+			for k := 0; k < 3; k++ {
+				f32(p.pos[k])
+			}
+		}
+		i32(int32(len(sys.explods[i])))
+	}
+
+	return crc32.ChecksumIEEE(buf)
+}
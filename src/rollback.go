@@ -11,6 +11,7 @@ import (
 	"time"
 
 	ggpo "github.com/ikemen-engine/ggpo"
+	"github.com/ikemen-engine/ggpo/transport"
 )
 
 type RollbackSystem struct {
@@ -29,6 +30,7 @@ type RollbackProperties struct {
 	DesyncTest            bool `ini:"DesyncTest"`
 	DesyncTestFrames      int  `ini:"DesyncTestFrames"`
 	DesyncTestAI          bool `ini:"DesyncTestAI"`
+	DesyncSnapshots       bool `ini:"DesyncSnapshots"`
 }
 
 // TODO: Merge with system.go
@@ -65,7 +67,12 @@ func (rs *RollbackSystem) hijackRunMatch(s *System) bool {
 			break
 		}
 
-		rs.session.next = rs.session.now + 1000/60
+		if rs.session.numPlayers > 2 {
+			// Keep the pace of the slowest party participant
+			rs.session.next = rs.session.now + rs.session.loopTimer.usToWaitThisLoop().Milliseconds()
+		} else {
+			rs.session.next = rs.session.now + 1000/60
+		}
 
 		if s.esc || !running {
 			break
@@ -88,13 +95,24 @@ func (rs *RollbackSystem) hijackRunMatch(s *System) bool {
 
 func (rs *RollbackSystem) preMatchSetup() {
 	if rs.session != nil && sys.netConnection != nil {
-		if rs.session.host != "" {
+		// Spectator keyframes are taken from the kept states, which have to
+		// reach back past the frames that can still be rolled back
+		if sys.netConnection.spectators != nil {
+			rs.session.desync.init(true)
+		}
+		if party := sys.netConnection.party; party != nil {
+			// Every party participant is a GGPO peer of its own
+			rs.session.InitParty(party)
+			rs.session.playerNo = party.info.Slot + 1
+		} else if rs.session.host != "" {
 			// Initialize client as P2
-			rs.session.InitP2(2, 7550, 7600, rs.session.host)
+			remoteIp, remotePort := sys.netConnection.ggpoRemote(rs.session.host, 7600, 7550)
+			rs.session.InitP2(2, 7550, remotePort, remoteIp)
 			rs.session.playerNo = 2
 		} else {
 			// Initialize host as P1
-			rs.session.InitP1(2, 7600, 7550, rs.session.remoteIp)
+			remoteIp, remotePort := sys.netConnection.ggpoRemote(rs.session.remoteIp, 7550, 7600)
+			rs.session.InitP1(2, 7600, remotePort, remoteIp)
 			rs.session.playerNo = 1
 		}
 
@@ -110,8 +128,9 @@ func (rs *RollbackSystem) preMatchSetup() {
 		//}
 		//sys.netConnection.Close()
 
-		// Borrow netConnection replay recording
+		// Borrow netConnection replay recording and spectators
 		rs.session.recording = sys.netConnection.recording
+		rs.session.spectators = sys.netConnection.spectators
 
 		// Transfer the active netConnection to the rollback system
 		rs.netConnection = sys.netConnection
@@ -134,7 +153,7 @@ func (rs *RollbackSystem) postMatchSetup() {
 	// sys.esc = true
 
 	sys.netConnection = rs.netConnection
-	rs.session.backend.Close()
+	rs.session.Close()
 
 	// Prep for the next match.
 	if sys.netConnection != nil {
@@ -188,9 +207,10 @@ func (rs *RollbackSystem) runFrame(s *System) bool {
 
 			// Record inputs against the rollback timeline. netTime is part of the saved state,
 			// so any confirmed re-simulation overwrites earlier speculative data for the same frame.
-			if rs.session.recording != nil {
+			if rs.session.recordsReplay() {
 				rs.session.RecordReplayFrame(rs.session.netTime, rs.ggpoInputs, rs.ggpoAnalogInputs)
 				rs.session.netTime++
+				rs.session.flushSpectatorFrames(false)
 			}
 
 			// Commit this frame to GGPO even if this frame exits gameplay.
@@ -206,7 +226,7 @@ func (rs *RollbackSystem) runFrame(s *System) bool {
 				}
 			}()
 
-			err := rs.session.backend.AdvanceFrame(rs.session.LiveChecksum())
+			err := rs.session.backend.AdvanceFrame(rs.session.frameChecksum())
 			if err != nil {
 				panic(err)
 			}
@@ -434,7 +454,9 @@ type RollbackSession struct {
 	next                int64
 	players             []ggpo.Player
 	handles             []ggpo.PlayerHandle
-	recording           *os.File
+	recording           *ReplayWriter
+	spectators          *SpectatorServer
+	spectatorFrame      int
 	connected           bool
 	host                string
 	playerNo            int
@@ -446,6 +468,7 @@ type RollbackSession struct {
 	currentPlayer       int
 	currentPlayerHandle ggpo.PlayerHandle
 	remotePlayerHandle  ggpo.PlayerHandle
+	numPlayers          int
 	loopTimer           LoopTimer
 	inputs              map[int][MaxPlayerNo]InputBits
 	analogInputs        map[int][MaxPlayerNo][6]int8
@@ -459,6 +482,7 @@ type RollbackSession struct {
 	inputBits           []InputBits
 	inRollback          bool
 	replaySaved         bool
+	desync              DesyncRecorder
 }
 
 func (rs *RollbackSession) SetInput(time int32, player int, input InputBits, axes [6]int8) {
@@ -486,6 +510,11 @@ func (rs *RollbackSession) ensureReplayFrame(frame int) {
 	rs.replayAnalogInputs = append(rs.replayAnalogInputs, make([][REPLAY_NUM_INPUTS][6]int8, missing)...)
 }
 
+// Whether inputs are kept for a replay file or for spectators
+func (rs *RollbackSession) recordsReplay() bool {
+	return rs.recording != nil || rs.spectators != nil
+}
+
 func (rs *RollbackSession) RecordReplayFrame(time int32, inputs []InputBits, axes [][6]int8) {
 	if rs == nil || time < 0 {
 		return
@@ -525,7 +554,7 @@ func (rs *RollbackSession) TruncateReplayFrom(time int32) {
 }
 
 func (rs *RollbackSession) SaveReplay() {
-	if rs == nil || rs.recording == nil || rs.replaySaved {
+	if rs == nil || !rs.recordsReplay() || rs.replaySaved {
 		return
 	}
 
@@ -545,14 +574,15 @@ func (rs *RollbackSession) SaveReplay() {
 		log.Printf("Missing rollback replay frames after frame %d; truncating replay at this point", frameCount)
 	}
 
+	rs.flushSpectatorFrames(true)
+	if rs.recording == nil {
+		return
+	}
+
 	for frame := 0; frame < frameCount; frame++ {
-		inputFrame := rs.replayInputs[frame]
-		axisFrame := rs.replayAnalogInputs[frame]
-		for i := 0; i < REPLAY_NUM_INPUTS; i++ {
-			if err := writeReplayInput(rs.recording, inputFrame[i], axisFrame[i]); err != nil {
-				log.Printf("Error while writing rollback replay frame %d controller %d: %v", frame, i, err)
-				return
-			}
+		if err := rs.recording.WriteFrame(&rs.replayInputs[frame], &rs.replayAnalogInputs[frame]); err != nil {
+			log.Printf("Error while writing rollback replay frame %d: %v", frame, err)
+			return
 		}
 	}
 }
@@ -604,6 +634,7 @@ func (r *RollbackSession) Close() {
 	if r.backend != nil {
 		r.backend.Close()
 	}
+	r.desync.free()
 }
 
 func (r *RollbackSession) IsConnected() bool {
@@ -613,22 +644,12 @@ func (r *RollbackSession) IsConnected() bool {
 func (r *RollbackSession) SaveGameState(stateID int) int {
 	sys.savePool.curStateID = stateID
 	sys.rollbackStateID = stateID
-	oldest := stateID + 1%(MaxSaveStates+2)
-	if _, ok := sys.arenaSaveMap[oldest]; ok {
-		sys.arenaSaveMap[oldest].Free()
-		sys.arenaSaveMap[oldest] = nil
-		delete(sys.arenaSaveMap, oldest)
-	}
-	sys.savePool.Free(oldest)
-	if _, ok := sys.arenaSaveMap[stateID]; ok {
-		sys.arenaSaveMap[stateID].Free()
-		sys.arenaSaveMap[stateID] = nil
-		delete(sys.arenaSaveMap, stateID)
-	}
-	sys.savePool.Free(stateID)
 
+	// The desync recorder takes the state and its arena, and frees them once
+	// GGPO can no longer load it and no desync snapshot needs it
 	r.saveStates[stateID] = sys.statePool.gameStatePool.Get().(*GameState)
 	r.saveStates[stateID].SaveState(stateID)
+	r.desync.saveState(stateID, r.saveStates[stateID])
 
 	if r.config.DesyncTest {
 		checksum := r.saveStates[stateID].Checksum()
@@ -666,14 +687,13 @@ func (r *RollbackSession) LoadGameState(stateID int) {
 	sys.loadPool.Free(stateID)
 
 	r.saveStates[stateID].LoadState(stateID)
+	r.desync.loadState(stateID)
 
 	if r.config.DesyncTest && r.config.LogsEnabled {
 		checksum := r.saveStates[stateID].Checksum()
 		r.log.logState("Loaded", stateID, r.saveStates[stateID].String(), checksum)
 	}
 
-	sys.statePool.gameStatePool.Put(r.saveStates[stateID])
-
 	lastLoadedFrame = stateID
 }
 
@@ -696,7 +716,7 @@ func (r *RollbackSession) AdvanceFrame(flags int) {
 	// Run frame again using confirmed inputs
 	if ggpoerr == nil {
 		sys.rollback.ggpoInputs, sys.rollback.ggpoAnalogInputs = decodeInputs(inputs)
-		if r.recording != nil {
+		if r.recordsReplay() {
 			r.RecordReplayFrame(r.netTime, sys.rollback.ggpoInputs, sys.rollback.ggpoAnalogInputs)
 			r.netTime++
 		}
@@ -713,7 +733,7 @@ func (r *RollbackSession) AdvanceFrame(flags int) {
 		}()
 
 		// Notify GGPO that frame has advanced
-		err := r.backend.AdvanceFrame(r.LiveChecksum())
+		err := r.backend.AdvanceFrame(r.frameChecksum())
 		if err != nil {
 			panic(err)
 		}
@@ -752,10 +772,23 @@ func (r *RollbackSession) OnEvent(info *ggpo.Event) {
 			r.log.saveLogs()
 		}
 		fmt.Println("EventCodeDesync")
-		log.Printf("Rollback desync detected")
+		log.Printf("Rollback desync detected at frame %d", info.NumFrameOfDesync)
+		if r.config.DesyncSnapshots {
+			if filename, err := r.desync.dump(info.NumFrameOfDesync, r.playerNo,
+				uint32(info.LocalChecksum), uint32(info.RemoteChecksum), r.timestamp); err != nil {
+				log.Printf("Failed to save desync snapshots: %v", err)
+			} else {
+				log.Printf("Desync snapshots saved to %s", filename)
+			}
+		}
 		sys.esc = true
 		r.SaveReplay()
 		sys.sessionWarning = sys.motif.WarningInfo.Text.Text["desync"]
+	case ggpo.EventCodeSyncTestDesync:
+		if sys.syncTest != nil {
+			// The frame was just recorded
+			sys.syncTest.checksumMismatch(r.desync.frame-1, info.CurrentState, info.LastVerified)
+		}
 	case ggpo.EventCodeConnectionInterrupted:
 		fmt.Println("EventCodeconnectionInterrupted")
 	case ggpo.EventCodeConnectionResumed:
@@ -769,6 +802,7 @@ func NewRollbackSession(config RollbackProperties) RollbackSession {
 	r.players = make([]ggpo.Player, 2)       // MaxPlayerNo
 	r.handles = make([]ggpo.PlayerHandle, 2) // MaxPlayerNo
 	r.config = config
+	r.desync.init(config.DesyncSnapshots)
 	r.loopTimer = NewLoopTimer(60, 100)
 	r.timestamp = time.Now().Format("2006-01-02_03-04PM-05s")
 	r.log = NewRollbackLogger(r.timestamp)
@@ -784,6 +818,13 @@ func encodeInputs(inputs InputBits) []byte {
 	return writeI16(int16(inputs))
 }
 
+// Checksum given to GGPO for the frame just simulated
+func (rs *RollbackSession) frameChecksum() uint32 {
+	checksum := rs.LiveChecksum()
+	rs.desync.record(checksum)
+	return checksum
+}
+
 func (rs *RollbackSession) LiveChecksum() uint32 {
 	// System variables. Check always
 	buf := writeI32(sys.randseed)
@@ -853,55 +894,22 @@ func (rs *RollbackSession) AnyButton() bool {
 }
 
 func (rs *RollbackSession) InitP1(numPlayers int, localPort int, remotePort int, remoteIp string) {
-	if rs.config.LogsEnabled {
-		logFileName := fmt.Sprintf("save/logs/Rollback-%s.log", rs.timestamp)
-		f, err := os.OpenFile(logFileName, os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			panic(err)
-		}
-		logger := log.New(f, "Logger:", log.Ldate|log.Ltime|log.Lshortfile)
-		ggpo.EnableLogs()
-		ggpo.SetLogger(logger)
-	}
-
-	var inputBits InputBits = 0
-	var inputAxes [6]int8 = [6]int8{}
-	var inputSize int = len(encodeInputs(inputBits)) + len(inputAxes)
-
-	player := ggpo.NewLocalPlayer(20, 1)
-	player2 := ggpo.NewRemotePlayer(20, 2, remoteIp, remotePort)
-	rs.players = append(rs.players, player)
-	rs.players = append(rs.players, player2)
-
-	peer := ggpo.NewPeer(rs, localPort, numPlayers, inputSize)
-	rs.backend = &peer
-
-	peer.InitializeConnection()
-
-	var handle ggpo.PlayerHandle
-	result := peer.AddPlayer(&player, &handle)
-	if result != nil {
-		panic("panic")
-	}
-	rs.handles = append(rs.handles, handle)
-	var handle2 ggpo.PlayerHandle
-	result = peer.AddPlayer(&player2, &handle2)
-	if result != nil {
-		panic("panic")
-	}
-	rs.handles = append(rs.handles, handle2)
-	rs.currentPlayer = int(handle)
-	rs.currentPlayerHandle = handle
-	rs.remotePlayerHandle = handle2
+	rs.InitPeer(numPlayers, 0, localPort, map[int]rollbackRemote{1: {remoteIp, remotePort}}, rs.config.FrameDelay)
+}
 
-	peer.SetDisconnectTimeout(rs.config.DisconnectTimeout)
-	peer.SetDisconnectNotifyStart(rs.config.DisconnectNotifyStart)
-	peer.SetFrameDelay(handle, rs.config.FrameDelay)
+func (rs *RollbackSession) InitP2(numPlayers int, localPort int, remotePort int, remoteIp string) {
+	rs.InitPeer(numPlayers, 1, localPort, map[int]rollbackRemote{0: {remoteIp, remotePort}}, rs.config.FrameDelay)
+}
 
-	peer.Start()
+// Address of the GGPO peer playing one of the remote slots
+type rollbackRemote struct {
+	ip   string
+	port int
 }
 
-func (rs *RollbackSession) InitP2(numPlayers int, localPort int, remotePort int, remoteIp string) {
+// Initializes a GGPO peer playing localSlot, with one remote peer for each
+// of the other slots. frameDelay must be the same on every peer.
+func (rs *RollbackSession) InitPeer(numPlayers, localSlot, localPort int, remotes map[int]rollbackRemote, frameDelay int) {
 	if rs.config.LogsEnabled {
 		logFileName := fmt.Sprintf("save/logs/Rollback-%s.log", rs.timestamp)
 		f, err := os.OpenFile(logFileName, os.O_CREATE|os.O_RDWR, 0666)
@@ -917,39 +925,64 @@ func (rs *RollbackSession) InitP2(numPlayers int, localPort int, remotePort int,
 	var inputAxes [6]int8 = [6]int8{}
 	var inputSize int = len(encodeInputs(inputBits)) + len(inputAxes)
 
-	player := ggpo.NewRemotePlayer(20, 1, remoteIp, remotePort)
-	player2 := ggpo.NewLocalPlayer(20, 2)
-	rs.players = append(rs.players, player)
-	rs.players = append(rs.players, player2)
+	players := make([]ggpo.Player, numPlayers)
+	for i := range players {
+		if i == localSlot {
+			players[i] = ggpo.NewLocalPlayer(20, i+1)
+		} else {
+			players[i] = ggpo.NewRemotePlayer(20, i+1, remotes[i].ip, remotes[i].port)
+		}
+	}
+	rs.players = append(rs.players, players...)
+	rs.numPlayers = numPlayers
 
 	peer := ggpo.NewPeer(rs, localPort, numPlayers, inputSize)
 	rs.backend = &peer
 
-	peer.InitializeConnection()
+	if sys.netSim != nil {
+		peer.InitializeConnection(sys.netSim.wrapUDP(transport.NewUdp(&peer, localPort)))
+	} else {
+		peer.InitializeConnection()
+	}
 
-	var handle ggpo.PlayerHandle
-	result := peer.AddPlayer(&player, &handle)
-	if result != nil {
-		panic("panic")
+	// The remote player of a 2 player session
+	firstRemote := 0
+	if localSlot == 0 {
+		firstRemote = 1
 	}
-	rs.handles = append(rs.handles, handle)
-	var handle2 ggpo.PlayerHandle
-	result = peer.AddPlayer(&player2, &handle2)
-	if result != nil {
-		panic("panic")
+	for i := range players {
+		var handle ggpo.PlayerHandle
+		result := peer.AddPlayer(&players[i], &handle)
+		if result != nil {
+			panic("panic")
+		}
+		rs.handles = append(rs.handles, handle)
+		if i == localSlot {
+			rs.currentPlayer = int(handle)
+			rs.currentPlayerHandle = handle
+		} else if i == firstRemote {
+			rs.remotePlayerHandle = handle
+		}
 	}
-	rs.handles = append(rs.handles, handle2)
-	rs.currentPlayer = int(handle2)
-	rs.currentPlayerHandle = handle2
-	rs.remotePlayerHandle = handle
 
 	peer.SetDisconnectTimeout(rs.config.DisconnectTimeout)
 	peer.SetDisconnectNotifyStart(rs.config.DisconnectNotifyStart)
-	peer.SetFrameDelay(handle2, rs.config.FrameDelay)
+	peer.SetFrameDelay(rs.currentPlayerHandle, frameDelay)
 
 	peer.Start()
 }
 
+// Initializes the GGPO peer of a party participant
+func (rs *RollbackSession) InitParty(np *NetParty) {
+	remotes := make(map[int]rollbackRemote)
+	for i, ip := range np.info.Addresses {
+		if i != np.info.Slot {
+			remotes[i] = rollbackRemote{ip, partyBasePort + i}
+		}
+	}
+	rs.InitPeer(np.info.Size, np.info.Slot, partyBasePort+np.info.Slot, remotes, np.info.FrameDelay)
+}
+
 func (rs *RollbackSession) InitSyncTest(numPlayers int) {
 	rs.syncTest = true
 	if rs.config.LogsEnabled {
@@ -973,7 +1006,11 @@ func (rs *RollbackSession) InitSyncTest(numPlayers int) {
 	rs.players = append(rs.players, player2)
 
 	//peer := ggpo.NewPeer(sys.rollbackNetwork, localPort, numPlayers, inputSize)
-	peer := ggpo.NewSyncTest(rs, numPlayers, rs.config.DesyncTestFrames, inputSize, true)
+	// -synctest reports the first failure instead of panicking
+	peer := ggpo.NewSyncTest(rs, numPlayers, rs.config.DesyncTestFrames, inputSize, sys.syncTest == nil)
+	if sys.syncTest != nil {
+		rs.desync.resimulated = sys.syncTest.resimulated
+	}
 	rs.backend = &peer
 
 	//
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"arena"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Desync snapshots are a field by field listing of the simulation state.
+// Rollback already saves the game state of every frame for GGPO. Instead of
+// freeing those states once GGPO stops needing them, the recorder keeps the
+// ones of the last frames, tagged with the frame and the checksum given to
+// GGPO. When GGPO reports a desync, the snapshots of the kept frames up to the
+// desynced one are built from those states and saved to save/logs, one file
+// per peer. Comparing the files of both peers with -desyncdiff shows which
+// fields diverged first and on which frame. Snapshots cover a lot more than
+// LiveChecksum, so they usually catch the divergence frames before the
+// checksums do.
+
+const (
+	// Enough to cover GGPO's checksum distance plus the network latency
+	desyncSnapshotFrames = 64
+	desyncDumpVersion    = 1
+
+	desyncDiffSame     = 0
+	desyncDiffDiverged = 1
+	desyncDiffError    = 2
+)
+
+type DesyncField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type DesyncSnapshot struct {
+	Frame    int           `json:"frame"`
+	Checksum uint32        `json:"checksum"`
+	Fields   []DesyncField `json:"fields"`
+}
+
+type DesyncDump struct {
+	Version        int              `json:"version"`
+	Created        string           `json:"created"`
+	Player         int              `json:"player"`
+	Frame          int              `json:"frame"`
+	LocalChecksum  uint32           `json:"local_checksum"`
+	RemoteChecksum uint32           `json:"remote_checksum"`
+	Snapshots      []DesyncSnapshot `json:"snapshots"` // Oldest first
+}
+
+// A saved game state, with the memory it was cloned into
+type desyncState struct {
+	frame    int // The frame whose result the state holds
+	checksum uint32
+	gs       *GameState
+	arena    *arena.Arena
+	objs     []interface{}
+}
+
+func (ds *desyncState) snapshot() DesyncSnapshot {
+	return DesyncSnapshot{Frame: ds.frame, Checksum: ds.checksum, Fields: takeDesyncSnapshot(ds.gs)}
+}
+
+func (ds *desyncState) free() {
+	if ds.arena != nil {
+		ds.arena.Free()
+	}
+	for _, o := range ds.objs {
+		sys.savePool.Put(o)
+	}
+	// SaveState doesn't always overwrite the stage of a reused state
+	ds.gs.stage = nil
+	sys.statePool.gameStatePool.Put(ds.gs)
+	*ds = desyncState{}
+}
+
+// Owns the game states rollback saves, and keeps the ones of the last frames.
+// Frames are counted like GGPO does, so the saved states remember the frame
+// they were taken on.
+type DesyncRecorder struct {
+	frame       int
+	checksum    uint32 // Of the last frame recorded
+	stateFrames map[int]int
+	states      [desyncSnapshotFrames]desyncState
+	// Number of frames whose states are kept. At least the states GGPO may
+	// still load, all of the ring when snapshots are enabled
+	window int
+	// If set, called with both snapshots of a frame simulated again
+	resimulated func(first, again DesyncSnapshot)
+}
+
+func (dr *DesyncRecorder) init(snapshots bool) {
+	dr.window = MaxSaveStates + 2
+	if snapshots {
+		dr.window = desyncSnapshotFrames
+	}
+}
+
+// Takes the state GGPO just saved as stateID, which holds the result of the
+// frame recorded last. A frame simulated again after a rollback replaces the
+// earlier state, and the state of the frame that falls out of the window is
+// freed.
+func (dr *DesyncRecorder) saveState(stateID int, gs *GameState) {
+	if dr.stateFrames == nil {
+		dr.stateFrames = make(map[int]int)
+	}
+	dr.stateFrames[stateID] = dr.frame
+
+	ds := desyncState{
+		frame:    dr.frame - 1,
+		checksum: dr.checksum,
+		gs:       gs,
+		arena:    sys.arenaSaveMap[stateID],
+		objs:     sys.savePool.poolObjs[stateID],
+	}
+	delete(sys.arenaSaveMap, stateID)
+	delete(sys.savePool.poolObjs, stateID)
+
+	// The state before the first frame is at -1
+	slot := &dr.states[(ds.frame+dr.window)%dr.window]
+	if slot.gs != nil {
+		if dr.resimulated != nil && slot.frame == ds.frame && ds.frame >= 0 {
+			dr.resimulated(slot.snapshot(), ds.snapshot())
+		}
+		slot.free()
+	}
+	*slot = ds
+}
+
+func (dr *DesyncRecorder) loadState(stateID int) {
+	if frame, ok := dr.stateFrames[stateID]; ok {
+		dr.frame = frame
+	}
+}
+
+// The kept state taken before the given frame, counted like netTime
+func (dr *DesyncRecorder) stateBefore(netTime int32) *GameState {
+	for i := range dr.states {
+		if gs := dr.states[i].gs; gs != nil && gs.netTime == netTime {
+			return gs
+		}
+	}
+	return nil
+}
+
+// Called with the checksum of each simulated frame
+func (dr *DesyncRecorder) record(checksum uint32) {
+	dr.checksum = checksum
+	dr.frame++
+}
+
+// Frees the kept states, when the session ends
+func (dr *DesyncRecorder) free() {
+	for i := range dr.states {
+		if dr.states[i].gs != nil {
+			dr.states[i].free()
+		}
+	}
+}
+
+// Writes the snapshots of the kept frames up to frame. Returns the file name.
+func (dr *DesyncRecorder) dump(frame int, player int, local, remote uint32, timestamp string) (string, error) {
+	d := DesyncDump{
+		Version:        desyncDumpVersion,
+		Created:        time.Now().Format(time.RFC3339),
+		Player:         player,
+		Frame:          frame,
+		LocalChecksum:  local,
+		RemoteChecksum: remote,
+	}
+	for i := range dr.states[:dr.window] {
+		if ds := &dr.states[i]; ds.gs != nil && ds.frame >= 0 && ds.frame <= frame {
+			d.Snapshots = append(d.Snapshots, ds.snapshot())
+		}
+	}
+	if len(d.Snapshots) == 0 {
+		return "", fmt.Errorf("no state kept for frame %d", frame)
+	}
+	sort.Slice(d.Snapshots, func(i, j int) bool { return d.Snapshots[i].Frame < d.Snapshots[j].Frame })
+	body, err := json.MarshalIndent(d, "", " ")
+	if err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("save/logs/Desync-%s-P%d.json", timestamp, player)
+	return filename, os.WriteFile(filename, body, 0666)
+}
+
+// Builds the field list of a snapshot
+type desyncWriter struct {
+	fields []DesyncField
+	prefix string
+}
+
+func (w *desyncWriter) str(key, v string) {
+	w.fields = append(w.fields, DesyncField{w.prefix + key, v})
+}
+
+func (w *desyncWriter) i32(key string, v int32) {
+	w.str(key, strconv.FormatInt(int64(v), 10))
+}
+
+func (w *desyncWriter) f32(key string, v float32) {
+	w.str(key, strconv.FormatFloat(float64(v), 'g', -1, 32))
+}
+
+func (w *desyncWriter) flag(key string, v bool) {
+	w.str(key, strconv.FormatBool(v))
+}
+
+func (w *desyncWriter) vec(key string, v []float32) {
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = strconv.FormatFloat(float64(v[i]), 'g', -1, 32)
+	}
+	w.str(key, strings.Join(s, ","))
+}
+
+// Character variables, in index order
+func desyncVars[T int32 | float32](w *desyncWriter, name string, vars map[int32]T) {
+	keys := make([]int32, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		w.str(fmt.Sprintf("%s(%d)", name, k), fmt.Sprint(vars[k]))
+	}
+}
+
+// Lists the characters, projectiles, explods, stage and fight screen of a
+// saved state
+func takeDesyncSnapshot(gs *GameState) []DesyncField {
+	w := &desyncWriter{}
+
+	w.prefix = "sys."
+	w.i32("randseed", gs.randseed)
+	w.i32("matchTime", gs.matchTime)
+	w.i32("curRoundTime", gs.curRoundTime)
+	w.i32("round", gs.round)
+	w.i32("finishType", int32(gs.finishType))
+	w.i32("intro", gs.intro)
+	w.i32("wins[0]", gs.wins[0])
+	w.i32("wins[1]", gs.wins[1])
+	w.i32("pausetime", gs.pausetime)
+	w.i32("supertime", gs.supertime)
+	w.vec("cam.Pos", gs.cam.Pos[:])
+	w.f32("cam.Scale", gs.cam.Scale)
+
+	for pn := range gs.charData {
+		for i := range gs.charData[pn] {
+			c := &gs.charData[pn][i]
+			w.prefix = fmt.Sprintf("chars.p%d[%d].", pn+1, i)
+			w.str("name", c.name)
+			w.i32("id", c.id)
+			w.i32("stateNo", c.ss.no)
+			w.i32("prevStateNo", c.ss.prevno)
+			w.i32("stateTime", c.ss.time)
+			w.i32("stateType", int32(c.ss.stateType))
+			w.i32("moveType", int32(c.ss.moveType))
+			w.i32("physics", int32(c.ss.physics))
+			w.flag("ctrl", c.ctrl())
+			w.i32("animNo", c.animNo)
+			if c.anim != nil {
+				w.i32("animElem", c.anim.curelem+1)
+				w.i32("animTime", c.anim.curtime)
+			}
+			w.i32("life", c.life)
+			w.i32("redLife", c.redLife)
+			w.i32("power", c.power)
+			w.i32("dizzyPoints", c.dizzyPoints)
+			w.i32("guardPoints", c.guardPoints)
+			w.i32("juggle", c.juggle)
+			w.i32("hitPauseTime", c.hitPauseTime)
+			w.i32("hitCount", c.hitCount)
+			w.vec("pos", c.pos[:])
+			w.vec("vel", c.vel[:])
+			w.f32("facing", c.facing)
+			desyncVars(w, "var", c.cnsvar)
+			desyncVars(w, "fvar", c.cnsfvar)
+			desyncVars(w, "sysvar", c.cnssysvar)
+			desyncVars(w, "sysfvar", c.cnssysfvar)
+		}
+		for i, p := range gs.projs[pn] {
+			if p == nil {
+				continue
+			}
+			w.prefix = fmt.Sprintf("projs.p%d[%d].", pn+1, i)
+			w.i32("id", p.id)
+			w.i32("status", int32(p.status))
+			w.i32("animNo", p.animNo)
+			w.i32("time", p.time)
+			w.i32("hits", p.hits)
+			w.i32("removetime", p.removetime)
+			w.vec("pos", p.pos[:])
+			w.vec("velocity", p.velocity[:])
+			w.f32("facing", p.facing)
+		}
+		for i, e := range gs.explods[pn] {
+			if e == nil {
+				continue
+			}
+			w.prefix = fmt.Sprintf("explods.p%d[%d].", pn+1, i)
+			w.i32("id", e.id)
+			w.i32("animNo", e.animNo)
+			w.i32("time", e.time)
+			w.i32("removetime", e.removetime)
+			w.vec("pos", e.pos[:])
+			w.vec("velocity", e.velocity[:])
+			w.f32("facing", e.facing)
+		}
+	}
+
+	// Only saved if the characters can change it
+	if gs.stage != nil {
+		w.prefix = "stage."
+		w.i32("stageTime", gs.stage.stageTime)
+	}
+
+	fs := &gs.fightScreen
+	if r := fs.round; r != nil {
+		w.prefix = "fightscreen.round."
+		w.flag("timerActive", r.timerActive)
+		w.i32("roundDisplayTimer", r.roundDisplayTimer)
+		w.i32("fightDisplayTimer", r.fightDisplayTimer)
+		w.i32("koDisplayTimer", r.koDisplayTimer)
+		w.i32("winDisplayTimer", r.winDisplayTimer)
+	}
+	for i, co := range fs.combos {
+		if co == nil {
+			continue
+		}
+		w.prefix = fmt.Sprintf("fightscreen.combos[%d].", i)
+		w.i32("trueHits", co.trueHits)
+		w.i32("shownHits", co.shownHits)
+		w.i32("shownDmg", co.shownDmg)
+		w.i32("resttime", co.resttime)
+	}
+
+	return w.fields
+}
+
+func readDesyncDump(filename string) (*DesyncDump, error) {
+	body, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var d DesyncDump
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if d.Version != desyncDumpVersion {
+		return nil, fmt.Errorf("%s: unsupported desync dump version %d", filename, d.Version)
+	}
+	return &d, nil
+}
+
+// Lists the fields that differ between two snapshots of the same frame
+func diffDesyncSnapshots(a, b DesyncSnapshot) []string {
+	values := make(map[string]string, len(b.Fields))
+	for _, f := range b.Fields {
+		values[f.Key] = f.Value
+	}
+	var diffs []string
+	for _, f := range a.Fields {
+		v, ok := values[f.Key]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: %s != <missing>", f.Key, f.Value))
+		} else if v != f.Value {
+			diffs = append(diffs, fmt.Sprintf("%s: %s != %s", f.Key, f.Value, v))
+		}
+		delete(values, f.Key)
+	}
+	for _, f := range b.Fields {
+		if _, ok := values[f.Key]; ok {
+			diffs = append(diffs, fmt.Sprintf("%s: <missing> != %s", f.Key, f.Value))
+		}
+	}
+	return diffs
+}
+
+// Compares the desync dumps of two peers (-desyncdiff and -desyncref).
+// Returns the process exit code.
+func runDesyncDiff(filename, refname string) int {
+	if filename == "" || refname == "" {
+		fmt.Println("Usage: -desyncdiff <dump.json> -desyncref <other peer's dump.json>")
+		return desyncDiffError
+	}
+	a, err := readDesyncDump(filename)
+	if err != nil {
+		fmt.Printf("Desync diff failed: %v\n", err)
+		return desyncDiffError
+	}
+	b, err := readDesyncDump(refname)
+	if err != nil {
+		fmt.Printf("Desync diff failed: %v\n", err)
+		return desyncDiffError
+	}
+	fmt.Printf("%s: player %d, desync reported at frame %d\n", filename, a.Player, a.Frame)
+	fmt.Printf("%s: player %d, desync reported at frame %d\n", refname, b.Player, b.Frame)
+
+	ref := make(map[int]DesyncSnapshot, len(b.Snapshots))
+	for _, s := range b.Snapshots {
+		ref[s.Frame] = s
+	}
+	compared, diverged := 0, false
+	for _, s := range a.Snapshots {
+		r, ok := ref[s.Frame]
+		if !ok {
+			continue
+		}
+		compared++
+		diffs := diffDesyncSnapshots(s, r)
+		if len(diffs) == 0 {
+			continue
+		}
+		if !diverged {
+			fmt.Printf("First divergence at frame %d (checksums %08x, %08x):\n", s.Frame, s.Checksum, r.Checksum)
+			for _, d := range diffs {
+				fmt.Printf("  %s\n", d)
+			}
+			diverged = true
+		} else {
+			fmt.Printf("Frame %d: %d fields differ\n", s.Frame, len(diffs))
+		}
+	}
+	if compared == 0 {
+		fmt.Println("Desync diff failed: the dumps have no frame in common")
+		return desyncDiffError
+	}
+	if !diverged {
+		fmt.Printf("No difference in the %d frames compared\n", compared)
+		return desyncDiffSame
+	}
+	return desyncDiffDiverged
+}
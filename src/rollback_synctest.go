@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Sync testing (-synctest <frames>) plays the quick VS match given with -p1,
+// -p2 and -s on an offline GGPO sync test session, AI against AI, headless
+// and as fast as possible. Every <frames> frames, the session loads the state
+// saved <frames> frames earlier and simulates the same frames again. Anything
+// the simulation depends on that GameState doesn't save or restore makes the
+// second pass differ from the first, which would desync rollback netplay.
+//
+// Each frame simulated again is checked twice: GGPO compares the GameState
+// checksums, and its desync snapshot is compared field by field with the one
+// taken the first time. The first failure ends the match and is reported.
+
+const (
+	syncTestExitOK      = 0
+	syncTestExitDesync  = 1
+	syncTestExitError   = 2
+	syncTestDefaultAI   = "8"
+	syncTestDefaultDist = 4
+)
+
+type SyncTester struct {
+	distance int
+	verified int // Frames simulated again and found identical
+	failed   bool
+	frame    int // First frame that failed
+	report   []string
+}
+
+// Creates a sync tester from the -synctest command line flag and sets up the
+// rollback config for it
+func newSyncTester(flags map[string]string, cfg *RollbackProperties) (*SyncTester, error) {
+	v, ok := flags["-synctest"]
+	if !ok {
+		return nil, nil
+	}
+	if flags["-p1"] == "" || flags["-p2"] == "" {
+		return nil, Error("-synctest needs the characters given with -p1 and -p2")
+	}
+	st := &SyncTester{distance: syncTestDefaultDist}
+	if v != "" && v != "true" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid -synctest frames: %s", v)
+		}
+		// GGPO only keeps the states of the last MaxSaveStates frames
+		st.distance = Min(n, MaxSaveStates)
+	}
+	for _, p := range []string{"-p1.ai", "-p2.ai"} {
+		if flags[p] == "" {
+			flags[p] = syncTestDefaultAI
+		}
+	}
+	cfg.DesyncTest = true
+	cfg.DesyncTestFrames = st.distance
+	cfg.DesyncTestAI = true
+	cfg.DesyncSnapshots = true
+	return st, nil
+}
+
+func (st *SyncTester) fail(frame int, reason string, details []string) {
+	if st.failed {
+		// Both checks may fail on the same frame
+		if frame == st.frame {
+			st.report = append(st.report, reason)
+			st.report = append(st.report, details...)
+		}
+		return
+	}
+	st.failed = true
+	st.frame = frame
+	st.report = append([]string{reason}, details...)
+	sys.esc = true
+}
+
+// Called with both snapshots of a frame simulated again after a rollback
+func (st *SyncTester) resimulated(first, again DesyncSnapshot) {
+	if diffs := diffDesyncSnapshots(first, again); len(diffs) > 0 {
+		st.fail(first.Frame, "Fields differ from the first simulation (first != again):", diffs)
+	} else if !st.failed {
+		st.verified++
+	}
+}
+
+// Called when GGPO finds a different GameState checksum on a frame simulated again
+func (st *SyncTester) checksumMismatch(frame int, stateID, lastVerifiedID int) {
+	st.fail(frame, fmt.Sprintf("GameState checksum differs from the first simulation (state %d, loaded from state %d)",
+		stateID, lastVerifiedID), nil)
+}
+
+// Prints the result. Returns the process exit code.
+func (st *SyncTester) finish() int {
+	if st.failed {
+		fmt.Printf("Sync test failed at frame %d, rolling back every %d frames\n", st.frame, st.distance)
+		for _, line := range st.report {
+			fmt.Printf("  %s\n", line)
+		}
+		return syncTestExitDesync
+	}
+	if st.verified == 0 {
+		fmt.Println("Sync test failed: no frame was simulated again")
+		return syncTestExitError
+	}
+	fmt.Printf("Sync test passed: %d frames simulated again, rolling back every %d frames\n", st.verified, st.distance)
+	return syncTestExitOK
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Scenario testing (-scenario <file>) plays a quick VS match headless and as
+// fast as possible, with the inputs of the players scripted frame by frame,
+// and checks trigger expressions at given frames. Character authors can use
+// it to regression-test combos and hit properties:
+//
+//	; Kung Fu Man's standing light punch
+//	p1 = kfm
+//	p2 = kfm
+//	stage = stages/stage0.def
+//
+//	0-3  p1 F
+//	4    p1 x
+//	6    p1 assert stateno = 200
+//	12   p1 assert movehit
+//	12   p2 assert life < lifemax && movetype = H
+//
+// Lines with '=' set the command line flags of the quick VS match, -p1, -s,
+// -p2.ai and so on, without their '-'. Frames count from the first frame of
+// round 1 where the players can fight (roundstate = 2), and can be ranges.
+// Inputs use the .cmd notation, with directions relative to where the player
+// faces: U, D, F, B, UF, UB, DF, DB and the buttons a, b, c, x, y, z, s, d, w
+// and m, joined with '+'. Assertions are trigger expressions, evaluated on
+// the root of the player after the frame ran. The scenario fails if any of
+// them is false.
+
+const (
+	scenarioExitOK     = 0
+	scenarioExitFailed = 1
+	scenarioExitError  = 2
+
+	// Frames to wait for round 1 to start
+	scenarioStartTimeout = 60 * 60
+)
+
+var scenarioSettingRegexp = regexp.MustCompile(`^([A-Za-z][\w.]*)\s*=\s*(.*)$`)
+var scenarioFrameRegexp = regexp.MustCompile(`^(\d+)(?:\s*-\s*(\d+))?\s+[pP](\d+)\s+(.+)$`)
+
+var scenarioKeys = map[string]InputBits{
+	"U": IB_PU, "D": IB_PD, "F": IB_PR, "B": IB_PL,
+	"UF": IB_PU | IB_PR, "UB": IB_PU | IB_PL, "DF": IB_PD | IB_PR, "DB": IB_PD | IB_PL,
+	"a": IB_A, "b": IB_B, "c": IB_C, "x": IB_X, "y": IB_Y, "z": IB_Z,
+	"s": IB_S, "d": IB_D, "w": IB_W, "m": IB_M,
+}
+
+type scenarioInput struct {
+	first, last int32
+	pn          int
+	bits        InputBits // Left and right are back and forward
+}
+
+type scenarioAssert struct {
+	first, last int32
+	pn          int
+	text        string
+	line        int
+	be          BytecodeExp
+	err         error
+	failedAt    int32 // First frame where it was false, -1 if none
+	context     string
+}
+
+type ScenarioRunner struct {
+	filename  string
+	inputs    []scenarioInput
+	asserts   []scenarioAssert
+	lastFrame int32
+	frame     int32 // Frame of the scenario, -1 until round 1 starts
+	waited    int32
+	done      bool
+	err       error
+}
+
+// Creates a scenario runner from the -scenario command line flag, and sets
+// the flags of the quick VS match from the scenario file
+func newScenarioRunner(flags map[string]string) (*ScenarioRunner, error) {
+	filename, ok := flags["-scenario"]
+	if !ok {
+		return nil, nil
+	}
+	str, err := LoadText(filename)
+	if err != nil {
+		return nil, err
+	}
+	sr := &ScenarioRunner{filename: filename, frame: -1}
+	for i, line := range SplitAndTrim(str, "\n") {
+		if j := strings.Index(line, ";"); j >= 0 {
+			line = strings.TrimSpace(line[:j])
+		}
+		if line == "" {
+			continue
+		}
+		if err := sr.parseLine(line, i+1, flags); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filename, i+1, err)
+		}
+	}
+	if flags["-p1"] == "" || flags["-p2"] == "" {
+		return nil, fmt.Errorf("%v: the characters p1 and p2 are not set", filename)
+	}
+	if len(sr.asserts) == 0 {
+		return nil, fmt.Errorf("%v: no assertions", filename)
+	}
+	// Time over would end the round in long scenarios
+	if _, ok := flags["-time"]; !ok {
+		flags["-time"] = "-1"
+	}
+	return sr, nil
+}
+
+func (sr *ScenarioRunner) parseLine(line string, ln int, flags map[string]string) error {
+	if m := scenarioSettingRegexp.FindStringSubmatch(line); m != nil {
+		key := m[1]
+		if key == "stage" {
+			key = "s"
+		}
+		flags["-"+key] = m[2]
+		return nil
+	}
+	m := scenarioFrameRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return Error("Expected <frame> p<n> <inputs>, or <frame> p<n> assert <trigger>: " + line)
+	}
+	first, err := strconv.ParseInt(m[1], 10, 32)
+	if err != nil {
+		return err
+	}
+	last := first
+	if m[2] != "" {
+		if last, err = strconv.ParseInt(m[2], 10, 32); err != nil {
+			return err
+		}
+		if last < first {
+			return Error("Invalid frame range: " + m[1] + "-" + m[2])
+		}
+	}
+	pn, err := strconv.Atoi(m[3])
+	if err != nil || pn < 1 || pn > MaxPlayerNo {
+		return Error("Invalid player: p" + m[3])
+	}
+	sr.lastFrame = Max(sr.lastFrame, int32(last))
+
+	if text, ok := strings.CutPrefix(m[4], "assert"); ok && (text == "" || text[0] == ' ' || text[0] == '\t') {
+		if text = strings.TrimSpace(text); text == "" {
+			return Error("Missing trigger after assert")
+		}
+		sr.asserts = append(sr.asserts, scenarioAssert{first: int32(first), last: int32(last),
+			pn: pn - 1, text: text, line: ln, failedAt: -1})
+		return nil
+	}
+	in := scenarioInput{first: int32(first), last: int32(last), pn: pn - 1}
+	for _, k := range strings.Split(strings.ReplaceAll(m[4], " ", ""), "+") {
+		bits, ok := scenarioKeys[k]
+		if !ok {
+			return Error("Invalid input: " + k)
+		}
+		in.bits |= bits
+	}
+	sr.inputs = append(sr.inputs, in)
+	return nil
+}
+
+// Inputs of a player on the current frame
+func (sr *ScenarioRunner) buttons(c *Char) [14]bool {
+	var bits InputBits
+	if sr.frame >= 0 && !sr.done {
+		for _, in := range sr.inputs {
+			if in.pn == c.playerNo && sr.frame >= in.first && sr.frame <= in.last {
+				bits |= in.bits
+			}
+		}
+		// Back and forward become left and right
+		if root := sys.chars[c.playerNo][0]; root.facing < 0 {
+			bits = bits&^(IB_PL|IB_PR) | (bits&IB_PL)<<1 | (bits&IB_PR)>>1
+		}
+	}
+	return bits.BitsToKeys()
+}
+
+// Compiles the assertions once the characters are loaded
+func (sr *ScenarioRunner) start() {
+	sr.frame = 0
+	for i := range sr.asserts {
+		a := &sr.asserts[i]
+		if len(sys.chars[a.pn]) == 0 {
+			a.err = fmt.Errorf("Player %v is not in the match", a.pn+1)
+			continue
+		}
+		a.be, a.err = debugConsoleExpression(sys.chars[a.pn][0], a.text)
+	}
+}
+
+func (sr *ScenarioRunner) end() {
+	sr.done = true
+	sys.endMatch = true
+}
+
+// Checks the assertions of the frame that just ran. Called after each
+// System.action
+func (sr *ScenarioRunner) step() {
+	if sr.done {
+		return
+	}
+	if sr.frame < 0 {
+		if sys.roundState() == 2 {
+			sr.start()
+		} else if sr.waited++; sr.waited > scenarioStartTimeout {
+			sr.err = Error("Round 1 didn't start")
+			sr.end()
+		}
+		return
+	}
+	for i := range sr.asserts {
+		a := &sr.asserts[i]
+		if a.be == nil || a.failedAt >= 0 || sr.frame < a.first || sr.frame > a.last {
+			continue
+		}
+		c := sys.chars[a.pn][0]
+		var ok bool
+		debugConsoleRun(c, func() {
+			ok = a.be.run(c).ToB()
+		})
+		if !ok {
+			a.failedAt = sr.frame
+			a.context = fmt.Sprintf("stateno %v, time %v", c.ss.no, c.ss.time)
+		}
+	}
+	sr.frame++
+	if sr.frame > sr.lastFrame {
+		sr.end()
+	}
+}
+
+// Prints the result. Returns the process exit code.
+func (sr *ScenarioRunner) finish() int {
+	if sr.err != nil {
+		fmt.Printf("Scenario failed: %v\n", sr.err)
+		return scenarioExitError
+	}
+	failed := 0
+	for _, a := range sr.asserts {
+		var msg string
+		switch {
+		case a.err != nil:
+			msg = a.err.Error()
+		case a.failedAt >= 0:
+			msg = fmt.Sprintf("frame %v: %v is false (%v)", a.failedAt, a.text, a.context)
+		case sr.frame <= a.last:
+			msg = fmt.Sprintf("frame %v: not reached, the match ended at frame %v", a.last, sr.frame)
+		default:
+			continue
+		}
+		failed++
+		fmt.Printf("%v:%v: p%v: %v\n", sr.filename, a.line, a.pn+1, msg)
+	}
+	if failed > 0 {
+		fmt.Printf("Scenario failed: %v of %v assertions\n", failed, len(sr.asserts))
+		return scenarioExitFailed
+	}
+	fmt.Printf("Scenario passed: %v assertions, %v frames\n", len(sr.asserts), sr.frame)
+	return scenarioExitOK
+}
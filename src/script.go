@@ -2234,6 +2234,45 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.continueFlg))
 		return 1
 	})
+	luaRegister(l, "disassemble", func(*lua.LState) int {
+		/*Print the bytecode a state of the debug character compiled to.
+		@function disassemble
+		@tparam[opt] int32|string state State number, or the name of a ZSS function. Defaults to the current state.
+		@tparam[opt] string filename If provided, the listing is written to this file instead of the debug console.
+		@treturn string listing The listing.
+		function disassemble(state, filename) end*/
+		c := sys.debugWC
+		if c == nil {
+			return 0
+		}
+		var listing string
+		switch {
+		case nilArg(l, 1):
+			listing = disassemble(c.ss.sb.playerNo, map[int32]StateBytecode{c.ss.no: c.ss.sb}, nil, nil)
+		case l.Get(1).Type() == lua.LTString:
+			if bf, ok := c.gi().callFuncs[strArg(l, 1)]; ok {
+				listing = disassemble(c.playerNo, nil, []int32{}, map[string]bytecodeFunction{strArg(l, 1): bf})
+			} else {
+				listing = "Function " + strArg(l, 1) + " doesn't exist\n"
+			}
+		default:
+			no := int32(numArg(l, 1))
+			listing = disassemble(c.playerNo, c.gi().states, []int32{no}, nil)
+		}
+		if !nilArg(l, 2) {
+			if err := os.WriteFile(strArg(l, 2), []byte(listing), 0666); err != nil {
+				sys.appendToConsole("Disassembly: " + err.Error())
+			} else {
+				sys.appendToConsole("Disassembly saved to " + strArg(l, 2))
+			}
+		} else {
+			for _, str := range strings.Split(strings.TrimSuffix(listing, "\n"), "\n") {
+				sys.appendToConsole(str)
+			}
+		}
+		l.Push(lua.LString(listing))
+		return 1
+	})
 	luaRegister(l, "endMatch", func(*lua.LState) int {
 		/*Signal that the current match should end (using menu fade-out settings).
 		@function endMatch
@@ -2243,6 +2282,39 @@ func systemScriptInit(l *lua.LState) {
 		sys.endMatch = true
 		return 0
 	})
+	luaRegister(l, "enterLobbyNetPlay", func(*lua.LState) int {
+		/*Enter netplay with the player matched by the lobby server. The host
+		  accepts the guest directly or through the lobby relay, and the guest
+		  falls back to the relay if the host can't be reached directly.
+		@function enterLobbyNetPlay
+		function enterLobbyNetPlay() end*/
+		if sys.netConnection != nil {
+			l.RaiseError("\nConnection already established.\n")
+		}
+		state, _, _, peer, _ := sys.lobby.Status()
+		if state != "matched" || peer == nil {
+			l.RaiseError("\nNo lobby match to connect to.\n")
+		}
+		relay, err := newLobbyRelay(sys.lobby.addr, peer)
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		sys.beginNetPlay()
+		if peer.Host {
+			sys.netConnection.AcceptLobby(sys.cfg.Netplay.ListenPort, relay)
+		} else {
+			port := peer.Port
+			if port == "" {
+				port = sys.cfg.Netplay.ListenPort
+			}
+			//Rollback only
+			if sys.cfg.Netplay.RollbackNetcode {
+				sys.rollback.session.host = peer.Address
+			}
+			sys.netConnection.ConnectLobby(peer.Address, port, relay)
+		}
+		return 0
+	})
 	luaRegister(l, "enterNetPlay", func(*lua.LState) int {
 		/*Enter netplay as client or host.
 		@function enterNetPlay
@@ -2252,15 +2324,7 @@ func systemScriptInit(l *lua.LState) {
 		if sys.netConnection != nil {
 			l.RaiseError("\nConnection already established.\n")
 		}
-		sys.sessionWarning = ""
-		sys.chars = [len(sys.chars)][]*Char{}
-		sys.netConnection = NewNetConnection()
-
-		//Rollback only
-		if sys.cfg.Netplay.RollbackNetcode {
-			rs := NewRollbackSession(sys.cfg.Netplay.Rollback)
-			sys.rollback.session = &rs
-		}
+		sys.beginNetPlay()
 
 		if host := strArg(l, 1); host != "" {
 			//Rollback only
@@ -2269,6 +2333,10 @@ func systemScriptInit(l *lua.LState) {
 			}
 
 			sys.netConnection.Connect(host, sys.cfg.Netplay.ListenPort)
+		} else if size := Clamp(sys.cfg.Netplay.Participants, 2, MaxPartySize); size > 2 {
+			if err := sys.netConnection.AcceptParty(sys.cfg.Netplay.ListenPort, size); err != nil {
+				l.RaiseError(err.Error())
+			}
 		} else {
 			if err := sys.netConnection.Accept(sys.cfg.Netplay.ListenPort); err != nil {
 				l.RaiseError(err.Error())
@@ -2306,6 +2374,20 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.replayFile != nil))
 		return 1
 	})
+	luaRegister(l, "enterSpectate", func(*lua.LState) int {
+		/*Start connecting to a netplay host as a spectator.
+		@function enterSpectate
+		@tparam string address Host address, optionally followed by `:port`. Without a port,
+		  `Netplay.SpectatorPort` is used.
+		function enterSpectate(address) end*/
+		sys.sessionWarning = ""
+		if sys.spectateStream != nil {
+			sys.spectateStream.Close()
+		}
+		host, port := spectatorAddress(strArg(l, 1))
+		sys.spectateStream = DialSpectatorStream(host, port, sys.cfg.Netplay.SpectatorDelay)
+		return 0
+	})
 	luaRegister(l, "esc", func(l *lua.LState) int {
 		/*Get or set the global escape flag.
 		@function esc
@@ -2351,6 +2433,10 @@ func systemScriptInit(l *lua.LState) {
 			sys.replayFile.Close()
 			sys.replayFile = nil
 		}
+		if sys.spectateStream != nil {
+			sys.spectateStream.Close()
+			sys.spectateStream = nil
+		}
 		sys.uiResetTokenGuard()
 		return 0
 	})
@@ -2721,6 +2807,7 @@ func systemScriptInit(l *lua.LState) {
 
 			sys.draws = 0
 			sys.statsLog.startMatch()
+			sys.replayRecorder().beginMatch()
 
 			// Anonymous function to perform gameplay
 			fight := func() (int32, error) {
@@ -2883,6 +2970,9 @@ func systemScriptInit(l *lua.LState) {
 				} else {
 					sys.statsLog.finalizeMatch()
 				}
+				if err := sys.replayRecorder().endMatch(sys.statsLog.currentStatsMatch()); err != nil {
+					LogMessage("Error while writing replay match info: %v", err)
+				}
 				// Cleanup
 				sys.timerStart = 0
 				sys.timerRounds = []int32{}
@@ -3642,6 +3732,22 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LNumber(sys.inputRemap[pn-1] + 1))
 		return 1
 	})
+	luaRegister(l, "getReplayInfo", func(l *lua.LState) int {
+		/*Read the details stored in a replay file without playing it.
+		@function getReplayInfo
+		@tparam string path Path to the replay file.
+		@treturn table|nil info Table with `FormatVersion`, `Created`, `Players` and a `Matches` array
+		  (stage, characters, team modes, round frames and `Result` stats of each match), or `nil`
+		  if the file can't be read. Replays older than format version 2 have no `Matches`.
+		function getReplayInfo(path) end*/
+		info, err := ReadReplayInfo(strArg(l, 1))
+		if err != nil {
+			l.Push(lua.LNil)
+			return 1
+		}
+		l.Push(toLValue(l, info))
+		return 1
+	})
 	luaRegister(l, "getRoundTime", func(l *lua.LState) int {
 		/*Get the configured round time limit.
 		@function getRoundTime
@@ -4519,6 +4625,16 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lTable)
 		return 1
 	})
+	luaRegister(l, "loadProgress", func(l *lua.LState) int {
+		/*Get the progress of the files read by the current match load.
+		@function loadProgress
+		@treturn table progress Table with `progress` (0 to 1, the average of the files
+		  started so far) and `assets`, a list of tables with `kind` (`"sff"`, `"snd"` or
+		  `"model"`), `file`, `done` and `total` (sprites for SFF, bytes otherwise).
+		function loadProgress() end*/
+		l.Push(sys.loader.progress.table(l))
+		return 1
+	})
 	luaRegister(l, "loadStart", func(l *lua.LState) int {
 		/*Validate selection and start asynchronous loading of characters and stage.
 		@function loadStart
@@ -4593,6 +4709,118 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LString(content))
 		return 1
 	})
+	luaRegister(l, "lobbyConnect", func(l *lua.LState) int {
+		/*Connect to a lobby server, replacing any previous lobby connection.
+		@function lobbyConnect
+		@tparam[opt] string address Lobby server address (`ip[:port]`). Defaults to the
+		  `Netplay.LobbyServer` option.
+		@treturn boolean success `true` if connected.
+		@treturn string|nil error Error message on failure.
+		function lobbyConnect(address) end*/
+		addr := sys.cfg.Netplay.LobbyServer
+		if !nilArg(l, 1) && strArg(l, 1) != "" {
+			addr = strArg(l, 1)
+		}
+		sys.lobby.Close()
+		sys.lobby = nil
+		lc, err := DialLobby(addr)
+		if err != nil {
+			LogMessage("Failed to connect to the lobby server %s: %v", addr, err)
+			l.Push(lua.LBool(false))
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		sys.lobby = lc
+		l.Push(lua.LBool(true))
+		return 1
+	})
+	luaRegister(l, "lobbyCreate", func(l *lua.LState) int {
+		/*Create a lobby room for a netplay session hosted on `Netplay.ListenPort`.
+		  The room stays listed until a guest joins it or it is left.
+		@function lobbyCreate
+		@tparam[opt] string name Room name.
+		function lobbyCreate(name) end*/
+		name := ""
+		if !nilArg(l, 1) {
+			name = strArg(l, 1)
+		}
+		if err := sys.lobby.Create(name, sys.cfg.Netplay.PlayerName, sys.cfg.Netplay.ListenPort, sys.cfg.Netplay.RollbackNetcode); err != nil {
+			LogMessage("Lobby: %v", err)
+		}
+		return 0
+	})
+	luaRegister(l, "lobbyDisconnect", func(*lua.LState) int {
+		/*Close the lobby server connection.
+		@function lobbyDisconnect
+		function lobbyDisconnect() end*/
+		sys.lobby.Close()
+		sys.lobby = nil
+		return 0
+	})
+	luaRegister(l, "lobbyJoin", func(l *lua.LState) int {
+		/*Join a lobby room. Once matched, `lobbyStatus().state` becomes `"matched"`
+		  and `enterLobbyNetPlay` connects to the host.
+		@function lobbyJoin
+		@tparam int32 id Room id, from `lobbyRooms`.
+		function lobbyJoin(id) end*/
+		if err := sys.lobby.Join(int32(numArg(l, 1)), sys.cfg.Netplay.PlayerName); err != nil {
+			LogMessage("Lobby: %v", err)
+		}
+		return 0
+	})
+	luaRegister(l, "lobbyLeave", func(*lua.LState) int {
+		/*Close the hosted lobby room, or forget the current lobby match.
+		@function lobbyLeave
+		function lobbyLeave() end*/
+		if err := sys.lobby.Leave(); err != nil {
+			LogMessage("Lobby: %v", err)
+		}
+		return 0
+	})
+	luaRegister(l, "lobbyRefresh", func(*lua.LState) int {
+		/*Request an updated room list from the lobby server.
+		@function lobbyRefresh
+		function lobbyRefresh() end*/
+		sys.lobby.Refresh()
+		return 0
+	})
+	luaRegister(l, "lobbyRooms", func(l *lua.LState) int {
+		/*Get the last room list received from the lobby server.
+		@function lobbyRooms
+		@treturn table rooms Array of tables with `id`, `name`, `host` (player name)
+		  and `rollback` (whether the host uses rollback netcode).
+		function lobbyRooms() end*/
+		tbl := l.NewTable()
+		for _, r := range sys.lobby.Rooms() {
+			t := l.NewTable()
+			t.RawSetString("id", lua.LNumber(r.ID))
+			t.RawSetString("name", lua.LString(r.Name))
+			t.RawSetString("host", lua.LString(r.Host))
+			t.RawSetString("rollback", lua.LBool(r.Rollback))
+			tbl.Append(t)
+		}
+		l.Push(tbl)
+		return 1
+	})
+	luaRegister(l, "lobbyStatus", func(l *lua.LState) int {
+		/*Get the state of the lobby connection.
+		@function lobbyStatus
+		@treturn table status Table with `state` (`"idle"`, `"hosting"`, `"joining"`,
+		  `"matched"` or `"closed"`), `room` (room id), `name` (room name), `peer`
+		  (matched player name) and `error` (last error message).
+		function lobbyStatus() end*/
+		state, room, name, peer, errMsg := sys.lobby.Status()
+		t := l.NewTable()
+		t.RawSetString("state", lua.LString(state))
+		t.RawSetString("room", lua.LNumber(room))
+		t.RawSetString("name", lua.LString(name))
+		if peer != nil {
+			t.RawSetString("peer", lua.LString(peer.Player))
+		}
+		t.RawSetString("error", lua.LString(errMsg))
+		l.Push(t)
+		return 1
+	})
 	luaRegister(l, "mapSet", func(*lua.LState) int {
 		/*[redirectable] Set the character's map value.
 		@function mapSet
@@ -4756,6 +4984,15 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.netplay()))
 		return 1
 	})
+	luaRegister(l, "netPlayers", func(*lua.LState) int {
+		/*Get the number of players taking part in the netplay session.
+		@function netPlayers
+		@treturn int32 count 3 or 4 for netplay parties, where participant `n`
+		  controls player `n`, 2 for other netplay sessions and replays, 0 offline.
+		function netPlayers() end*/
+		l.Push(lua.LNumber(sys.netplayParticipants()))
+		return 1
+	})
 	luaRegister(l, "panicError", func(*lua.LState) int {
 		/*Raise an immediate Lua error with a custom message.
 		@function panicError
@@ -5131,6 +5368,28 @@ func systemScriptInit(l *lua.LState) {
 		fmt.Println(strArg(l, 1))
 		return 0
 	})
+	luaRegister(l, "profilerDump", func(*lua.LState) int {
+		/*Write the character code profiler results to a file.
+		@function profilerDump
+		@tparam string filename Path of the file. Written as JSON if it ends in `.json`, otherwise as CSV.
+		@treturn boolean success `false` if the file couldn't be written.
+		function profilerDump(filename) end*/
+		if err := sys.profiler.dump(strArg(l, 1)); err != nil {
+			sys.appendToConsole("Profiler: " + err.Error())
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		sys.appendToConsole("Profiler results saved to " + strArg(l, 1))
+		l.Push(lua.LBool(true))
+		return 1
+	})
+	luaRegister(l, "profilerReset", func(*lua.LState) int {
+		/*Clear the character code profiler results.
+		@function profilerReset
+		function profilerReset() end*/
+		sys.profiler.reset()
+		return 0
+	})
 	luaRegister(l, "puts", func(*lua.LState) int {
 		/*Print text to standard output (stdout) only.
 		@function puts
@@ -5359,17 +5618,121 @@ func systemScriptInit(l *lua.LState) {
 		sys.debugWC.unsetSCF(SCF_dizzy)
 		return 0
 	})
+	luaRegister(l, "replayFrame", func(*lua.LState) int {
+		/*Get the current replay playback position.
+		@function replayFrame
+		@treturn int32|nil frame Number of input frames played so far,
+		  or `nil` if no replay is being played.
+		function replayFrame() end*/
+		if sys.replayFile == nil {
+			return 0
+		}
+		l.Push(lua.LNumber(sys.replayFile.Frame()))
+		return 1
+	})
+	luaRegister(l, "replayLength", func(*lua.LState) int {
+		/*Get the approximate length of the replay being played.
+		@function replayLength
+		@treturn int32|nil frames Estimated number of input frames in the file,
+		  or `nil` if no replay is being played.
+		function replayLength() end*/
+		if sys.replayFile == nil {
+			return 0
+		}
+		l.Push(lua.LNumber(sys.replayFile.Length()))
+		return 1
+	})
 	luaRegister(l, "replayRecord", func(*lua.LState) int {
 		/*Start recording rollback/netplay input to a file.
 		@function replayRecord
 		@tparam string path Output file path.
 		function replayRecord(path) end*/
 		if sys.netConnection != nil {
-			sys.netConnection.recording, _ = os.Create(strArg(l, 1))
+			rw, err := CreateReplayWriter(strArg(l, 1))
+			if err != nil {
+				LogMessage("Failed to create replay file: %v", err)
+			}
+			sys.netConnection.recording = rw
 			sys.netConnection.headerWritten = false
 		}
 		return 0
 	})
+	luaRegister(l, "replayRoundMarkers", func(*lua.LState) int {
+		/*Get the round start positions found so far in the current replay match.
+		@function replayRoundMarkers
+		@treturn table markers Array of `{round = int32, frame = int32}` tables.
+		function replayRoundMarkers() end*/
+		tbl := l.NewTable()
+		if sys.replayFile != nil {
+			for _, m := range sys.replayFile.RoundMarkers() {
+				mt := l.NewTable()
+				mt.RawSetString("round", lua.LNumber(m.Round))
+				mt.RawSetString("frame", lua.LNumber(m.Frame))
+				tbl.Append(mt)
+			}
+		}
+		l.Push(tbl)
+		return 1
+	})
+	luaRegister(l, "replaySeek", func(*lua.LState) int {
+		/*Seek the replay being played to the given frame. Rewinding is limited
+		to the current match.
+		@function replaySeek
+		@tparam int32 frame Target input frame.
+		@tparam[opt=true] boolean pause If `true`, pauses playback once the frame is reached.
+		@treturn boolean success `false` if the frame can't be reached exactly.
+		function replaySeek(frame, pause) end*/
+		if sys.replayFile == nil {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		pause := true
+		if !nilArg(l, 2) {
+			pause = boolArg(l, 2)
+		}
+		l.Push(lua.LBool(sys.replayFile.RequestSeek(int32(numArg(l, 1)), pause)))
+		return 1
+	})
+	luaRegister(l, "replaySeekRound", func(*lua.LState) int {
+		/*Jump to the start of a round of the current replay match.
+		@function replaySeekRound
+		@tparam int32 round Round number.
+		@tparam[opt=true] boolean pause If `true`, pauses playback at the round start.
+		@treturn boolean success `false` if the round can't be reached.
+		function replaySeekRound(round, pause) end*/
+		if sys.replayFile == nil {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		pause := true
+		if !nilArg(l, 2) {
+			pause = boolArg(l, 2)
+		}
+		l.Push(lua.LBool(sys.replayFile.RequestSeekRound(int32(numArg(l, 1)), pause)))
+		return 1
+	})
+	luaRegister(l, "replaySeeking", func(*lua.LState) int {
+		/*Check whether a replay seek is in progress.
+		@function replaySeeking
+		@treturn boolean seeking `true` while fast-forwarding to a seek target.
+		function replaySeeking() end*/
+		l.Push(lua.LBool(sys.replayFile != nil && sys.replayFile.Seeking()))
+		return 1
+	})
+	luaRegister(l, "replayStep", func(*lua.LState) int {
+		/*Step the replay being played by a number of frames and pause.
+		@function replayStep
+		@tparam int32 frames Frames to step; negative values step backwards.
+		@treturn boolean success `false` if the frame can't be reached exactly.
+		function replayStep(frames) end*/
+		if sys.replayFile == nil {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		frame := sys.replayFile.Frame() + int32(numArg(l, 1))
+		l.Push(lua.LBool(sys.replayFile.RequestSeek(frame, true)))
+		return 1
+	})
 	luaRegister(l, "replayStop", func(*lua.LState) int {
 		/*Stop input replay recording.
 		@function replayStop
@@ -5388,6 +5751,20 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "replayVerifyFinish", func(*lua.LState) int {
+		/*Finish replay verification started with `-verifyreplay`, comparing the
+		checksum trace against the reference and a second run.
+		@function replayVerifyFinish
+		@treturn int|nil code Process exit code (0 if the replay is deterministic),
+		  or `nil` if replay verification is not active.
+		function replayVerifyFinish() end*/
+		if sys.replayVerify == nil {
+			return 0
+		}
+		l.Push(lua.LNumber(sys.replayVerify.finish()))
+		sys.replayVerify = nil
+		return 1
+	})
 	luaRegister(l, "resetAILevel", func(l *lua.LState) int {
 		/*Reset AI level for all players to 0 (human control).
 		@function resetAILevel
@@ -5562,6 +5939,20 @@ func systemScriptInit(l *lua.LState) {
 		sys.saveStateFlag = true
 		return 0
 	})
+	luaRegister(l, "scenarioFinish", func(*lua.LState) int {
+		/*Finish the scenario started with `-scenario`, printing the assertions
+		that failed.
+		@function scenarioFinish
+		@treturn int|nil code Process exit code (0 if every assertion passed),
+		  or `nil` if no scenario is running.
+		function scenarioFinish() end*/
+		if sys.scenario == nil {
+			return 0
+		}
+		l.Push(lua.LNumber(sys.scenario.finish()))
+		sys.scenario = nil
+		return 1
+	})
 	luaRegister(l, "screenshot", func(*lua.LState) int {
 		/*Take a screenshot on the next frame.
 		@function screenshot
@@ -6382,6 +6773,87 @@ func systemScriptInit(l *lua.LState) {
 		s.stop([...]int32{int32(numArg(l, 2)), int32(numArg(l, 3))})
 		return 0
 	})
+	luaRegister(l, "spectateConnected", func(*lua.LState) int {
+		/*Check whether the spectator connection started by `enterSpectate` is ready.
+		@function spectateConnected
+		@treturn boolean ready `true` once the host's session settings have been received,
+		  or if the connection failed.
+		function spectateConnected() end*/
+		l.Push(lua.LBool(sys.spectateStream != nil && sys.spectateStream.Ready()))
+		return 1
+	})
+	luaRegister(l, "spectateMatch", func(*lua.LState) int {
+		/*Prepare the next match of the host's session, for spectators that join at keyframes.
+		  Once it returns `true`, the match is loading and `game()` plays it back from the keyframe.
+		@function spectateMatch
+		@treturn boolean|nil started `true` if the match was selected and started loading,
+		  `false` if the session is over (see `getSessionWarning()`), `nil` while waiting for
+		  the next match to start.
+		function spectateMatch() end*/
+		rf := sys.replayFile
+		if rf == nil || rf.file == nil || rf.stream == nil {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		kf, ended := rf.stream.NextKeyframe()
+		if kf == nil {
+			if ended {
+				if err := rf.stream.Err(); err != nil && sys.sessionWarning == "" {
+					sys.sessionWarning = err.Error()
+				}
+				l.Push(lua.LBool(false))
+			} else {
+				l.Push(lua.LNil)
+			}
+			return 1
+		}
+		if err := kf.context.apply(); err != nil {
+			sys.sessionWarning = err.Error()
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		rf.keyframe = kf
+		l.Push(lua.LBool(true))
+		return 1
+	})
+	luaRegister(l, "spectateStart", func(*lua.LState) int {
+		/*Start playing back the host's session as a spectator. Call `synchronize()` afterwards,
+		  as with `enterReplay`, unless the spectator joins at keyframes; then call
+		  `spectateMatch()` to play back each match.
+		@function spectateStart
+		@treturn boolean success `true` if playback started, `false` otherwise
+		  (see `getSessionWarning()`).
+		@treturn boolean late `true` if the session started too long ago to receive all of it,
+		  so the spectator joins matches at keyframes and doesn't see the menus.
+		function spectateStart() end*/
+		if sys.spectateStream == nil {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		ss := sys.spectateStream
+		sys.spectateStream = nil
+		rf, err := OpenSpectatorReplay(ss)
+		if err != nil {
+			sys.sessionWarning = err.Error()
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		if sys.cfg.Video.VSync >= 0 {
+			sys.window.SetSwapInterval(1) // broken frame skipping when set to 0
+		}
+		sys.chars = [len(sys.chars)][]*Char{}
+		sys.replayFile = rf
+		if err := sys.beginReplaySession(sys.replayFile); err != nil {
+			sys.replayFile.Close()
+			sys.replayFile = nil
+			if sys.sessionWarning == "" {
+				sys.sessionWarning = err.Error()
+			}
+		}
+		l.Push(lua.LBool(sys.replayFile != nil))
+		l.Push(lua.LBool(sys.replayFile != nil && sys.replayFile.stream.Late()))
+		return 2
+	})
 	luaRegister(l, "stopAllCharSounds", func(l *lua.LState) int {
 		/*Stop all character sounds.
 		@function stopAllCharSounds
@@ -6419,6 +6891,20 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(true))
 		return 1
 	})
+	luaRegister(l, "syncTestFinish", func(*lua.LState) int {
+		/*Finish the rollback sync test started with `-synctest`, printing the
+		first frame that didn't simulate the same way twice.
+		@function syncTestFinish
+		@treturn int|nil code Process exit code (0 if every frame matched),
+		  or `nil` if no sync test is running.
+		function syncTestFinish() end*/
+		if sys.syncTest == nil {
+			return 0
+		}
+		l.Push(lua.LNumber(sys.syncTest.finish()))
+		sys.syncTest = nil
+		return 1
+	})
 	luaRegister(l, "textImgAddPos", func(*lua.LState) int {
 		/*Offset a text sprite's position by the given amounts.
 		@function textImgAddPos
@@ -6956,6 +7442,22 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleConsoleInput", func(*lua.LState) int {
+		/*Open or close the debug console input, to evaluate trigger expressions
+		and run ZSS statements on the character selected in the debug display.
+		@function toggleConsoleInput
+		@tparam[opt] boolean state If provided, opens/closes the input; otherwise toggles it.
+		function toggleConsoleInput(state) end*/
+		if !sys.debugModeAllowed() {
+			return 0
+		}
+		if !nilArg(l, 1) {
+			sys.debugConsole.toggle(boolArg(l, 1))
+		} else {
+			sys.debugConsole.toggle(!sys.debugConsole.active)
+		}
+		return 0
+	})
 	luaRegister(l, "toggleDebugDisplay", func(*lua.LState) int {
 		/*Toggle or cycle debug display.
 		@function toggleDebugDisplay
@@ -7121,6 +7623,21 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleProfiler", func(*lua.LState) int {
+		/*Toggle the character code profiler and its table in the debug display.
+		@function toggleProfiler
+		@tparam[opt] boolean state If provided, turns the profiler on/off; otherwise toggles it.
+		function toggleProfiler(state) end*/
+		if !sys.debugModeAllowed() {
+			return 0
+		}
+		if !nilArg(l, 1) {
+			sys.profiler.toggle(boolArg(l, 1))
+		} else {
+			sys.profiler.toggle(!sys.profiler.active)
+		}
+		return 0
+	})
 	luaRegister(l, "toggleVSync", func(*lua.LState) int {
 		/*Toggle vertical sync (VSync).
 		@function toggleVSync
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"image"
+	colour "image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+)
+
+// SFF files as plain data. Unlike loadSff, readSffFile decodes the sprites
+// without creating textures, so tools can convert and compare them. Encode
+// writes SFF v2, or v1 for 8 bit sprites only:
+//   - Palettes with the same colors as an earlier one are stored as links.
+//   - Sprites with the same pixels as an earlier one are stored as links.
+//   - Each sprite of a v2 file is compressed with its own format. v1 files
+//     always use PCX.
+
+type SffFormat byte
+
+const (
+	SffRaw   SffFormat = 0
+	SffRLE8  SffFormat = 2
+	SffRLE5  SffFormat = 3
+	SffLZ5   SffFormat = 4
+	SffPNG8  SffFormat = 10
+	SffPNG24 SffFormat = 11
+	SffPNG32 SffFormat = 12
+	// Sprites of v1 files
+	SffPCX SffFormat = 0xfe
+	// Smallest of the formats the sprite can be written in
+	SffAuto SffFormat = 0xff
+)
+
+var sffFormatNames = map[SffFormat]string{
+	SffRaw: "raw", SffRLE8: "rle8", SffRLE5: "rle5", SffLZ5: "lz5",
+	SffPNG8: "png8", SffPNG24: "png24", SffPNG32: "png32", SffPCX: "pcx", SffAuto: "auto",
+}
+
+func (f SffFormat) String() string {
+	if name, ok := sffFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("format %v", byte(f))
+}
+
+type SffSprite struct {
+	Group, Number uint16
+	Offset        [2]int16
+	Width, Height int
+	Depth         int       // 8 for palette indices, 32 for RGBA
+	Pix           []byte    // Rows of pixels, 4 bytes each with a depth of 32
+	Pal           int       // Palette of 8 bit sprites, index in SffFile.Palettes
+	Format        SffFormat // Compression
+	link          int       // Sprite it's linked to in the file it was read from, -1 if none
+	dataSize      int       // Size of its data in that file
+}
+
+type SffPalette struct {
+	Group, Number uint16
+	Colors        []uint32 // Same layout as Sprite.Pal, alpha<<24 | b<<16 | g<<8 | r
+}
+
+type SffFile struct {
+	Version  int // 1 or 2
+	Sprites  []*SffSprite
+	Palettes []*SffPalette
+}
+
+func sffSameColors(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether only color 0 is transparent, which SFF 2.00 palettes can't change
+func sffStandardAlpha(colors []uint32) bool {
+	for i, c := range colors {
+		if a := c >> 24; i == 0 && a != 0 || i > 0 && a != 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether every palette has the standard alpha, so the file can be an SFF 2.00
+func (sf *SffFile) standardAlpha() bool {
+	for _, p := range sf.Palettes {
+		if !sffStandardAlpha(p.Colors) {
+			return false
+		}
+	}
+	return true
+}
+
+// Pixels cut or padded to the size of the sprite
+func sffPixels(px []byte, size int) []byte {
+	if len(px) >= size {
+		return px[:size]
+	}
+	return append(px, make([]byte, size-len(px))...)
+}
+
+// Palette of 256 colors for PNG images
+func sffColorPalette(colors []uint32) colour.Palette {
+	p := make(colour.Palette, 256)
+	for i := range p {
+		var c uint32
+		if i < len(colors) {
+			c = colors[i]
+		}
+		p[i] = colour.NRGBA{byte(c), byte(c >> 8), byte(c >> 16), byte(c >> 24)}
+	}
+	return p
+}
+
+// Colors of the palette of a sprite, nil if it has none
+func (sf *SffFile) palette(s *SffSprite) []uint32 {
+	if s.Depth != 8 || s.Pal < 0 || s.Pal >= len(sf.Palettes) {
+		return nil
+	}
+	return sf.Palettes[s.Pal].Colors
+}
+
+// Index of the palette with these colors, which is added as palette 0,n if
+// there is none
+func (sf *SffFile) addPalette(colors []uint32) int {
+	var number uint16
+	for i, p := range sf.Palettes {
+		if sffSameColors(p.Colors, colors) {
+			return i
+		}
+		if p.Group == 0 && p.Number >= number {
+			number = p.Number + 1
+		}
+	}
+	sf.Palettes = append(sf.Palettes, &SffPalette{Number: number, Colors: colors})
+	return len(sf.Palettes) - 1
+}
+
+// Reads every sprite and palette of an SFF file
+func readSffFile(filename string) (*SffFile, error) {
+	f, err := OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var h SffHeader
+	var lofs, tofs uint32
+	if err := h.Read(f, &lofs, &tofs); err != nil {
+		return nil, err
+	}
+	read := func(x interface{}) error {
+		return binary.Read(f, binary.LittleEndian, x)
+	}
+	sf := &SffFile{Version: int(h.Version[0])}
+
+	if sf.Version == 2 {
+		sff := &Sff{header: h}
+		for i := 0; i < int(h.NumberOfPalettes); i++ {
+			f.Seek(int64(h.FirstPaletteHeaderOffset)+int64(i*16), io.SeekStart)
+			var gn [3]uint16
+			var link uint16
+			var ofs, size uint32
+			for _, x := range []interface{}{gn[:], &link, &ofs, &size} {
+				if err := read(x); err != nil {
+					return nil, err
+				}
+			}
+			p := &SffPalette{Group: gn[0], Number: gn[1]}
+			if size == 0 {
+				if int(link) >= i {
+					return nil, fmt.Errorf("Palette %v,%v is linked to palette %v, which doesn't come before it",
+						gn[0], gn[1], link)
+				}
+				p.Colors = sf.Palettes[link].Colors
+			} else {
+				colors, err := sff.ReadPalette(f, int64(lofs+ofs), size)
+				if err != nil {
+					return nil, err
+				}
+				p.Colors = colors[:Min(int(size/4), len(colors))]
+			}
+			sf.Palettes = append(sf.Palettes, p)
+		}
+	}
+
+	shofs := int64(h.FirstSpriteHeaderOffset)
+	var prev *SffSprite // Last sprite with its own data
+	for i := 0; i < int(h.NumberOfSprites); i++ {
+		f.Seek(shofs, io.SeekStart)
+		spr := newSprite()
+		var ofs, size uint32
+		var link uint16
+		if sf.Version == 1 {
+			err = spr.readHeader(f, &ofs, &size, &link)
+		} else {
+			err = spr.readHeaderV2(f, &ofs, &size, lofs, tofs, &link)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := &SffSprite{Group: spr.Group, Number: spr.Number, Offset: spr.Offset, Depth: 8,
+			Pal: spr.palidx, Format: SffFormat(-spr.rle), link: -1, dataSize: int(size)}
+		switch {
+		case size == 0 && int(link) < i:
+			src := sf.Sprites[link]
+			s.Width, s.Height, s.Depth, s.Pix, s.Format = src.Width, src.Height, src.Depth, src.Pix, src.Format
+			s.link = int(link)
+			if s.Pal < 0 {
+				s.Pal = src.Pal
+			}
+		case size == 0:
+			// Linked to a sprite that isn't loaded yet, blank like in loadSff
+			s.Pal = 0
+		case sf.Version == 1:
+			s.Format = SffPCX
+			if err := sf.readPcx(f, spr, s, shofs+32, size, ofs, prev); err != nil {
+				return nil, fmt.Errorf("Sprite %v,%v: %v", s.Group, s.Number, err)
+			}
+			prev = s
+		default:
+			if err := s.readData(f, spr, int64(ofs), size); err != nil {
+				return nil, fmt.Errorf("Sprite %v,%v: %v", s.Group, s.Number, err)
+			}
+			prev = s
+		}
+		sf.Sprites = append(sf.Sprites, s)
+		if sf.Version == 1 {
+			shofs = int64(ofs)
+		} else {
+			shofs += 28
+		}
+	}
+	return sf, nil
+}
+
+// Reads the PCX image of a v1 sprite, and its palette unless it uses the one
+// of the previous sprite. The palette is found as in Sprite.read
+func (sf *SffFile) readPcx(f io.ReadSeeker, spr *Sprite, s *SffSprite, offset int64,
+	size, next uint32, prev *SffSprite) error {
+	var same byte
+	if err := binary.Read(f, binary.LittleEndian, &same); err != nil {
+		return err
+	}
+	if err := spr.readPcxHeader(f, offset); err != nil {
+		return err
+	}
+	end := offset + int64(size)
+	if int64(next) > offset {
+		end = int64(next)
+	}
+	data := make([]byte, Max(0, end-offset))
+	f.Seek(offset, io.SeekStart)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	data = data[:n]
+
+	paletteSame := same != 0 && prev != nil
+	palOfs := len(data)
+	if !paletteSame {
+		palOfs = len(data) - 769
+		for i := palOfs; i >= 128; i-- {
+			if data[i] == 0x0C {
+				palOfs = i
+				break
+			}
+		}
+	}
+	var rle []byte
+	if palOfs > 128 {
+		rle = data[128:palOfs]
+	}
+	s.Width, s.Height = int(spr.Size[0]), int(spr.Size[1])
+	s.Pix = sffPixels(spr.RlePcxDecode(rle), s.Width*s.Height)
+
+	if paletteSame {
+		s.Pal = prev.Pal
+		return nil
+	}
+	if palOfs < 0 {
+		return Error("PCX palette not found")
+	}
+	colors := make([]uint32, 256)
+	for i := range colors {
+		rgb := data[palOfs+1+i*3:]
+		var alpha uint32 = 255
+		if i == 0 {
+			alpha = 0
+		}
+		colors[i] = alpha<<24 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
+	}
+	s.Pal = sf.addPalette(colors)
+	return nil
+}
+
+// Decodes the data of a v2 sprite, as Sprite.readV2 does
+func (s *SffSprite) readData(f io.ReadSeeker, spr *Sprite, offset int64, size uint32) error {
+	s.Width, s.Height = int(spr.Size[0]), int(spr.Size[1])
+	data := make([]byte, size)
+	f.Seek(offset, io.SeekStart)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return err
+	}
+	n := s.Width * s.Height
+	switch s.Format {
+	case SffRaw:
+		switch spr.coldepth {
+		case 8:
+			s.Pix = data
+		case 24:
+			s.Depth, s.Pix = 32, make([]byte, n*4)
+			for i := 0; i < n && i*3+2 < len(data); i++ {
+				copy(s.Pix[i*4:], data[i*3:i*3+3])
+				s.Pix[i*4+3] = 255
+			}
+		case 32:
+			s.Depth, s.Pix = 32, data
+		default:
+			return Error("Unknown color depth")
+		}
+	case SffRLE8, SffRLE5, SffLZ5:
+		data = sffPixels(data, Max(4, len(data)))[4:]
+		switch s.Format {
+		case SffRLE8:
+			s.Pix = spr.Rle8Decode(data)
+		case SffRLE5:
+			s.Pix = spr.Rle5Decode(data)
+		default:
+			s.Pix = spr.Lz5Decode(data)
+		}
+	case SffPNG8, SffPNG24, SffPNG32:
+		if len(data) < 4 {
+			return Error("PNG data missing")
+		}
+		img, err := png.Decode(bytes.NewReader(data[4:]))
+		if err != nil {
+			return err
+		}
+		if s.Format == SffPNG8 {
+			pi, ok := img.(*image.Paletted)
+			if !ok {
+				return Error("PNG image is not paletted")
+			}
+			s.Pix = pi.Pix
+		} else {
+			rect := img.Bounds()
+			rgba := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			draw.Draw(rgba, rgba.Rect, img, rect.Min, draw.Src)
+			s.Width, s.Height, s.Depth, s.Pix = rect.Dx(), rect.Dy(), 32, rgba.Pix
+		}
+	default:
+		return Error("Unknown format")
+	}
+	s.Pix = sffPixels(s.Pix, s.Width*s.Height*s.Depth/8)
+	return nil
+}
+
+// Writes the file, in SFF v2 or v1 depending on Version
+func (sf *SffFile) Save(filename string) error {
+	data, err := sf.Encode()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+func (sf *SffFile) Encode() ([]byte, error) {
+	if err := sf.check(); err != nil {
+		return nil, err
+	}
+	if sf.Version == 1 {
+		return sf.encodeV1()
+	}
+	return sf.encodeV2()
+}
+
+func (sf *SffFile) check() error {
+	if len(sf.Sprites) > 0xffff || len(sf.Palettes) > 0xffff {
+		return Error("Too many sprites or palettes, links can't refer to more than 65535")
+	}
+	palettes := make(map[[2]uint16]bool)
+	for _, p := range sf.Palettes {
+		key := [2]uint16{p.Group, p.Number}
+		if palettes[key] {
+			return fmt.Errorf("Duplicate palette %v,%v", p.Group, p.Number)
+		}
+		palettes[key] = true
+		if len(p.Colors) == 0 || len(p.Colors) > 256 {
+			return fmt.Errorf("Palette %v,%v: %v colors, expected 1 to 256", p.Group, p.Number, len(p.Colors))
+		}
+	}
+	sprites := make(map[[2]uint16]bool)
+	for _, s := range sf.Sprites {
+		key := [2]uint16{s.Group, s.Number}
+		if sprites[key] {
+			return fmt.Errorf("Duplicate sprite %v,%v", s.Group, s.Number)
+		}
+		sprites[key] = true
+		if s.Depth != 8 && s.Depth != 32 {
+			return fmt.Errorf("Sprite %v,%v: invalid color depth %v", s.Group, s.Number, s.Depth)
+		}
+		if s.Width < 0 || s.Height < 0 || s.Width > 0xffff || s.Height > 0xffff ||
+			len(s.Pix) != s.Width*s.Height*s.Depth/8 {
+			return fmt.Errorf("Sprite %v,%v: %v bytes of pixels for a %vx%v, %v bit image",
+				s.Group, s.Number, len(s.Pix), s.Width, s.Height, s.Depth)
+		}
+		if s.Depth == 8 && sf.palette(s) == nil {
+			return fmt.Errorf("Sprite %v,%v: palette %v doesn't exist", s.Group, s.Number, s.Pal)
+		}
+	}
+	return nil
+}
+
+// Index of the earlier palette each palette has the same colors as, -1 for
+// those stored with their own data. Palettes of group 1, the colors of
+// characters, always keep their data, as loadCharPalettes doesn't resolve
+// links the way loadSff does
+func (sf *SffFile) paletteLinks() []int {
+	links := make([]int, len(sf.Palettes))
+	for i, p := range sf.Palettes {
+		links[i] = -1
+		if p.Group == 1 {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if links[j] < 0 && sffSameColors(sf.Palettes[j].Colors, p.Colors) {
+				links[i] = j
+				break
+			}
+		}
+	}
+	return links
+}
+
+// Index of the earlier sprite each sprite has the same pixels as, -1 for
+// those stored with their own data. Sprites of v1 files have their palette in
+// their data, so linked ones must also have the same colors. Linked v2
+// sprites are read with the palette of the sprite they link to, so they must
+// use the same palette
+func (sf *SffFile) spriteLinks(sameColors, samePal bool) []int {
+	links := make([]int, len(sf.Sprites))
+	seen := make(map[uint64][]int)
+	for i, s := range sf.Sprites {
+		links[i] = -1
+		if len(s.Pix) == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(s.Pix)
+		key := h.Sum64() ^ uint64(s.Width)<<32 ^ uint64(s.Depth)
+		for _, j := range seen[key] {
+			o := sf.Sprites[j]
+			if o.Width == s.Width && o.Height == s.Height && o.Depth == s.Depth && bytes.Equal(o.Pix, s.Pix) &&
+				(!sameColors || sffSameColors(sf.palette(o), sf.palette(s))) &&
+				(!samePal || s.Depth != 8 || o.Pal == s.Pal) {
+				links[i] = j
+				break
+			}
+		}
+		if links[i] < 0 {
+			seen[key] = append(seen[key], i)
+		}
+	}
+	return links
+}
+
+func (sf *SffFile) encodeV2() ([]byte, error) {
+	const headerSize = 512
+	var sprHeaders, palHeaders, ldata, tdata bytes.Buffer
+	write := func(w io.Writer, x ...interface{}) {
+		for _, v := range x {
+			binary.Write(w, binary.LittleEndian, v)
+		}
+	}
+
+	// 2.01 keeps the alpha of every color
+	var verlo2 byte
+	if !sf.standardAlpha() {
+		verlo2 = 1
+	}
+	palLinks := sf.paletteLinks()
+	for i, p := range sf.Palettes {
+		if palLinks[i] >= 0 {
+			write(&palHeaders, p.Group, p.Number, uint16(len(p.Colors)), uint16(palLinks[i]), uint32(0), uint32(0))
+			continue
+		}
+		ofs := ldata.Len()
+		for _, c := range p.Colors {
+			var a byte
+			if verlo2 != 0 {
+				a = byte(c >> 24)
+			}
+			ldata.Write([]byte{byte(c), byte(c >> 8), byte(c >> 16), a})
+		}
+		write(&palHeaders, p.Group, p.Number, uint16(len(p.Colors)), uint16(0), uint32(ofs), uint32(len(p.Colors)*4))
+	}
+
+	// Sprite data goes to tdata, with the flag set
+	sprLinks := sf.spriteLinks(false, true)
+	formats := make([]SffFormat, len(sf.Sprites))
+	depths := make([]int, len(sf.Sprites))
+	for i, s := range sf.Sprites {
+		link, ofs, size := sprLinks[i], 0, 0
+		if link >= 0 {
+			formats[i], depths[i] = formats[link], depths[link]
+		} else {
+			data, format, err := s.encode(sf.palette(s))
+			if err != nil {
+				return nil, fmt.Errorf("Sprite %v,%v: %v", s.Group, s.Number, err)
+			}
+			formats[i], depths[i] = format, s.Depth
+			if len(s.Pix) == 0 {
+				depths[i] = 8
+			}
+			link, ofs, size = 0, tdata.Len(), len(data)
+			tdata.Write(data)
+		}
+		var pal uint16
+		if s.Depth == 8 {
+			pal = uint16(s.Pal)
+		}
+		write(&sprHeaders, s.Group, s.Number, uint16(s.Width), uint16(s.Height), s.Offset,
+			uint16(link), byte(formats[i]), byte(depths[i]), uint32(ofs), uint32(size), pal, uint16(1))
+	}
+
+	sprOfs := headerSize
+	palOfs := sprOfs + sprHeaders.Len()
+	lofs := palOfs + palHeaders.Len()
+	tofs := lofs + ldata.Len()
+	var buf bytes.Buffer
+	version := []byte{0, verlo2, 0, 2}
+	buf.WriteString("ElecbyteSpr\x00")
+	buf.Write(version)
+	write(&buf, uint32(0), uint32(0))
+	buf.Write(version)
+	write(&buf, uint32(0), uint32(0),
+		uint32(sprOfs), uint32(len(sf.Sprites)), uint32(palOfs), uint32(len(sf.Palettes)),
+		uint32(lofs), uint32(ldata.Len()), uint32(tofs), uint32(tdata.Len()))
+	buf.Write(make([]byte, headerSize-buf.Len()))
+	for _, b := range []*bytes.Buffer{&sprHeaders, &palHeaders, &ldata, &tdata} {
+		buf.Write(b.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// Data of a v2 sprite, and the format it was written in
+func (s *SffSprite) encode(pal []uint32) ([]byte, SffFormat, error) {
+	// Data of size 0 would be read as a link
+	if len(s.Pix) == 0 {
+		return make([]byte, 4), SffRLE8, nil
+	}
+	if s.Format != SffAuto {
+		data, err := s.encodeAs(s.Format, pal)
+		return data, s.Format, err
+	}
+	formats := []SffFormat{SffRaw, SffRLE8, SffLZ5, SffPNG8}
+	if s.Depth == 32 {
+		formats = []SffFormat{SffRaw, SffPNG32}
+	}
+	var best []byte
+	var bestFormat SffFormat
+	for _, format := range formats {
+		// LZ5 fails on colors above 31
+		if data, err := s.encodeAs(format, pal); err == nil && (best == nil || len(data) < len(best)) {
+			best, bestFormat = data, format
+		}
+	}
+	return best, bestFormat, nil
+}
+
+func (s *SffSprite) encodeAs(format SffFormat, pal []uint32) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case format == SffRaw:
+		return s.Pix, nil
+	case format == SffRLE8 && s.Depth == 8:
+		data = rle8Encode(s.Pix)
+	case format == SffLZ5 && s.Depth == 8:
+		data, err = lz5Encode(s.Pix)
+	case format == SffPNG8 && s.Depth == 8, format == SffPNG32 && s.Depth == 32:
+		data, err = s.pngEncode(pal)
+	default:
+		return nil, fmt.Errorf("Can't write a %v bit sprite as %v", s.Depth, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Compressed data starts with the uncompressed size
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(s.Pix))), data...), nil
+}
+
+func (s *SffSprite) pngEncode(pal []uint32) ([]byte, error) {
+	rect := image.Rect(0, 0, s.Width, s.Height)
+	var img image.Image
+	if s.Depth == 32 {
+		img = &image.RGBA{Pix: s.Pix, Stride: s.Width * 4, Rect: rect}
+	} else {
+		img = &image.Paletted{Pix: s.Pix, Stride: s.Width, Rect: rect, Palette: sffColorPalette(pal)}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RLE8 compression, which Sprite.Rle8Decode reverses
+func rle8Encode(px []byte) []byte {
+	var out []byte
+	for i := 0; i < len(px); {
+		c, n := px[i], 1
+		for i+n < len(px) && px[i+n] == c && n < 0x3f {
+			n++
+		}
+		// Colors 0x40 to 0x7f would read as runs
+		if n > 1 || c&0xc0 == 0x40 {
+			out = append(out, 0x40|byte(n), c)
+		} else {
+			out = append(out, c)
+		}
+		i += n
+	}
+	return out
+}
+
+// LZ5 compression, which Sprite.Lz5Decode reverses. Its runs only store
+// colors 0 to 31, and copies repeat earlier pixels, so it can't write sprites
+// with other colors
+func lz5Encode(px []byte) ([]byte, error) {
+	for _, c := range px {
+		if c >= 32 {
+			return nil, Error("LZ5 only stores colors 0 to 31")
+		}
+	}
+	var out []byte
+	var ctrl, packets int
+	// First bytes of the short copies since the last fourth one, whose offset
+	// is stored in their two high bits
+	var short []int
+	packet := func(isCopy bool) {
+		if packets%8 == 0 {
+			ctrl = len(out)
+			out = append(out, 0)
+		}
+		if isCopy {
+			out[ctrl] |= 1 << (packets % 8)
+		}
+		packets++
+	}
+	for j := 0; j < len(px); {
+		c, run := px[j], 1
+		for j+run < len(px) && px[j+run] == c && run < 263 {
+			run++
+		}
+		// Longest copy of earlier pixels. Short copies reach 256 pixels back
+		// and repeat 2 to 64 pixels, long ones reach 1024 back and repeat 3 to 258
+		length, dist := 0, 0
+		for d := 1; d <= 1024 && d <= j; d++ {
+			n := 0
+			for j+n < len(px) && n < 258 && px[j+n] == px[j+n-d] {
+				n++
+			}
+			if (n >= 3 || n == 2 && d <= 256) && n > length {
+				length, dist = n, d
+				if n == 258 {
+					break
+				}
+			}
+		}
+		switch {
+		case length <= run:
+			packet(false)
+			if run >= 8 {
+				out = append(out, c, byte(run-8))
+			} else {
+				out = append(out, byte(run)<<5|c)
+			}
+			j += run
+			continue
+		case length > 64 || dist > 256:
+			packet(true)
+			d := dist - 1
+			out = append(out, byte(d>>8)<<6, byte(d), byte(length-3))
+		case len(short) < 3:
+			packet(true)
+			short = append(short, len(out))
+			out = append(out, byte(length-1), byte(dist-1))
+		default:
+			packet(true)
+			out = append(out, byte(length-1))
+			d := byte(dist - 1)
+			for k, i := range append(short, len(out)-1) {
+				out[i] |= (d >> (6 - 2*k) & 3) << 6
+			}
+			short = short[:0]
+		}
+		j += length
+	}
+	return out, nil
+}
+
+func (sf *SffFile) encodeV1() ([]byte, error) {
+	const headerSize, subheaderSize = 512, 32
+	var buf bytes.Buffer
+	write := func(x ...interface{}) {
+		for _, v := range x {
+			binary.Write(&buf, binary.LittleEndian, v)
+		}
+	}
+	groups := make(map[uint16]bool)
+	for _, s := range sf.Sprites {
+		if s.Depth != 8 {
+			return nil, fmt.Errorf("Sprite %v,%v: SFF v1 only stores 8 bit sprites", s.Group, s.Number)
+		}
+		groups[s.Group] = true
+	}
+	buf.WriteString("ElecbyteSpr\x00")
+	buf.Write([]byte{0, 1, 0, 1})
+	write(uint32(len(groups)), uint32(len(sf.Sprites)), uint32(headerSize), uint32(subheaderSize))
+	buf.Write(make([]byte, headerSize-buf.Len()))
+
+	links := sf.spriteLinks(true, false)
+	var prevPal []uint32 // Palette of the last sprite with its own data
+	for i, s := range sf.Sprites {
+		var data []byte
+		var link uint16
+		var same byte
+		if links[i] >= 0 {
+			link = uint16(links[i])
+		} else {
+			pal := sf.palette(s)
+			if prevPal != nil && sffSameColors(pal, prevPal) {
+				same = 1
+			}
+			data, prevPal = pcxEncode(s, pal, same == 0), pal
+		}
+		next := buf.Len() + subheaderSize + len(data)
+		write(uint32(next), uint32(len(data)), s.Offset, s.Group, s.Number, link, same)
+		buf.Write(make([]byte, subheaderSize-19))
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// PCX image of a v1 sprite, followed by its palette unless it uses the one of
+// the previous sprite
+func pcxEncode(s *SffSprite, pal []uint32, withPal bool) []byte {
+	// Lines have an even number of bytes
+	bpl := s.Width + s.Width%2
+	out := make([]byte, 128)
+	out[0], out[1], out[2], out[3] = 10, 5, 1, 8
+	binary.LittleEndian.PutUint16(out[8:], uint16(s.Width-1))
+	binary.LittleEndian.PutUint16(out[10:], uint16(s.Height-1))
+	out[65] = 1
+	binary.LittleEndian.PutUint16(out[66:], uint16(bpl))
+	binary.LittleEndian.PutUint16(out[68:], 1)
+
+	line := make([]byte, bpl)
+	for y := 0; y < s.Height; y++ {
+		copy(line, s.Pix[y*s.Width:(y+1)*s.Width])
+		for x := 0; x < bpl; {
+			c, n := line[x], 1
+			for x+n < bpl && line[x+n] == c && n < 0x3f {
+				n++
+			}
+			if n > 1 || c >= 0xc0 {
+				out = append(out, 0xc0|byte(n), c)
+			} else {
+				out = append(out, c)
+			}
+			x += n
+		}
+	}
+	if withPal {
+		out = append(out, 0x0C)
+		for i := 0; i < 256; i++ {
+			var c uint32
+			if i < len(pal) {
+				c = pal[i]
+			}
+			out = append(out, byte(c), byte(c>>8), byte(c>>16))
+		}
+	}
+	return out
+}
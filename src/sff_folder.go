@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	colour "image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sprite folders hold the sprites of an SFF as PNG files, and its palettes as
+// ACT files, listed in a manifest. Characters, stages, motifs and storyboards
+// load them where they'd load an SFF, with sprite = <folder>/ pointing at a
+// folder with an sff.txt inside, or sprite = <manifest>.txt. Folders in zip
+// archives need the second form. The manifest is the one the SFF tool
+// unpacks to:
+//
+//	; Unpacked from kfm.sff
+//	version = 2
+//
+//	[Palettes]
+//	; group, number, file[, colors]
+//	1, 1, pal1-1.act
+//
+//	[Sprites]
+//	; group, number, file, axis x, axis y[, compression[, palette group, palette number]]
+//	0, 0, 0-0.png, 36, 105, lz5, 1, 1
+//
+// Compression is raw, rle8, lz5, png or auto, the smallest of them, and only
+// matters when packing. 8 bit sprites without a palette keep the one of their
+// paletted PNG, shared with the other palettes that have the same colors, so
+// a PNG with the colors of palette 1,1 still follows the selected palette.
+// Sprites without a file are empty.
+
+const sffManifestName = "sff.txt"
+
+// Manifest of a sprite folder, if the sprite file is one
+func sffManifestPath(filename string) (string, bool) {
+	if strings.EqualFold(filepath.Ext(filename), ".txt") {
+		return filename, true
+	}
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		return filepath.Join(filename, sffManifestName), true
+	}
+	return "", false
+}
+
+// Reads the palettes and sprites of a manifest. With keep, only the sprites
+// in it are read
+func readSffManifest(manifest string, keep map[[2]uint16]bool) (*SffFile, error) {
+	str, err := LoadText(manifest)
+	if err != nil {
+		return nil, err
+	}
+	sf := &SffFile{Version: 2}
+	palettes := make(map[[2]uint16]int)
+	dir, section := filepath.Dir(manifest), ""
+	for i, line := range SplitAndTrim(str, "\n") {
+		if j := strings.Index(line, ";"); j >= 0 {
+			line = strings.TrimSpace(line[:j])
+		}
+		if line == "" {
+			continue
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section != "palettes" && section != "sprites" {
+				err = Error("Unknown section: " + line)
+			}
+		case section == "":
+			key, value, _ := strings.Cut(line, "=")
+			if strings.TrimSpace(key) != "version" {
+				err = Error("Expected version = 1 or 2: " + line)
+			} else if sf.Version, err = strconv.Atoi(strings.TrimSpace(value)); err == nil &&
+				sf.Version != 1 && sf.Version != 2 {
+				err = Error("Unsupported SFF version: " + value)
+			}
+		case section == "palettes":
+			err = sf.manifestPalette(SplitAndTrim(line, ","), dir, palettes)
+		default:
+			err = sf.manifestSprite(SplitAndTrim(line, ","), dir, palettes, keep)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", manifest, i+1, err)
+		}
+	}
+	return sf, nil
+}
+
+func sffParseKey(group, number string) ([2]uint16, error) {
+	g, err := strconv.ParseUint(group, 10, 16)
+	if err != nil {
+		return [2]uint16{}, Error("Invalid group: " + group)
+	}
+	n, err := strconv.ParseUint(number, 10, 16)
+	if err != nil {
+		return [2]uint16{}, Error("Invalid number: " + number)
+	}
+	return [2]uint16{uint16(g), uint16(n)}, nil
+}
+
+// Reads a palette line of a manifest: group, number, file[, colors]
+func (sf *SffFile) manifestPalette(fields []string, dir string, palettes map[[2]uint16]int) error {
+	if len(fields) < 3 || len(fields) > 4 {
+		return Error("Expected group, number, file[, colors]")
+	}
+	key, err := sffParseKey(fields[0], fields[1])
+	if err != nil {
+		return err
+	}
+	colors, err := readActPalette(filepath.Join(dir, fields[2]))
+	if err != nil {
+		return err
+	}
+	if len(fields) == 4 {
+		n, err := strconv.Atoi(fields[3])
+		if err != nil || n < 1 || n > len(colors) {
+			return Error("Invalid number of colors: " + fields[3])
+		}
+		colors = colors[:n]
+	}
+	palettes[key] = len(sf.Palettes)
+	sf.Palettes = append(sf.Palettes, &SffPalette{Group: key[0], Number: key[1], Colors: colors})
+	return nil
+}
+
+// Reads a sprite line of a manifest:
+// group, number, file, axis x, axis y[, compression[, palette group, palette number]]
+func (sf *SffFile) manifestSprite(fields []string, dir string, palettes map[[2]uint16]int,
+	keep map[[2]uint16]bool) error {
+	if len(fields) < 5 || len(fields) == 7 || len(fields) > 8 {
+		return Error("Expected group, number, file, axis x, axis y[, compression[, palette group, palette number]]")
+	}
+	key, err := sffParseKey(fields[0], fields[1])
+	if err != nil {
+		return err
+	}
+	if _, ok := keep[key]; keep != nil && !ok {
+		return nil
+	}
+	var s *SffSprite
+	var pal []uint32
+	if fields[2] == "" {
+		s = &SffSprite{Depth: 8}
+	} else if s, pal, err = sffReadPng(filepath.Join(dir, fields[2])); err != nil {
+		return err
+	}
+	s.Group, s.Number = key[0], key[1]
+	for i := range s.Offset {
+		v, err := strconv.ParseInt(fields[3+i], 10, 16)
+		if err != nil {
+			return Error("Invalid axis: " + fields[3+i])
+		}
+		s.Offset[i] = int16(v)
+	}
+	s.Format = SffAuto
+	if len(fields) > 5 && fields[5] != "" {
+		if s.Format, err = sffParseFormat(fields[5], s.Depth); err != nil {
+			return err
+		}
+	}
+	if len(fields) == 8 {
+		pk, err := sffParseKey(fields[6], fields[7])
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if s.Pal, ok = palettes[pk]; !ok {
+			return fmt.Errorf("Palette %v,%v is not in the palettes above", pk[0], pk[1])
+		}
+	} else if s.Depth == 8 {
+		if pal == nil {
+			return Error("Empty sprites need a palette")
+		}
+		s.Pal = sf.addPalette(pal)
+	}
+	sf.Sprites = append(sf.Sprites, s)
+	return nil
+}
+
+func sffParseFormat(name string, depth int) (SffFormat, error) {
+	switch name = strings.ToLower(name); name {
+	case "raw":
+		return SffRaw, nil
+	case "rle8":
+		return SffRLE8, nil
+	case "lz5":
+		return SffLZ5, nil
+	case "png":
+		if depth == 32 {
+			return SffPNG32, nil
+		}
+		return SffPNG8, nil
+	case "auto":
+		return SffAuto, nil
+	}
+	return 0, Error("Unknown compression: " + name)
+}
+
+// Reads a PNG as an 8 bit sprite with its palette if it's paletted, or as an
+// RGBA sprite
+func sffReadPng(filename string) (*SffSprite, []uint32, error) {
+	f, err := OpenFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	rect := img.Bounds()
+	s := &SffSprite{Width: rect.Dx(), Height: rect.Dy()}
+	pi, ok := img.(*image.Paletted)
+	if !ok {
+		rgba := image.NewRGBA(image.Rect(0, 0, s.Width, s.Height))
+		draw.Draw(rgba, rgba.Rect, img, rect.Min, draw.Src)
+		s.Depth, s.Pix = 32, rgba.Pix
+		return s, nil, nil
+	}
+	s.Depth, s.Pix = 8, make([]byte, 0, s.Width*s.Height)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := pi.PixOffset(rect.Min.X, y)
+		s.Pix = append(s.Pix, pi.Pix[i:i+s.Width]...)
+	}
+	pal := make([]uint32, len(pi.Palette))
+	for i, c := range pi.Palette {
+		nc := colour.NRGBAModel.Convert(c).(colour.NRGBA)
+		// Color 0 is transparent in sprites
+		if i == 0 {
+			nc.A = 0
+		}
+		pal[i] = uint32(nc.A)<<24 | uint32(nc.B)<<16 | uint32(nc.G)<<8 | uint32(nc.R)
+	}
+	return s, pal, nil
+}
+
+// Header version the loaded folder acts as. Palettes with their own alpha
+// need 2.01, like when packed
+func (sf *SffFile) headerVersion() [4]byte {
+	if sf.standardAlpha() {
+		return [4]byte{2, 0, 0, 0}
+	}
+	return [4]byte{2, 0, 1, 0}
+}
+
+// Colors of a palette padded the way ReadPalette pads those of an SFF
+func sffPaddedPalette(colors []uint32, standardAlpha bool) []uint32 {
+	pal := make([]uint32, paletteDepth(len(colors)))
+	copy(pal, colors)
+	if standardAlpha {
+		for i := len(colors); i < len(pal); i++ {
+			pal[i] = 0xff000000
+		}
+	}
+	return pal
+}
+
+// Sprite with the header of a folder sprite. 8 bit ones use palette s.Pal
+func (s *SffSprite) sprite() *Sprite {
+	spr := newSprite()
+	spr.Group, spr.Number = s.Group, s.Number
+	spr.Offset = s.Offset
+	spr.Size = [...]uint16{uint16(s.Width), uint16(s.Height)}
+	spr.coldepth = byte(s.Depth)
+	if s.Depth == 8 {
+		spr.palidx = s.Pal
+	} else {
+		spr.palidx = 0
+	}
+	return spr
+}
+
+// Loads every sprite and palette of a sprite folder, as loadSff does for an
+// SFF v2
+func loadSffFolder(filename, manifest string, isMainThread bool) (*Sff, error) {
+	sf, err := readSffManifest(manifest, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := newSff()
+	s.filename = filename
+	s.atlas = newSpriteAtlas()
+	s.header.Version = sf.headerVersion()
+	s.header.NumberOfSprites = uint32(len(sf.Sprites))
+	s.header.NumberOfPalettes = uint32(len(sf.Palettes))
+
+	standard := sf.standardAlpha()
+	for i, p := range sf.Palettes {
+		s.setPalette(i, i, [...]uint16{p.Group, p.Number, uint16(len(p.Colors))},
+			sffPaddedPalette(p.Colors, standard))
+	}
+	asset := trackLoad("sff", filename, int64(len(sf.Sprites)))
+	// Sprites with the same pixels share their texture
+	links := sf.spriteLinks(false, false)
+	spriteList := make([]*Sprite, len(sf.Sprites))
+	for i, ss := range sf.Sprites {
+		spriteList[i] = ss.sprite()
+		spriteList[i].atlas = s.atlas
+		switch {
+		case links[i] >= 0:
+			spriteList[i].shareCopy(spriteList[links[i]])
+		case ss.Depth == 8:
+			spriteList[i].SetPxl(ss.Pix)
+		default:
+			spriteList[i].SetRaw(ss.Pix, int32(ss.Width), int32(ss.Height), 32)
+		}
+		key := [...]uint16{ss.Group, ss.Number}
+		if s.sprites[key] != nil {
+			LogMessage("WARNING: Duplicate sprite key in %v: %v,%v (index %v ignored)", filename, ss.Group, ss.Number, i)
+		} else {
+			s.sprites[key] = spriteList[i]
+		}
+		asset.add(1)
+		if isMainThread {
+			sys.runMainThreadTask()
+		}
+	}
+	return s, nil
+}
+
+// Loads only specific sprites of a sprite folder, as preloadSff does for an
+// SFF v2. 8 bit sprites get their own palette, and palidx 0 if it's the one
+// the selected palette replaces
+func preloadSffFolder(filename, manifest string, char bool, preloadSpr map[[2]uint16]bool) (*Sff, []int32, error) {
+	if preloadSpr == nil {
+		preloadSpr = make(map[[2]uint16]bool)
+	}
+	sf, err := readSffManifest(manifest, preloadSpr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sff := newSff()
+	sff.filename = filename
+	sff.header.Version = sf.headerVersion()
+	sff.header.NumberOfPalettes = uint32(len(sf.Palettes))
+
+	standard := sf.standardAlpha()
+	for _, ss := range sf.Sprites {
+		key := [...]uint16{ss.Group, ss.Number}
+		if sff.sprites[key] != nil {
+			continue
+		}
+		spr := ss.sprite()
+		if ss.Depth == 8 {
+			p := sf.Palettes[ss.Pal]
+			spr.Pal = sffPaddedPalette(p.Colors, standard)
+			if p.Group == 1 && p.Number == 1 {
+				spr.palidx = 0
+			} else {
+				spr.palidx = 1
+			}
+			spr.SetPxl(ss.Pix)
+		} else {
+			spr.SetRaw(ss.Pix, int32(ss.Width), int32(ss.Height), 32)
+		}
+		sff.sprites[key] = spr
+	}
+	// selectable palettes
+	var selPal []int32
+	if char {
+		for _, p := range sf.Palettes {
+			if p.Group == 1 && p.Number >= 1 && int(p.Number) <= sys.cfg.Config.PaletteMax {
+				selPal = append(selPal, int32(p.Number))
+			}
+		}
+		sort.Slice(selPal, func(i, j int) bool { return selPal[i] < selPal[j] })
+	}
+	return sff, selPal, nil
+}
+
+// Reads the selectable palettes, group 1, of a sprite folder
+func loadFolderCharPalettes(sff *Sff, manifest string, maxPal int) error {
+	sf, err := readSffManifest(manifest, make(map[[2]uint16]bool))
+	if err != nil {
+		return err
+	}
+	standard := sf.standardAlpha()
+	for _, p := range sf.Palettes {
+		if p.Group != 1 || p.Number < 1 || int(p.Number) > maxPal {
+			continue
+		}
+		i := int(p.Number) - 1
+		sff.palList.SetSource(i, sffPaddedPalette(p.Colors, standard))
+		sff.palList.PalTable[[...]uint16{1, p.Number}] = i
+		sff.palList.numcols[[...]uint16{1, p.Number}] = len(p.Colors)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SFF tool (-sff <command>, or ikemen-sff <command> when the executable is
+// named so) packs, unpacks, lists and compares sprite files without starting
+// the engine. Unpack writes each sprite as a PNG, paletted for 8 bit ones,
+// each palette as an ACT file, and the manifest of a sprite folder, which
+// pack reads back. The engine also loads such folders as they are.
+
+const (
+	sffToolOK      = 0
+	sffToolDiffers = 1
+	sffToolError   = 2
+)
+
+const sffToolUsage = `Usage: ikemen-sff <command>, or Ikemen_GO -sff <command>
+
+pack <folder or manifest> <file.sff> [-v1]
+                        Writes the sprites and palettes of a manifest (default: <folder>/` + sffManifestName + `)
+unpack <file.sff> <folder>
+                        Writes each sprite as a PNG, each palette as an ACT and the manifest
+list <file.sff>         Prints the palettes and sprites
+diff <a.sff> <b.sff>    Prints the palettes and sprites that differ, exits with 1 if any do
+`
+
+// Arguments of the SFF tool, if the command line runs it
+func sffToolArgs(args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	if strings.HasPrefix(strings.ToLower(filepath.Base(args[0])), "ikemen-sff") {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == "-sff" {
+		return args[2:], true
+	}
+	return nil, false
+}
+
+// Runs a command of the SFF tool. Returns the process exit code
+func runSffTool(args []string) int {
+	var cmd string
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	var err error
+	switch {
+	case cmd == "pack" && (len(args) == 3 || len(args) == 4 && args[3] == "-v1"):
+		err = sffPack(args[1], args[2], len(args) == 4)
+	case cmd == "unpack" && len(args) == 3:
+		err = sffUnpack(args[1], args[2])
+	case cmd == "list" && len(args) == 2:
+		err = sffList(args[1])
+	case cmd == "diff" && len(args) == 3:
+		var differ bool
+		if differ, err = sffDiff(args[1], args[2]); err == nil && differ {
+			return sffToolDiffers
+		}
+	default:
+		fmt.Print(sffToolUsage)
+		return sffToolError
+	}
+	if err != nil {
+		fmt.Printf("SFF %v failed: %v\n", cmd, err)
+		return sffToolError
+	}
+	return sffToolOK
+}
+
+func sffPack(src, dst string, v1 bool) error {
+	manifest := src
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		manifest = filepath.Join(src, sffManifestName)
+	}
+	sf, err := readSffManifest(manifest, nil)
+	if err != nil {
+		return err
+	}
+	if v1 {
+		sf.Version = 1
+	}
+	if err := sf.Save(dst); err != nil {
+		return err
+	}
+	fmt.Printf("%v: %v sprites, %v palettes\n", dst, len(sf.Sprites), len(sf.Palettes))
+	return nil
+}
+
+// Name of the compression a sprite can be written back with
+func sffFormatName(f SffFormat) string {
+	switch f {
+	case SffRaw, SffRLE8, SffLZ5:
+		return f.String()
+	case SffPNG8, SffPNG24, SffPNG32:
+		return "png"
+	}
+	return "auto"
+}
+
+// Writes a palette the way readActPalette reads it, last color first
+func sffWriteAct(filename string, colors []uint32) error {
+	data := make([]byte, 768)
+	for i := 0; i < len(colors) && i < 256; i++ {
+		c := colors[i]
+		copy(data[(255-i)*3:], []byte{byte(c), byte(c >> 8), byte(c >> 16)})
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+func sffUnpack(filename, dir string) error {
+	sf, err := readSffFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var m strings.Builder
+	fmt.Fprintf(&m, "; Unpacked from %v\nversion = %v\n\n[Palettes]\n; group, number, file[, colors]\n",
+		filepath.Base(filename), sf.Version)
+	for _, p := range sf.Palettes {
+		name := fmt.Sprintf("pal%v-%v.act", p.Group, p.Number)
+		if err := sffWriteAct(filepath.Join(dir, name), p.Colors); err != nil {
+			return err
+		}
+		fmt.Fprintf(&m, "%v, %v, %v", p.Group, p.Number, name)
+		if len(p.Colors) != 256 {
+			fmt.Fprintf(&m, ", %v", len(p.Colors))
+		}
+		m.WriteString("\n")
+	}
+
+	m.WriteString("\n[Sprites]\n; group, number, file, axis x, axis y[, compression[, palette group, palette number]]\n")
+	files := make([]string, len(sf.Sprites))
+	for i, s := range sf.Sprites {
+		if s.link >= 0 {
+			files[i] = files[s.link]
+		} else if len(s.Pix) > 0 {
+			files[i] = fmt.Sprintf("%v-%v.png", s.Group, s.Number)
+			data, err := s.pngEncode(sf.palette(s))
+			if err != nil {
+				return fmt.Errorf("Sprite %v,%v: %v", s.Group, s.Number, err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, files[i]), data, 0644); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(&m, "%v, %v, %v, %v, %v, %v", s.Group, s.Number, files[i],
+			s.Offset[0], s.Offset[1], sffFormatName(s.Format))
+		if s.Depth == 8 && s.Pal >= 0 && s.Pal < len(sf.Palettes) {
+			fmt.Fprintf(&m, ", %v, %v", sf.Palettes[s.Pal].Group, sf.Palettes[s.Pal].Number)
+		}
+		m.WriteString("\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, sffManifestName), []byte(m.String()), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%v: %v sprites, %v palettes\n", dir, len(sf.Sprites), len(sf.Palettes))
+	return nil
+}
+
+func sffList(filename string) error {
+	sf, err := readSffFile(filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v: SFF v%v, %v sprites, %v palettes\n", filename, sf.Version, len(sf.Sprites), len(sf.Palettes))
+	for _, p := range sf.Palettes {
+		fmt.Printf("palette %v,%v: %v colors\n", p.Group, p.Number, len(p.Colors))
+	}
+	for _, s := range sf.Sprites {
+		line := fmt.Sprintf("sprite %v,%v: %vx%v, axis %v,%v, %v bit", s.Group, s.Number,
+			s.Width, s.Height, s.Offset[0], s.Offset[1], s.Depth)
+		if s.Depth == 8 && s.Pal >= 0 && s.Pal < len(sf.Palettes) {
+			line += fmt.Sprintf(", palette %v,%v", sf.Palettes[s.Pal].Group, sf.Palettes[s.Pal].Number)
+		}
+		if s.link >= 0 {
+			line += fmt.Sprintf(", linked to %v,%v", sf.Sprites[s.link].Group, sf.Sprites[s.link].Number)
+		} else {
+			line += fmt.Sprintf(", %v, %v bytes", s.Format, s.dataSize)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// Prints the palettes and sprites of two files that differ, by group and
+// number. Returns whether any do
+func sffDiff(a, b string) (bool, error) {
+	fa, err := readSffFile(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := readSffFile(b)
+	if err != nil {
+		return false, err
+	}
+	var diffs []string
+
+	pa, pb := make(map[[2]uint16]*SffPalette), make(map[[2]uint16]*SffPalette)
+	for _, p := range fa.Palettes {
+		pa[[2]uint16{p.Group, p.Number}] = p
+	}
+	for _, p := range fb.Palettes {
+		pb[[2]uint16{p.Group, p.Number}] = p
+	}
+	for _, p := range fa.Palettes {
+		if q, ok := pb[[2]uint16{p.Group, p.Number}]; !ok {
+			diffs = append(diffs, fmt.Sprintf("- palette %v,%v", p.Group, p.Number))
+		} else if !sffSameColors(p.Colors, q.Colors) {
+			diffs = append(diffs, fmt.Sprintf("~ palette %v,%v: %v", p.Group, p.Number, sffColorsDiff(p.Colors, q.Colors)))
+		}
+	}
+	for _, q := range fb.Palettes {
+		if _, ok := pa[[2]uint16{q.Group, q.Number}]; !ok {
+			diffs = append(diffs, fmt.Sprintf("+ palette %v,%v", q.Group, q.Number))
+		}
+	}
+
+	sa, sb := make(map[[2]uint16]*SffSprite), make(map[[2]uint16]*SffSprite)
+	for _, s := range fa.Sprites {
+		sa[[2]uint16{s.Group, s.Number}] = s
+	}
+	for _, s := range fb.Sprites {
+		sb[[2]uint16{s.Group, s.Number}] = s
+	}
+	for _, s := range fa.Sprites {
+		t, ok := sb[[2]uint16{s.Group, s.Number}]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("- sprite %v,%v", s.Group, s.Number))
+			continue
+		}
+		var what []string
+		if s.Offset != t.Offset {
+			what = append(what, fmt.Sprintf("axis %v,%v -> %v,%v", s.Offset[0], s.Offset[1], t.Offset[0], t.Offset[1]))
+		}
+		switch {
+		case len(s.Pix) == 0 && len(t.Pix) == 0:
+		case s.Width != t.Width || s.Height != t.Height || s.Depth != t.Depth:
+			what = append(what, fmt.Sprintf("%vx%v %v bit -> %vx%v %v bit",
+				s.Width, s.Height, s.Depth, t.Width, t.Height, t.Depth))
+		default:
+			bpp, n := s.Depth/8, 0
+			for i := 0; i < len(s.Pix); i += bpp {
+				if string(s.Pix[i:i+bpp]) != string(t.Pix[i:i+bpp]) {
+					n++
+				}
+			}
+			if n > 0 {
+				what = append(what, fmt.Sprintf("%v pixels", n))
+			}
+			if ca, cb := fa.palette(s), fb.palette(t); !sffSameColors(ca, cb) {
+				what = append(what, "palette "+sffColorsDiff(ca, cb))
+			}
+		}
+		if what != nil {
+			diffs = append(diffs, fmt.Sprintf("~ sprite %v,%v: %v", s.Group, s.Number, strings.Join(what, ", ")))
+		}
+	}
+	for _, t := range fb.Sprites {
+		if _, ok := sa[[2]uint16{t.Group, t.Number}]; !ok {
+			diffs = append(diffs, fmt.Sprintf("+ sprite %v,%v", t.Group, t.Number))
+		}
+	}
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("%v and %v have the same palettes and sprites\n", a, b)
+	}
+	return len(diffs) > 0, nil
+}
+
+func sffColorsDiff(a, b []uint32) string {
+	if len(a) != len(b) {
+		return fmt.Sprintf("%v colors -> %v colors", len(a), len(b))
+	}
+	n := 0
+	for i := range a {
+		if a[i] != b[i] {
+			n++
+		}
+	}
+	return fmt.Sprintf("%v colors differ", n)
+}
@@ -788,7 +788,8 @@ func LoadSnd(filename string) (*Snd, error) {
 		return s, nil
 	}
 
-	s, err := LoadSndFiltered(filename, func(gn [2]int32) bool { return gn[0] >= 0 && gn[1] >= 0 }, 0)
+	asset := trackLoad("snd", filename, 0)
+	s, err := loadSnd(filename, func(gn [2]int32) bool { return gn[0] >= 0 && gn[1] >= 0 }, 0, asset)
 	if err != nil {
 		return nil, Error(fmt.Sprintf("LoadSnd failed: %v\n%v", filename, err))
 	}
@@ -801,12 +802,18 @@ func LoadSnd(filename string) (*Snd, error) {
 // The "keepItem" function allows to filter out unwanted waves.
 // If max > 0, the function returns immediately when a matching entry is found. It also gives up after "max" non-matching entries.
 func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32) (*Snd, error) {
+	return loadSnd(filename, keepItem, max, nil)
+}
+
+// Counts the bytes of the sounds read into asset, if not nil
+func loadSnd(filename string, keepItem func([2]int32) bool, max uint32, asset *LoadAsset) (*Snd, error) {
 	s := newSnd()
 	f, err := OpenFile(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { chk(f.Close()) }()
+	asset.setTotal(loadFileSize(f))
 	buf := make([]byte, 12)
 	var n int
 	if n, err = f.Read(buf); err != nil {
@@ -873,8 +880,10 @@ func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32)
 				}
 			}
 		}
+		asset.add(int64(subFileLength))
 		subHeaderOffset = nextSubHeaderOffset
 	}
+	asset.finish()
 	return s, nil
 }
 
@@ -101,6 +101,7 @@ type GameState struct {
 	id    int
 	saved bool
 	frame int32
+	quiet bool // Don't log saving and loading to the console
 
 	SystemStateVars
 
@@ -259,7 +260,7 @@ func (gs *GameState) LoadState(stateID int) {
 	}
 
 	// Log state load
-	if sys.rollback.session == nil {
+	if sys.rollback.session == nil && !gs.quiet {
 		sys.appendToConsole(fmt.Sprintf("%v: Game state loaded", sys.tickCount))
 	}
 }
@@ -348,7 +349,7 @@ func (gs *GameState) SaveState(stateID int) {
 	}
 
 	// Log save state
-	if sys.rollback.session == nil {
+	if sys.rollback.session == nil && !gs.quiet {
 		sys.appendToConsole(fmt.Sprintf("%v: Game state saved", sys.tickCount))
 	}
 }
@@ -163,6 +163,8 @@ func (sb *StateBytecode) Clone(a *arena.Arena) (result StateBytecode) {
 
 	result.ctrlsps = arena.MakeSlice[int32](a, len(sb.ctrlsps), len(sb.ctrlsps))
 	copy(result.ctrlsps, sb.ctrlsps)
+	result.locals = arena.MakeSlice[BytecodeValue](a, len(sb.locals), len(sb.locals))
+	copy(result.locals, sb.locals)
 	result.block = sb.block.Clone(a)
 	return result
 }
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Game states are serialized so spectators can join a match in progress. Most
+// of a saved state is what SaveState cloned, and that is written out in full.
+// The rest points to data loaded from files, like sprites, sounds, fonts and
+// compiled states. Both sides loaded the same files, so such references are
+// written as the path that leads to them from the loaded resources (sys.cgi,
+// sys.stage, sys.motif and so on), and the reading side follows the same path
+// to its own copy. Characters are referenced by their place in sys.chars. A
+// character that doesn't exist on the reading side, like a helper, is
+// allocated, since LoadState overwrites it anyway.
+//
+// Values are written field by field, so both sides need the same build. A hash
+// of the GameState layout is written first to check that.
+
+const stateFormatVersion = 1
+
+// How a pointer, map, slice or channel is written
+const (
+	stateRefNil    = iota
+	stateRefEmpty  // Non-nil slice without elements
+	stateRefSeen   // Written before, followed by its index
+	stateRefStatic // Loaded data, followed by the index of its path
+	stateRefValue  // Written in full
+)
+
+// Identity of a pointer, map, slice or channel
+type stateRefKey struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+func stateRefKeyOf(v reflect.Value) (stateRefKey, bool) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Chan:
+		if !v.IsNil() {
+			return stateRefKey{typ: v.Type(), ptr: v.Pointer()}, true
+		}
+	case reflect.Slice:
+		if v.Len() > 0 {
+			return stateRefKey{typ: v.Type(), ptr: v.Pointer(), len: v.Len()}, true
+		}
+	}
+	return stateRefKey{}, false
+}
+
+// Returns a settable field, unexported or not. v must be addressable.
+func stateField(v reflect.Value, i int) reflect.Value {
+	f := v.Field(i)
+	if !f.CanSet() {
+		f = reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+	}
+	return f
+}
+
+// Map values and interface contents aren't addressable, so their fields are
+// read from a copy
+func stateAddressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return c
+}
+
+var stateRefTypes = map[reflect.Type]bool{}
+var stateRefTypesMu sync.Mutex
+
+// Whether values of a type can contain references, so whether walking the
+// loaded resources has to look inside them
+func stateHasRefs(t reflect.Type) bool {
+	stateRefTypesMu.Lock()
+	defer stateRefTypesMu.Unlock()
+	return stateHasRefsLocked(t)
+}
+
+func stateHasRefsLocked(t reflect.Type) bool {
+	if r, ok := stateRefTypes[t]; ok {
+		return r
+	}
+	r := false
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Chan, reflect.Interface:
+		r = true
+	case reflect.Array:
+		r = t.Len() > 0 && stateHasRefsLocked(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField() && !r; i++ {
+			r = stateHasRefsLocked(t.Field(i).Type)
+		}
+	}
+	stateRefTypes[t] = r
+	return r
+}
+
+var stateLayoutOnce sync.Once
+var stateLayout uint64
+
+// Hash of the GameState type graph, so states from another build are rejected
+func stateLayoutHash() uint64 {
+	stateLayoutOnce.Do(func() {
+		h := fnv.New64a()
+		seen := map[reflect.Type]bool{}
+		var walk func(t reflect.Type)
+		walk = func(t reflect.Type) {
+			fmt.Fprintf(h, "%v:%d;", t, t.Kind())
+			if seen[t] {
+				return
+			}
+			seen[t] = true
+			switch t.Kind() {
+			case reflect.Pointer, reflect.Slice, reflect.Chan:
+				walk(t.Elem())
+			case reflect.Array:
+				fmt.Fprintf(h, "%d;", t.Len())
+				walk(t.Elem())
+			case reflect.Map:
+				walk(t.Key())
+				walk(t.Elem())
+			case reflect.Struct:
+				for i := 0; i < t.NumField(); i++ {
+					fmt.Fprintf(h, "%s.", t.Field(i).Name)
+					walk(t.Field(i).Type)
+				}
+			}
+		}
+		walk(reflect.TypeOf(GameState{}))
+		stateLayout = h.Sum64()
+	})
+	return stateLayout
+}
+
+// Paths to the loaded resources that game states point to. When writing, every
+// reference gets the first path it is found at. When reading, only the paths
+// used by the state are kept. Map keys are visited in order, so both sides
+// find shared data at the same path.
+type stateResources struct {
+	paths  map[stateRefKey]string
+	seen   map[stateRefKey]bool
+	want   map[string]bool
+	values map[string]reflect.Value
+	types  map[string]reflect.Type
+	// Copies made while walking, kept so their addresses aren't reused
+	copies []reflect.Value
+}
+
+func newStateResources(want map[string]bool) *stateResources {
+	sr := &stateResources{
+		seen:  make(map[stateRefKey]bool),
+		types: make(map[string]reflect.Type),
+	}
+	for _, v := range []interface{}{false, 0, int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0), float64(0), ""} {
+		sr.types[reflect.TypeOf(v).String()] = reflect.TypeOf(v)
+	}
+	if want == nil {
+		sr.paths = make(map[stateRefKey]string)
+	} else {
+		sr.want = want
+		sr.values = make(map[string]reflect.Value)
+	}
+	sr.walkSystem()
+	return sr
+}
+
+func (sr *stateResources) walkSystem() {
+	roots := []struct {
+		name string
+		v    interface{}
+	}{
+		{"cgi", &sys.cgi},
+		{"ffx", &sys.ffx},
+		{"stage", &sys.stage},
+		{"stageList", &sys.stageList},
+		{"fightScreen", &sys.fightScreen},
+		{"motif", &sys.motif},
+		{"storyboard", &sys.storyboard},
+		{"sel", &sys.sel},
+		{"commandLists", &sys.commandLists},
+	}
+	for _, r := range roots {
+		sr.walk(reflect.ValueOf(r.v).Elem(), r.name)
+	}
+	// Only the characters themselves, everything else about them is state
+	for i := range sys.chars {
+		for j, c := range sys.chars[i] {
+			sr.add(reflect.ValueOf(c), fmt.Sprintf("chars[%d][%d]", i, j))
+		}
+	}
+}
+
+// Returns whether the reference wasn't known yet
+func (sr *stateResources) add(v reflect.Value, path string) bool {
+	key, ok := stateRefKeyOf(v)
+	if !ok || sr.seen[key] {
+		return false
+	}
+	sr.seen[key] = true
+	if sr.paths != nil {
+		sr.paths[key] = path
+	} else if sr.want[path] {
+		sr.values[path] = v
+	}
+	return true
+}
+
+func (sr *stateResources) walk(v reflect.Value, path string) {
+	t := v.Type()
+	switch v.Kind() {
+	case reflect.Pointer:
+		if sr.add(v, path) && stateHasRefs(t.Elem()) {
+			sr.walk(v.Elem(), path+"*")
+		}
+	case reflect.Map:
+		// Keys that are references can't be followed from another process
+		if !sr.add(v, path) || stateHasRefs(t.Key()) || !stateHasRefs(t.Elem()) {
+			return
+		}
+		type entry struct {
+			name string
+			val  reflect.Value
+		}
+		entries := make([]entry, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries = append(entries, entry{fmt.Sprintf("%s[%v]", path, iter.Key()), iter.Value()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+		for _, e := range entries {
+			sr.walk(sr.addressable(e.val), e.name)
+		}
+	case reflect.Slice:
+		if sr.add(v, path) && stateHasRefs(t.Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				sr.walk(v.Index(i), path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case reflect.Array:
+		if stateHasRefs(t.Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				sr.walk(v.Index(i), path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case reflect.Struct:
+		// States can point to structs that are part of something else
+		sr.add(v.Addr(), path+"&")
+		for i := 0; i < v.NumField(); i++ {
+			if ft := t.Field(i).Type; ft.Kind() == reflect.Struct || stateHasRefs(ft) {
+				sr.walk(stateField(v, i), path+"."+t.Field(i).Name)
+			}
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			e := sr.addressable(v.Elem())
+			sr.types[e.Type().String()] = e.Type()
+			sr.walk(e, path)
+		}
+	case reflect.Chan:
+		sr.add(v, path)
+	}
+}
+
+func (sr *stateResources) addressable(v reflect.Value) reflect.Value {
+	if !v.CanAddr() {
+		v = stateAddressable(v)
+		sr.copies = append(sr.copies, v)
+	}
+	return v
+}
+
+type stateEncoder struct {
+	buf   []byte
+	res   *stateResources
+	refs  map[stateRefKey]int
+	paths []string
+	err   error
+}
+
+// Serializes a saved game state. Has to be called while the state's match is
+// loaded, since references to loaded data are looked up in sys.
+func encodeGameState(gs *GameState) ([]byte, error) {
+	e := &stateEncoder{
+		res:  newStateResources(nil),
+		refs: make(map[stateRefKey]int),
+	}
+	e.value(reflect.ValueOf(gs).Elem())
+	if e.err != nil {
+		return nil, e.err
+	}
+	out := []byte{stateFormatVersion}
+	out = binary.LittleEndian.AppendUint64(out, stateLayoutHash())
+	out = binary.AppendUvarint(out, uint64(len(e.paths)))
+	for _, p := range e.paths {
+		out = binary.AppendUvarint(out, uint64(len(p)))
+		out = append(out, p...)
+	}
+	return append(out, e.buf...), nil
+}
+
+func (e *stateEncoder) fail(t reflect.Type, what string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("can't serialize %v: %s", t, what)
+	}
+}
+
+func (e *stateEncoder) uint(x uint64) {
+	e.buf = binary.AppendUvarint(e.buf, x)
+}
+
+// Writes how a reference is stored. Returns whether its contents follow.
+func (e *stateEncoder) ref(v reflect.Value) bool {
+	key, ok := stateRefKeyOf(v)
+	if !ok {
+		if v.Kind() == reflect.Slice && !v.IsNil() {
+			e.buf = append(e.buf, stateRefEmpty)
+		} else {
+			e.buf = append(e.buf, stateRefNil)
+		}
+		return false
+	}
+	if i, ok := e.refs[key]; ok {
+		e.buf = append(e.buf, stateRefSeen)
+		e.uint(uint64(i))
+		return false
+	}
+	e.refs[key] = len(e.refs)
+	if path, ok := e.res.paths[key]; ok {
+		e.buf = append(e.buf, stateRefStatic)
+		e.uint(uint64(len(e.paths)))
+		e.paths = append(e.paths, path)
+		return false
+	}
+	e.buf = append(e.buf, stateRefValue)
+	return true
+}
+
+func (e *stateEncoder) value(v reflect.Value) {
+	if e.err != nil {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buf = binary.AppendVarint(e.buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.uint(v.Uint())
+	case reflect.Float32:
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.Complex64:
+		c := v.Complex()
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(float32(real(c))))
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(float32(imag(c))))
+	case reflect.Complex128:
+		c := v.Complex()
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(real(c)))
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(imag(c)))
+	case reflect.String:
+		e.uint(uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			e.value(v.Index(i))
+		}
+	case reflect.Struct:
+		v = stateAddressable(v)
+		for i := 0; i < v.NumField(); i++ {
+			e.value(stateField(v, i))
+		}
+	case reflect.Pointer:
+		if e.ref(v) {
+			e.value(v.Elem())
+		}
+	case reflect.Slice:
+		if e.ref(v) {
+			e.uint(uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				e.value(v.Index(i))
+			}
+		}
+	case reflect.Map:
+		if e.ref(v) {
+			e.uint(uint64(v.Len()))
+			iter := v.MapRange()
+			for iter.Next() {
+				e.value(iter.Key())
+				e.value(iter.Value())
+			}
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return
+		}
+		name := v.Elem().Type().String()
+		e.buf = append(e.buf, 1)
+		e.uint(uint64(len(name)))
+		e.buf = append(e.buf, name...)
+		e.value(v.Elem())
+	case reflect.Chan:
+		if e.ref(v) {
+			e.fail(v.Type(), "channel that isn't part of the loaded data")
+		}
+	case reflect.Func:
+		if !v.IsNil() {
+			e.fail(v.Type(), "function")
+		}
+		e.buf = append(e.buf, stateRefNil)
+	default:
+		e.fail(v.Type(), "unsupported kind")
+	}
+}
+
+type stateDecoder struct {
+	data  []byte
+	pos   int
+	res   *stateResources
+	paths []string
+	// Resolved paths, and characters allocated for missing ones
+	static map[string]reflect.Value
+	refs   []reflect.Value
+	err    error
+}
+
+var errStateTruncated = errors.New("truncated game state")
+
+// Rebuilds a game state written by encodeGameState. References to loaded data
+// are resolved against what is currently loaded, so the same match must be.
+func decodeGameState(data []byte) (*GameState, error) {
+	d := &stateDecoder{data: data, static: make(map[string]reflect.Value)}
+	if d.byte() != stateFormatVersion {
+		return nil, fmt.Errorf("unsupported game state format")
+	}
+	if d.pos+8 > len(d.data) || binary.LittleEndian.Uint64(d.data[d.pos:]) != stateLayoutHash() {
+		return nil, fmt.Errorf("game state was saved by a different build")
+	}
+	d.pos += 8
+	n := d.count()
+	want := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		p := d.string()
+		d.paths = append(d.paths, p)
+		want[p] = true
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.res = newStateResources(want)
+	gs := NewGameState()
+	d.value(reflect.ValueOf(gs).Elem())
+	if d.err == nil && d.pos != len(d.data) {
+		d.err = fmt.Errorf("%d bytes left after the game state", len(d.data)-d.pos)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return gs, nil
+}
+
+func (d *stateDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *stateDecoder) bytes(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.data)-d.pos {
+		d.fail(errStateTruncated)
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *stateDecoder) byte() byte {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *stateDecoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	d.pos += n
+	return x
+}
+
+func (d *stateDecoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	d.pos += n
+	return x
+}
+
+// Element counts can't exceed the remaining bytes, which keeps corrupt data
+// from allocating huge slices
+func (d *stateDecoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *stateDecoder) string() string {
+	return string(d.bytes(d.count()))
+}
+
+func (d *stateDecoder) float32() float64 {
+	if b := d.bytes(4); b != nil {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (d *stateDecoder) float64() float64 {
+	if b := d.bytes(8); b != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Reads how a reference is stored and sets v if it is already known. Returns
+// whether its contents follow, in which case the caller registers the new
+// value with d.refs before reading them.
+func (d *stateDecoder) ref(v reflect.Value) bool {
+	t := v.Type()
+	var r reflect.Value
+	switch d.byte() {
+	case stateRefNil:
+		v.Set(reflect.Zero(t))
+		return false
+	case stateRefEmpty:
+		v.Set(reflect.MakeSlice(t, 0, 0))
+		return false
+	case stateRefSeen:
+		i := d.uint()
+		if i >= uint64(len(d.refs)) {
+			d.fail(fmt.Errorf("invalid reference in game state"))
+			return false
+		}
+		r = d.refs[i]
+	case stateRefStatic:
+		i := d.uint()
+		if i >= uint64(len(d.paths)) {
+			d.fail(fmt.Errorf("invalid path in game state"))
+			return false
+		}
+		path := d.paths[i]
+		var ok bool
+		if r, ok = d.static[path]; !ok {
+			if r, ok = d.res.values[path]; !ok {
+				if t.Kind() != reflect.Pointer || !strings.HasPrefix(path, "chars[") {
+					d.fail(fmt.Errorf("game state refers to %s, which isn't loaded", path))
+					return false
+				}
+				r = reflect.New(t.Elem())
+			}
+			d.static[path] = r
+		}
+		d.refs = append(d.refs, r)
+	case stateRefValue:
+		return d.err == nil
+	default:
+		d.fail(fmt.Errorf("invalid reference in game state"))
+		return false
+	}
+	if d.err != nil {
+		return false
+	}
+	if r.Type() != t {
+		d.fail(fmt.Errorf("game state refers to %v where %v is expected", r.Type(), t))
+		return false
+	}
+	v.Set(r)
+	return false
+}
+
+// Reads into v, which has to be settable
+func (d *stateDecoder) value(v reflect.Value) {
+	if d.err != nil {
+		return
+	}
+	t := v.Type()
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(d.byte() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(d.int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(d.uint())
+	case reflect.Float32:
+		v.SetFloat(d.float32())
+	case reflect.Float64:
+		v.SetFloat(d.float64())
+	case reflect.Complex64:
+		re := d.float32()
+		v.SetComplex(complex(re, d.float32()))
+	case reflect.Complex128:
+		re := d.float64()
+		v.SetComplex(complex(re, d.float64()))
+	case reflect.String:
+		v.SetString(d.string())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			d.value(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			d.value(stateField(v, i))
+		}
+	case reflect.Pointer:
+		if d.ref(v) {
+			p := reflect.New(t.Elem())
+			d.refs = append(d.refs, p)
+			v.Set(p)
+			d.value(p.Elem())
+		}
+	case reflect.Slice:
+		if d.ref(v) {
+			n := d.count()
+			s := reflect.MakeSlice(t, n, n)
+			d.refs = append(d.refs, s)
+			v.Set(s)
+			for i := 0; i < n; i++ {
+				d.value(s.Index(i))
+			}
+		}
+	case reflect.Map:
+		if d.ref(v) {
+			n := d.count()
+			m := reflect.MakeMapWithSize(t, n)
+			d.refs = append(d.refs, m)
+			v.Set(m)
+			for i := 0; i < n && d.err == nil; i++ {
+				k := reflect.New(t.Key()).Elem()
+				d.value(k)
+				e := reflect.New(t.Elem()).Elem()
+				d.value(e)
+				m.SetMapIndex(k, e)
+			}
+		}
+	case reflect.Interface:
+		if d.byte() == 0 {
+			v.Set(reflect.Zero(t))
+			return
+		}
+		name := d.string()
+		et, ok := d.res.types[name]
+		if !ok {
+			d.fail(fmt.Errorf("unknown type %s in game state", name))
+			return
+		}
+		if !et.Implements(t) {
+			d.fail(fmt.Errorf("%s doesn't implement %v", name, t))
+			return
+		}
+		e := reflect.New(et).Elem()
+		d.value(e)
+		if d.err == nil {
+			v.Set(e)
+		}
+	case reflect.Chan:
+		if d.ref(v) {
+			d.fail(fmt.Errorf("game state contains a %v", t))
+		}
+	case reflect.Func:
+		if d.byte() != stateRefNil {
+			d.fail(fmt.Errorf("game state contains a %v", t))
+		}
+	default:
+		d.fail(fmt.Errorf("unsupported type %v in game state", t))
+	}
+}
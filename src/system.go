@@ -218,6 +218,9 @@ type System struct {
 	debugDisplay        bool
 	debugRef            [2]int // player number, helper index
 	debugLastID         int32
+	profiler            Profiler
+	hotReload           HotReload
+	debugConsole        DebugConsole
 	soundMixer          *beep.Mixer
 	bgm                 Bgm
 	pauseVolumeApplied  bool
@@ -234,6 +237,12 @@ type System struct {
 	keyState            map[Key]bool
 	netConnection       *NetConnection
 	replayFile          *ReplayFile
+	spectateStream      *SpectatorStream
+	lobby               *LobbyClient
+	replayVerify        *ReplayVerifier
+	syncTest            *SyncTester
+	scenario            *ScenarioRunner
+	netSim              *NetSim
 	keyConfig           []KeyConfig
 	joystickConfig      []KeyConfig
 	loader              Loader
@@ -461,8 +470,12 @@ func (s *System) init(w, h int32) *lua.LState {
 	Logcat("Check D: We are GOOD")
 	gfx.BeginFrame(false)
 
-	// And the audio.
-	speaker = &SDLSpeaker{}
+	// And the audio. Headless runs have no audio device to open.
+	if renderName == "Null" {
+		speaker = &NullSpeaker{}
+	} else {
+		speaker = &SDLSpeaker{}
+	}
 	speaker.Init(beep.SampleRate(sys.cfg.Sound.SampleRate), audioOutLen)
 	speaker.Play(NewNormalizer(s.soundMixer))
 	l := lua.NewState()
@@ -526,7 +539,12 @@ func (s *System) shutdown() {
 	}
 	if sys.rollback.session != nil && sys.rollback.session.recording != nil {
 		sys.rollback.session.SaveReplay()
+		sys.rollback.session.recording.Close()
+	}
+	if sys.netConnection != nil {
+		sys.netConnection.recording.Close()
 	}
+	sys.lobby.Close()
 	gfx.Close()
 	s.window.Close()
 	if speaker != nil {
@@ -768,7 +786,7 @@ func (s *System) await(fps int) bool {
 	if !s.frameSkip {
 		// Render the finished frame
 		gfx.EndFrame()
-		if gfx.GetName()[:6] == "OpenGL" {
+		if strings.HasPrefix(gfx.GetName(), "OpenGL") {
 			s.window.SwapBuffers()
 		} else {
 			gfx.Await()
@@ -785,6 +803,20 @@ func (s *System) await(fps int) bool {
 
 	s.runMainThreadTask()
 
+	// Replay verification, sync tests and scenarios run as fast as possible
+	if s.replayVerify != nil || s.syncTest != nil || s.scenario != nil {
+		s.frameSkip = false
+		s.eventUpdate()
+		return !s.gameEnd
+	}
+
+	// Skip drawing and waiting while a replay seek is fast-forwarding
+	if s.replayFile != nil && s.replayFile.Seeking() {
+		s.frameSkip = true
+		s.eventUpdate()
+		return !s.gameEnd
+	}
+
 	now := time.Now()
 	diff := s.redrawWait.nextTime.Sub(now)
 
@@ -897,6 +929,9 @@ func (s *System) update() bool {
 	}
 
 	if s.replayFile != nil {
+		if s.replayVerify != nil {
+			s.replayVerify.record()
+		}
 		if s.anyHardButton() {
 			s.await(s.gameRenderSpeed() * 4)
 		} else {
@@ -2309,6 +2344,7 @@ func (s *System) resetRoundState() {
 }
 
 func (s *System) resetRound() {
+	s.replayRecorder().roundStart(s.round)
 	s.resetRoundState()
 	s.runMainThreadTask()
 	gfx.Await()
@@ -2540,6 +2576,9 @@ func (s *System) action() {
 			// "NoKOSlow" added to facilitate custom slowdown. In Mugen that flag only needs to be asserted in first frame of KO slowdown
 			s.specialFlag = (s.specialFlag&GSF_nokoslow | s.specialFlag&GSF_timerfreeze)
 		}
+		if s.profiler.active {
+			s.profiler.frames++
+		}
 		s.charList.action()
 		s.allPalFX.step()
 		s.bgPalFX.step()
@@ -3519,6 +3558,18 @@ func (s *System) drawDebugText() {
 		for _, s := range s.consoleText {
 			put(&x, &y, s)
 		}
+		// Console input and watches
+		s.debugFont.SetColor(255, 255, 127, 255)
+		for _, s := range s.debugConsole.lines() {
+			put(&x, &y, s)
+		}
+		// Profiler
+		if s.profiler.active {
+			s.debugFont.SetColor(127, 255, 255, 255)
+			for _, s := range s.profiler.lines() {
+				put(&x, &y, s)
+			}
+		}
 		// Data
 		y = float32(s.gameHeight) - float32(s.debugFont.fnt.Size[1])*sys.debugFont.yscl/s.heightScale*
 			(float32(len(s.listLFunc))+float32(s.cfg.Debug.ClipboardRows)) - 1*s.heightScale
@@ -3589,7 +3640,10 @@ func (s *System) runMatch() (reload bool) {
 		s.clsnDisplay = false
 		s.lifebarHide = false
 		s.debugAccel = 1
+		s.profiler.active = false
+		s.debugConsole.active = false
 	}
+	s.debugConsole.recompile()
 
 	// Defer resetting variables on return
 	defer func() {
@@ -3641,6 +3695,12 @@ func (s *System) runMatch() (reload bool) {
 	// Reset the clock right before entering the loop to ensure we start with a clean timeline
 	s.resetFrameTime()
 
+	// Start taking replay keyframes for seeking
+	if s.replayFile != nil {
+		s.replayFile.beginMatch()
+		defer s.replayFile.clearKeyframes()
+	}
+
 	// Now switch to rollback if applicable
 	// TODO: More merging so we don't hijack this function at all
 	if s.rollback.session != nil || s.cfg.Netplay.Rollback.DesyncTestFrames > 0 {
@@ -3659,6 +3719,13 @@ func (s *System) runMatch() (reload bool) {
 			}
 		}
 
+		// Replay seeking and keyframes
+		if s.replayFile != nil {
+			s.replayFile.stepSeek()
+		} else if s.netConnection != nil {
+			s.netConnection.spectators.stepKeyframe()
+		}
+
 		// Save/load state
 		// TODO: Confirm at which exact point rollback does its own save/restore and match that
 		if s.saveStateFlag {
@@ -3676,6 +3743,9 @@ func (s *System) runMatch() (reload bool) {
 
 		// Update game state
 		s.action()
+		if s.scenario != nil {
+			s.scenario.step()
+		}
 
 		debugInput()
 
@@ -3721,6 +3791,11 @@ func (s *System) runMatch() (reload bool) {
 			}
 		}
 
+		// Reload the characters whose files were edited
+		s.hotReload.update()
+		// Run the lines typed into the debug console
+		s.debugConsole.update()
+
 		// F4 pressed to reset round
 		if s.roundResetFlg && !s.postMatchFlg {
 			for i := 0; i < MaxPlayerNo; i++ {
@@ -3900,6 +3975,7 @@ func (s *System) runNextRound() bool {
 		}
 		s.clearAllSound()
 		s.statsLog.nextRound()
+		s.replayRecorder().roundEnd(s.round)
 		s.scoreRounds = append(s.scoreRounds, [2]float32{s.fightScreen.scores[0].scorePoints, s.fightScreen.scores[1].scorePoints})
 
 		if !s.matchOver() &&
@@ -4919,10 +4995,11 @@ type Loader struct {
 	state    LoaderState
 	loadExit chan LoaderState
 	err      error
+	progress *LoadProgress // Files read by the current load, for loadProgress()
 }
 
 func newLoader() *Loader {
-	return &Loader{state: LS_NotYet, loadExit: make(chan LoaderState, 1)}
+	return &Loader{state: LS_NotYet, loadExit: make(chan LoaderState, 1), progress: &LoadProgress{}}
 }
 
 /*
@@ -5440,6 +5517,7 @@ func (l *Loader) runTread() bool {
 	if l.state != LS_NotYet {
 		return false
 	}
+	l.progress.reset()
 	l.state = LS_Loading
 	SafeGo(func() {
 		l.load()
@@ -39,6 +39,10 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 			return nil, fmt.Errorf("failed to create window: %w", err)
 		}
 		fullscreen = true
+	} else if gfx.GetName() == "Null" {
+		// Headless mode: no video subsystem and no window, the Window struct
+		// only keeps the requested size for viewport calculations
+		chk(sdl.Init(sdl.INIT_EVENTS | sdl.INIT_TIMER))
 	} else {
 
 		var windowFlags sdl.WindowFlags = sdl.WINDOW_INPUT_FOCUS
@@ -152,6 +156,9 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 }
 
 func (w *Window) SwapBuffers() {
+	if w.Window == nil {
+		return
+	}
 	w.Window.GLSwap()
 }
 
@@ -188,6 +195,9 @@ func (w *Window) imageToSurface(img image.Image) (*sdl.Surface, error) {
 }
 
 func (w *Window) SetIcon(icon []image.Image) {
+	if w.Window == nil {
+		return
+	}
 	if surface, err := w.imageToSurface(icon[0]); err == nil {
 		w.Window.SetIcon(surface)
 	}
@@ -198,6 +208,9 @@ func (w *Window) SetSwapInterval(interval int) {
 }
 
 func (w *Window) GetSize() (int, int) {
+	if w.Window == nil {
+		return w.w, w.h
+	}
 	w2, h2 := w.Window.GetSize()
 	return int(w2), int(h2)
 }
@@ -245,6 +258,9 @@ func (w *Window) GetClipboardString() string {
 }
 
 func (w *Window) toggleFullscreen() {
+	if w.Window == nil {
+		return
+	}
 	if w.fullscreen {
 		w.Window.SetFullscreen(0)
 		w.Window.SetBordered(!sys.cfg.Video.Borderless)
@@ -70,6 +70,9 @@ func selectRenderer(cfgVal string) (Renderer, FontRenderer) {
 	case "Vulkan 1.3":
 		gfx = &Renderer_VK{}
 		gfxFont = &FontRenderer_VK{}
+	case "Null":
+		gfx = &Renderer_Null{}
+		gfxFont = &FontRenderer_Null{}
 	default:
 		fmt.Printf("Error: Invalid RenderMode '%s'. Defaulting to OpenGL 3.3.\n", cfgVal)
 		gfx = &Renderer_GL33{}